@@ -0,0 +1,473 @@
+// Package abuse detects abusive traffic patterns per device and per client IP
+// — port scanning, SMTP, fan-out to very many hosts and bursts of requests to
+// a single host, as in credential stuffing — so that abuse is noticed before
+// it turns into complaints to the host's provider.
+//
+// Responses are graduated: the first detection only counts in metrics, the
+// next one throttles the offender and the one after that blocks it, up to the
+// harshest response configured for the pattern. A response lasts for a
+// penalty period after the last detection, and a repeat offender picks up
+// where it left off for a while longer.
+package abuse
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/golog"
+	lru "github.com/hashicorp/golang-lru"
+
+	"github.com/getlantern/http-proxy-lantern/v2/instrument"
+	"github.com/getlantern/http-proxy-lantern/v2/listeners"
+)
+
+var log = golog.LoggerFor("abuse")
+
+const (
+	DefaultWindow       = 1 * time.Minute
+	DefaultPenalty      = 15 * time.Minute
+	DefaultThrottleRate = int64(128 * 1000 / 8) // 128 Kbps
+
+	DefaultScanPorts     = 20
+	DefaultScanIPs       = 100
+	DefaultSMTPAttempts  = 5
+	DefaultFanOutHosts   = 400
+	DefaultBurstRequests = 300
+
+	// maxSubjects bounds how many devices and client IPs are tracked at
+	// once, the least recently active being forgotten first.
+	maxSubjects = 100000
+
+	// strikeMemory is how many penalty periods strikes are remembered for
+	// after the last detection, so that an offender that comes back after
+	// its block lapsed is blocked again straight away.
+	strikeMemory = 4
+)
+
+// smtpPorts are the ports mail is submitted or relayed on.
+var smtpPorts = map[int]bool{25: true, 465: true, 587: true, 2525: true}
+
+// Pattern is an abusive traffic pattern.
+type Pattern string
+
+const (
+	// PortScan is connecting to many distinct destination ports, or to many
+	// distinct IP addresses given as such.
+	PortScan Pattern = "port-scan"
+	// SMTP is connecting to mail servers, as spam bots do.
+	SMTP Pattern = "smtp"
+	// FanOut is connecting to very many distinct hosts.
+	FanOut Pattern = "fan-out"
+	// Burst is sending very many requests to a single host, as in credential
+	// stuffing.
+	Burst Pattern = "burst"
+)
+
+// Patterns are all the patterns detected.
+var Patterns = []Pattern{PortScan, SMTP, FanOut, Burst}
+
+// Response is how a subject of abuse is dealt with, from the mildest to the
+// harshest.
+type Response int
+
+const (
+	None Response = iota
+	// Report only counts detections in metrics.
+	Report
+	// Throttle holds the offender's new connections to Options.ThrottleRate.
+	Throttle
+	// Block refuses the offender's requests with a 403.
+	Block
+)
+
+var responseNames = []string{"none", "report", "throttle", "block"}
+
+func (r Response) String() string {
+	if r < None || r > Block {
+		return "unknown"
+	}
+	return responseNames[r]
+}
+
+// MarshalText makes Responses show up by name in JSON.
+func (r Response) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// ParseResponses parses comma-separated pattern=response pairs, e.g.
+// "port-scan=block,smtp=block,fan-out=throttle,burst=report", into the
+// harshest response each pattern may get. Patterns that aren't listed aren't
+// detected.
+func ParseResponses(spec string) (map[Pattern]Response, error) {
+	responses := make(map[Pattern]Response)
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, errors.New("abuse response %q is not of the form pattern=response", pair)
+		}
+		pattern := Pattern(strings.ToLower(strings.TrimSpace(name)))
+		if !knownPattern(pattern) {
+			return nil, errors.New("unknown abuse pattern %q", name)
+		}
+		response := None
+		for r := Report; r <= Block; r++ {
+			if strings.EqualFold(strings.TrimSpace(value), r.String()) {
+				response = r
+			}
+		}
+		if response == None {
+			return nil, errors.New("unknown response %q to %v, should be report, throttle or block", value, pattern)
+		}
+		if _, dupe := responses[pattern]; dupe {
+			return nil, errors.New("response to %v given twice", pattern)
+		}
+		responses[pattern] = response
+	}
+	return responses, nil
+}
+
+func knownPattern(pattern Pattern) bool {
+	for _, p := range Patterns {
+		if p == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// Options configures a Detector. Zero values get the defaults.
+type Options struct {
+	// Responses maps patterns to the harshest response they may get. Patterns
+	// not in it aren't detected.
+	Responses map[Pattern]Response
+	// Window is how long activity is counted over before it starts over.
+	Window time.Duration
+	// Penalty is how long a response lasts after the last detection.
+	Penalty time.Duration
+	// ThrottleRate is the rate throttled offenders are held to in both
+	// directions, in bytes per second.
+	ThrottleRate int64
+
+	// The thresholds, per Window, past which each pattern is detected:
+	// ScanPorts distinct destination ports or ScanIPs distinct IP addresses
+	// for PortScan, SMTPAttempts connections to mail ports for SMTP,
+	// FanOutHosts distinct hosts for FanOut and BurstRequests requests to
+	// any one host for Burst.
+	ScanPorts     int
+	ScanIPs       int
+	SMTPAttempts  int
+	FanOutHosts   int
+	BurstRequests int
+}
+
+func (opts Options) withDefaults() Options {
+	setDefault := func(v *int, def int) {
+		if *v == 0 {
+			*v = def
+		}
+	}
+	if opts.Window == 0 {
+		opts.Window = DefaultWindow
+	}
+	if opts.Penalty == 0 {
+		opts.Penalty = DefaultPenalty
+	}
+	if opts.ThrottleRate == 0 {
+		opts.ThrottleRate = DefaultThrottleRate
+	}
+	setDefault(&opts.ScanPorts, DefaultScanPorts)
+	setDefault(&opts.ScanIPs, DefaultScanIPs)
+	setDefault(&opts.SMTPAttempts, DefaultSMTPAttempts)
+	setDefault(&opts.FanOutHosts, DefaultFanOutHosts)
+	setDefault(&opts.BurstRequests, DefaultBurstRequests)
+	return opts
+}
+
+// Validate reports why opts can't be used, if they can't.
+func (opts Options) Validate() error {
+	for pattern, response := range opts.Responses {
+		if !knownPattern(pattern) {
+			return errors.New("unknown abuse pattern %q", pattern)
+		}
+		if response < Report || response > Block {
+			return errors.New("invalid response %d to %v", response, pattern)
+		}
+	}
+	if opts.Window < 0 || opts.Penalty < 0 || opts.ThrottleRate < 0 {
+		return errors.New("abuse window, penalty and throttle rate must not be negative")
+	}
+	if opts.ScanPorts < 0 || opts.ScanIPs < 0 || opts.SMTPAttempts < 0 || opts.FanOutHosts < 0 || opts.BurstRequests < 0 {
+		return errors.New("abuse thresholds must not be negative")
+	}
+	return nil
+}
+
+// Subjects are what activity is attributed to.
+const (
+	SubjectDevice   = "device"
+	SubjectClientIP = "client-ip"
+)
+
+// Event is a request to proxy traffic somewhere.
+type Event struct {
+	DeviceID string
+	ClientIP string
+	// Host is the destination host, a name or an IP address, and Port the
+	// destination port.
+	Host string
+	Port int
+}
+
+// Offender is a subject that abuse was detected from, for introspection.
+type Offender struct {
+	Subject  string    `json:"subject"`
+	ID       string    `json:"id"`
+	Response Response  `json:"response"`
+	Patterns []Pattern `json:"patterns"`
+	Strikes  int       `json:"strikes"`
+	Until    time.Time `json:"until"`
+}
+
+type subjectKey struct {
+	kind string
+	id   string
+}
+
+// subject is the activity of one device or client IP in the current window,
+// and what's been detected from it.
+type subject struct {
+	windowStart time.Time
+	ports       map[int]bool
+	ips         map[string]bool
+	hosts       map[string]int
+	smtp        int
+	// detected are the patterns detected in the current window, each only
+	// counting once per window.
+	detected map[Pattern]bool
+
+	strikes  int
+	patterns []Pattern
+	response Response
+	// until is when response lapses, and forget when strikes are forgotten.
+	until  time.Time
+	forget time.Time
+}
+
+func (s *subject) startWindow(now time.Time) {
+	s.windowStart = now
+	s.ports = make(map[int]bool)
+	s.ips = make(map[string]bool)
+	s.hosts = make(map[string]int)
+	s.smtp = 0
+	s.detected = make(map[Pattern]bool)
+}
+
+// responseAt returns the response s gets at now.
+func (s *subject) responseAt(now time.Time) Response {
+	if now.Before(s.until) {
+		return s.response
+	}
+	return None
+}
+
+// record counts ev against s and returns the patterns it newly trips. The
+// sets of ports, IPs and hosts stop growing at their thresholds, which bounds
+// how much memory a subject takes.
+func (s *subject) record(ev Event, now time.Time, opts Options) (tripped []Pattern) {
+	if now.Sub(s.windowStart) >= opts.Window {
+		s.startWindow(now)
+	}
+	if !s.forget.IsZero() && !now.Before(s.forget) {
+		s.strikes = 0
+		s.patterns = nil
+		s.forget = time.Time{}
+	}
+
+	if len(s.ports) < opts.ScanPorts {
+		s.ports[ev.Port] = true
+	}
+	if net.ParseIP(ev.Host) != nil && len(s.ips) < opts.ScanIPs {
+		s.ips[ev.Host] = true
+	}
+	if _, known := s.hosts[ev.Host]; known || len(s.hosts) < opts.FanOutHosts {
+		s.hosts[ev.Host]++
+	}
+	if smtpPorts[ev.Port] {
+		s.smtp++
+	}
+
+	check := func(pattern Pattern, trips bool) {
+		harshest, enabled := opts.Responses[pattern]
+		if !enabled || !trips || s.detected[pattern] {
+			return
+		}
+		s.detected[pattern] = true
+		s.strikes++
+		response := min(Response(min(s.strikes, int(Block))), harshest)
+		s.response = max(s.responseAt(now), response)
+		s.until = now.Add(opts.Penalty)
+		s.forget = now.Add(strikeMemory * opts.Penalty)
+		s.addPattern(pattern)
+		tripped = append(tripped, pattern)
+	}
+	check(PortScan, len(s.ports) >= opts.ScanPorts || len(s.ips) >= opts.ScanIPs)
+	check(SMTP, s.smtp >= opts.SMTPAttempts)
+	check(FanOut, len(s.hosts) >= opts.FanOutHosts)
+	check(Burst, s.hosts[ev.Host] >= opts.BurstRequests)
+	return tripped
+}
+
+func (s *subject) addPattern(pattern Pattern) {
+	for _, p := range s.patterns {
+		if p == pattern {
+			return
+		}
+	}
+	s.patterns = append(s.patterns, pattern)
+}
+
+// Detector detects abusive traffic patterns and decides how offenders are
+// dealt with.
+type Detector struct {
+	instrument instrument.Instrument
+	// limiter is shared by the connections of every throttled offender, so
+	// that together they can't use more than the throttle rate.
+	limiter *listeners.RateLimiter
+
+	mx       sync.Mutex
+	opts     Options
+	subjects *lru.Cache
+}
+
+// New creates a Detector.
+func New(opts Options, instrument instrument.Instrument) (*Detector, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	opts = opts.withDefaults()
+	subjects, err := lru.New(maxSubjects)
+	if err != nil {
+		return nil, err
+	}
+	return &Detector{
+		instrument: instrument,
+		limiter:    listeners.NewRateLimiter(opts.ThrottleRate, opts.ThrottleRate),
+		opts:       opts,
+		subjects:   subjects,
+	}, nil
+}
+
+// Reconfigure changes the responses, thresholds and penalty, e.g. after a
+// config reload, keeping track of activity so far.
+func (d *Detector) Reconfigure(opts Options) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	opts = opts.withDefaults()
+	d.mx.Lock()
+	d.opts = opts
+	d.mx.Unlock()
+	d.limiter.SetRates(opts.ThrottleRate, opts.ThrottleRate)
+	return nil
+}
+
+// Observe counts ev against its device and client IP.
+func (d *Detector) Observe(ev Event) {
+	d.observe(ev, time.Now())
+}
+
+func (d *Detector) observe(ev Event, now time.Time) {
+	type detection struct {
+		key      subjectKey
+		pattern  Pattern
+		response Response
+	}
+	var detections []detection
+
+	d.mx.Lock()
+	for _, key := range []subjectKey{{SubjectDevice, ev.DeviceID}, {SubjectClientIP, ev.ClientIP}} {
+		if key.id == "" {
+			continue
+		}
+		var s *subject
+		if v, found := d.subjects.Get(key); found {
+			s = v.(*subject)
+		} else {
+			s = &subject{}
+			d.subjects.Add(key, s)
+		}
+		for _, pattern := range s.record(ev, now, d.opts) {
+			detections = append(detections, detection{key, pattern, s.response})
+		}
+	}
+	d.mx.Unlock()
+
+	for _, det := range detections {
+		d.instrument.AbuseDetected(context.Background(), string(det.pattern), det.key.kind, det.response.String())
+		log.Debugf("Detected %v from %v %v, response: %v", det.pattern, det.key.kind, det.key.id, det.response)
+	}
+}
+
+// Response returns how a request from deviceID at clientIP is dealt with, the
+// harsher of the responses the two get.
+func (d *Detector) Response(deviceID, clientIP string) Response {
+	now := time.Now()
+	response := None
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	for _, key := range []subjectKey{{SubjectDevice, deviceID}, {SubjectClientIP, clientIP}} {
+		if key.id == "" {
+			continue
+		}
+		if v, found := d.subjects.Peek(key); found {
+			response = max(response, v.(*subject).responseAt(now))
+		}
+	}
+	return response
+}
+
+// Limiter is the limiter throttled offenders are held to.
+func (d *Detector) Limiter() *listeners.RateLimiter {
+	return d.limiter
+}
+
+// Offenders returns the subjects that abuse was detected from and that still
+// have strikes, harshest response first.
+func (d *Detector) Offenders() []Offender {
+	now := time.Now()
+	d.mx.Lock()
+	offenders := make([]Offender, 0)
+	for _, k := range d.subjects.Keys() {
+		v, found := d.subjects.Peek(k)
+		if !found {
+			continue
+		}
+		s := v.(*subject)
+		if s.strikes == 0 || !now.Before(s.forget) {
+			continue
+		}
+		key := k.(subjectKey)
+		offenders = append(offenders, Offender{
+			Subject:  key.kind,
+			ID:       key.id,
+			Response: s.responseAt(now),
+			Patterns: append([]Pattern(nil), s.patterns...),
+			Strikes:  s.strikes,
+			Until:    s.until,
+		})
+	}
+	d.mx.Unlock()
+	sort.SliceStable(offenders, func(i, j int) bool {
+		return offenders[i].Response > offenders[j].Response
+	})
+	return offenders
+}
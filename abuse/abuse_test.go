@@ -0,0 +1,176 @@
+package abuse
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/getlantern/proxy/v3/filters"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/http-proxy-lantern/v2/common"
+	"github.com/getlantern/http-proxy-lantern/v2/instrument"
+	"github.com/getlantern/http-proxy-lantern/v2/proxyfilters"
+)
+
+func newTestDetector(t *testing.T, responses map[Pattern]Response) *Detector {
+	t.Helper()
+	d, err := New(Options{Responses: responses, ScanPorts: 5, ScanIPs: 5, SMTPAttempts: 2, FanOutHosts: 5, BurstRequests: 5}, instrument.NoInstrument{})
+	require.NoError(t, err)
+	return d
+}
+
+// scan connects to n distinct ports, each on a different host.
+func scan(d *Detector, deviceID, clientIP string, n int, now time.Time) {
+	for i := 0; i < n; i++ {
+		d.observe(Event{DeviceID: deviceID, ClientIP: clientIP, Host: fmt.Sprintf("host%d.example.com", i), Port: 1000 + i}, now)
+	}
+}
+
+func TestParseResponses(t *testing.T) {
+	responses, err := ParseResponses(" port-scan=block, SMTP=Throttle,fan-out=report ")
+	require.NoError(t, err)
+	assert.Equal(t, map[Pattern]Response{PortScan: Block, SMTP: Throttle, FanOut: Report}, responses)
+
+	responses, err = ParseResponses("")
+	require.NoError(t, err)
+	assert.Empty(t, responses)
+
+	for _, spec := range []string{"port-scan", "port-scan=ban", "flood=block", "burst=block,burst=report", "smtp=none"} {
+		_, err := ParseResponses(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestPatterns(t *testing.T) {
+	all := map[Pattern]Response{PortScan: Report, SMTP: Report, FanOut: Report, Burst: Report}
+	for name, test := range map[string]struct {
+		events  func(i int) Event
+		n       int
+		pattern Pattern
+	}{
+		"distinct ports": {func(i int) Event { return Event{Host: "example.com", Port: 1000 + i} }, 5, PortScan},
+		"distinct IPs":   {func(i int) Event { return Event{Host: fmt.Sprintf("10.0.0.%d", i), Port: 443} }, 5, PortScan},
+		"smtp":           {func(i int) Event { return Event{Host: "mail.example.com", Port: 25} }, 2, SMTP},
+		"fan-out":        {func(i int) Event { return Event{Host: fmt.Sprintf("host%d.example.com", i), Port: 443} }, 5, FanOut},
+		"burst":          {func(i int) Event { return Event{Host: "login.example.com", Port: 443} }, 5, Burst},
+	} {
+		d := newTestDetector(t, all)
+		now := time.Now()
+		for i := 0; i < test.n-1; i++ {
+			ev := test.events(i)
+			ev.DeviceID = "device1"
+			d.observe(ev, now)
+		}
+		assert.Empty(t, d.Offenders(), "%v: nothing should be detected below the threshold", name)
+		ev := test.events(test.n - 1)
+		ev.DeviceID = "device1"
+		d.observe(ev, now)
+		offenders := d.Offenders()
+		if assert.Len(t, offenders, 1, name) {
+			assert.Contains(t, offenders[0].Patterns, test.pattern, name)
+			assert.Equal(t, Report, offenders[0].Response, name)
+		}
+	}
+}
+
+func TestGraduatedResponses(t *testing.T) {
+	d := newTestDetector(t, map[Pattern]Response{PortScan: Block, Burst: Throttle})
+	now := time.Now()
+
+	scan(d, "device1", "1.2.3.4", 5, now)
+	assert.Equal(t, Report, d.Response("device1", ""), "the first detection should only be reported")
+	assert.Equal(t, Report, d.Response("", "1.2.3.4"), "the client IP should be flagged too")
+	scan(d, "device1", "1.2.3.4", 50, now)
+	assert.Equal(t, Report, d.Response("device1", ""), "a pattern should only count once per window")
+
+	now = now.Add(DefaultWindow)
+	scan(d, "device1", "1.2.3.4", 5, now)
+	assert.Equal(t, Throttle, d.Response("device1", ""))
+
+	now = now.Add(DefaultWindow)
+	scan(d, "device1", "1.2.3.4", 5, now)
+	assert.Equal(t, Block, d.Response("device1", ""))
+	assert.Equal(t, Block, d.Response("device2", "1.2.3.4"), "other devices behind a blocked IP should be blocked")
+	assert.Equal(t, None, d.Response("device2", "5.6.7.8"))
+
+	// Burst is at most throttled, but doesn't lift the block.
+	now = now.Add(DefaultWindow)
+	for i := 0; i < 5; i++ {
+		d.observe(Event{DeviceID: "device1", Host: "login.example.com", Port: 443}, now)
+	}
+	assert.Equal(t, Block, d.Response("device1", ""))
+
+	d2 := newTestDetector(t, map[Pattern]Response{Burst: Throttle})
+	for w := 0; w < 5; w++ {
+		for i := 0; i < 5; i++ {
+			d2.observe(Event{DeviceID: "device1", Host: "login.example.com", Port: 443}, now.Add(time.Duration(w)*DefaultWindow))
+		}
+	}
+	offenders := d2.Offenders()
+	require.Len(t, offenders, 1)
+	assert.Equal(t, 5, offenders[0].Strikes)
+	assert.Equal(t, Throttle, offenders[0].Response, "responses should be capped at the harshest allowed for the pattern")
+}
+
+func TestPenalty(t *testing.T) {
+	d := newTestDetector(t, map[Pattern]Response{PortScan: Block})
+	now := time.Now().Add(-time.Hour)
+	for w := 0; w < 3; w++ {
+		scan(d, "device1", "", 5, now)
+		now = now.Add(DefaultWindow)
+	}
+	require.Equal(t, Block, d.subjectResponse("device1", now))
+
+	now = now.Add(DefaultPenalty)
+	assert.Equal(t, None, d.subjectResponse("device1", now), "the block should lapse after the penalty")
+	scan(d, "device1", "", 5, now)
+	assert.Equal(t, Block, d.subjectResponse("device1", now), "a repeat offender should be blocked again straight away")
+
+	now = now.Add(strikeMemory * DefaultPenalty)
+	scan(d, "device1", "", 5, now)
+	assert.Equal(t, Report, d.subjectResponse("device1", now), "strikes should be forgotten eventually")
+}
+
+// subjectResponse is the response device gets at now.
+func (d *Detector) subjectResponse(deviceID string, now time.Time) Response {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	v, found := d.subjects.Peek(subjectKey{SubjectDevice, deviceID})
+	if !found {
+		return None
+	}
+	return v.(*subject).responseAt(now)
+}
+
+func TestFilter(t *testing.T) {
+	d := newTestDetector(t, map[Pattern]Response{PortScan: Block})
+	chain := filters.Join(NewFilter(d, instrument.NoInstrument{}), proxyfilters.RecordOpObserved(d.ObserveOp))
+	connect := func(port int) int {
+		req, _ := http.NewRequest(http.MethodConnect, fmt.Sprintf("http://example.com:%d", port), nil)
+		req.Host = fmt.Sprintf("example.com:%d", port)
+		req.RemoteAddr = "1.2.3.4:5678"
+		req.Header.Set(common.DeviceIdHeader, "device1")
+		resp, _, _ := chain.Apply(filters.NewConnectionState(req, nil, nil), req, func(cs *filters.ConnectionState, req *http.Request) (*http.Response, *filters.ConnectionState, error) {
+			return &http.Response{StatusCode: http.StatusOK}, cs, nil
+		})
+		return resp.StatusCode
+	}
+
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, http.StatusOK, connect(1000+i))
+	}
+	offenders := d.Offenders()
+	require.Len(t, offenders, 2, "the device and its client IP should both be flagged")
+	assert.Equal(t, []Pattern{PortScan}, offenders[0].Patterns)
+
+	d.mx.Lock()
+	for _, k := range d.subjects.Keys() {
+		v, _ := d.subjects.Peek(k)
+		v.(*subject).response = Block
+	}
+	d.mx.Unlock()
+	assert.Equal(t, http.StatusForbidden, connect(443), "blocked offenders should be refused")
+}
@@ -0,0 +1,74 @@
+package abuse
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/proxy/v3/filters"
+
+	"github.com/getlantern/http-proxy-lantern/v2/common"
+	"github.com/getlantern/http-proxy-lantern/v2/egress"
+	"github.com/getlantern/http-proxy-lantern/v2/instrument"
+	"github.com/getlantern/http-proxy-lantern/v2/listeners"
+)
+
+type filter struct {
+	detector   *Detector
+	instrument instrument.Instrument
+}
+
+// NewFilter creates the filter applying the detector's responses to every
+// request: blocked offenders get a 403, and throttled ones have their
+// connection held to the throttle rate. It must come after the filters
+// attaching the device's own limiter, which it replaces.
+func NewFilter(detector *Detector, instrument instrument.Instrument) filters.Filter {
+	return &filter{detector: detector, instrument: instrument}
+}
+
+func (f *filter) Apply(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+	deviceID, clientIP := identify(cs, req)
+	switch f.detector.Response(deviceID, clientIP) {
+	case Block:
+		f.instrument.AbuseEnforced(req.Context(), Block.String())
+		log.Tracef("Blocking request from %v to %v for abuse", req.RemoteAddr, req.Host)
+		return filters.Fail(cs, req, http.StatusForbidden, errors.New("blocked for abuse"))
+	case Throttle:
+		f.instrument.AbuseEnforced(req.Context(), Throttle.String())
+		if wc, ok := cs.Downstream().(listeners.WrapConn); ok {
+			wc.ControlMessage("throttle", f.detector.Limiter())
+		}
+	}
+	return next(cs, req)
+}
+
+// ObserveOp counts a proxied request against its device and client IP. It's
+// meant to be passed to proxyfilters.RecordOpObserved, so that requests are
+// counted whether or not they succeed.
+func (d *Detector) ObserveOp(cs *filters.ConnectionState, req *http.Request, resp *http.Response, err error) {
+	defaultPort := 80
+	if req.Method == http.MethodConnect || req.URL.Scheme == "https" {
+		defaultPort = 443
+	}
+	host, port := egress.ParseAddr(req.Host, defaultPort)
+	deviceID, clientIP := identify(cs, req)
+	d.Observe(Event{DeviceID: deviceID, ClientIP: clientIP, Host: host, Port: port})
+}
+
+// identify returns the device and client IP a request comes from. They're
+// taken from the measured listener's context where possible, since it keeps
+// them for the whole connection while later requests on persistent
+// connections may lack the device ID header.
+func identify(cs *filters.ConnectionState, req *http.Request) (deviceID, clientIP string) {
+	if ctx := listeners.MeasuredContext(cs.Downstream()); ctx != nil {
+		deviceID, _ = ctx[common.DeviceID].(string)
+		clientIP, _ = ctx[common.ClientIP].(string)
+	}
+	if deviceID == "" {
+		deviceID = req.Header.Get(common.DeviceIdHeader)
+	}
+	if clientIP == "" {
+		clientIP, _, _ = net.SplitHostPort(req.RemoteAddr)
+	}
+	return deviceID, clientIP
+}
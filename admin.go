@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/getlantern/errors"
+
+	"github.com/getlantern/http-proxy-lantern/v2/datacap"
+	"github.com/getlantern/http-proxy-lantern/v2/tlslistener"
+)
+
+// activeListener is a protocol listener the proxy is serving on.
+type activeListener struct {
+	Protocol string `json:"protocol"`
+	Addr     string `json:"addr"`
+}
+
+type sessionTicketKeyStatus struct {
+	Addr string `json:"addr"`
+	tlslistener.SessionTicketKeyStatus
+	// AgeSeconds is how long the current primary key has been in use.
+	AgeSeconds int64 `json:"ageSeconds"`
+}
+
+type banditStatus struct {
+	Enabled    bool   `json:"enabled"`
+	Emitted    uint64 `json:"emitted"`
+	Suppressed uint64 `json:"suppressed"`
+}
+
+// serveAdmin starts the local admin/status API at AdminAddr. Like pprof, it
+// has no authentication and must only listen on localhost or a private
+// address.
+func (p *Proxy) serveAdmin() error {
+	l, err := net.Listen("tcp", p.AdminAddr)
+	if err != nil {
+		return errors.New("Unable to listen for admin API at %v: %v", p.AdminAddr, err)
+	}
+	log.Debugf("Serving admin API at http://%v", l.Addr())
+	go func() {
+		if err := http.Serve(l, p.adminHandler()); err != nil {
+			log.Errorf("Error serving admin API: %v", err)
+		}
+	}()
+	return nil
+}
+
+func (p *Proxy) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /listeners", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, p.activeListeners)
+	})
+	mux.HandleFunc("GET /devices", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, p.datacapDevices())
+	})
+	mux.HandleFunc("GET /devices/{id}", func(w http.ResponseWriter, r *http.Request) {
+		deviceID := r.PathValue("id")
+		for _, d := range p.datacapDevices() {
+			if d.DeviceID == deviceID {
+				writeJSON(w, d)
+				return
+			}
+		}
+		http.Error(w, "device not tracked on this proxy", http.StatusNotFound)
+	})
+	mux.HandleFunc("GET /datacap", func(w http.ResponseWriter, r *http.Request) {
+		if p.datacapTracker == nil {
+			http.Error(w, "no datacap sidecar on this proxy", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, p.datacapTracker.Health())
+	})
+	mux.HandleFunc("GET /scheduler", func(w http.ResponseWriter, r *http.Request) {
+		if p.scheduler == nil {
+			http.Error(w, "fair-share is not enabled on this proxy", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, p.scheduler.Status())
+	})
+	mux.HandleFunc("GET /budget", func(w http.ResponseWriter, r *http.Request) {
+		if p.budget == nil {
+			http.Error(w, "no bandwidth budget on this proxy", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, p.budget.Status())
+	})
+	mux.HandleFunc("GET /abuse", func(w http.ResponseWriter, r *http.Request) {
+		if p.abuse == nil {
+			http.Error(w, "abuse detection is not enabled on this proxy", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, p.abuse.Offenders())
+	})
+	mux.HandleFunc("GET /blacklist", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, p.blacklist.Stats())
+	})
+	mux.HandleFunc("GET /bandit", func(w http.ResponseWriter, r *http.Request) {
+		p.reloadMx.Lock()
+		emitter := p.banditCallbackEmitter
+		p.reloadMx.Unlock()
+		status := banditStatus{Enabled: emitter.Enabled()}
+		if emitter != nil {
+			status.Emitted, status.Suppressed = emitter.Stats()
+		}
+		writeJSON(w, status)
+	})
+	mux.HandleFunc("GET /sessiontickets", func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		statuses := make([]sessionTicketKeyStatus, 0, len(p.tlsListeners))
+		for _, l := range p.tlsListeners {
+			st, _ := tlslistener.SessionTicketKeys(l)
+			status := sessionTicketKeyStatus{Addr: l.Addr().String(), SessionTicketKeyStatus: st}
+			if !st.Updated.IsZero() {
+				status.AgeSeconds = int64(now.Sub(st.Updated).Seconds())
+			}
+			statuses = append(statuses, status)
+		}
+		writeJSON(w, statuses)
+	})
+	return mux
+}
+
+// datacapDevices returns the datacap tracker's device table sorted by device
+// ID, or an empty table when this proxy doesn't report to a datacap sidecar.
+func (p *Proxy) datacapDevices() []datacap.DeviceStatus {
+	if p.datacapTracker == nil {
+		return []datacap.DeviceStatus{}
+	}
+	devices := p.datacapTracker.Devices()
+	sort.Slice(devices, func(i, j int) bool { return devices[i].DeviceID < devices[j].DeviceID })
+	return devices
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Errorf("Unable to write admin API response: %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/http-proxy-lantern/v2/banditcallback"
+	"github.com/getlantern/http-proxy-lantern/v2/blacklist"
+	"github.com/getlantern/http-proxy-lantern/v2/listeners"
+)
+
+func TestAdminAPI(t *testing.T) {
+	p := &Proxy{
+		blacklist:             blacklist.New(blacklist.Options{}),
+		banditCallbackEmitter: banditcallback.New("", "", time.Minute),
+		activeListeners:       []activeListener{{"https", "127.0.0.1:443"}, {"quic_ietf", "127.0.0.1:444"}},
+	}
+	handler := p.adminHandler()
+	get := func(path string, v interface{}) int {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code == http.StatusOK {
+			require.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), v))
+		}
+		return rec.Code
+	}
+
+	var listeners []activeListener
+	require.Equal(t, http.StatusOK, get("/listeners", &listeners))
+	assert.Equal(t, p.activeListeners, listeners)
+
+	var devices []interface{}
+	require.Equal(t, http.StatusOK, get("/devices", &devices))
+	assert.Empty(t, devices, "no datacap tracker configured")
+	assert.Equal(t, http.StatusNotFound, get("/devices/unknown", nil))
+	assert.Equal(t, http.StatusNotFound, get("/datacap", nil))
+	assert.Equal(t, http.StatusNotFound, get("/abuse", nil))
+
+	var stats blacklist.Stats
+	require.Equal(t, http.StatusOK, get("/blacklist", &stats))
+	assert.Equal(t, blacklist.Stats{}, stats)
+
+	var bandit banditStatus
+	require.Equal(t, http.StatusOK, get("/bandit", &bandit))
+	assert.False(t, bandit.Enabled)
+
+	var tickets []sessionTicketKeyStatus
+	require.Equal(t, http.StatusOK, get("/sessiontickets", &tickets))
+	assert.Empty(t, tickets)
+}
+
+func TestAdminScheduler(t *testing.T) {
+	p := &Proxy{}
+	rec := httptest.NewRecorder()
+	p.adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/scheduler", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code, "fair-share not enabled")
+
+	p.scheduler = listeners.NewScheduler(1000)
+	p.scheduler.Flow("device1", 1)
+	rec = httptest.NewRecorder()
+	p.adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/scheduler", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var status listeners.SchedulerStatus
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+	assert.EqualValues(t, 1000, status.Capacity)
+	if assert.Len(t, status.Flows, 1) {
+		assert.Equal(t, "device1", status.Flows[0].DeviceID)
+	}
+}
@@ -1,12 +1,20 @@
 // Package blacklist provides a mechanism for blacklisting IP addresses that
 // connect but never make it past our security filtering, either because they're
 // not sending HTTP requests or sending invalid HTTP requests.
+//
+// By default the blacklist only tracks such IPs and reports who it would have
+// blacklisted. Setting Options.Enforce makes it actually refuse their
+// connections. Independently of that, IPs in Options.Allow are never tracked or
+// refused and IPs in Options.Deny are always refused.
 package blacklist
 
 import (
 	"context"
 	"fmt"
+	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/getlantern/golog"
@@ -34,8 +42,6 @@ const (
 
 var (
 	log = golog.LoggerFor("blacklist")
-
-	blacklistingEnabled = false // we've temporarily turned off blacklisting for safety
 )
 
 // Options is a set of options to initialize a blacklist.
@@ -58,6 +64,24 @@ type Options struct {
 	// 6 hours.
 	Expiration time.Duration
 
+	// Enforce makes the blacklist refuse connections from blacklisted IPs.
+	// Without it, IPs are still tracked and blacklisted but allowed to connect,
+	// which is a safe way to see what enforcing would do.
+	Enforce bool
+
+	// Allow lists networks that are never tracked or blacklisted, e.g. our own
+	// monitoring and checkfallbacks hosts.
+	Allow []*net.IPNet
+
+	// Deny lists networks whose connections are always refused, whether or not
+	// Enforce is set. Allow takes precedence over Deny.
+	Deny []*net.IPNet
+
+	// File, if set, is where the blacklist is persisted so that it survives a
+	// restart. It's read once by New and rewritten whenever the blacklist
+	// changes.
+	File string
+
 	Instrument instrument.Instrument
 }
 
@@ -86,14 +110,80 @@ func (opts *Options) applyDefaults() {
 	}
 }
 
+// Stats is a snapshot of what the blacklist is tracking.
+type Stats struct {
+	// Connecting is the number of IPs that connected but haven't yet sent a
+	// successful request.
+	Connecting int `json:"connecting"`
+	// Failing is the number of IPs with at least one recorded failure.
+	Failing int `json:"failing"`
+	// Blacklisted is the number of IPs currently on the blacklist.
+	Blacklisted int `json:"blacklisted"`
+}
+
+// ParseNetworks parses a comma-separated list of CIDRs and bare IP addresses,
+// as accepted by Options.Allow and Options.Deny.
+func ParseNetworks(csv string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, s := range strings.Split(csv, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", s)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// policy is the part of Options consulted on every connection. It's swapped
+// as a whole by Reconfigure.
+type policy struct {
+	enforce bool
+	allow   []*net.IPNet
+	deny    []*net.IPNet
+}
+
+func newPolicy(opts Options) *policy {
+	return &policy{enforce: opts.Enforce, allow: opts.Allow, deny: opts.Deny}
+}
+
+func contains(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 // Blacklist is a blacklist of IPs.
 type Blacklist struct {
+	policy              atomic.Pointer[policy]
+	file                string
 	maxIdleTime         time.Duration
 	maxConnectInterval  time.Duration
 	allowedFailures     int
 	blacklistExpiration time.Duration
 	connections         chan string
 	successes           chan string
+	reconfigure         chan Options
+	statsRequests       chan chan Stats
 	firstConnectionTime map[string]time.Time
 	lastConnectionTime  map[string]time.Time
 	failureCounts       map[string]int
@@ -113,11 +203,18 @@ func New(opts Options) *Blacklist {
 		blacklistExpiration: opts.Expiration,
 		connections:         make(chan string, 10000),
 		successes:           make(chan string, 10000),
+		reconfigure:         make(chan Options),
+		statsRequests:       make(chan chan Stats),
 		firstConnectionTime: make(map[string]time.Time),
 		lastConnectionTime:  make(map[string]time.Time),
 		failureCounts:       make(map[string]int),
 		blacklist:           make(map[string]time.Time),
 		instrument:          opts.Instrument,
+		file:                opts.File,
+	}
+	bl.policy.Store(newPolicy(opts))
+	if bl.file != "" {
+		bl.load()
 	}
 	go bl.track()
 	return bl
@@ -135,21 +232,34 @@ func (bl *Blacklist) Succeed(ip string) {
 }
 
 // OnConnect records an attempt to connect from the given IP. If the IP is
-// blacklisted, this returns false.
+// denied, or blacklisted while enforcing, this returns false.
 func (bl *Blacklist) OnConnect(ip string) bool {
-	if !blacklistingEnabled {
-		bl.instrument.Blacklist(context.Background(), false)
-		return true
+	pol := bl.policy.Load()
+	if len(pol.allow) > 0 || len(pol.deny) > 0 {
+		parsed := net.ParseIP(ip)
+		if contains(pol.allow, parsed) {
+			bl.instrument.Blacklist(context.Background(), false)
+			return true
+		}
+		if contains(pol.deny, parsed) {
+			log.Debugf("%v is denied", ip)
+			bl.instrument.Blacklist(context.Background(), true)
+			return false
+		}
 	}
+
 	bl.mutex.RLock()
-	defer bl.mutex.RUnlock()
 	_, blacklisted := bl.blacklist[ip]
-	if blacklisted {
+	bl.mutex.RUnlock()
+	if blacklisted && pol.enforce {
 		log.Errorf("%v is blacklisted", ip)
 		bl.instrument.Blacklist(context.Background(), true)
 		return false
 	}
 	bl.instrument.Blacklist(context.Background(), false)
+	if blacklisted {
+		log.Tracef("%v is blacklisted but not enforcing, allowing", ip)
+	}
 	select {
 	case bl.connections <- ip:
 		// ip submitted as connected
@@ -159,6 +269,23 @@ func (bl *Blacklist) OnConnect(ip string) bool {
 	return true
 }
 
+// Reconfigure applies new options to a running blacklist, e.g. after a config
+// reload. Failure counts and IPs that are already blacklisted are kept; the
+// latter expire according to the new Expiration. The File and Instrument
+// options are ignored.
+func (bl *Blacklist) Reconfigure(opts Options) {
+	opts.applyDefaults()
+	bl.policy.Store(newPolicy(opts))
+	bl.reconfigure <- opts
+}
+
+// Stats returns a snapshot of the blacklist's tracking state.
+func (bl *Blacklist) Stats() Stats {
+	result := make(chan Stats, 1)
+	bl.statsRequests <- result
+	return <-result
+}
+
 func (bl *Blacklist) track() {
 	idleTicker := time.NewTicker(bl.maxIdleTime)
 	blacklistTicker := time.NewTicker(bl.blacklistExpiration / 10)
@@ -168,6 +295,15 @@ func (bl *Blacklist) track() {
 			bl.onConnection(ip)
 		case ip := <-bl.successes:
 			bl.onSuccess(ip)
+		case opts := <-bl.reconfigure:
+			bl.maxIdleTime = opts.MaxIdleTime
+			bl.maxConnectInterval = opts.MaxConnectInterval
+			bl.allowedFailures = opts.AllowedFailures
+			bl.blacklistExpiration = opts.Expiration
+			idleTicker.Reset(bl.maxIdleTime)
+			blacklistTicker.Reset(bl.blacklistExpiration / 10)
+		case result := <-bl.statsRequests:
+			result <- bl.stats()
 		case <-idleTicker.C:
 			bl.checkForIdlers()
 		case <-blacklistTicker.C:
@@ -176,6 +312,19 @@ func (bl *Blacklist) track() {
 	}
 }
 
+func (bl *Blacklist) stats() Stats {
+	stats := Stats{Connecting: len(bl.firstConnectionTime)}
+	for _, count := range bl.failureCounts {
+		if count > 0 {
+			stats.Failing++
+		}
+	}
+	bl.mutex.RLock()
+	stats.Blacklisted = len(bl.blacklist)
+	bl.mutex.RUnlock()
+	return stats
+}
+
 func (bl *Blacklist) onConnection(ip string) {
 	now := time.Now()
 	t, exists := bl.lastConnectionTime[ip]
@@ -196,8 +345,12 @@ func (bl *Blacklist) onSuccess(ip string) {
 	delete(bl.lastConnectionTime, ip)
 	delete(bl.firstConnectionTime, ip)
 	bl.mutex.Lock()
+	_, wasBlacklisted := bl.blacklist[ip]
 	delete(bl.blacklist, ip)
 	bl.mutex.Unlock()
+	if wasBlacklisted {
+		bl.save()
+	}
 }
 
 func (bl *Blacklist) checkForIdlers() {
@@ -213,7 +366,11 @@ func (bl *Blacklist) checkForIdlers() {
 			count := bl.failureCounts[ip] + 1
 			bl.failureCounts[ip] = count
 			if count >= bl.allowedFailures {
-				_ = log.Errorf("Blacklisting %v", ip)
+				if bl.policy.Load().enforce {
+					_ = log.Errorf("Blacklisting %v", ip)
+				} else {
+					log.Debugf("Blacklisting %v (not enforcing)", ip)
+				}
 				blacklistAdditions = append(blacklistAdditions, ip)
 			}
 		}
@@ -224,11 +381,13 @@ func (bl *Blacklist) checkForIdlers() {
 			bl.blacklist[ip] = now
 		}
 		bl.mutex.Unlock()
+		bl.save()
 	}
 }
 
 func (bl *Blacklist) checkExpiration() {
 	now := time.Now()
+	removed := false
 	bl.mutex.Lock()
 	for ip, blacklistedAt := range bl.blacklist {
 		if now.Sub(blacklistedAt) > bl.blacklistExpiration {
@@ -236,7 +395,11 @@ func (bl *Blacklist) checkExpiration() {
 			delete(bl.blacklist, ip)
 			delete(bl.failureCounts, ip)
 			delete(bl.firstConnectionTime, ip)
+			removed = true
 		}
 	}
 	bl.mutex.Unlock()
+	if removed {
+		bl.save()
+	}
 }
@@ -1,26 +1,25 @@
 package blacklist
 
 import (
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 const (
 	ip = "8.8.8.8"
 )
 
-func init() {
-	blacklistingEnabled = true
-}
-
 func TestBlacklistSucceed(t *testing.T) {
 	bl := New(Options{
 		MaxIdleTime:        50 * time.Millisecond,
 		MaxConnectInterval: 1 * time.Millisecond,
 		AllowedFailures:    2,
 		Expiration:         5 * time.Second,
+		Enforce:            true,
 	})
 	for i := 0; i < 10000; i++ {
 		assert.True(t, bl.OnConnect(ip), "Should be able to continuously connect while succeeding")
@@ -35,6 +34,7 @@ func TestBlacklistFail(t *testing.T) {
 		MaxConnectInterval: maxIdleTime * 5,
 		AllowedFailures:    3,
 		Expiration:         maxIdleTime * 50,
+		Enforce:            true,
 	})
 	// Run through the same tests multiple times since this depends somewhat on timing
 	for i := 0; i < 10; i++ {
@@ -61,3 +61,97 @@ func TestBlacklistFail(t *testing.T) {
 		bl.Succeed(ip)
 	}
 }
+
+func TestBlacklistStats(t *testing.T) {
+	bl := New(Options{
+		MaxIdleTime:        time.Hour,
+		MaxConnectInterval: time.Hour,
+		AllowedFailures:    10,
+		Expiration:         time.Hour,
+	})
+	bl.OnConnect(ip)
+	bl.OnConnect(ip)
+	bl.OnConnect("8.8.4.4")
+	assert.Eventually(t, func() bool {
+		return bl.Stats() == Stats{Connecting: 1}
+	}, time.Second, 5*time.Millisecond, "only the IP that reconnected within MaxConnectInterval is a candidate")
+
+	bl.Succeed(ip)
+	assert.Eventually(t, func() bool {
+		return bl.Stats() == Stats{}
+	}, time.Second, 5*time.Millisecond, "a success should clear the candidate")
+}
+
+func TestBlacklistNotEnforcing(t *testing.T) {
+	bl := New(Options{
+		MaxIdleTime:        time.Hour,
+		MaxConnectInterval: time.Hour,
+		AllowedFailures:    10,
+		Expiration:         time.Hour,
+	})
+	bl.mutex.Lock()
+	bl.blacklist[ip] = time.Now()
+	bl.mutex.Unlock()
+	assert.True(t, bl.OnConnect(ip), "blacklisted IPs should be allowed when not enforcing")
+
+	bl.Reconfigure(Options{Expiration: time.Hour, Enforce: true})
+	assert.False(t, bl.OnConnect(ip), "blacklisted IPs should be refused once enforcing")
+}
+
+func TestBlacklistAllowDeny(t *testing.T) {
+	allow, err := ParseNetworks("8.8.8.0/24, 10.0.0.1")
+	require.NoError(t, err)
+	deny, err := ParseNetworks("8.8.0.0/16,2001:db8::/32")
+	require.NoError(t, err)
+	bl := New(Options{
+		MaxIdleTime:        time.Hour,
+		MaxConnectInterval: time.Hour,
+		AllowedFailures:    10,
+		Expiration:         time.Hour,
+		Enforce:            true,
+		Allow:              allow,
+		Deny:               deny,
+	})
+	bl.mutex.Lock()
+	bl.blacklist[ip] = time.Now()
+	bl.mutex.Unlock()
+
+	assert.True(t, bl.OnConnect(ip), "allow should take precedence over the blacklist and deny")
+	assert.True(t, bl.OnConnect("10.0.0.1"))
+	assert.False(t, bl.OnConnect("8.8.4.4"), "denied network")
+	assert.False(t, bl.OnConnect("2001:db8::1"), "denied IPv6 network")
+	assert.True(t, bl.OnConnect("1.1.1.1"))
+	bl.OnConnect(ip)
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, 0, bl.Stats().Connecting, "allowed IPs should never be tracked")
+
+	_, err = ParseNetworks("8.8.8.8,bogus")
+	assert.Error(t, err)
+}
+
+func TestBlacklistPersistence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "blacklist.json")
+	opts := Options{
+		MaxIdleTime:        10 * time.Millisecond,
+		MaxConnectInterval: time.Hour,
+		AllowedFailures:    1,
+		Expiration:         time.Hour,
+		Enforce:            true,
+		File:               file,
+	}
+	bl := New(opts)
+	bl.OnConnect(ip)
+	bl.OnConnect(ip)
+	require.Eventually(t, func() bool {
+		return !bl.OnConnect(ip)
+	}, time.Second, 5*time.Millisecond, "IP should get blacklisted")
+
+	reloaded := New(opts)
+	assert.False(t, reloaded.OnConnect(ip), "blacklist should survive a restart")
+	assert.Equal(t, 1, reloaded.Stats().Blacklisted)
+
+	opts.Expiration = time.Millisecond
+	time.Sleep(2 * opts.Expiration)
+	expired := New(opts)
+	assert.True(t, expired.OnConnect(ip), "expired entries should not be loaded")
+}
@@ -0,0 +1,52 @@
+package blacklist
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/getlantern/http-proxy-lantern/v2/internal/atomicfile"
+)
+
+// load reads the blacklist persisted at bl.file, skipping entries that have
+// already expired. A missing file is not an error.
+func (bl *Blacklist) load() {
+	b, err := os.ReadFile(bl.file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("Unable to read blacklist from %v: %v", bl.file, err)
+		}
+		return
+	}
+	var persisted map[string]time.Time
+	if err := json.Unmarshal(b, &persisted); err != nil {
+		log.Errorf("Unable to parse blacklist in %v: %v", bl.file, err)
+		return
+	}
+	now := time.Now()
+	bl.mutex.Lock()
+	for ip, blacklistedAt := range persisted {
+		if now.Sub(blacklistedAt) <= bl.blacklistExpiration {
+			bl.blacklist[ip] = blacklistedAt
+		}
+	}
+	log.Debugf("Loaded %d blacklisted IPs from %v", len(bl.blacklist), bl.file)
+	bl.mutex.Unlock()
+}
+
+// save writes the current blacklist to bl.file.
+func (bl *Blacklist) save() {
+	if bl.file == "" {
+		return
+	}
+	bl.mutex.RLock()
+	b, err := json.Marshal(bl.blacklist)
+	bl.mutex.RUnlock()
+	if err != nil {
+		log.Errorf("Unable to serialize blacklist: %v", err)
+		return
+	}
+	if err := atomicfile.Write(bl.file, b); err != nil {
+		log.Errorf("Unable to save blacklist to %v: %v", bl.file, err)
+	}
+}
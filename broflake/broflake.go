@@ -2,12 +2,21 @@ package broflake
 
 import (
 	"context"
+	"crypto/tls"
 	"net"
 
 	"github.com/getlantern/broflake/egress"
 	egcmdcommon "github.com/getlantern/broflake/egress/cmd/common"
 )
 
-func Wrap(ll net.Listener, certPEM string, keyPEM string) (net.Listener, error) {
-	return egress.NewListener(context.Background(), ll, egcmdcommon.GenerateSelfSignedTLSConfig(true))
+// Wrap serves broflake on ll. getCertificate, if not nil, provides its
+// certificates instead of a self-signed one.
+func Wrap(ll net.Listener, getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) (net.Listener, error) {
+	tlsConfig := egcmdcommon.GenerateSelfSignedTLSConfig(true)
+	if getCertificate != nil {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.Certificates = nil
+		tlsConfig.GetCertificate = getCertificate
+	}
+	return egress.NewListener(context.Background(), ll, tlsConfig)
 }
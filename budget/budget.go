@@ -0,0 +1,327 @@
+// Package budget tracks how many bytes the host has transferred in its current
+// billing cycle against the monthly quota its provider bills for, and how
+// close it is to running out.
+//
+// Past a soft threshold, the default rate devices are held to is lowered
+// progressively (see RateFactor), and past a hard threshold new sessions from
+// non-pro devices are refused (see NewFilter), so that the proxy degrades
+// instead of running up overage charges.
+package budget
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/golog"
+	"github.com/getlantern/measured"
+
+	"github.com/getlantern/http-proxy-lantern/v2/internal/atomicfile"
+	"github.com/getlantern/http-proxy-lantern/v2/listeners"
+)
+
+var log = golog.LoggerFor("budget")
+
+const (
+	// checkInterval is how often the budget checks for the end of the billing
+	// cycle and recomputes the rate factor.
+	checkInterval = 10 * time.Second
+
+	// saveInterval is how often usage is persisted. At most this much usage
+	// is forgotten if the proxy crashes.
+	saveInterval = 1 * time.Minute
+
+	// MinRateFactor is what the default rate is multiplied by at the hard
+	// threshold.
+	MinRateFactor = 0.1
+)
+
+// Levels of usage relative to the thresholds.
+const (
+	LevelOK   = "ok"
+	LevelSoft = "soft"
+	LevelHard = "hard"
+)
+
+// Options configures a Budget.
+type Options struct {
+	// Quota is how many bytes the host may transfer per billing cycle. Both
+	// directions of client connections count, since what clients download
+	// leaves the host towards them and what they upload leaves it towards
+	// origins.
+	Quota int64
+	// Soft and Hard are the fractions of Quota at which the default rate
+	// starts to be lowered and at which new non-pro sessions are refused.
+	// 0 < Soft <= Hard <= 1.
+	Soft float64
+	Hard float64
+	// CycleDay is the day of the month, between 1 and 28, on which billing
+	// cycles start, at midnight UTC.
+	CycleDay int
+	// File, if set, is where usage is persisted across restarts.
+	File string
+	// OnRateFactor, if set, is called with the new RateFactor whenever it
+	// changes, including once at startup.
+	OnRateFactor func(factor float64)
+}
+
+// Validate reports why opts can't be used, if they can't.
+func (opts Options) Validate() error {
+	if opts.Quota <= 0 {
+		return errors.New("budget quota must be positive, not %d", opts.Quota)
+	}
+	if opts.Soft <= 0 || opts.Soft > opts.Hard || opts.Hard > 1 {
+		return errors.New("budget thresholds must satisfy 0 < soft (%v) <= hard (%v) <= 1", opts.Soft, opts.Hard)
+	}
+	if opts.CycleDay < 1 || opts.CycleDay > 28 {
+		return errors.New("budget cycle day must be between 1 and 28, not %d", opts.CycleDay)
+	}
+	return nil
+}
+
+// Status is a snapshot of a Budget, for introspection and metrics.
+type Status struct {
+	Quota      int64     `json:"quota"`
+	Used       int64     `json:"used"`
+	CycleStart time.Time `json:"cycleStart"`
+	CycleEnd   time.Time `json:"cycleEnd"`
+	// Projected is the share of the quota that will have been used by the end
+	// of the cycle if usage continues at its average rate so far.
+	Projected  float64 `json:"projected"`
+	Level      string  `json:"level"`
+	RateFactor float64 `json:"rateFactor"`
+}
+
+// persisted is what's saved to Options.File.
+type persisted struct {
+	CycleStart time.Time `json:"cycleStart"`
+	Used       int64     `json:"used"`
+}
+
+// Budget tracks the host's usage in the current billing cycle.
+type Budget struct {
+	// used is updated on every measured report, so it's kept outside of mx.
+	used atomic.Int64
+	// hardBytes is the usage at the hard threshold, read on every new session.
+	hardBytes atomic.Int64
+
+	mx         sync.Mutex
+	opts       Options
+	cycleStart time.Time
+	factor     float64
+	savedUsed  int64
+	lastSave   time.Time
+}
+
+// New creates a Budget, resuming the usage persisted in opts.File if it's from
+// the current billing cycle, and starts checking it periodically.
+func New(opts Options) (*Budget, error) {
+	b, err := newBudget(opts, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	go b.checkPeriodically()
+	return b, nil
+}
+
+func newBudget(opts Options, now time.Time) (*Budget, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	b := &Budget{opts: opts, factor: -1}
+	b.hardBytes.Store(hardBytes(opts))
+	b.cycleStart, _ = cycleBounds(now, opts.CycleDay)
+	b.load()
+	b.savedUsed = b.used.Load()
+	b.lastSave = now
+	b.check(now)
+	return b, nil
+}
+
+// Reconfigure changes the quota, thresholds and cycle day, e.g. after a config
+// reload, keeping the usage so far. Changing the cycle day ends the current
+// cycle on the next occurrence of the new day.
+func (b *Budget) Reconfigure(opts Options) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	b.mx.Lock()
+	opts.File, opts.OnRateFactor = b.opts.File, b.opts.OnRateFactor
+	b.opts = opts
+	b.hardBytes.Store(hardBytes(opts))
+	b.mx.Unlock()
+	b.check(time.Now())
+	return nil
+}
+
+func hardBytes(opts Options) int64 {
+	return int64(opts.Hard * float64(opts.Quota))
+}
+
+// Reporter returns the callback the measured listener feeds connection deltas
+// into.
+func (b *Budget) Reporter() listeners.MeasuredReportFN {
+	return func(ctx map[string]interface{}, stats *measured.Stats, deltaStats *measured.Stats, final bool) {
+		if bytes := int64(deltaStats.SentTotal) + int64(deltaStats.RecvTotal); bytes > 0 {
+			b.used.Add(bytes)
+		}
+	}
+}
+
+// Exhausted reports whether usage has reached the hard threshold.
+func (b *Budget) Exhausted() bool {
+	return b.used.Load() >= b.hardBytes.Load()
+}
+
+// RateFactor is what the default rate devices are held to should be
+// multiplied by: 1 below the soft threshold, falling linearly to
+// MinRateFactor at the hard threshold.
+func (b *Budget) RateFactor() float64 {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return rateFactor(b.used.Load(), b.opts)
+}
+
+func rateFactor(used int64, opts Options) float64 {
+	soft := opts.Soft * float64(opts.Quota)
+	hard := opts.Hard * float64(opts.Quota)
+	switch {
+	case float64(used) < soft:
+		return 1
+	case float64(used) >= hard:
+		return MinRateFactor
+	default:
+		return 1 - (1-MinRateFactor)*(float64(used)-soft)/(hard-soft)
+	}
+}
+
+// Status returns a snapshot of the budget.
+func (b *Budget) Status() Status {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return b.status(time.Now())
+}
+
+func (b *Budget) status(now time.Time) Status {
+	used := b.used.Load()
+	_, end := cycleBounds(b.cycleStart, b.opts.CycleDay)
+	st := Status{
+		Quota:      b.opts.Quota,
+		Used:       used,
+		CycleStart: b.cycleStart,
+		CycleEnd:   end,
+		RateFactor: rateFactor(used, b.opts),
+		Level:      LevelOK,
+	}
+	if elapsed := now.Sub(b.cycleStart); elapsed > 0 {
+		cycle := end.Sub(b.cycleStart)
+		st.Projected = float64(used) / float64(b.opts.Quota) * cycle.Seconds() / elapsed.Seconds()
+	}
+	switch {
+	case used >= hardBytes(b.opts):
+		st.Level = LevelHard
+	case float64(used) >= b.opts.Soft*float64(b.opts.Quota):
+		st.Level = LevelSoft
+	}
+	return st
+}
+
+func (b *Budget) checkPeriodically() {
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		b.check(now)
+	}
+}
+
+// check starts a new billing cycle if the current one is over, tells
+// OnRateFactor about changes to the rate factor and saves usage if it's due.
+func (b *Budget) check(now time.Time) {
+	b.mx.Lock()
+	if _, end := cycleBounds(b.cycleStart, b.opts.CycleDay); !now.Before(end) {
+		b.cycleStart, _ = cycleBounds(now, b.opts.CycleDay)
+		used := b.used.Swap(0)
+		log.Debugf("Starting billing cycle at %v after using %d of %d bytes", b.cycleStart, used, b.opts.Quota)
+		b.savedUsed = -1
+	}
+	st := b.status(now)
+	var onRateFactor func(float64)
+	if st.RateFactor != b.factor {
+		if b.factor >= 0 || st.Level != LevelOK {
+			log.Debugf("Used %d of %d bytes this billing cycle (%v), default rate now at %.0f%%",
+				st.Used, st.Quota, st.Level, st.RateFactor*100)
+		}
+		b.factor = st.RateFactor
+		onRateFactor = b.opts.OnRateFactor
+	}
+	save := st.Used != b.savedUsed && now.Sub(b.lastSave) >= saveInterval
+	b.mx.Unlock()
+
+	if onRateFactor != nil {
+		onRateFactor(st.RateFactor)
+	}
+	if save {
+		b.Save()
+	}
+}
+
+// cycleBounds returns the start and end of the billing cycle starting on day
+// of the month that t falls in.
+func cycleBounds(t time.Time, day int) (start, end time.Time) {
+	t = t.UTC()
+	start = time.Date(t.Year(), t.Month(), day, 0, 0, 0, 0, time.UTC)
+	if t.Before(start) {
+		start = start.AddDate(0, -1, 0)
+	}
+	return start, start.AddDate(0, 1, 0)
+}
+
+// load resumes the usage persisted at opts.File if it's from the current
+// billing cycle. A missing file is not an error.
+func (b *Budget) load() {
+	if b.opts.File == "" {
+		return
+	}
+	data, err := os.ReadFile(b.opts.File)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("Unable to read budget usage from %v: %v", b.opts.File, err)
+		}
+		return
+	}
+	var p persisted
+	if err := json.Unmarshal(data, &p); err != nil {
+		log.Errorf("Unable to parse budget usage in %v: %v", b.opts.File, err)
+		return
+	}
+	if !p.CycleStart.Equal(b.cycleStart) {
+		log.Debugf("Not resuming usage of %d bytes from the billing cycle starting %v", p.Used, p.CycleStart)
+		return
+	}
+	b.used.Store(p.Used)
+	log.Debugf("Resumed usage of %d bytes this billing cycle from %v", p.Used, b.opts.File)
+}
+
+// Save writes the usage to opts.File.
+func (b *Budget) Save() {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	if b.opts.File == "" {
+		return
+	}
+	p := persisted{CycleStart: b.cycleStart, Used: b.used.Load()}
+	data, err := json.Marshal(p)
+	if err != nil {
+		log.Errorf("Unable to serialize budget usage: %v", err)
+		return
+	}
+	if err := atomicfile.Write(b.opts.File, data); err != nil {
+		log.Errorf("Unable to save budget usage to %v: %v", b.opts.File, err)
+		return
+	}
+	b.savedUsed = p.Used
+	b.lastSave = time.Now()
+}
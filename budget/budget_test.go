@@ -0,0 +1,155 @@
+package budget
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/getlantern/measured"
+	"github.com/getlantern/proxy/v3/filters"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/http-proxy-lantern/v2/instrument"
+)
+
+func testOptions() Options {
+	return Options{Quota: 1000, Soft: 0.5, Hard: 0.9, CycleDay: 15}
+}
+
+func use(b *Budget, sent, recv int) {
+	b.Reporter()(nil, nil, &measured.Stats{SentTotal: sent, RecvTotal: recv}, false)
+}
+
+func TestValidate(t *testing.T) {
+	assert.NoError(t, testOptions().Validate())
+	for name, modify := range map[string]func(*Options){
+		"no quota":         func(o *Options) { o.Quota = 0 },
+		"no soft":          func(o *Options) { o.Soft = 0 },
+		"soft above hard":  func(o *Options) { o.Soft = 0.95 },
+		"hard above quota": func(o *Options) { o.Hard = 1.1 },
+		"cycle day 0":      func(o *Options) { o.CycleDay = 0 },
+		"cycle day 31":     func(o *Options) { o.CycleDay = 31 },
+	} {
+		opts := testOptions()
+		modify(&opts)
+		assert.Error(t, opts.Validate(), name)
+	}
+}
+
+func TestCycleBounds(t *testing.T) {
+	start, end := cycleBounds(time.Date(2026, 3, 20, 12, 0, 0, 0, time.UTC), 15)
+	assert.Equal(t, time.Date(2026, 3, 15, 0, 0, 0, 0, time.UTC), start)
+	assert.Equal(t, time.Date(2026, 4, 15, 0, 0, 0, 0, time.UTC), end)
+
+	start, end = cycleBounds(time.Date(2026, 1, 3, 0, 0, 0, 0, time.UTC), 15)
+	assert.Equal(t, time.Date(2025, 12, 15, 0, 0, 0, 0, time.UTC), start, "cycles should wrap around the year")
+	assert.Equal(t, time.Date(2026, 1, 15, 0, 0, 0, 0, time.UTC), end)
+
+	start, _ = cycleBounds(time.Date(2026, 3, 15, 0, 0, 0, 0, time.UTC), 15)
+	assert.Equal(t, time.Date(2026, 3, 15, 0, 0, 0, 0, time.UTC), start, "cycles should start at midnight on their day")
+}
+
+func TestThresholds(t *testing.T) {
+	var factors []float64
+	opts := testOptions()
+	opts.OnRateFactor = func(factor float64) { factors = append(factors, factor) }
+	now := time.Date(2026, 3, 20, 0, 0, 0, 0, time.UTC)
+	b, err := newBudget(opts, now)
+	require.NoError(t, err)
+	assert.Equal(t, []float64{1}, factors, "the rate factor should be reported at startup")
+
+	use(b, 300, 100)
+	b.check(now)
+	assert.Equal(t, LevelOK, b.Status().Level)
+	assert.EqualValues(t, 1, b.RateFactor())
+	assert.Len(t, factors, 1, "an unchanged rate factor shouldn't be reported")
+
+	use(b, 200, 0)
+	b.check(now)
+	assert.Equal(t, LevelSoft, b.Status().Level)
+	assert.InDelta(t, 1-(1-MinRateFactor)*0.25, b.RateFactor(), 0.0001)
+	assert.False(t, b.Exhausted())
+
+	use(b, 0, 300)
+	b.check(now)
+	st := b.Status()
+	assert.Equal(t, LevelHard, st.Level)
+	assert.EqualValues(t, 900, st.Used)
+	assert.EqualValues(t, MinRateFactor, b.RateFactor())
+	assert.True(t, b.Exhausted())
+	assert.Equal(t, []float64{1, 1 - (1-MinRateFactor)*0.25, MinRateFactor}, factors)
+
+	opts.Quota = 2000
+	require.NoError(t, b.Reconfigure(opts))
+	assert.False(t, b.Exhausted(), "raising the quota should un-exhaust the budget")
+	assert.Equal(t, LevelOK, b.Status().Level)
+	assert.Error(t, b.Reconfigure(Options{}))
+}
+
+func TestProjected(t *testing.T) {
+	opts := testOptions()
+	opts.CycleDay = 1
+	start := time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC)
+	b, err := newBudget(opts, start)
+	require.NoError(t, err)
+	use(b, 100, 0)
+	// a third of the way through a 30 day cycle
+	st := b.status(start.Add(10 * 24 * time.Hour))
+	assert.InDelta(t, 0.3, st.Projected, 0.0001)
+	assert.Equal(t, time.Date(2026, 5, 1, 0, 0, 0, 0, time.UTC), st.CycleEnd)
+}
+
+func TestNewCycle(t *testing.T) {
+	opts := testOptions()
+	now := time.Date(2026, 3, 20, 0, 0, 0, 0, time.UTC)
+	b, err := newBudget(opts, now)
+	require.NoError(t, err)
+	use(b, 950, 0)
+	b.check(now)
+	require.True(t, b.Exhausted())
+
+	b.check(time.Date(2026, 4, 15, 0, 0, 0, 0, time.UTC))
+	st := b.Status()
+	assert.Zero(t, st.Used, "usage should start over with the billing cycle")
+	assert.Equal(t, time.Date(2026, 4, 15, 0, 0, 0, 0, time.UTC), st.CycleStart)
+	assert.False(t, b.Exhausted())
+}
+
+func TestPersistence(t *testing.T) {
+	opts := testOptions()
+	opts.File = filepath.Join(t.TempDir(), "budget.json")
+	now := time.Now()
+	b, err := newBudget(opts, now)
+	require.NoError(t, err)
+	use(b, 400, 0)
+	b.Save()
+
+	b, err = newBudget(opts, now)
+	require.NoError(t, err)
+	assert.EqualValues(t, 400, b.Status().Used, "usage should be resumed")
+
+	_, end := cycleBounds(now, opts.CycleDay)
+	b, err = newBudget(opts, end)
+	require.NoError(t, err)
+	assert.Zero(t, b.Status().Used, "usage from a past cycle shouldn't be resumed")
+}
+
+func TestFilter(t *testing.T) {
+	b, err := newBudget(testOptions(), time.Now())
+	require.NoError(t, err)
+	f := NewFilter(b, instrument.NoInstrument{})
+	next := func(cs *filters.ConnectionState, req *http.Request) (*http.Response, *filters.ConnectionState, error) {
+		return &http.Response{StatusCode: http.StatusOK}, cs, nil
+	}
+	apply := func() int {
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+		resp, _, _ := f.Apply(filters.NewConnectionState(req, nil, nil), req, next)
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusOK, apply())
+	use(b, 900, 0)
+	assert.Equal(t, http.StatusServiceUnavailable, apply(), "new sessions should be refused once the budget is exhausted")
+}
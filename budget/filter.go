@@ -0,0 +1,36 @@
+package budget
+
+import (
+	"net/http"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/proxy/v3/filters"
+
+	"github.com/getlantern/http-proxy-lantern/v2/instrument"
+	"github.com/getlantern/http-proxy-lantern/v2/tokenfilter"
+)
+
+type filter struct {
+	budget     *Budget
+	instrument instrument.Instrument
+}
+
+// NewFilter creates the filter refusing new sessions from non-pro devices with
+// a 503 once the budget is exhausted, so that clients move on to another
+// proxy. Only a signed token can vouch for a device being pro. Sessions that
+// were already open carry on.
+func NewFilter(budget *Budget, instrument instrument.Instrument) filters.Filter {
+	return &filter{budget: budget, instrument: instrument}
+}
+
+func (f *filter) Apply(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+	if !f.budget.Exhausted() {
+		return next(cs, req)
+	}
+	if claims := tokenfilter.ClaimsFromContext(req.Context()); claims != nil && claims.Pro {
+		return next(cs, req)
+	}
+	f.instrument.BudgetRefused(req.Context())
+	log.Tracef("Refusing session from %v, bandwidth budget exhausted", req.RemoteAddr)
+	return filters.Fail(cs, req, http.StatusServiceUnavailable, errors.New("bandwidth budget exhausted"))
+}
@@ -0,0 +1,254 @@
+package certmanager
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/acme"
+)
+
+// testCertValidity is how long the certificates testACMEServer issues are
+// valid, long enough for them not to be renewed during tests.
+const testCertValidity = 90 * 24 * time.Hour
+
+// idPeACMEIdentifier is the extension TLS-ALPN-01 challenge certificates
+// carry the key authorization digest in, see RFC 8737.
+var idPeACMEIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// testACMEServer is a minimal ACME server in the spirit of Pebble. It only
+// does TLS-ALPN-01, validating every host by connecting to validationAddr, and
+// doesn't check request signatures.
+type testACMEServer struct {
+	*httptest.Server
+	validationAddr string
+	ca             *x509.Certificate
+	caKey          *ecdsa.PrivateKey
+
+	mx         sync.Mutex
+	thumbprint string
+	orders     []*testOrder
+	issued     int
+}
+
+type testOrder struct {
+	status string
+	host   string
+	token  string
+	authz  string
+	cert   []byte
+}
+
+func newTestACMEServer(t *testing.T, validationAddr string) *testACMEServer {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test ACME CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+	ca, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	s := &testACMEServer{validationAddr: validationAddr, ca: ca, caKey: caKey}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Roots returns a pool with the CA of s.
+func (s *testACMEServer) Roots() *x509.CertPool {
+	roots := x509.NewCertPool()
+	roots.AddCert(s.ca)
+	return roots
+}
+
+// Issued returns how many certificates s has issued.
+func (s *testACMEServer) Issued() int {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.issued
+}
+
+func (s *testACMEServer) serve(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", base64.RawURLEncoding.EncodeToString(big.NewInt(time.Now().UnixNano()).Bytes()))
+	if r.URL.Path == "/directory" {
+		writeJSON(w, http.StatusOK, map[string]string{
+			"newNonce":   s.URL + "/nonce",
+			"newAccount": s.URL + "/account",
+			"newOrder":   s.URL + "/order",
+		})
+		return
+	}
+	if r.URL.Path == "/nonce" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var jws struct{ Protected, Payload string }
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	var kind string
+	var id int
+	fmt.Sscanf(strings.ReplaceAll(r.URL.Path, "/", " "), "%s %d", &kind, &id)
+	var order *testOrder
+	if id > 0 && id <= len(s.orders) {
+		order = s.orders[id-1]
+	}
+	switch {
+	case kind == "account":
+		protected, _ := base64.RawURLEncoding.DecodeString(jws.Protected)
+		var header struct{ JWK struct{ X, Y string } }
+		json.Unmarshal(protected, &header)
+		x, _ := base64.RawURLEncoding.DecodeString(header.JWK.X)
+		y, _ := base64.RawURLEncoding.DecodeString(header.JWK.Y)
+		s.thumbprint, _ = acme.JWKThumbprint(&ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)})
+		w.Header().Set("Location", s.URL+"/account/1")
+		writeJSON(w, http.StatusCreated, map[string]string{"status": "valid"})
+	case kind == "order" && id == 0:
+		var req struct{ Identifiers []struct{ Value string } }
+		json.Unmarshal(payload, &req)
+		s.orders = append(s.orders, &testOrder{status: "pending", host: req.Identifiers[0].Value, token: fmt.Sprintf("token%d", len(s.orders)+1), authz: "pending"})
+		s.writeOrder(w, http.StatusCreated, len(s.orders))
+	case kind == "order" && order != nil:
+		s.writeOrder(w, http.StatusOK, id)
+	case kind == "authz" && order != nil:
+		s.writeAuthz(w, id)
+	case kind == "challenge" && order != nil:
+		if err := s.validate(order); err != nil {
+			order.authz, order.status = "invalid", "invalid"
+		} else {
+			order.authz, order.status = "valid", "ready"
+		}
+		writeJSON(w, http.StatusOK, s.challenge(id))
+	case kind == "finalize" && order != nil:
+		var req struct{ CSR string }
+		json.Unmarshal(payload, &req)
+		der, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(time.Now().UnixNano()),
+			Subject:      pkix.Name{CommonName: csr.DNSNames[0]},
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Minute),
+			NotAfter:     time.Now().Add(testCertValidity),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+		cert, err := x509.CreateCertificate(rand.Reader, template, s.ca, csr.PublicKey, s.caKey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		order.cert = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.ca.Raw})...)
+		order.status = "valid"
+		s.issued++
+		s.writeOrder(w, http.StatusOK, id)
+	case kind == "cert" && order != nil && order.cert != nil:
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(order.cert)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// validate connects to the validation address the way ACME servers check
+// TLS-ALPN-01 challenges.
+func (s *testACMEServer) validate(order *testOrder) error {
+	conn, err := tls.Dial("tcp", s.validationAddr, &tls.Config{
+		ServerName:         order.host,
+		NextProtos:         []string{acme.ALPNProto},
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	state := conn.ConnectionState()
+	if state.NegotiatedProtocol != acme.ALPNProto {
+		return fmt.Errorf("negotiated %q", state.NegotiatedProtocol)
+	}
+	digest := sha256.Sum256([]byte(order.token + "." + s.thumbprint))
+	for _, ext := range state.PeerCertificates[0].Extensions {
+		var value []byte
+		if ext.Id.Equal(idPeACMEIdentifier) {
+			if _, err := asn1.Unmarshal(ext.Value, &value); err == nil && string(value) == string(digest[:]) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("no valid acmeIdentifier extension")
+}
+
+func (s *testACMEServer) writeOrder(w http.ResponseWriter, status int, id int) {
+	order := s.orders[id-1]
+	body := map[string]interface{}{
+		"status":         order.status,
+		"identifiers":    []map[string]string{{"type": "dns", "value": order.host}},
+		"authorizations": []string{fmt.Sprintf("%v/authz/%d", s.URL, id)},
+		"finalize":       fmt.Sprintf("%v/finalize/%d", s.URL, id),
+	}
+	if order.cert != nil {
+		body["certificate"] = fmt.Sprintf("%v/cert/%d", s.URL, id)
+	}
+	w.Header().Set("Location", fmt.Sprintf("%v/order/%d", s.URL, id))
+	writeJSON(w, status, body)
+}
+
+func (s *testACMEServer) writeAuthz(w http.ResponseWriter, id int) {
+	order := s.orders[id-1]
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":     order.authz,
+		"identifier": map[string]string{"type": "dns", "value": order.host},
+		"challenges": []interface{}{s.challenge(id)},
+	})
+}
+
+func (s *testACMEServer) challenge(id int) map[string]string {
+	order := s.orders[id-1]
+	return map[string]string{
+		"type":   "tls-alpn-01",
+		"url":    fmt.Sprintf("%v/challenge/%d", s.URL, id),
+		"token":  order.token,
+		"status": order.authz,
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,246 @@
+// Package certmanager provides the proxy's TLS certificates to all of its
+// listeners through GetCertificate, so that they pick up new certificates
+// without restarting. The default certificate is reloaded from its files
+// whenever they change, and the certificates of ACME hosts are obtained and
+// renewed through ACME, kept on disk in between.
+package certmanager
+
+import (
+	"crypto/tls"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/golog"
+	"github.com/getlantern/keyman"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	// DefaultCheckInterval is how often the certificate files are checked for
+	// changes by default.
+	DefaultCheckInterval = 10 * time.Second
+
+	selfSignedValidity = 10 * 365 * 24 * time.Hour
+)
+
+var log = golog.LoggerFor("certmanager")
+
+// Options configures a Manager.
+type Options struct {
+	// CertFile and KeyFile hold the default certificate and its key, and
+	// default to cert.pem and key.pem. If either is missing, a self-signed
+	// certificate for Host is generated and saved there.
+	CertFile string
+	KeyFile  string
+	Host     string
+
+	// CheckInterval is how often the files are checked for changes,
+	// DefaultCheckInterval if zero.
+	CheckInterval time.Duration
+
+	// ACMEHosts get their certificates from the ACME server at
+	// ACMEDirectoryURL, Let's Encrypt's if empty, instead. They're cached in
+	// ACMECacheDir and renewed ahead of expiry. The ACME server validates the
+	// hosts with TLS-ALPN-01 challenges, see IsACMEHost.
+	ACMEHosts        []string
+	ACMEDirectoryURL string
+	ACMEEmail        string
+	ACMECacheDir     string
+}
+
+// Manager provides certificates, see the package doc.
+type Manager struct {
+	opts      Options
+	current   atomic.Pointer[keyPair]
+	acme      *autocert.Manager
+	acmeHosts []string
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// keyPair is the default certificate, as loaded from files last modified at
+// certModified and keyModified.
+type keyPair struct {
+	cert         *tls.Certificate
+	certModified time.Time
+	keyModified  time.Time
+}
+
+// New loads the default certificate and starts watching its files.
+func New(opts Options) (*Manager, error) {
+	if opts.CertFile == "" {
+		opts.CertFile = "cert.pem"
+	}
+	if opts.KeyFile == "" {
+		opts.KeyFile = "key.pem"
+	}
+	if opts.CheckInterval <= 0 {
+		opts.CheckInterval = DefaultCheckInterval
+	}
+	if err := generateIfMissing(opts.CertFile, opts.KeyFile, opts.Host); err != nil {
+		return nil, err
+	}
+	kp, err := load(opts.CertFile, opts.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manager{opts: opts, closed: make(chan struct{})}
+	m.current.Store(kp)
+	for _, host := range opts.ACMEHosts {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			m.acmeHosts = append(m.acmeHosts, host)
+		}
+	}
+	if len(m.acmeHosts) > 0 {
+		if opts.ACMECacheDir == "" {
+			return nil, errors.New("a cache directory is required for ACME hosts")
+		}
+		directoryURL := opts.ACMEDirectoryURL
+		if directoryURL == "" {
+			directoryURL = autocert.DefaultACMEDirectory
+		}
+		m.acme = &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(opts.ACMECacheDir),
+			HostPolicy: autocert.HostWhitelist(m.acmeHosts...),
+			Client:     &acme.Client{DirectoryURL: directoryURL},
+			Email:      opts.ACMEEmail,
+		}
+		log.Debugf("Managing certificates for %v with ACME at %v", strings.Join(m.acmeHosts, ", "), directoryURL)
+	}
+
+	go m.watch()
+	return m, nil
+}
+
+// GetCertificate returns the certificate for hello, for use as
+// tls.Config.GetCertificate: the ACME certificate for ACME hosts, including
+// the TLS-ALPN-01 challenge certificates while they're validated, and the
+// default certificate for everything else.
+func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if m.IsACMEHost(hello.ServerName) {
+		return m.acme.GetCertificate(hello)
+	}
+	return m.current.Load().cert, nil
+}
+
+// TLSConfig returns a new config serving the certificates of m.
+func (m *Manager) TLSConfig() *tls.Config {
+	return &tls.Config{GetCertificate: m.GetCertificate}
+}
+
+// IsACMEHost reports whether the certificate for serverName comes from ACME.
+// TLS listeners need to negotiate the acme.ALPNProto protocol with clients
+// offering it for these hosts, which is how ACME servers validate them.
+func (m *Manager) IsACMEHost(serverName string) bool {
+	return m.acme != nil && slices.Contains(m.acmeHosts, strings.ToLower(serverName))
+}
+
+// ACMEHosts returns the hosts whose certificates come from ACME.
+func (m *Manager) ACMEHosts() []string {
+	return m.acmeHosts
+}
+
+// Close stops watching the files.
+func (m *Manager) Close() error {
+	m.closeOnce.Do(func() { close(m.closed) })
+	return nil
+}
+
+func (m *Manager) watch() {
+	ticker := time.NewTicker(m.opts.CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.closed:
+			return
+		case <-ticker.C:
+			if err := m.reload(); err != nil {
+				log.Errorf("Unable to reload certificate: %v", err)
+			}
+		}
+	}
+}
+
+// reload reloads the default certificate if its files changed. The current
+// one is kept if the new one doesn't load, e.g. while the files are being
+// written.
+func (m *Manager) reload() error {
+	current := m.current.Load()
+	certModified, keyModified, err := modified(m.opts.CertFile, m.opts.KeyFile)
+	if err != nil {
+		return err
+	}
+	if certModified.Equal(current.certModified) && keyModified.Equal(current.keyModified) {
+		return nil
+	}
+	kp, err := load(m.opts.CertFile, m.opts.KeyFile)
+	if err != nil {
+		return err
+	}
+	m.current.Store(kp)
+	log.Debugf("Reloaded certificate from %v, valid until %v", m.opts.CertFile, kp.cert.Leaf.NotAfter)
+	return nil
+}
+
+func load(certFile, keyFile string) (*keyPair, error) {
+	certModified, keyModified, err := modified(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, errors.New("unable to load certificate and key from %v and %v: %v", certFile, keyFile, err)
+	}
+	return &keyPair{cert: &cert, certModified: certModified, keyModified: keyModified}, nil
+}
+
+func modified(certFile, keyFile string) (certModified, keyModified time.Time, err error) {
+	certInfo, err := os.Stat(certFile)
+	if err != nil {
+		return certModified, keyModified, err
+	}
+	keyInfo, err := os.Stat(keyFile)
+	if err != nil {
+		return certModified, keyModified, err
+	}
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
+
+// generateIfMissing saves a new self-signed certificate for host in certFile,
+// along with its key in keyFile if that's missing too, unless both exist.
+func generateIfMissing(certFile, keyFile, host string) error {
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	if !os.IsNotExist(certErr) && !os.IsNotExist(keyErr) {
+		return nil
+	}
+	log.Debugf("At least one of %v and %v is missing, generating a self-signed certificate", certFile, keyFile)
+	pk, err := keyman.LoadPKFromFile(keyFile)
+	if os.IsNotExist(err) {
+		pk, err = keyman.GeneratePK(2048)
+		if err != nil {
+			return errors.New("unable to generate private key: %v", err)
+		}
+		if err := pk.WriteToFile(keyFile); err != nil {
+			return errors.New("unable to save private key: %v", err)
+		}
+	} else if err != nil {
+		return errors.New("unable to read private key: %v", err)
+	}
+	cert, err := pk.TLSCertificateFor(time.Now().Add(selfSignedValidity), true, nil, "Lantern", host)
+	if err != nil {
+		return errors.New("unable to generate certificate: %v", err)
+	}
+	if err := cert.WriteToFile(certFile); err != nil {
+		return errors.New("unable to save certificate: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package certmanager
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/acme"
+)
+
+func TestGenerate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	m, err := New(Options{CertFile: certFile, KeyFile: keyFile, Host: "127.0.0.1"})
+	require.NoError(t, err)
+	defer m.Close()
+	require.FileExists(t, certFile)
+	require.FileExists(t, keyFile)
+
+	cert, err := m.GetCertificate(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	require.NoError(t, cert.Leaf.VerifyHostname("127.0.0.1"))
+
+	// existing files are left alone
+	m2, err := New(Options{CertFile: certFile, KeyFile: keyFile, Host: "127.0.0.1"})
+	require.NoError(t, err)
+	defer m2.Close()
+	cert2, err := m2.GetCertificate(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	require.Equal(t, cert.Certificate, cert2.Certificate)
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCertificate(t, certFile, keyFile, "first.example.com", time.Now().Add(-time.Minute))
+	m, err := New(Options{CertFile: certFile, KeyFile: keyFile, CheckInterval: 10 * time.Millisecond})
+	require.NoError(t, err)
+	defer m.Close()
+
+	commonName := func() string {
+		cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "whatever.example.com"})
+		require.NoError(t, err)
+		return cert.Leaf.Subject.CommonName
+	}
+	require.Equal(t, "first.example.com", commonName())
+
+	writeTestCertificate(t, certFile, keyFile, "second.example.com", time.Now())
+	require.Eventually(t, func() bool { return commonName() == "second.example.com" }, 5*time.Second, 10*time.Millisecond)
+
+	// a broken certificate doesn't replace the current one
+	require.NoError(t, os.WriteFile(certFile, []byte("garbage"), 0644))
+	require.Error(t, m.reload())
+	require.Equal(t, "second.example.com", commonName())
+}
+
+func TestACME(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	server := newTestACMEServer(t, l.Addr().String())
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCertificate(t, certFile, keyFile, "default.example.com", time.Now())
+	opts := Options{
+		CertFile:         certFile,
+		KeyFile:          keyFile,
+		ACMEHosts:        []string{"ACME.example.com "},
+		ACMEDirectoryURL: server.URL + "/directory",
+		ACMECacheDir:     filepath.Join(dir, "acme"),
+	}
+	m, err := New(opts)
+	require.NoError(t, err)
+	defer m.Close()
+	require.Equal(t, []string{"acme.example.com"}, m.ACMEHosts())
+	require.True(t, m.IsACMEHost("Acme.Example.com"))
+	require.False(t, m.IsACMEHost("default.example.com"))
+
+	// Serve like a TLS listener answering challenges would.
+	cfg := m.TLSConfig()
+	cfg.NextProtos = []string{acme.ALPNProto}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				tls.Server(conn, cfg).Handshake()
+			}()
+		}
+	}()
+
+	dial := func(serverName string) *x509.Certificate {
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{ServerName: serverName, RootCAs: server.Roots()})
+		require.NoError(t, err, serverName)
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0]
+	}
+	require.Equal(t, "acme.example.com", dial("acme.example.com").Subject.CommonName)
+	require.Equal(t, 1, server.Issued())
+	require.Equal(t, "acme.example.com", dial("acme.example.com").Subject.CommonName)
+	require.Equal(t, 1, server.Issued(), "certificate should be reused")
+
+	cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.example.com"})
+	require.NoError(t, err)
+	require.Equal(t, "default.example.com", cert.Leaf.Subject.CommonName)
+
+	// The certificate is kept on disk for the next start.
+	server.Close()
+	m2, err := New(opts)
+	require.NoError(t, err)
+	defer m2.Close()
+	cert, err = m2.GetCertificate(&tls.ClientHelloInfo{
+		ServerName:       "acme.example.com",
+		CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "acme.example.com", cert.Leaf.Subject.CommonName)
+}
+
+// writeTestCertificate writes a self-signed certificate for commonName and
+// its key, with modTime as their modification time.
+func writeTestCertificate(t *testing.T, certFile, keyFile, commonName string, modTime time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644))
+	require.NoError(t, os.Chtimes(keyFile, modTime, modTime))
+	require.NoError(t, os.Chtimes(certFile, modTime, modTime))
+}
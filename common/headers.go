@@ -43,4 +43,12 @@ const (
 	ClientIP          = "client_ip"
 	TimeZone          = "time_zone"
 	SupportedDataCaps = "supported_data_caps"
+	// AccessKeyID is the ID of the shadowsocks access key a connection
+	// authenticated with.
+	AccessKeyID = "access_key_id"
 )
+
+// AccessKeyDevicePrefix prefixes the ID of the shadowsocks access key a
+// connection authenticated with to make up its device ID, if the client
+// doesn't send one, so that keys are accounted and throttled like devices.
+const AccessKeyDevicePrefix = "ss-key:"
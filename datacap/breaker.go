@@ -0,0 +1,114 @@
+package datacap
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// breakerThreshold is how many flush cycles in a row must fail outright
+	// before the sidecar is considered down. A single failed cycle is just
+	// retried on the next one.
+	breakerThreshold = 3
+
+	// breakerMaxBackoff caps how long reporting is held off while the sidecar
+	// is down, so that it's noticed again within minutes once it recovers.
+	breakerMaxBackoff = 5 * time.Minute
+
+	// breakerJitter spreads the retries of proxies sharing a sidecar host, so
+	// that they don't all probe it in the same instant when it comes back.
+	breakerJitter = 0.2
+)
+
+// Breaker states, as reported in Health.
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// breaker holds off reporting to a sidecar that keeps failing. Once
+// breakerThreshold cycles in a row have failed, it opens and flushes are
+// skipped for an exponentially growing backoff, after which a single report
+// probes whether the sidecar is back. Deltas keep accumulating meanwhile and
+// go out in one report per device once it is.
+type breaker struct {
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	mx       sync.Mutex
+	failures int
+	// backoff is the current backoff, zero while the breaker is closed.
+	backoff time.Duration
+	retryAt time.Time
+}
+
+func newBreaker(minBackoff time.Duration) *breaker {
+	maxBackoff := breakerMaxBackoff
+	if maxBackoff < minBackoff {
+		maxBackoff = minBackoff
+	}
+	return &breaker{minBackoff: minBackoff, maxBackoff: maxBackoff}
+}
+
+// allow reports whether a flush may go ahead at now, and whether it's a probe,
+// in which case only one report should be sent until it succeeds.
+func (b *breaker) allow(now time.Time) (allowed, probe bool) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	if b.backoff == 0 {
+		return true, false
+	}
+	if now.Before(b.retryAt) {
+		return false, false
+	}
+	return true, true
+}
+
+// succeed records a cycle in which the sidecar answered, closing the breaker.
+// It reports whether the breaker was open.
+func (b *breaker) succeed() (closed bool) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	closed = b.backoff > 0
+	b.failures = 0
+	b.backoff = 0
+	b.retryAt = time.Time{}
+	return closed
+}
+
+// fail records a cycle in which the sidecar didn't answer at all. It reports
+// whether that opened the breaker, along with the time to hold off for.
+func (b *breaker) fail(now time.Time) (opened bool, backoff time.Duration) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	b.failures++
+	if b.failures < breakerThreshold {
+		return false, 0
+	}
+	opened = b.backoff == 0
+	if opened {
+		b.backoff = b.minBackoff
+	} else if b.backoff *= 2; b.backoff > b.maxBackoff {
+		b.backoff = b.maxBackoff
+	}
+	backoff = time.Duration(float64(b.backoff) * (1 - breakerJitter + 2*breakerJitter*rand.Float64()))
+	b.retryAt = now.Add(backoff)
+	return opened, backoff
+}
+
+// state returns the breaker's state at now, the consecutive failed cycles and
+// when reporting will be retried if the breaker is open.
+func (b *breaker) state(now time.Time) (state string, failures int, retryAt time.Time) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	switch {
+	case b.backoff == 0:
+		return BreakerClosed, b.failures, time.Time{}
+	case now.Before(b.retryAt):
+		return BreakerOpen, b.failures, b.retryAt
+	default:
+		return BreakerHalfOpen, b.failures, b.retryAt
+	}
+}
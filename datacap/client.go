@@ -5,19 +5,23 @@
 // writing `_client:<deviceID>` hashes to a shared Redis and reading cohort
 // settings back out of a `_throttle` key, the proxy POSTs deltas to a sidecar
 // on localhost that owns the cap accounting and answers with the current
-// throttle state. The wire contract is the same one lantern-box speaks
-// (getlantern/lantern-box tracker/datacap), so a device's traffic accumulates
-// into one counter no matter which proxy flavor carried it.
+// throttle state. The per-device wire contract is the same one lantern-box
+// speaks (getlantern/lantern-box tracker/datacap), so a device's traffic
+// accumulates into one counter no matter which proxy flavor carried it. Busy
+// proxies batch their reports through /data-cap/batch instead, if the sidecar
+// supports it.
 package datacap
 
 import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -26,6 +30,22 @@ import (
 // wedged and the delta is better retried on the next cycle than left in flight.
 const DefaultHTTPTimeout = 10 * time.Second
 
+const (
+	// MaxBatchSize bounds the reports posted in one batch, so that a single
+	// request body stays small enough for the sidecar to decode in one go.
+	MaxBatchSize = 500
+
+	// batchRetryInterval is how long a sidecar that doesn't support batches
+	// is reported to per device before batches are tried again, in case it
+	// was upgraded meanwhile.
+	batchRetryInterval = time.Hour
+)
+
+// ErrBatchUnsupported is returned by ReportUsageBatch when the sidecar
+// predates the batch endpoint. The reports should be sent through ReportUsage
+// instead.
+var ErrBatchUnsupported = errors.New("sidecar does not support batch reports")
+
 // Report is the body of POST /data-cap/. BytesUsed is a delta since the last
 // report, not a running total — the sidecar accumulates.
 type Report struct {
@@ -33,6 +53,8 @@ type Report struct {
 	CountryCode string `json:"countryCode"`
 	Platform    string `json:"platform"`
 	BytesUsed   int64  `json:"bytesUsed"`
+	// BytesUploaded is the part of BytesUsed the device uploaded.
+	BytesUploaded int64 `json:"bytesUploaded,omitempty"`
 }
 
 // Status is the sidecar's answer: the throttle verdict plus enough of the
@@ -42,12 +64,43 @@ type Status struct {
 	CapLimit   int64 `json:"capLimit"`
 	ExpiryTime int64 `json:"expiryTime"` // Unix seconds
 	BytesUsed  int64 `json:"bytesUsed"`
+	// BytesUploaded is the part of BytesUsed the device uploaded, for
+	// sidecars that account for it separately.
+	BytesUploaded int64 `json:"bytesUploaded,omitempty"`
+	// UploadLimit, if set, is the upload rate in bytes per second this
+	// particular device is held to, e.g. after being caught seeding.
+	UploadLimit int64 `json:"uploadLimit,omitempty"`
+}
+
+// BatchRequest is the body of POST /data-cap/batch, many Reports in one
+// request.
+type BatchRequest struct {
+	Reports []Report `json:"reports"`
+}
+
+// BatchResponse is the sidecar's answer to a BatchRequest, one BatchStatus per
+// Report, in the same order.
+type BatchResponse struct {
+	Statuses []BatchStatus `json:"statuses"`
+}
+
+// BatchStatus is the Status for one Report in a batch, or why the sidecar
+// couldn't account for it. A report with an Error was not accounted for and
+// should be retried.
+type BatchStatus struct {
+	Status
+	Error string `json:"error,omitempty"`
 }
 
 // Client talks to the datacap sidecar over HTTP.
 type Client struct {
-	httpClient *http.Client
-	baseURL    string
+	httpClient   *http.Client
+	streamClient *http.Client
+	baseURL      string
+	// noBatchUntil is when batches will be tried again, in Unix nanoseconds,
+	// after the sidecar turned out not to support them. Zero means batches
+	// are worth trying.
+	noBatchUntil atomic.Int64
 }
 
 // NewClient returns a Client posting to baseURL, e.g. "http://127.0.0.1:8078".
@@ -60,49 +113,115 @@ func NewClient(baseURL string, timeout time.Duration) *Client {
 	if timeout <= 0 {
 		timeout = DefaultHTTPTimeout
 	}
+	// A bare Transport also deliberately ignores HTTP_PROXY et al. — this
+	// client only ever talks to the local sidecar. The idle pool matches the
+	// flush fan-out so a full cycle's connections are all reusable instead of
+	// the excess being closed each cycle.
+	transport := &http.Transport{
+		MaxIdleConnsPerHost: flushConcurrency,
+	}
 	return &Client{
 		httpClient: &http.Client{
-			Timeout: timeout,
-			// A bare Transport also deliberately ignores HTTP_PROXY et al. —
-			// this client only ever talks to the local sidecar. The idle pool
-			// matches the flush fan-out so a full cycle's connections are all
-			// reusable instead of the excess being closed each cycle.
-			Transport: &http.Transport{
-				MaxIdleConnsPerHost: flushConcurrency,
-			},
+			Timeout:   timeout,
+			Transport: transport,
 		},
-		baseURL: strings.TrimSuffix(baseURL, "/"),
+		// The verdict stream is meant to stay open, so it's only bounded by
+		// streamIdleTimeout.
+		streamClient: &http.Client{Transport: transport},
+		baseURL:      strings.TrimSuffix(baseURL, "/"),
 	}
 }
 
 // ReportUsage posts a usage delta and returns the device's updated cap state.
 func (c *Client) ReportUsage(ctx context.Context, report *Report) (*Status, error) {
-	body, err := json.Marshal(report)
+	var status Status
+	if err := c.post(ctx, "/data-cap/", report, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// SupportsBatch reports whether batches are worth trying, i.e. the sidecar
+// hasn't turned out not to support them recently.
+func (c *Client) SupportsBatch() bool {
+	until := c.noBatchUntil.Load()
+	return until == 0 || time.Now().UnixNano() >= until
+}
+
+// ReportUsageBatch posts up to MaxBatchSize usage deltas in one request and
+// returns the devices' updated cap states in the same order, along with an
+// error for each report the sidecar couldn't account for. It returns
+// ErrBatchUnsupported if the sidecar doesn't know the batch endpoint, in which
+// case SupportsBatch is false for a while.
+func (c *Client) ReportUsageBatch(ctx context.Context, reports []Report) ([]*Status, []error, error) {
+	var resp BatchResponse
+	err := c.post(ctx, "/data-cap/batch", &BatchRequest{Reports: reports}, &resp)
+	var statusErr *statusError
+	if errors.As(err, &statusErr) && statusErr.unsupported() {
+		c.noBatchUntil.Store(time.Now().Add(batchRetryInterval).UnixNano())
+		return nil, nil, ErrBatchUnsupported
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(resp.Statuses) != len(reports) {
+		return nil, nil, fmt.Errorf("sidecar returned %d statuses for %d reports", len(resp.Statuses), len(reports))
+	}
+	c.noBatchUntil.Store(0)
+	statuses := make([]*Status, len(reports))
+	errs := make([]error, len(reports))
+	for i := range resp.Statuses {
+		if resp.Statuses[i].Error != "" {
+			errs[i] = fmt.Errorf("sidecar rejected report: %s", resp.Statuses[i].Error)
+			continue
+		}
+		statuses[i] = &resp.Statuses[i].Status
+	}
+	return statuses, errs, nil
+}
+
+// statusError is a response from the sidecar with an unexpected status code.
+type statusError struct {
+	code   int
+	detail string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("sidecar returned HTTP %d: %s", e.code, e.detail)
+}
+
+// unsupported is whether the error means the sidecar doesn't know the
+// endpoint at all, as opposed to failing to handle the request.
+func (e *statusError) unsupported() bool {
+	return e.code == http.StatusNotFound || e.code == http.StatusMethodNotAllowed || e.code == http.StatusNotImplemented
+}
+
+func (c *Client) post(ctx context.Context, path string, in, out interface{}) error {
+	body, err := json.Marshal(in)
 	if err != nil {
-		return nil, fmt.Errorf("marshal report: %w", err)
+		return fmt.Errorf("marshal report: %w", err)
 	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/data-cap/", bytes.NewReader(body))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+path, bytes.NewReader(body))
 	if err != nil {
-		return nil, fmt.Errorf("build request: %w", err)
+		return fmt.Errorf("build request: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", "application/json")
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("post usage: %w", err)
+		return fmt.Errorf("post usage: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
 		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
-		return nil, fmt.Errorf("sidecar returned HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(detail)))
+		return &statusError{code: resp.StatusCode, detail: strings.TrimSpace(string(detail))}
 	}
 
-	var status Status
-	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
-		return nil, fmt.Errorf("decode status: %w", err)
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decode status: %w", err)
 	}
-	return &status, nil
+	return nil
 }
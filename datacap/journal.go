@@ -0,0 +1,69 @@
+package datacap
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/getlantern/http-proxy-lantern/v2/internal/atomicfile"
+)
+
+// journal persists the deltas the sidecar hasn't accepted yet, so that usage
+// survives a proxy restart during a sidecar outage. It holds a snapshot rather
+// than an append-only log: the tracker rewrites it after every flush, which
+// keeps it as small as the set of devices with unreported usage.
+//
+// Accounting through the journal is at-least-once. A delta the sidecar
+// accepted right before a crash is still in the last snapshot and is reported
+// again on startup, while at most one report interval's worth of new deltas is
+// lost. Over-counting a few seconds of usage is the lesser evil.
+type journal struct {
+	path string
+
+	mx sync.Mutex
+	// empty is whether the last snapshot written had no deltas, in which case
+	// there's no point in writing another empty one.
+	empty bool
+}
+
+func newJournal(path string) *journal {
+	return &journal{path: path}
+}
+
+// load returns the deltas in the journal. A missing journal is not an error.
+func (j *journal) load() ([]Report, error) {
+	data, err := os.ReadFile(j.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read journal: %w", err)
+	}
+	var reports []Report
+	if err := json.Unmarshal(data, &reports); err != nil {
+		return nil, fmt.Errorf("parse journal: %w", err)
+	}
+	return reports, nil
+}
+
+// save replaces the journal with reports.
+func (j *journal) save(reports []Report) error {
+	j.mx.Lock()
+	defer j.mx.Unlock()
+	if len(reports) == 0 && j.empty {
+		return nil
+	}
+	if reports == nil {
+		reports = []Report{}
+	}
+	data, err := json.Marshal(reports)
+	if err != nil {
+		return fmt.Errorf("marshal journal: %w", err)
+	}
+	if err := atomicfile.Write(j.path, data); err != nil {
+		return fmt.Errorf("write journal: %w", err)
+	}
+	j.empty = len(reports) == 0
+	return nil
+}
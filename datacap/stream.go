@@ -0,0 +1,133 @@
+package datacap
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// streamIdleTimeout is how long the verdict stream may stay silent before
+	// it's considered dead. The sidecar sends a comment at least every 15
+	// seconds to keep it alive.
+	streamIdleTimeout = time.Minute
+
+	// streamMinBackoff and streamMaxBackoff bound how long to wait before
+	// reconnecting a verdict stream that broke or couldn't be opened.
+	streamMinBackoff = time.Second
+	streamMaxBackoff = time.Minute
+)
+
+// Verdict stream states, as reported in Health.
+const (
+	StreamConnected    = "connected"
+	StreamDisconnected = "disconnected"
+	// StreamUnsupported means the sidecar predates the verdict stream, so
+	// verdicts only change when usage is reported.
+	StreamUnsupported = "unsupported"
+)
+
+// Verdict is a change to a device's cap state that the sidecar pushes without
+// being asked, e.g. when the backend lifts a device's cap because it went
+// pro.
+type Verdict struct {
+	DeviceID string `json:"deviceId"`
+	Status
+}
+
+// StreamVerdicts subscribes to the verdicts the sidecar pushes as server-sent
+// events at GET /data-cap/verdicts, one JSON Verdict per "verdict" event, and
+// calls onVerdict with each of them until ctx is done or the stream breaks.
+// onConnected is called once the stream is open.
+func (c *Client) StreamVerdicts(ctx context.Context, onConnected func(), onVerdict func(Verdict)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var idle atomic.Bool
+	idleTimer := time.AfterFunc(streamIdleTimeout, func() {
+		idle.Store(true)
+		cancel()
+	})
+	defer idleTimer.Stop()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/data-cap/verdicts", nil)
+	if err != nil {
+		return fmt.Errorf("build request: %w", err)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := c.streamClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("subscribe to verdicts: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &statusError{code: resp.StatusCode, detail: strings.TrimSpace(string(detail))}
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "text/event-stream" {
+		return fmt.Errorf("sidecar answered with %q instead of an event stream", resp.Header.Get("Content-Type"))
+	}
+	onConnected()
+
+	err = readEvents(resp.Body, func() { idleTimer.Reset(streamIdleTimeout) }, func(event, data string) {
+		if event != "verdict" {
+			return
+		}
+		var v Verdict
+		if err := json.Unmarshal([]byte(data), &v); err != nil {
+			log.Errorf("Unable to parse verdict pushed by the datacap sidecar: %v", err)
+			return
+		}
+		if v.DeviceID != "" {
+			onVerdict(v)
+		}
+	})
+	if idle.Load() {
+		return fmt.Errorf("no events for %v", streamIdleTimeout)
+	}
+	if err == nil {
+		err = io.EOF
+	}
+	return fmt.Errorf("read verdicts: %w", err)
+}
+
+// readEvents parses the server-sent events in r, calling onLine for every
+// line read, comments included, and onEvent for every event dispatched.
+func readEvents(r io.Reader, onLine func(), onEvent func(event, data string)) error {
+	scanner := bufio.NewScanner(r)
+	var event string
+	var data []string
+	for scanner.Scan() {
+		onLine()
+		line := scanner.Text()
+		if line == "" {
+			if len(data) > 0 {
+				if event == "" {
+					event = "message"
+				}
+				onEvent(event, strings.Join(data, "\n"))
+			}
+			event, data = "", nil
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			// a comment, e.g. a keepalive
+			continue
+		}
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "event":
+			event = value
+		case "data":
+			data = append(data, value)
+		}
+	}
+	return scanner.Err()
+}
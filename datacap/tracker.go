@@ -2,6 +2,8 @@ package datacap
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -29,7 +31,7 @@ const (
 	// device sees the same speed whichever proxy flavor it lands on.
 	ThrottledWriteRate int64 = 16 * 1024 // 128 Kb/s
 
-	// flushConcurrency bounds the reports in flight during one cycle, so a
+	// flushConcurrency bounds the requests in flight during one cycle, so a
 	// proxy with many active devices does not open an unbounded number of
 	// connections to the sidecar.
 	flushConcurrency = 16
@@ -43,22 +45,81 @@ const (
 	// bytes, whose deltas refresh lastSeen and block eviction. At 30 minutes
 	// the margin over idleclose plus the measured reporting interval is >10x.
 	idleDeviceTTL = 30 * time.Minute
+
+	// staleCycles is how many report intervals a device's usage may go
+	// unreported before its verdict counts as stale.
+	staleCycles = 3
 )
 
+// FailurePolicy is what happens to throttling while the sidecar is down.
+type FailurePolicy string
+
+const (
+	// KeepLastVerdict keeps every device at the last verdict the sidecar gave
+	// for it. Capped devices stay capped, but devices that cross their cap
+	// during the outage aren't capped until it's over.
+	KeepLastVerdict FailurePolicy = "keep-last-verdict"
+	// FailOpen lifts every cap once the sidecar is considered down, so that
+	// an outage can't leave devices throttled on verdicts nobody can revise.
+	// Usage still accumulates, and the caps are back as soon as the sidecar
+	// is.
+	FailOpen FailurePolicy = "fail-open"
+)
+
+// ParseFailurePolicy parses a FailurePolicy, the empty string being
+// KeepLastVerdict.
+func ParseFailurePolicy(s string) (FailurePolicy, error) {
+	switch FailurePolicy(s) {
+	case "", KeepLastVerdict:
+		return KeepLastVerdict, nil
+	case FailOpen:
+		return FailOpen, nil
+	default:
+		return "", fmt.Errorf("unknown datacap failure policy %q, expected %q or %q", s, KeepLastVerdict, FailOpen)
+	}
+}
+
 // Usage is a device's cap state as of the last sidecar response.
 type Usage struct {
 	// BytesUsed is the total consumed in the current allotment period.
-	BytesUsed int64
+	BytesUsed int64 `json:"bytesUsed"`
+	// BytesUploaded is the part of BytesUsed the device uploaded, zero if
+	// the sidecar doesn't account for it separately.
+	BytesUploaded int64 `json:"bytesUploaded"`
 	// CapLimit is the allotment in bytes. Zero means this device is uncapped
 	// (no cap entry for its country/platform).
-	CapLimit int64
+	CapLimit int64 `json:"capLimit"`
 	// Expiry is when the current allotment resets.
-	Expiry time.Time
+	Expiry time.Time `json:"expiry"`
 	// AsOf is when the sidecar reported these numbers. A zero AsOf means the
 	// sidecar has not answered for this device yet.
-	AsOf time.Time
+	AsOf time.Time `json:"asOf"`
 	// Throttled is the sidecar's verdict at AsOf.
-	Throttled bool
+	Throttled bool `json:"throttled"`
+	// UploadLimit is the upload rate the sidecar holds this particular
+	// device to, in bytes per second, zero if none.
+	UploadLimit int64 `json:"uploadLimit,omitempty"`
+}
+
+// DeviceStatus is a snapshot of one tracked device, for introspection.
+type DeviceStatus struct {
+	DeviceID     string `json:"deviceId"`
+	CountryCode  string `json:"countryCode"`
+	Platform     string `json:"platform"`
+	Usage        Usage  `json:"usage"`
+	PendingBytes int64  `json:"pendingBytes"`
+	// PendingSince is when the oldest usage the sidecar hasn't accepted yet
+	// was seen, zero if there is none.
+	PendingSince time.Time `json:"pendingSince,omitempty"`
+	// VerdictAgeSeconds is how long ago the sidecar gave the verdict the
+	// device is held to, Usage.AsOf, zero until it has given one.
+	VerdictAgeSeconds float64   `json:"verdictAgeSeconds,omitempty"`
+	LastSeen          time.Time `json:"lastSeen"`
+	// ReadRate and WriteRate are the current rates of the device's limiter in
+	// bytes per second, zero meaning unlimited. ReadRate is the upload rate,
+	// see UploadLimits, and WriteRate drops to ThrottledWriteRate once capped.
+	ReadRate  int64 `json:"readRate"`
+	WriteRate int64 `json:"writeRate"`
 }
 
 // device holds the per-device state shared between the reporting loop and the
@@ -76,8 +137,16 @@ type device struct {
 
 	usage Usage
 
-	// pendingBytes is the delta not yet accepted by the sidecar.
-	pendingBytes int64
+	// pendingBytes is the delta not yet accepted by the sidecar, and
+	// inflightBytes the part of it being reported right now. The Uploaded
+	// counterparts are the part of them the device uploaded.
+	pendingBytes     int64
+	inflightBytes    int64
+	pendingUploaded  int64
+	inflightUploaded int64
+	// pendingSince is when the oldest byte in pendingBytes or inflightBytes
+	// was seen, zero if there are none.
+	pendingSince time.Time
 	// countryCode, platform key the sidecar's cap-limit lookup. countryCode is
 	// sticky — set once from the first delta that resolves one — matching the
 	// reporting-Redis behavior this replaces.
@@ -93,12 +162,38 @@ type Tracker struct {
 	client        *Client
 	countryLookup geo.CountryLookup
 	// defaultRate is the ceiling every non-pro device is held to regardless of
-	// its cap state, to keep bandwidth hogs from monopolizing a proxy.
+	// its cap state, to keep bandwidth hogs from monopolizing a proxy. It's
+	// zero when the egress scheduler shares the proxy out instead, and lowered
+	// through SetDefaultRate as the host runs through its bandwidth budget.
+	// Guarded by mx.
 	defaultRate    int64
 	reportInterval time.Duration
+	failurePolicy  FailurePolicy
+	breaker        *breaker
+	// journal is nil if pending deltas aren't persisted.
+	journal *journal
+	// closeCh stops the reporting and streaming loops, which loops waits
+	// for.
+	closeCh   chan struct{}
+	loops     sync.WaitGroup
+	closeOnce sync.Once
+	// restartStream makes the streaming loop reconnect right away, e.g. to a
+	// new sidecar.
+	restartStream chan struct{}
+	onVerdictAge  func(age time.Duration)
 
 	mx      sync.RWMutex
 	devices map[string]*device
+	// failedOpen is whether verdicts are being ignored because the sidecar
+	// is down and the failure policy is FailOpen. Guarded by mx.
+	failedOpen bool
+	// uploadLimits are the cohort and per-connection upload rates. Guarded
+	// by mx.
+	uploadLimits UploadLimits
+	// streamState is one of the Stream constants, and cancelStream closes
+	// the current verdict stream, if any. Guarded by mx.
+	streamState  string
+	cancelStream context.CancelFunc
 }
 
 // TrackerOpts configures a Tracker.
@@ -107,6 +202,19 @@ type TrackerOpts struct {
 	CountryLookup  geo.CountryLookup
 	DefaultRate    int64
 	ReportInterval time.Duration
+	// JournalFile, if set, is where deltas the sidecar hasn't accepted yet
+	// are persisted, to be reported after a restart.
+	JournalFile string
+	// FailurePolicy is what happens to throttling while the sidecar is down,
+	// KeepLastVerdict if empty.
+	FailurePolicy FailurePolicy
+	// UploadLimits are the upload rates devices are held to besides
+	// DefaultRate.
+	UploadLimits UploadLimits
+	// OnVerdictAge, if set, is called with the age of a device's verdict,
+	// see DeviceStatus.VerdictAgeSeconds, whenever its usage is reported and
+	// whenever the sidecar pushes it a new verdict.
+	OnVerdictAge func(age time.Duration)
 }
 
 // NewTracker starts a Tracker and its reporting loop.
@@ -120,23 +228,154 @@ func NewTracker(opts TrackerOpts) *Tracker {
 		// reporting loop.
 		opts.CountryLookup = geo.NoLookup{}
 	}
+	if opts.FailurePolicy == "" {
+		opts.FailurePolicy = KeepLastVerdict
+	}
 	t := &Tracker{
 		client:         opts.Client,
 		countryLookup:  opts.CountryLookup,
 		defaultRate:    opts.DefaultRate,
 		reportInterval: opts.ReportInterval,
-		devices:        make(map[string]*device),
+		failurePolicy:  opts.FailurePolicy,
+		uploadLimits:   opts.UploadLimits,
+		// Hold off for at least a whole cycle, so that a sidecar that's down
+		// misses at least one flush.
+		breaker:       newBreaker(2 * opts.ReportInterval),
+		closeCh:       make(chan struct{}),
+		restartStream: make(chan struct{}, 1),
+		onVerdictAge:  opts.OnVerdictAge,
+		streamState:   StreamDisconnected,
+		devices:       make(map[string]*device),
 	}
+	if opts.JournalFile != "" {
+		t.journal = newJournal(opts.JournalFile)
+		t.resume()
+	}
+	t.loops.Add(2)
 	go t.reportPeriodically()
+	go t.streamVerdicts()
 	return t
 }
 
+// resume restores the deltas left in the journal by a previous run, to be
+// reported on the next flush.
+func (t *Tracker) resume() {
+	reports, err := t.journal.load()
+	if err != nil {
+		log.Errorf("Unable to resume unreported usage from %v: %v", t.journal.path, err)
+		return
+	}
+	var bytes int64
+	now := time.Now()
+	for _, r := range reports {
+		if r.DeviceID == "" || r.BytesUsed <= 0 {
+			continue
+		}
+		d := t.deviceFor(r.DeviceID)
+		t.mx.Lock()
+		d.pendingBytes += r.BytesUsed
+		d.pendingUploaded += r.BytesUploaded
+		d.countryCode = r.CountryCode
+		d.platform = r.Platform
+		if d.pendingSince.IsZero() {
+			d.pendingSince = now
+		}
+		t.mx.Unlock()
+		bytes += r.BytesUsed
+	}
+	if bytes > 0 {
+		log.Debugf("Resumed %d bytes of unreported usage from %v", bytes, t.journal.path)
+	}
+}
+
+// SetClient points the tracker at a different sidecar, e.g. after a config
+// reload changed its URL. Pending deltas are reported through the new client on
+// the next flush.
+func (t *Tracker) SetClient(client *Client) {
+	t.mx.Lock()
+	t.client = client
+	t.mx.Unlock()
+	t.reconnectStream()
+}
+
+// SetDefaultRate changes the ceiling devices are held to until they're capped,
+// e.g. as the host runs through its bandwidth budget. The limiters of every
+// tracked device are re-rated right away.
+func (t *Tracker) SetDefaultRate(rate int64) {
+	t.mx.Lock()
+	if rate == t.defaultRate {
+		t.mx.Unlock()
+		return
+	}
+	t.defaultRate = rate
+	t.mx.Unlock()
+	t.rerate()
+}
+
+// SetUploadLimits changes the upload rates devices are held to, e.g. after a
+// config reload. The limiters of every tracked device are re-rated right away,
+// while the per-connection limit applies to new connections.
+func (t *Tracker) SetUploadLimits(limits UploadLimits) {
+	t.mx.Lock()
+	t.uploadLimits = limits
+	t.mx.Unlock()
+	t.rerate()
+}
+
+// ConnUploadRate is the most any one connection may upload, in bytes per
+// second, zero meaning no limit.
+func (t *Tracker) ConnUploadRate() int64 {
+	t.mx.RLock()
+	defer t.mx.RUnlock()
+	return t.uploadLimits.PerConnection
+}
+
+// ratesLocked returns the read and write rates for the limiter of a device in
+// the given cohort with usage u, reads being what the device uploads and
+// writes what it downloads. Downloads are held to the default rate, or to
+// ThrottledWriteRate if the device is capped and the tracker didn't fail open.
+// Uploads are held to the lowest of the default rate, the rate for the
+// device's cohort and the rate the sidecar set for the device. mx must be
+// held.
+func (t *Tracker) ratesLocked(countryCode, platform string, u Usage) (read, write int64) {
+	write = t.defaultRate
+	if u.Throttled && !t.failedOpen {
+		write = ThrottledWriteRate
+	}
+	read = minRate(t.defaultRate, t.uploadLimits.For(countryCode, platform), u.UploadLimit)
+	return read, write
+}
+
+// rerate sets the limiters of every tracked device to the rates their cohort
+// and last verdict call for.
+func (t *Tracker) rerate() {
+	type rates struct {
+		d           *device
+		read, write int64
+	}
+	t.mx.RLock()
+	defaultRate := t.defaultRate
+	devices := make([]rates, 0, len(t.devices))
+	for _, d := range t.devices {
+		read, write := t.ratesLocked(d.countryCode, d.platform, d.usage)
+		devices = append(devices, rates{d, read, write})
+	}
+	t.mx.RUnlock()
+
+	for _, r := range devices {
+		r.d.limiter.SetRates(r.read, r.write)
+		r.d.unthrottledLimiter.SetRates(defaultRate, defaultRate)
+	}
+}
+
 // Reporter returns the callback the measured listener feeds connection deltas
 // into. Deltas are folded into per-device state synchronously: the tracker lock
 // is never held across a sidecar call, so this cannot block on the network.
 func (t *Tracker) Reporter() listeners.MeasuredReportFN {
 	return func(ctx map[string]interface{}, stats *measured.Stats, deltaStats *measured.Stats, final bool) {
-		bytes := int64(deltaStats.SentTotal) + int64(deltaStats.RecvTotal)
+		// What's received from the client is what it uploads.
+		uploaded := int64(deltaStats.RecvTotal)
+		bytes := int64(deltaStats.SentTotal) + uploaded
 		if bytes == 0 {
 			return
 		}
@@ -147,7 +386,7 @@ func (t *Tracker) Reporter() listeners.MeasuredReportFN {
 		}
 		clientIP, _ := ctx[common.ClientIP].(string)
 		platform, _ := ctx[common.Platform].(string)
-		t.accumulate(deviceID, clientIP, platform, bytes)
+		t.accumulate(deviceID, clientIP, platform, bytes, uploaded)
 	}
 }
 
@@ -185,6 +424,32 @@ func (t *Tracker) Usage(deviceID string) (Usage, bool) {
 	return d.usage, true
 }
 
+// Devices returns a snapshot of every device the tracker currently holds.
+func (t *Tracker) Devices() []DeviceStatus {
+	now := time.Now()
+	t.mx.RLock()
+	defer t.mx.RUnlock()
+	devices := make([]DeviceStatus, 0, len(t.devices))
+	for deviceID, d := range t.devices {
+		status := DeviceStatus{
+			DeviceID:     deviceID,
+			CountryCode:  d.countryCode,
+			Platform:     d.platform,
+			Usage:        d.usage,
+			PendingBytes: d.pendingBytes + d.inflightBytes,
+			PendingSince: d.pendingSince,
+			LastSeen:     d.lastSeen,
+			ReadRate:     d.limiter.GetRateRead(),
+			WriteRate:    d.limiter.GetRateWrite(),
+		}
+		if !d.usage.AsOf.IsZero() {
+			status.VerdictAgeSeconds = now.Sub(d.usage.AsOf).Seconds()
+		}
+		devices = append(devices, status)
+	}
+	return devices
+}
+
 func (t *Tracker) deviceFor(deviceID string) *device {
 	t.mx.RLock()
 	d, exists := t.devices[deviceID]
@@ -198,8 +463,9 @@ func (t *Tracker) deviceFor(deviceID string) *device {
 	if d, exists = t.devices[deviceID]; exists {
 		return d
 	}
+	read, write := t.ratesLocked("", "", Usage{})
 	d = &device{
-		limiter:            listeners.NewRateLimiter(t.defaultRate, t.defaultRate),
+		limiter:            listeners.NewRateLimiter(read, write),
 		unthrottledLimiter: listeners.NewRateLimiter(t.defaultRate, t.defaultRate),
 		lastSeen:           time.Now(),
 	}
@@ -207,10 +473,27 @@ func (t *Tracker) deviceFor(deviceID string) *device {
 	return d
 }
 
+// Close stops reporting and journals the deltas the sidecar hasn't accepted
+// yet, if the tracker has a journal.
+func (t *Tracker) Close() {
+	t.closeOnce.Do(func() {
+		close(t.closeCh)
+		t.reconnectStream()
+		t.loops.Wait()
+		t.SaveJournal()
+	})
+}
+
 func (t *Tracker) reportPeriodically() {
+	defer t.loops.Done()
 	ticker := time.NewTicker(t.reportInterval)
 	defer ticker.Stop()
-	for range ticker.C {
+	for {
+		select {
+		case <-t.closeCh:
+			return
+		case <-ticker.C:
+		}
 		// Bound the whole cycle. Reports run concurrently, but a wedged
 		// sidecar would still hold this goroutine for a full HTTP timeout,
 		// and for that entire window no throttle verdict is applied.
@@ -225,10 +508,11 @@ func (t *Tracker) reportPeriodically() {
 		ctx, cancel := context.WithTimeout(context.Background(), timeout)
 		t.flush(ctx)
 		cancel()
+		t.SaveJournal()
 	}
 }
 
-func (t *Tracker) accumulate(deviceID, clientIP, platform string, bytes int64) {
+func (t *Tracker) accumulate(deviceID, clientIP, platform string, bytes, uploaded int64) {
 	d := t.deviceFor(deviceID)
 
 	// The country lookup walks the MaxMind database, so do it at most once per
@@ -244,14 +528,30 @@ func (t *Tracker) accumulate(deviceID, clientIP, platform string, bytes int64) {
 	now := time.Now()
 	t.mx.Lock()
 	d.pendingBytes += bytes
-	if d.countryCode == "" {
+	d.pendingUploaded += uploaded
+	if d.pendingSince.IsZero() {
+		d.pendingSince = now
+	}
+	cohortChanged := false
+	if d.countryCode == "" && countryCode != "" {
 		d.countryCode = countryCode
+		cohortChanged = true
 	}
-	if platform != "" {
+	if platform != "" && platform != d.platform {
 		d.platform = platform
+		cohortChanged = true
 	}
 	d.lastSeen = now
+	var read, write int64
+	if cohortChanged {
+		read, write = t.ratesLocked(d.countryCode, d.platform, d.usage)
+	}
 	t.mx.Unlock()
+
+	if cohortChanged {
+		// the device's cohort may have its own upload rate
+		d.limiter.SetRates(read, write)
+	}
 }
 
 // pendingReport is one device's delta, detached from the tracker so the HTTP
@@ -262,9 +562,12 @@ type pendingReport struct {
 }
 
 func (t *Tracker) flush(ctx context.Context) {
-	evictBefore := time.Now().Add(-idleDeviceTTL)
+	now := time.Now()
+	allowed, probe := t.breaker.allow(now)
+	evictBefore := now.Add(-idleDeviceTTL)
 
 	t.mx.Lock()
+	client := t.client
 	reports := make([]pendingReport, 0, len(t.devices))
 	for deviceID, d := range t.devices {
 		if d.pendingBytes == 0 {
@@ -275,16 +578,22 @@ func (t *Tracker) flush(ctx context.Context) {
 			}
 			continue
 		}
+		if !allowed {
+			// The sidecar is down: keep accumulating.
+			continue
+		}
 		reports = append(reports, pendingReport{
 			device: d,
 			report: Report{
-				DeviceID:    deviceID,
-				CountryCode: d.countryCode,
-				Platform:    d.platform,
-				BytesUsed:   d.pendingBytes,
+				DeviceID:      deviceID,
+				CountryCode:   d.countryCode,
+				Platform:      d.platform,
+				BytesUsed:     d.pendingBytes,
+				BytesUploaded: d.pendingUploaded,
 			},
 		})
-		d.pendingBytes = 0
+		d.inflightBytes, d.inflightUploaded = d.pendingBytes, d.pendingUploaded
+		d.pendingBytes, d.pendingUploaded = 0, 0
 	}
 	t.mx.Unlock()
 
@@ -292,14 +601,158 @@ func (t *Tracker) flush(ctx context.Context) {
 		return
 	}
 
-	// Report concurrently: serially, one slow device delays the throttle
-	// verdict for every device behind it in the batch, and the cycle's
-	// duration grows with the number of active devices.
 	statuses := make([]*Status, len(reports))
 	errs := make([]error, len(reports))
+	if probe {
+		// Find out whether the sidecar is back with a single report before
+		// letting the whole batch through.
+		t.report(ctx, client, reports[:1], statuses[:1], errs[:1])
+		if errs[0] == nil {
+			t.report(ctx, client, reports[1:], statuses[1:], errs[1:])
+		} else {
+			for i := 1; i < len(reports); i++ {
+				errs[i] = errs[0]
+			}
+		}
+	} else {
+		t.report(ctx, client, reports, statuses, errs)
+	}
+
+	// The usage bookkeeping feeds the XBQ headers, which tolerate a batch's
+	// worth of staleness — record the whole cycle under one lock acquisition
+	// instead of one per device.
+	now = time.Now()
+	failed := 0
+	var lastErr error
+	var verdictAges []time.Duration
+	t.mx.Lock()
+	for i, pr := range reports {
+		pr.device.inflightBytes, pr.device.inflightUploaded = 0, 0
+		if !pr.device.usage.AsOf.IsZero() {
+			verdictAges = append(verdictAges, now.Sub(pr.device.usage.AsOf))
+		}
+		if errs[i] != nil {
+			failed++
+			lastErr = errs[i]
+			// Put the bytes back so the next cycle retries them.
+			pr.device.pendingBytes += pr.report.BytesUsed
+			pr.device.pendingUploaded += pr.report.BytesUploaded
+			continue
+		}
+		pr.device.usage = usageFromStatus(statuses[i], now)
+		pr.device.pendingSince = time.Time{}
+		if pr.device.pendingBytes > 0 {
+			// seen while the report was in flight
+			pr.device.pendingSince = now
+		}
+	}
+	t.mx.Unlock()
+	t.observeVerdictAges(verdictAges...)
+
+	if failed < len(reports) {
+		if t.breaker.succeed() {
+			log.Debug("Datacap sidecar is reachable again, resuming reports")
+			t.setFailedOpen(false)
+		}
+		if failed > 0 {
+			log.Errorf("Unable to report usage for %d of %d devices, will retry: %v", failed, len(reports), lastErr)
+		}
+		return
+	}
+
+	opened, backoff := t.breaker.fail(now)
+	switch {
+	case opened:
+		log.Errorf("Datacap sidecar looks down, holding off reports for %v: %v", backoff, lastErr)
+		if t.failurePolicy == FailOpen {
+			t.setFailedOpen(true)
+		}
+	case backoff > 0:
+		log.Errorf("Datacap sidecar still down, holding off reports for %v: %v", backoff, lastErr)
+	default:
+		// A wedged sidecar fails every device in the batch, so log once per
+		// cycle rather than once per device.
+		log.Errorf("Unable to report usage for %d devices, will retry: %v", len(reports), lastErr)
+	}
+}
+
+// report sends reports, recording their results in statuses and errs, and
+// re-rates each device's limiter as soon as its verdict is in. Reports go out
+// in batches if the sidecar supports them, one per device otherwise.
+func (t *Tracker) report(ctx context.Context, client *Client, reports []pendingReport, statuses []*Status, errs []error) {
+	apply := func(i int) {
+		if st := statuses[i]; st != nil {
+			// Re-rate as soon as the verdict is in — SetRates is lock-free,
+			// and waiting for the whole cycle would let one slow request
+			// delay enforcement for every other device. Only writes back to
+			// the client are throttled: a capped device can keep uploading at
+			// its upload rate.
+			r := reports[i].report
+			t.mx.RLock()
+			read, write := t.ratesLocked(r.CountryCode, r.Platform, usageFromStatus(st, time.Time{}))
+			t.mx.RUnlock()
+			reports[i].device.limiter.SetRates(read, write)
+		}
+	}
+
+	// single holds the indexes of the reports to send one per device.
+	var single []int
+	if client.SupportsBatch() {
+		batches := (len(reports) + MaxBatchSize - 1) / MaxBatchSize
+		var mx sync.Mutex
+		parallel(batches, func(b int) {
+			from := b * MaxBatchSize
+			to := from + MaxBatchSize
+			if to > len(reports) {
+				to = len(reports)
+			}
+			batch := make([]Report, 0, to-from)
+			for _, pr := range reports[from:to] {
+				batch = append(batch, pr.report)
+			}
+			batchStatuses, batchErrs, err := client.ReportUsageBatch(ctx, batch)
+			if err == ErrBatchUnsupported {
+				mx.Lock()
+				for i := from; i < to; i++ {
+					single = append(single, i)
+				}
+				mx.Unlock()
+				return
+			}
+			for i := from; i < to; i++ {
+				if err != nil {
+					errs[i] = err
+					continue
+				}
+				statuses[i], errs[i] = batchStatuses[i-from], batchErrs[i-from]
+				apply(i)
+			}
+		})
+		if len(single) > 0 {
+			log.Debug("Datacap sidecar doesn't support batch reports, reporting per device")
+		}
+	} else {
+		for i := range reports {
+			single = append(single, i)
+		}
+	}
+
+	// Report concurrently: serially, one slow device delays the throttle
+	// verdict for every device behind it, and the cycle's duration grows with
+	// the number of active devices.
+	parallel(len(single), func(j int) {
+		i := single[j]
+		statuses[i], errs[i] = client.ReportUsage(ctx, &reports[i].report)
+		apply(i)
+	})
+}
+
+// parallel calls fn with every index below n, from up to flushConcurrency
+// goroutines, and waits for them all to return.
+func parallel(n int, fn func(i int)) {
 	workers := flushConcurrency
-	if len(reports) < workers {
-		workers = len(reports)
+	if n < workers {
+		workers = n
 	}
 	var next atomic.Int64
 	var wg sync.WaitGroup
@@ -309,60 +762,260 @@ func (t *Tracker) flush(ctx context.Context) {
 			defer wg.Done()
 			for {
 				i := int(next.Add(1)) - 1
-				if i >= len(reports) {
+				if i >= n {
 					return
 				}
-				pr := reports[i]
-				statuses[i], errs[i] = t.client.ReportUsage(ctx, &pr.report)
-				if st := statuses[i]; st != nil {
-					// Re-rate as soon as the verdict is in — SetRates is
-					// lock-free, and waiting for the whole batch would let one
-					// slow device delay enforcement for every other device.
-					// Only writes back to the client are throttled: a capped
-					// device can keep uploading at the default rate.
-					if st.Throttle {
-						pr.device.limiter.SetRates(t.defaultRate, ThrottledWriteRate)
-					} else {
-						pr.device.limiter.SetRates(t.defaultRate, t.defaultRate)
-					}
-				}
+				fn(i)
 			}
 		}()
 	}
 	wg.Wait()
+}
 
-	// The usage bookkeeping feeds the XBQ headers, which tolerate a batch's
-	// worth of staleness — record the whole cycle under one lock acquisition
-	// instead of one per device.
-	now := time.Now()
-	failed := 0
-	var lastErr error
+// setFailedOpen starts or stops ignoring verdicts, re-rating every device
+// accordingly. When the sidecar comes back, devices go back to their last
+// verdict until their next report revises it.
+func (t *Tracker) setFailedOpen(failedOpen bool) {
 	t.mx.Lock()
-	for i, pr := range reports {
-		if errs[i] != nil {
-			failed++
-			lastErr = errs[i]
-			// Put the bytes back so the next cycle retries them.
-			pr.device.pendingBytes += pr.report.BytesUsed
-			continue
+	changed := t.failedOpen != failedOpen
+	t.failedOpen = failedOpen
+	t.mx.Unlock()
+	if !changed {
+		return
+	}
+	if failedOpen {
+		log.Error("Lifting data caps until the datacap sidecar is reachable again")
+	}
+	t.rerate()
+}
+
+// SaveJournal persists the deltas the sidecar hasn't accepted yet, if the
+// tracker has a journal. It's called after every flush and on Close.
+func (t *Tracker) SaveJournal() {
+	if t.journal == nil {
+		return
+	}
+	t.mx.RLock()
+	var reports []Report
+	for deviceID, d := range t.devices {
+		if bytes := d.pendingBytes + d.inflightBytes; bytes > 0 {
+			reports = append(reports, Report{
+				DeviceID:      deviceID,
+				CountryCode:   d.countryCode,
+				Platform:      d.platform,
+				BytesUsed:     bytes,
+				BytesUploaded: d.pendingUploaded + d.inflightUploaded,
+			})
+		}
+	}
+	t.mx.RUnlock()
+	if err := t.journal.save(reports); err != nil {
+		log.Errorf("Unable to journal unreported usage to %v: %v", t.journal.path, err)
+	}
+}
+
+func usageFromStatus(st *Status, asOf time.Time) Usage {
+	u := Usage{
+		BytesUsed:     st.BytesUsed,
+		BytesUploaded: st.BytesUploaded,
+		CapLimit:      st.CapLimit,
+		AsOf:          asOf,
+		Throttled:     st.Throttle,
+		UploadLimit:   st.UploadLimit,
+	}
+	if st.ExpiryTime > 0 {
+		u.Expiry = time.Unix(st.ExpiryTime, 0)
+	}
+	return u
+}
+
+// streamVerdicts keeps a verdict stream open to the sidecar, reconnecting
+// with exponential backoff when it breaks. A sidecar that doesn't support
+// the stream is asked again every batchRetryInterval.
+func (t *Tracker) streamVerdicts() {
+	defer t.loops.Done()
+	backoff := streamMinBackoff
+	for {
+		ctx, cancel := context.WithCancel(context.Background())
+		t.mx.Lock()
+		client := t.client
+		t.cancelStream = cancel
+		t.mx.Unlock()
+		select {
+		case <-t.closeCh:
+			// closed before the stream could be cancelled
+			cancel()
+			return
+		default:
 		}
-		st := statuses[i]
-		u := Usage{
-			BytesUsed: st.BytesUsed,
-			CapLimit:  st.CapLimit,
-			AsOf:      now,
-			Throttled: st.Throttle,
+
+		connected := false
+		err := client.StreamVerdicts(ctx, func() {
+			connected = true
+			t.setStreamState(StreamConnected)
+			log.Debug("Receiving verdicts pushed by the datacap sidecar")
+		}, t.applyVerdict)
+		cancel()
+		if connected {
+			backoff = streamMinBackoff
+		}
+
+		wait := backoff
+		var statusErr *statusError
+		select {
+		case <-t.closeCh:
+			return
+		default:
 		}
-		if st.ExpiryTime > 0 {
-			u.Expiry = time.Unix(st.ExpiryTime, 0)
+		if errors.As(err, &statusErr) && statusErr.unsupported() {
+			if t.setStreamState(StreamUnsupported) != StreamUnsupported {
+				log.Debug("Datacap sidecar doesn't push verdicts, relying on reports alone")
+			}
+			wait = batchRetryInterval
+		} else {
+			t.setStreamState(StreamDisconnected)
+			switch {
+			case ctx.Err() != nil:
+				// reconnecting on purpose
+			case connected:
+				log.Errorf("Verdict stream from the datacap sidecar broke, reconnecting in %v: %v", wait, err)
+			default:
+				// the breaker already tells when the sidecar is down
+				log.Debugf("Unable to open verdict stream from the datacap sidecar, retrying in %v: %v", wait, err)
+			}
+			if backoff *= 2; backoff > streamMaxBackoff {
+				backoff = streamMaxBackoff
+			}
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-t.closeCh:
+			timer.Stop()
+			return
+		case <-t.restartStream:
+			backoff = streamMinBackoff
+		case <-timer.C:
 		}
-		pr.device.usage = u
+		timer.Stop()
 	}
+}
+
+// reconnectStream closes the current verdict stream, if any, and makes the
+// streaming loop reconnect right away.
+func (t *Tracker) reconnectStream() {
+	t.mx.Lock()
+	cancel := t.cancelStream
 	t.mx.Unlock()
+	select {
+	case t.restartStream <- struct{}{}:
+	default:
+	}
+	if cancel != nil {
+		cancel()
+	}
+}
 
-	if failed > 0 {
-		// A wedged sidecar fails every device in the batch, so log once per
-		// cycle rather than once per device.
-		log.Errorf("Unable to report usage for %d of %d devices, will retry: %v", failed, len(reports), lastErr)
+// setStreamState records the state of the verdict stream and returns the
+// previous one.
+func (t *Tracker) setStreamState(state string) string {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	previous := t.streamState
+	t.streamState = state
+	return previous
+}
+
+// applyVerdict applies a verdict the sidecar pushed, re-rating the device's
+// limiter right away instead of on its next report. Verdicts for devices this
+// proxy doesn't track are of no use to it.
+func (t *Tracker) applyVerdict(v Verdict) {
+	t.mx.Lock()
+	d, known := t.devices[v.DeviceID]
+	if !known {
+		t.mx.Unlock()
+		return
+	}
+	now := time.Now()
+	changed := d.usage.Throttled != v.Throttle
+	var verdictAges []time.Duration
+	if !d.usage.AsOf.IsZero() {
+		verdictAges = append(verdictAges, now.Sub(d.usage.AsOf))
+	}
+	d.usage = usageFromStatus(&v.Status, now)
+	read, write := t.ratesLocked(d.countryCode, d.platform, d.usage)
+	t.mx.Unlock()
+
+	t.observeVerdictAges(verdictAges...)
+	d.limiter.SetRates(read, write)
+	if changed {
+		log.Debugf("Datacap sidecar pushed a verdict for %v, throttled: %v", v.DeviceID, v.Throttle)
+	}
+}
+
+// observeVerdictAges passes the ages of the verdicts devices were held to
+// until now on to onVerdictAge.
+func (t *Tracker) observeVerdictAges(ages ...time.Duration) {
+	if t.onVerdictAge == nil {
+		return
+	}
+	for _, age := range ages {
+		t.onVerdictAge(age)
+	}
+}
+
+// Health is a snapshot of how reporting to the sidecar is going, for
+// introspection and metrics.
+type Health struct {
+	FailurePolicy FailurePolicy `json:"failurePolicy"`
+	// Breaker is one of BreakerClosed, BreakerOpen or BreakerHalfOpen.
+	Breaker string `json:"breaker"`
+	// ConsecutiveFailures counts the flush cycles in a row in which the
+	// sidecar didn't answer at all.
+	ConsecutiveFailures int `json:"consecutiveFailures"`
+	// RetryAt is when reporting resumes while the breaker is open.
+	RetryAt time.Time `json:"retryAt,omitempty"`
+	// FailedOpen is whether caps are lifted until the sidecar is back.
+	FailedOpen bool `json:"failedOpen"`
+	// VerdictStream is one of StreamConnected, StreamDisconnected or
+	// StreamUnsupported.
+	VerdictStream string `json:"verdictStream"`
+	// PendingBytes is the usage the sidecar hasn't accepted yet, across
+	// PendingDevices devices.
+	PendingBytes   int64 `json:"pendingBytes"`
+	PendingDevices int   `json:"pendingDevices"`
+	// MaxStalenessSeconds is how long the oldest unreported usage has been
+	// waiting, and StaleDevices how many devices have had some waiting for
+	// more than a few report intervals.
+	MaxStalenessSeconds float64 `json:"maxStalenessSeconds"`
+	StaleDevices        int     `json:"staleDevices"`
+}
+
+// Health returns a snapshot of how reporting to the sidecar is going.
+func (t *Tracker) Health() Health {
+	now := time.Now()
+	h := Health{FailurePolicy: t.failurePolicy}
+	h.Breaker, h.ConsecutiveFailures, h.RetryAt = t.breaker.state(now)
+	staleAfter := staleCycles * t.reportInterval
+
+	t.mx.RLock()
+	defer t.mx.RUnlock()
+	h.FailedOpen = t.failedOpen
+	h.VerdictStream = t.streamState
+	for _, d := range t.devices {
+		bytes := d.pendingBytes + d.inflightBytes
+		if bytes == 0 {
+			continue
+		}
+		h.PendingBytes += bytes
+		h.PendingDevices++
+		staleness := now.Sub(d.pendingSince)
+		if seconds := staleness.Seconds(); seconds > h.MaxStalenessSeconds {
+			h.MaxStalenessSeconds = seconds
+		}
+		if staleness > staleAfter {
+			h.StaleDevices++
+		}
 	}
+	return h
 }
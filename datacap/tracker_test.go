@@ -1,10 +1,14 @@
 package datacap
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -13,6 +17,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/getlantern/http-proxy-lantern/v2/common"
+	"github.com/getlantern/http-proxy-lantern/v2/listeners"
 	"github.com/getlantern/measured"
 )
 
@@ -23,55 +28,128 @@ type fixedCountry string
 func (c fixedCountry) CountryCode(net.IP) string { return string(c) }
 
 // fakeSidecar accumulates reported deltas the way the real sidecar does and
-// throttles once the cap is exceeded.
+// throttles once the cap is exceeded. It serves both the per-device and the
+// batch endpoint, unless noBatch makes it behave like a sidecar predating
+// batches, and pushes the verdicts passed to push over the verdict stream.
 type fakeSidecar struct {
 	*httptest.Server
 
 	mu       sync.Mutex
 	reports  []Report
 	total    int64
+	uploaded int64
 	capLimit int64
 	fail     bool
 	delay    time.Duration
+	noBatch  bool
+	// uploadLimit is the upload rate every device is held to, if any.
+	uploadLimit int64
+	// requests counts the requests to each endpoint.
+	requests map[string]int
+	// verdicts is where the verdict stream takes the verdicts to push from.
+	verdicts chan Verdict
+	closed   chan struct{}
 }
 
 func newFakeSidecar(capLimit int64) *fakeSidecar {
-	s := &fakeSidecar{capLimit: capLimit}
+	s := &fakeSidecar{
+		capLimit: capLimit,
+		requests: make(map[string]int),
+		verdicts: make(chan Verdict),
+		closed:   make(chan struct{}),
+	}
 	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		var report Report
-		if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
-
 		s.mu.Lock()
-		if s.fail {
-			s.mu.Unlock()
-			w.WriteHeader(http.StatusInternalServerError)
+		s.requests[r.URL.Path]++
+		fail, noBatch := s.fail, s.noBatch
+		s.mu.Unlock()
+
+		var resp interface{}
+		switch {
+		case r.URL.Path == "/data-cap/verdicts" && r.Method == http.MethodGet:
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			for {
+				select {
+				case v := <-s.verdicts:
+					data, _ := json.Marshal(v)
+					fmt.Fprintf(w, ": keepalive\n\nevent: verdict\ndata: %s\n\n", data)
+					w.(http.Flusher).Flush()
+				case <-r.Context().Done():
+					return
+				case <-s.closed:
+					return
+				}
+			}
+		case r.URL.Path == "/data-cap/batch" && !noBatch:
+			var batch BatchRequest
+			if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if fail {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			statuses := make([]BatchStatus, 0, len(batch.Reports))
+			for _, report := range batch.Reports {
+				statuses = append(statuses, BatchStatus{Status: s.account(report)})
+			}
+			resp = BatchResponse{Statuses: statuses}
+		case r.URL.Path == "/data-cap/":
+			var report Report
+			if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if fail {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			resp = s.account(report)
+		default:
+			http.NotFound(w, r)
 			return
 		}
-		delay := s.delay
-		if delay > 0 && report.DeviceID == "slowpoke" {
-			s.mu.Unlock()
-			time.Sleep(delay)
-			s.mu.Lock()
-		}
-		s.reports = append(s.reports, report)
-		s.total += report.BytesUsed
-		status := Status{
-			Throttle:   s.capLimit > 0 && s.total >= s.capLimit,
-			CapLimit:   s.capLimit,
-			ExpiryTime: time.Now().Add(6 * time.Hour).Unix(),
-			BytesUsed:  s.total,
-		}
-		s.mu.Unlock()
 
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(status)
+		json.NewEncoder(w).Encode(resp)
 	}))
 	return s
 }
 
+// push pushes v to the tracker over the verdict stream, once it's connected.
+func (s *fakeSidecar) push(v Verdict) {
+	s.verdicts <- v
+}
+
+func (s *fakeSidecar) Close() {
+	close(s.closed)
+	s.Server.Close()
+}
+
+func (s *fakeSidecar) account(report Report) Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.delay > 0 && report.DeviceID == "slowpoke" {
+		s.mu.Unlock()
+		time.Sleep(s.delay)
+		s.mu.Lock()
+	}
+	s.reports = append(s.reports, report)
+	s.total += report.BytesUsed
+	s.uploaded += report.BytesUploaded
+	return Status{
+		Throttle:      s.capLimit > 0 && s.total >= s.capLimit,
+		CapLimit:      s.capLimit,
+		ExpiryTime:    time.Now().Add(6 * time.Hour).Unix(),
+		BytesUsed:     s.total,
+		BytesUploaded: s.uploaded,
+		UploadLimit:   s.uploadLimit,
+	}
+}
+
 func (s *fakeSidecar) snapshot() (reports []Report, total int64) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -86,12 +164,14 @@ func (s *fakeSidecar) setFail(fail bool) {
 
 func newTestTracker(t *testing.T, sidecar *fakeSidecar) *Tracker {
 	t.Helper()
-	return NewTracker(TrackerOpts{
+	tracker := NewTracker(TrackerOpts{
 		Client:         NewClient(sidecar.URL, time.Second),
 		CountryLookup:  fixedCountry("ES"),
 		DefaultRate:    testDefaultRate,
 		ReportInterval: 10 * time.Millisecond,
 	})
+	t.Cleanup(tracker.Close)
+	return tracker
 }
 
 func report(t *Tracker, deviceID string, bytes int) {
@@ -214,12 +294,14 @@ func TestDeltasWithoutADeviceIDAreIgnored(t *testing.T) {
 }
 
 // One unresponsive device must not hold up the throttle verdict for every other
-// device in the batch.
+// device in the cycle. A batch is answered as a whole, so this only holds when
+// reporting per device.
 func TestASlowDeviceDoesNotDelayTheBatch(t *testing.T) {
 	sidecar := newFakeSidecar(1000)
 	defer sidecar.Close()
 	sidecar.mu.Lock()
 	sidecar.delay = 750 * time.Millisecond
+	sidecar.noBatch = true
 	sidecar.mu.Unlock()
 
 	tracker := newTestTracker(t, sidecar)
@@ -233,3 +315,419 @@ func TestASlowDeviceDoesNotDelayTheBatch(t *testing.T) {
 	}, 500*time.Millisecond, 5*time.Millisecond,
 		"device1 should be throttled well before the slow device's report returns")
 }
+
+func TestDevicesSnapshot(t *testing.T) {
+	sidecar := newFakeSidecar(100)
+	defer sidecar.Close()
+	tracker := newTestTracker(t, sidecar)
+
+	report(tracker, "device1", 500)
+	assert.Eventually(t, func() bool {
+		u, ok := tracker.Usage("device1")
+		return ok && u.Throttled
+	}, time.Second, 5*time.Millisecond)
+
+	devices := tracker.Devices()
+	require.Len(t, devices, 1)
+	d := devices[0]
+	assert.Equal(t, "device1", d.DeviceID)
+	assert.Equal(t, "ES", d.CountryCode)
+	assert.Equal(t, "android", d.Platform)
+	assert.True(t, d.Usage.Throttled)
+	assert.Equal(t, int64(500), d.Usage.BytesUsed)
+	assert.Equal(t, testDefaultRate, d.ReadRate)
+	assert.Equal(t, ThrottledWriteRate, d.WriteRate)
+}
+
+func TestBreaker(t *testing.T) {
+	now := time.Now()
+	b := newBreaker(time.Second)
+	for i := 1; i < breakerThreshold; i++ {
+		opened, _ := b.fail(now)
+		require.False(t, opened, "a few failed cycles should just be retried")
+	}
+	allowed, probe := b.allow(now)
+	assert.True(t, allowed)
+	assert.False(t, probe)
+
+	opened, backoff := b.fail(now)
+	assert.True(t, opened)
+	assert.InDelta(t, time.Second, backoff, float64(breakerJitter*float64(time.Second)))
+	allowed, _ = b.allow(now)
+	assert.False(t, allowed, "reports should be held off while the breaker is open")
+	state, failures, _ := b.state(now)
+	assert.Equal(t, BreakerOpen, state)
+	assert.Equal(t, breakerThreshold, failures)
+
+	now = now.Add(2 * time.Second)
+	allowed, probe = b.allow(now)
+	assert.True(t, allowed)
+	assert.True(t, probe, "the first report after the backoff should probe the sidecar")
+	opened, backoff = b.fail(now)
+	assert.False(t, opened)
+	assert.InDelta(t, 2*time.Second, backoff, float64(2*breakerJitter*float64(time.Second)), "the backoff should double")
+
+	assert.True(t, b.succeed())
+	state, failures, _ = b.state(now)
+	assert.Equal(t, BreakerClosed, state)
+	assert.Zero(t, failures)
+	assert.False(t, b.succeed())
+}
+
+func throttleThenFail(t *testing.T, policy FailurePolicy) (*fakeSidecar, *Tracker, *listeners.RateLimiter) {
+	sidecar := newFakeSidecar(100)
+	tracker := NewTracker(TrackerOpts{
+		Client:         NewClient(sidecar.URL, time.Second),
+		CountryLookup:  fixedCountry("ES"),
+		DefaultRate:    testDefaultRate,
+		ReportInterval: 10 * time.Millisecond,
+		FailurePolicy:  policy,
+	})
+	t.Cleanup(tracker.Close)
+	limiter := tracker.Limiter("device1", false)
+	report(tracker, "device1", 500)
+	require.Eventually(t, func() bool {
+		return limiter.GetRateWrite() == ThrottledWriteRate
+	}, time.Second, 5*time.Millisecond)
+
+	sidecar.setFail(true)
+	report(tracker, "device1", 500)
+	require.Eventually(t, func() bool {
+		return tracker.Health().Breaker != BreakerClosed
+	}, time.Second, 5*time.Millisecond, "the breaker should open once the sidecar keeps failing")
+	return sidecar, tracker, limiter
+}
+
+func TestFailOpen(t *testing.T) {
+	sidecar, tracker, limiter := throttleThenFail(t, FailOpen)
+	defer sidecar.Close()
+	assert.Equal(t, testDefaultRate, limiter.GetRateWrite(), "caps should be lifted while the sidecar is down")
+	h := tracker.Health()
+	assert.True(t, h.FailedOpen)
+	assert.EqualValues(t, 500, h.PendingBytes)
+	assert.Equal(t, 1, h.PendingDevices)
+
+	sidecar.setFail(false)
+	assert.Eventually(t, func() bool {
+		return limiter.GetRateWrite() == ThrottledWriteRate && !tracker.Health().FailedOpen
+	}, 2*time.Second, 5*time.Millisecond, "caps should be back with the sidecar")
+	_, total := sidecar.snapshot()
+	assert.EqualValues(t, 1000, total, "usage during the outage should still be accounted for")
+}
+
+func TestKeepLastVerdict(t *testing.T) {
+	sidecar, tracker, limiter := throttleThenFail(t, KeepLastVerdict)
+	defer sidecar.Close()
+	assert.Equal(t, ThrottledWriteRate, limiter.GetRateWrite(), "the last verdict should stand while the sidecar is down")
+	assert.False(t, tracker.Health().FailedOpen)
+}
+
+func TestStaleness(t *testing.T) {
+	sidecar := newFakeSidecar(0)
+	defer sidecar.Close()
+	sidecar.setFail(true)
+	tracker := newTestTracker(t, sidecar)
+
+	report(tracker, "device1", 10)
+	assert.Eventually(t, func() bool {
+		return tracker.Health().StaleDevices == 1
+	}, time.Second, 5*time.Millisecond, "unreported usage should make the device's verdict stale")
+	assert.Greater(t, tracker.Health().MaxStalenessSeconds, (staleCycles * 10 * time.Millisecond).Seconds())
+
+	sidecar.setFail(false)
+	assert.Eventually(t, func() bool {
+		h := tracker.Health()
+		return h.StaleDevices == 0 && h.MaxStalenessSeconds == 0
+	}, 2*time.Second, 5*time.Millisecond)
+	assert.True(t, tracker.Devices()[0].PendingSince.IsZero())
+}
+
+func TestVerdictAge(t *testing.T) {
+	sidecar := newFakeSidecar(100)
+	defer sidecar.Close()
+	var mx sync.Mutex
+	var ages []time.Duration
+	tracker := NewTracker(TrackerOpts{
+		Client:         NewClient(sidecar.URL, time.Second),
+		CountryLookup:  fixedCountry("ES"),
+		DefaultRate:    testDefaultRate,
+		ReportInterval: 10 * time.Millisecond,
+		OnVerdictAge: func(age time.Duration) {
+			mx.Lock()
+			ages = append(ages, age)
+			mx.Unlock()
+		},
+	})
+	defer tracker.Close()
+	observed := func() []time.Duration {
+		mx.Lock()
+		defer mx.Unlock()
+		return append([]time.Duration(nil), ages...)
+	}
+
+	report(tracker, "device1", 10)
+	require.Eventually(t, func() bool {
+		_, ok := tracker.Usage("device1")
+		return ok
+	}, time.Second, 5*time.Millisecond)
+	assert.Empty(t, observed(), "there's no age until there's a verdict")
+
+	time.Sleep(50 * time.Millisecond)
+	devices := tracker.Devices()
+	require.Len(t, devices, 1)
+	assert.GreaterOrEqual(t, devices[0].VerdictAgeSeconds, 0.05)
+
+	report(tracker, "device1", 10)
+	require.Eventually(t, func() bool { return len(observed()) == 1 }, time.Second, 5*time.Millisecond)
+	assert.GreaterOrEqual(t, observed()[0], 50*time.Millisecond)
+}
+
+// A sidecar outage followed by a restart must not lose usage.
+func TestJournal(t *testing.T) {
+	down := newFakeSidecar(0)
+	defer down.Close()
+	down.setFail(true)
+	dir := t.TempDir()
+	journalFile := filepath.Join(dir, "journal.json")
+	tracker := NewTracker(TrackerOpts{
+		Client:         NewClient(down.URL, time.Second),
+		CountryLookup:  fixedCountry("ES"),
+		ReportInterval: 10 * time.Millisecond,
+		JournalFile:    journalFile,
+	})
+	defer tracker.Close()
+	report(tracker, "device1", 300)
+	var journaled []Report
+	require.Eventually(t, func() bool {
+		journaled, _ = newJournal(journalFile).load()
+		return len(journaled) == 1 && journaled[0].BytesUsed == 300
+	}, time.Second, 5*time.Millisecond, "unreported usage should be journaled")
+	assert.Equal(t, Report{DeviceID: "device1", CountryCode: "ES", Platform: "android", BytesUsed: 300, BytesUploaded: 300}, journaled[0])
+
+	// restart from a copy of the journal while the first tracker keeps
+	// running, so that it's still journaling for the sidecar that's down
+	restartedJournal := filepath.Join(dir, "restarted.json")
+	require.NoError(t, newJournal(restartedJournal).save(journaled))
+	up := newFakeSidecar(0)
+	defer up.Close()
+	restarted := NewTracker(TrackerOpts{
+		Client:         NewClient(up.URL, time.Second),
+		CountryLookup:  fixedCountry("ES"),
+		ReportInterval: 10 * time.Millisecond,
+		JournalFile:    restartedJournal,
+	})
+	defer restarted.Close()
+	assert.Eventually(t, func() bool {
+		_, total := up.snapshot()
+		return total == 300
+	}, time.Second, 5*time.Millisecond, "journaled usage should be reported after a restart")
+	assert.Eventually(t, func() bool {
+		reports, err := newJournal(restartedJournal).load()
+		return err == nil && len(reports) == 0
+	}, time.Second, 5*time.Millisecond, "the journal should be emptied once the sidecar has the usage")
+	reports, _ := up.snapshot()
+	assert.Equal(t, "ES", reports[0].CountryCode)
+}
+
+func TestParseFailurePolicy(t *testing.T) {
+	for s, expected := range map[string]FailurePolicy{
+		"":                  KeepLastVerdict,
+		"keep-last-verdict": KeepLastVerdict,
+		"fail-open":         FailOpen,
+	} {
+		policy, err := ParseFailurePolicy(s)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, policy)
+	}
+	_, err := ParseFailurePolicy("fail-closed")
+	assert.Error(t, err)
+}
+
+func TestBatchReports(t *testing.T) {
+	sidecar := newFakeSidecar(0)
+	defer sidecar.Close()
+	tracker := newTestTracker(t, sidecar)
+
+	devices := MaxBatchSize + 10
+	for i := 0; i < devices; i++ {
+		report(tracker, fmt.Sprintf("device%d", i), 1)
+	}
+	assert.Eventually(t, func() bool {
+		for i := 0; i < devices; i++ {
+			if _, ok := tracker.Usage(fmt.Sprintf("device%d", i)); !ok {
+				return false
+			}
+		}
+		return true
+	}, time.Second, 5*time.Millisecond, "every device should get its verdict back")
+	_, total := sidecar.snapshot()
+	assert.EqualValues(t, devices, total)
+
+	sidecar.mu.Lock()
+	defer sidecar.mu.Unlock()
+	assert.Zero(t, sidecar.requests["/data-cap/"], "a sidecar supporting batches should only get batches")
+	assert.LessOrEqual(t, sidecar.requests["/data-cap/batch"], 4, "reports should be batched")
+}
+
+func TestBatchFallback(t *testing.T) {
+	sidecar := newFakeSidecar(100)
+	defer sidecar.Close()
+	sidecar.noBatch = true
+	tracker := newTestTracker(t, sidecar)
+
+	limiter := tracker.Limiter("device1", false)
+	report(tracker, "device1", 500)
+	assert.Eventually(t, func() bool {
+		return limiter.GetRateWrite() == ThrottledWriteRate
+	}, time.Second, 5*time.Millisecond, "verdicts should come back through the per-device endpoint")
+	report(tracker, "device1", 500)
+	assert.Eventually(t, func() bool {
+		_, total := sidecar.snapshot()
+		return total == 1000
+	}, time.Second, 5*time.Millisecond)
+
+	sidecar.mu.Lock()
+	defer sidecar.mu.Unlock()
+	assert.Equal(t, 1, sidecar.requests["/data-cap/batch"], "batches shouldn't be tried again right away")
+	assert.Equal(t, 2, sidecar.requests["/data-cap/"])
+}
+
+func TestBatchErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(BatchResponse{Statuses: []BatchStatus{
+			{Status: Status{BytesUsed: 10}},
+			{Error: "unknown platform"},
+		}})
+	}))
+	defer server.Close()
+	client := NewClient(server.URL, time.Second)
+
+	statuses, errs, err := client.ReportUsageBatch(context.Background(), []Report{{DeviceID: "a"}, {DeviceID: "b"}})
+	require.NoError(t, err)
+	assert.EqualValues(t, 10, statuses[0].BytesUsed)
+	assert.NoError(t, errs[0])
+	assert.Nil(t, statuses[1])
+	assert.Error(t, errs[1], "a report the sidecar rejected should be retried")
+
+	_, _, err = client.ReportUsageBatch(context.Background(), []Report{{DeviceID: "a"}})
+	assert.Error(t, err, "a batch answered with the wrong number of statuses should fail as a whole")
+	assert.True(t, client.SupportsBatch())
+}
+
+// A verdict the backend changes, e.g. because the device went pro, must be
+// applied without waiting for the device's next report.
+func TestPushedVerdicts(t *testing.T) {
+	sidecar := newFakeSidecar(100)
+	defer sidecar.Close()
+	tracker := newTestTracker(t, sidecar)
+
+	limiter := tracker.Limiter("device1", false)
+	report(tracker, "device1", 500)
+	require.Eventually(t, func() bool {
+		return limiter.GetRateWrite() == ThrottledWriteRate
+	}, time.Second, 5*time.Millisecond)
+	require.Eventually(t, func() bool {
+		return tracker.Health().VerdictStream == StreamConnected
+	}, time.Second, 5*time.Millisecond)
+
+	sidecar.push(Verdict{DeviceID: "unknown", Status: Status{Throttle: true}})
+	sidecar.push(Verdict{DeviceID: "device1", Status: Status{Throttle: false, CapLimit: 100, BytesUsed: 500}})
+	assert.Eventually(t, func() bool {
+		return limiter.GetRateWrite() == testDefaultRate
+	}, time.Second, 5*time.Millisecond, "a pushed verdict should re-rate the device right away")
+	u, _ := tracker.Usage("device1")
+	assert.False(t, u.Throttled)
+	assert.EqualValues(t, 500, u.BytesUsed)
+	_, known := tracker.Usage("unknown")
+	assert.False(t, known, "verdicts for devices this proxy doesn't track should be ignored")
+
+	sidecar.mu.Lock()
+	reports := len(sidecar.reports)
+	sidecar.mu.Unlock()
+	assert.Equal(t, 1, reports, "the verdict should have come without a report")
+}
+
+func TestVerdictStreamUnsupported(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	tracker := NewTracker(TrackerOpts{Client: NewClient(server.URL, time.Second)})
+	defer tracker.Close()
+	assert.Eventually(t, func() bool {
+		return tracker.Health().VerdictStream == StreamUnsupported
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestReadEvents(t *testing.T) {
+	type event struct{ event, data string }
+	var events []event
+	lines := 0
+	err := readEvents(strings.NewReader(": hello\n\nevent: verdict\ndata: {\ndata:}\n\ndata: plain\nid: 3\n\nevent: ignored\n\n"),
+		func() { lines++ },
+		func(e, data string) { events = append(events, event{e, data}) })
+	require.NoError(t, err)
+	assert.Equal(t, []event{{"verdict", "{\n}"}, {"message", "plain"}}, events)
+	assert.Equal(t, 11, lines)
+}
+
+func TestParseUploadLimits(t *testing.T) {
+	limits, err := ParseUploadLimits(" *=2000, ir=500,IR/Android=250,*/windows=1000 ", 100)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"*": 250000, "IR": 62500, "IR/android": 31250, "*/windows": 125000}, limits.Cohorts)
+	assert.EqualValues(t, 100, limits.PerConnection)
+
+	assert.EqualValues(t, 31250, limits.For("ir", "android"), "country and platform should beat country alone")
+	assert.EqualValues(t, 62500, limits.For("IR", "windows"), "the country should beat the platform")
+	assert.EqualValues(t, 125000, limits.For("ES", "windows"))
+	assert.EqualValues(t, 250000, limits.For("ES", "android"))
+	assert.EqualValues(t, 250000, limits.For("", ""))
+
+	limits, err = ParseUploadLimits("", 0)
+	require.NoError(t, err)
+	assert.Zero(t, limits.For("IR", "android"), "no cohort should mean no limit")
+
+	for _, spec := range []string{"IR", "IR=0", "IR=-5", "IR=fast", "IR=1,ir=2"} {
+		_, err := ParseUploadLimits(spec, 0)
+		assert.Error(t, err, spec)
+	}
+	_, err = ParseUploadLimits("", -1)
+	assert.Error(t, err)
+}
+
+func TestUploadLimits(t *testing.T) {
+	sidecar := newFakeSidecar(0)
+	defer sidecar.Close()
+	tracker := newTestTracker(t, sidecar)
+
+	limiter := tracker.Limiter("device1", false)
+	require.Equal(t, testDefaultRate, limiter.GetRateRead(), "uploads should start at the default rate")
+
+	limits, err := ParseUploadLimits("ES/android=800,ES=1600", 2000)
+	require.NoError(t, err)
+	tracker.SetUploadLimits(limits)
+	assert.EqualValues(t, 2000, tracker.ConnUploadRate())
+	assert.Equal(t, testDefaultRate, limiter.GetRateRead(), "no cohort should apply before the device's country is known")
+
+	report(tracker, "device1", 400)
+	assert.EqualValues(t, 100000, limiter.GetRateRead(), "the device's cohort should apply once it's known")
+	assert.Equal(t, testDefaultRate, limiter.GetRateWrite(), "downloads shouldn't be affected")
+
+	sidecar.mu.Lock()
+	sidecar.uploadLimit = 50000
+	sidecar.mu.Unlock()
+	report(tracker, "device1", 100)
+	assert.Eventually(t, func() bool {
+		return limiter.GetRateRead() == 50000
+	}, time.Second, 5*time.Millisecond, "a lower limit from the sidecar should win")
+	u, _ := tracker.Usage("device1")
+	assert.EqualValues(t, 500, u.BytesUploaded, "uploads should be accounted separately")
+	assert.EqualValues(t, 50000, u.UploadLimit)
+
+	reports, _ := sidecar.snapshot()
+	for _, r := range reports {
+		assert.Equal(t, r.BytesUsed, r.BytesUploaded, "everything reported was uploaded")
+	}
+
+	tracker.SetUploadLimits(UploadLimits{})
+	assert.EqualValues(t, 50000, limiter.GetRateRead(), "the sidecar's limit should outlive the cohort limits")
+	assert.Zero(t, tracker.ConnUploadRate())
+}
@@ -0,0 +1,100 @@
+package datacap
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// UploadLimits configures how fast devices may upload, independently of the
+// download rate their cap state holds them to, so that abusive uploads
+// (seeding, mass mailing) can be curbed without slowing down browsing. All
+// rates are in bytes per second.
+type UploadLimits struct {
+	// Cohorts maps cohorts to the upload rate every device in them is held
+	// to. A cohort is "<country>/<platform>", "<country>", "*/<platform>" or
+	// "*", the most specific match applying.
+	Cohorts map[string]int64
+	// PerConnection is the most any one connection may upload, zero meaning
+	// no limit, so that a device can't spend its whole upload rate on a
+	// single transfer.
+	PerConnection int64
+}
+
+// ParseUploadLimits parses comma-separated cohort=rate pairs, rates being in
+// Kbps, e.g. "*=2000,IR=500,IR/android=250,*/windows=1000".
+func ParseUploadLimits(spec string, perConnection int64) (UploadLimits, error) {
+	limits := UploadLimits{Cohorts: make(map[string]int64), PerConnection: perConnection}
+	if perConnection < 0 {
+		return limits, fmt.Errorf("per-connection upload limit must not be negative, not %d", perConnection)
+	}
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		cohort, rate, ok := strings.Cut(pair, "=")
+		if !ok {
+			return limits, fmt.Errorf("upload limit %q is not of the form cohort=kbps", pair)
+		}
+		cohort = normalizeCohort(strings.TrimSpace(cohort))
+		kbps, err := strconv.ParseInt(strings.TrimSpace(rate), 10, 64)
+		if err != nil || kbps <= 0 {
+			return limits, fmt.Errorf("upload limit for %q must be a positive number of Kbps, not %q", cohort, rate)
+		}
+		if _, dupe := limits.Cohorts[cohort]; dupe {
+			return limits, fmt.Errorf("upload limit for %q given twice", cohort)
+		}
+		limits.Cohorts[cohort] = kbps * 1000 / 8
+	}
+	return limits, nil
+}
+
+// normalizeCohort upper-cases the country and lower-cases the platform, the
+// way they're reported.
+func normalizeCohort(cohort string) string {
+	country, platform, hasPlatform := strings.Cut(cohort, "/")
+	country = strings.ToUpper(country)
+	if country == "" {
+		country = "*"
+	}
+	if !hasPlatform || platform == "*" || platform == "" {
+		return country
+	}
+	return country + "/" + strings.ToLower(platform)
+}
+
+// For returns the upload rate for devices in countryCode on platform, zero if
+// no cohort applies.
+func (l UploadLimits) For(countryCode, platform string) int64 {
+	countryCode, platform = strings.ToUpper(countryCode), strings.ToLower(platform)
+	candidates := make([]string, 0, 4)
+	if countryCode != "" && platform != "" {
+		candidates = append(candidates, countryCode+"/"+platform)
+	}
+	if countryCode != "" {
+		candidates = append(candidates, countryCode)
+	}
+	if platform != "" {
+		candidates = append(candidates, "*/"+platform)
+	}
+	candidates = append(candidates, "*")
+	for _, cohort := range candidates {
+		if rate, ok := l.Cohorts[cohort]; ok {
+			return rate
+		}
+	}
+	return 0
+}
+
+// minRate returns the lowest of the given rates that are limits at all, zero
+// meaning unlimited.
+func minRate(rates ...int64) int64 {
+	var lowest int64
+	for _, rate := range rates {
+		if rate > 0 && (lowest == 0 || rate < lowest) {
+			lowest = rate
+		}
+	}
+	return lowest
+}
@@ -17,6 +17,8 @@ import (
 	"github.com/getlantern/http-proxy-lantern/v2/datacap"
 	"github.com/getlantern/http-proxy-lantern/v2/domains"
 	"github.com/getlantern/http-proxy-lantern/v2/instrument"
+	"github.com/getlantern/http-proxy-lantern/v2/shadowsocks"
+	"github.com/getlantern/http-proxy-lantern/v2/tokenfilter"
 )
 
 var (
@@ -52,6 +54,19 @@ func throttleSentinelDevice(inst instrument.Instrument, wc listeners.WrapConn, r
 	return false
 }
 
+// deviceIDFor returns the device a request comes from: the one in its device
+// ID header or, failing that, the shadowsocks access key its connection
+// authenticated with, so that keys are accounted and throttled like devices.
+func deviceIDFor(cs *filters.ConnectionState, req *http.Request) string {
+	if deviceID := req.Header.Get(common.DeviceIdHeader); deviceID != "" {
+		return deviceID
+	}
+	if keyID := shadowsocks.AccessKeyID(cs.Downstream()); keyID != "" {
+		return common.AccessKeyDevicePrefix + keyID
+	}
+	return ""
+}
+
 // setXBQHeaders attaches the XBQ/XBQv2 usage headers flashlight's bandwidth
 // package renders in the client UI. This is the single definition of that wire
 // format for both accounting paths — a device must see identical headers no
@@ -99,7 +114,14 @@ func (f *datacapFilterPre) Apply(cs *filters.ConnectionState, req *http.Request,
 	}
 
 	wc := cs.Downstream().(listeners.WrapConn)
-	deviceID := req.Header.Get(common.DeviceIdHeader)
+	deviceID := deviceIDFor(cs, req)
+
+	// Pro devices are never capped. Only a signed token can vouch for that,
+	// since its claims have already been verified by tokenfilter.
+	if claims := tokenfilter.ClaimsFromContext(req.Context()); claims != nil && claims.Pro {
+		f.instrument.Throttle(req.Context(), false, "pro")
+		return next(cs, req)
+	}
 
 	// Some domains are excluded from being throttled. Their bytes still count
 	// towards the cap (accounting is per connection, not per request), they are
@@ -126,6 +148,7 @@ func (f *datacapFilterPre) Apply(cs *filters.ConnectionState, req *http.Request,
 	// the whole of enforcement here.
 	limiter, u, haveUsage := f.tracker.LimiterAndUsage(deviceID)
 	wc.ControlMessage("throttle", limiter)
+	wc.ControlMessage("upload", f.tracker.ConnUploadRate())
 
 	if !haveUsage {
 		// The sidecar only learns of a device from its first usage report, so
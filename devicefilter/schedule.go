@@ -0,0 +1,43 @@
+package devicefilter
+
+import (
+	"net/http"
+
+	"github.com/getlantern/proxy/v3/filters"
+
+	"github.com/getlantern/http-proxy-lantern/v2/listeners"
+	"github.com/getlantern/http-proxy-lantern/v2/tokenfilter"
+)
+
+const (
+	// freeWeight and proWeight are how much of the egress capacity free and
+	// pro devices get relative to one another when the proxy is contended.
+	freeWeight = 1
+	proWeight  = 2
+)
+
+// scheduleFilter attaches each device's flow in the egress scheduler to its
+// connections.
+type scheduleFilter struct {
+	scheduler *listeners.Scheduler
+}
+
+// NewSchedule creates the filter sharing the proxy's egress capacity fairly
+// among devices through scheduler. Devices a signed token vouches for as pro
+// are weighted higher. The flow comes on top of whatever limiter an earlier
+// filter attached, so the datacap throttle remains a hard ceiling.
+func NewSchedule(scheduler *listeners.Scheduler) filters.Filter {
+	return &scheduleFilter{scheduler: scheduler}
+}
+
+func (f *scheduleFilter) Apply(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+	weight := float64(freeWeight)
+	if claims := tokenfilter.ClaimsFromContext(req.Context()); claims != nil && claims.Pro {
+		weight = proWeight
+	}
+	// Requests without a device ID share one flow, like they share a limiter.
+	deviceID := deviceIDFor(cs, req)
+	wc := cs.Downstream().(listeners.WrapConn)
+	wc.ControlMessage("schedule", f.scheduler.Flow(deviceID, weight))
+	return next(cs, req)
+}
@@ -0,0 +1,149 @@
+package egress
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testPolicy = `
+default: allow
+rules:
+  - action: deny
+    ports: [25, 465, 587]
+  - action: deny
+    domains: ["tracker.example.com", "*.Tracker.example.com"]
+  - action: deny
+    cidrs: ["203.0.113.0/24"]
+    countries: [ir]
+  - action: route
+    route: exit
+    domains: ["*.example.org"]
+    ports: [443]
+  - action: route
+    route: direct
+    domains: ["*.example.net"]
+upstreams:
+  exit: socks5://192.0.2.10:1080
+`
+
+func country(code string) func() string {
+	return func() string { return code }
+}
+
+func TestDecide(t *testing.T) {
+	p, err := Parse([]byte(testPolicy))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"exit": "socks5://192.0.2.10:1080"}, p.Upstreams)
+
+	decide := func(dest Destination) Action {
+		action, _ := p.Decide(dest)
+		return action
+	}
+
+	assert.Equal(t, Deny, decide(Destination{Host: "smtp.example.com", Port: 25}))
+	assert.Equal(t, Allow, decide(Destination{Host: "smtp.example.com", Port: 443}))
+
+	assert.Equal(t, Deny, decide(Destination{Host: "tracker.example.com", Port: 80}))
+	assert.Equal(t, Deny, decide(Destination{Host: "announce.TRACKER.example.com.", Port: 6969}))
+	assert.Equal(t, Deny, decide(Destination{Host: "a.b.tracker.example.com", Port: 80}), "globs should match nested subdomains")
+	assert.Equal(t, Allow, decide(Destination{Host: "nottracker.example.com", Port: 80}))
+
+	assert.Equal(t, Deny, decide(Destination{Host: "203.0.113.5", Port: 443, Country: country("IR")}))
+	assert.Equal(t, Deny, decide(Destination{Host: "host.example.com", IPs: []net.IP{net.ParseIP("203.0.113.5")}, Port: 443, Country: country("IR")}))
+	assert.Equal(t, Allow, decide(Destination{Host: "203.0.113.5", Port: 443, Country: country("US")}))
+	assert.Equal(t, Allow, decide(Destination{Host: "203.0.113.5", Port: 443}), "unknown country shouldn't match")
+	assert.Equal(t, Allow, decide(Destination{Host: "host.example.com", Port: 443, Country: country("IR")}), "unknown IP shouldn't match")
+
+	action, route := p.Decide(Destination{Host: "www.example.org", Port: 443})
+	assert.Equal(t, Route, action)
+	assert.Equal(t, "exit", route)
+	assert.Equal(t, Allow, decide(Destination{Host: "www.example.org", Port: 80}))
+	action, route = p.Decide(Destination{Host: "www.example.net", Port: 443})
+	assert.Equal(t, Route, action)
+	assert.Equal(t, Direct, route)
+}
+
+func TestCountryOnlyLookedUpWhenNeeded(t *testing.T) {
+	p, err := Parse([]byte(testPolicy))
+	require.NoError(t, err)
+	p.Decide(Destination{Host: "198.51.100.1", Port: 443, Country: func() string {
+		assert.Fail(t, "country looked up for destination outside of CIDR")
+		return ""
+	}})
+}
+
+func TestDefaultDeny(t *testing.T) {
+	p, err := Parse([]byte(`
+default: deny
+rules:
+  - action: allow
+    ports: [80, 443]
+`))
+	require.NoError(t, err)
+	action, _ := p.Decide(Destination{Host: "example.com", Port: 443})
+	assert.Equal(t, Allow, action)
+	action, _ = p.Decide(Destination{Host: "example.com", Port: 22})
+	assert.Equal(t, Deny, action)
+}
+
+func TestInvalidPolicies(t *testing.T) {
+	for _, policy := range []string{
+		"default: maybe",
+		"rules: [{action: block}]",
+		"rules: [{action: route}]",
+		"rules: [{action: deny, route: exit}]",
+		"rules: [{action: route, route: exit}]",
+		"upstreams: {direct: 'socks5://192.0.2.10:1080'}",
+		"rules: [{action: deny, cidrs: [not-a-cidr]}]",
+		"rules: [{action: deny, domains: ['[']}]",
+		"rules: {",
+	} {
+		_, err := Parse([]byte(policy))
+		assert.Error(t, err, policy)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "egress.yaml")
+	_, err := Load(filename)
+	assert.Error(t, err)
+
+	require.NoError(t, os.WriteFile(filename, []byte(testPolicy), 0644))
+	p, err := Load(filename)
+	require.NoError(t, err)
+	assert.Len(t, p.Rules, 5)
+}
+
+func TestParseAddr(t *testing.T) {
+	host, port := ParseAddr("example.com:8080", 80)
+	assert.Equal(t, "example.com", host)
+	assert.Equal(t, 8080, port)
+
+	host, port = ParseAddr("example.com", 80)
+	assert.Equal(t, "example.com", host)
+	assert.Equal(t, 80, port)
+
+	host, port = ParseAddr("[2001:db8::1]", 443)
+	assert.Equal(t, "2001:db8::1", host)
+	assert.Equal(t, 443, port)
+}
+
+func TestRoutes(t *testing.T) {
+	var routes Routes
+	a, b := &net.TCPConn{}, &net.TCPConn{}
+	routes.Set(a, "exit")
+	routes.Set(b, "other")
+	routes.Forget(b)
+	route, ok := routes.Take(a)
+	assert.True(t, ok)
+	assert.Equal(t, "exit", route)
+	_, ok = routes.Take(a)
+	assert.False(t, ok, "route should only be taken once")
+	_, ok = routes.Take(b)
+	assert.False(t, ok)
+}
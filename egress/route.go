@@ -0,0 +1,49 @@
+package egress
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+type routeKey struct{}
+
+// WithRoute returns a context that makes dials with it use the given route.
+func WithRoute(ctx context.Context, route string) context.Context {
+	return context.WithValue(ctx, routeKey{}, route)
+}
+
+// RouteFromContext returns the route set with WithRoute, if any.
+func RouteFromContext(ctx context.Context) (string, bool) {
+	route, ok := ctx.Value(routeKey{}).(string)
+	return route, ok
+}
+
+// Routes hands routes picked for CONNECT requests to the dialer. Plain HTTP
+// requests are dialed with their own context and can carry their route with
+// WithRoute, but CONNECT requests are dialed with the context of the
+// connection they arrived on, so their route is kept per downstream connection
+// until it's dialed.
+type Routes struct {
+	byConn sync.Map
+}
+
+// Set remembers the route for the next dial on behalf of downstream.
+func (r *Routes) Set(downstream net.Conn, route string) {
+	r.byConn.Store(downstream, route)
+}
+
+// Forget forgets the route set for downstream, for when it won't be dialed
+// after all.
+func (r *Routes) Forget(downstream net.Conn) {
+	r.byConn.Delete(downstream)
+}
+
+// Take returns and forgets the route set for downstream, if any.
+func (r *Routes) Take(downstream net.Conn) (string, bool) {
+	route, ok := r.byConn.LoadAndDelete(downstream)
+	if !ok {
+		return "", false
+	}
+	return route.(string), true
+}
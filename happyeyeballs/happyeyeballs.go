@@ -0,0 +1,230 @@
+// Package happyeyeballs dials hosts that have several addresses by racing
+// connection attempts to them, as described in RFC 8305 ("Happy Eyeballs
+// Version 2"), so that an unreachable address or address family only delays
+// connecting instead of failing it.
+//
+// Addresses are tried in the order of the preferred address family,
+// alternating between families. Each attempt gets a head start of
+// AttemptDelay before the next one starts, and a failed attempt immediately
+// makes way for the next. The first connection to succeed wins and the other
+// attempts are abandoned.
+package happyeyeballs
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/getlantern/errors"
+)
+
+// DefaultAttemptDelay is the default head start of each connection attempt,
+// as recommended by RFC 8305.
+const DefaultAttemptDelay = 250 * time.Millisecond
+
+// Preference configures which address family is tried first, or used at all.
+type Preference int
+
+const (
+	PreferIPv4 Preference = iota
+	PreferIPv6
+	IPv4Only
+	IPv6Only
+)
+
+// ParsePreference parses ipv4, ipv6, ipv4only or ipv6only. An empty string
+// means ipv4.
+func ParsePreference(s string) (Preference, error) {
+	switch s {
+	case "", "ipv4":
+		return PreferIPv4, nil
+	case "ipv6":
+		return PreferIPv6, nil
+	case "ipv4only":
+		return IPv4Only, nil
+	case "ipv6only":
+		return IPv6Only, nil
+	default:
+		return 0, errors.New("unknown IP preference %q, must be ipv4, ipv6, ipv4only or ipv6only", s)
+	}
+}
+
+// Resolver looks up the addresses of hosts.
+type Resolver interface {
+	LookupIP(ctx context.Context, host string) ([]net.IP, error)
+}
+
+type resolvedKey struct{}
+
+type resolved struct {
+	host string
+	ips  []net.IP
+}
+
+// WithResolved returns a context that makes dials of host with it use ips
+// instead of resolving host again, for addresses that were already resolved
+// and vetted and mustn't change by the time they're dialed.
+func WithResolved(ctx context.Context, host string, ips []net.IP) context.Context {
+	return context.WithValue(ctx, resolvedKey{}, &resolved{host: host, ips: ips})
+}
+
+// ResolvedFromContext returns the addresses set for host with WithResolved, if
+// any.
+func ResolvedFromContext(ctx context.Context, host string) ([]net.IP, bool) {
+	r, ok := ctx.Value(resolvedKey{}).(*resolved)
+	if !ok || !strings.EqualFold(r.host, host) {
+		return nil, false
+	}
+	return r.ips, true
+}
+
+// Dialer dials TCP addresses, resolving hostnames with Resolver.
+type Dialer struct {
+	Resolver   Resolver
+	Preference Preference
+
+	// AttemptDelay is how long to wait for a connection attempt before
+	// starting the next one. Defaults to DefaultAttemptDelay.
+	AttemptDelay time.Duration
+
+	// Timeout bounds the whole dial, including resolving. Zero means no
+	// timeout beyond the context's.
+	Timeout time.Duration
+
+	// dialAddr dials a single resolved address, overridden in tests.
+	dialAddr func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// DialContext connects to addr, which is host:port, on the tcp, tcp4 or tcp6
+// network. Hosts are resolved with Resolver unless ctx already carries their
+// addresses, see WithResolved.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, ok := ResolvedFromContext(ctx, host)
+	if !ok {
+		ips, err = d.Resolver.LookupIP(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+	}
+	addrs := d.sort(network, ips)
+	if len(addrs) == 0 {
+		return nil, errors.New("no usable addresses for %v among %v", host, ips)
+	}
+	for i, a := range addrs {
+		addrs[i] = net.JoinHostPort(a, port)
+	}
+	return d.race(ctx, network, addrs)
+}
+
+// sort filters ips down to the families allowed by network and the
+// preference and orders them for dialing, alternating between families
+// starting with the preferred one.
+func (d *Dialer) sort(network string, ips []net.IP) []string {
+	var v4, v6 []string
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip.String())
+		} else {
+			v6 = append(v6, ip.String())
+		}
+	}
+	if network == "tcp6" || d.Preference == IPv6Only {
+		v4 = nil
+	}
+	if network == "tcp4" || d.Preference == IPv4Only {
+		v6 = nil
+	}
+	primary, secondary := v4, v6
+	if d.Preference == PreferIPv6 || d.Preference == IPv6Only {
+		primary, secondary = v6, v4
+	}
+	sorted := make([]string, 0, len(primary)+len(secondary))
+	for i := 0; i < len(primary) || i < len(secondary); i++ {
+		if i < len(primary) {
+			sorted = append(sorted, primary[i])
+		}
+		if i < len(secondary) {
+			sorted = append(sorted, secondary[i])
+		}
+	}
+	return sorted
+}
+
+func (d *Dialer) race(ctx context.Context, network string, addrs []string) (net.Conn, error) {
+	dialAddr := d.dialAddr
+	if dialAddr == nil {
+		var nd net.Dialer
+		dialAddr = nd.DialContext
+	}
+	delay := d.AttemptDelay
+	if delay <= 0 {
+		delay = DefaultAttemptDelay
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(addrs))
+	next, pending := 0, 0
+	startNext := func() {
+		addr := addrs[next]
+		next++
+		pending++
+		go func() {
+			conn, err := dialAddr(ctx, network, addr)
+			results <- result{conn, err}
+		}()
+	}
+
+	startNext()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	var firstErr error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// close whatever the abandoned attempts still come up with
+				go func(pending int) {
+					for i := 0; i < pending; i++ {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(addrs) {
+				startNext()
+				timer.Reset(delay)
+			}
+		case <-timer.C:
+			if next < len(addrs) {
+				startNext()
+				timer.Reset(delay)
+			}
+		}
+	}
+	if len(addrs) == 1 {
+		return nil, firstErr
+	}
+	return nil, errors.New("unable to connect to any of %v: %v", addrs, firstErr)
+}
@@ -0,0 +1,185 @@
+package happyeyeballs
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type staticResolver []net.IP
+
+func (r staticResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	return r, nil
+}
+
+var dualStack = staticResolver{
+	net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"),
+	net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"),
+}
+
+// fakeNetwork simulates dialing addresses that either connect after a delay,
+// refuse connections immediately or never answer.
+type fakeNetwork struct {
+	connectAfter map[string]time.Duration
+	refused      map[string]bool
+	// stubborn addresses connect even if the attempt is canceled
+	stubborn map[string]bool
+
+	mx       sync.Mutex
+	attempts []string
+	closed   int
+}
+
+type fakeConn struct {
+	net.Conn
+	addr    string
+	network *fakeNetwork
+}
+
+func (c *fakeConn) Close() error {
+	c.network.mx.Lock()
+	c.network.closed++
+	c.network.mx.Unlock()
+	return nil
+}
+
+func (n *fakeNetwork) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	n.mx.Lock()
+	n.attempts = append(n.attempts, addr)
+	n.mx.Unlock()
+	if n.refused[addr] {
+		return nil, errors.New("connection refused")
+	}
+	delay, ok := n.connectAfter[addr]
+	if !ok {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if n.stubborn[addr] {
+		time.Sleep(delay)
+		return &fakeConn{addr: addr, network: n}, nil
+	}
+	select {
+	case <-time.After(delay):
+		return &fakeConn{addr: addr, network: n}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (n *fakeNetwork) dialed() []string {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+	return append([]string(nil), n.attempts...)
+}
+
+func TestSort(t *testing.T) {
+	d := &Dialer{}
+	assert.Equal(t, []string{"192.0.2.1", "2001:db8::1", "192.0.2.2", "2001:db8::2"}, d.sort("tcp", dualStack))
+	assert.Equal(t, []string{"192.0.2.1", "192.0.2.2"}, d.sort("tcp4", dualStack))
+	d.Preference = PreferIPv6
+	assert.Equal(t, []string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2"}, d.sort("tcp", dualStack))
+	assert.Equal(t, []string{"192.0.2.1", "192.0.2.2"}, d.sort("tcp4", dualStack))
+	d.Preference = IPv6Only
+	assert.Equal(t, []string{"2001:db8::1", "2001:db8::2"}, d.sort("tcp", dualStack))
+	assert.Empty(t, d.sort("tcp4", dualStack))
+	d.Preference = IPv4Only
+	assert.Equal(t, []string{"192.0.2.1", "192.0.2.2"}, d.sort("tcp", dualStack))
+}
+
+func TestDeadAddressOnlyDelays(t *testing.T) {
+	network := &fakeNetwork{connectAfter: map[string]time.Duration{
+		"[2001:db8::1]:443": 10 * time.Millisecond,
+		"192.0.2.2:443":     0,
+	}}
+	d := &Dialer{Resolver: dualStack, AttemptDelay: 50 * time.Millisecond, dialAddr: network.dial}
+	start := time.Now()
+	conn, err := d.DialContext(context.Background(), "tcp", "example.com:443")
+	require.NoError(t, err)
+	assert.Equal(t, "[2001:db8::1]:443", conn.(*fakeConn).addr)
+	elapsed := time.Since(start)
+	assert.GreaterOrEqual(t, elapsed, 50*time.Millisecond, "second attempt should have waited for the first one's head start")
+	assert.Less(t, elapsed, 1*time.Second)
+	assert.Equal(t, []string{"192.0.2.1:443", "[2001:db8::1]:443"}, network.dialed())
+}
+
+func TestRefusedAddressFailsOverImmediately(t *testing.T) {
+	network := &fakeNetwork{
+		refused:      map[string]bool{"192.0.2.1:443": true, "[2001:db8::1]:443": true},
+		connectAfter: map[string]time.Duration{"192.0.2.2:443": 0},
+	}
+	d := &Dialer{Resolver: dualStack, AttemptDelay: 10 * time.Second, dialAddr: network.dial}
+	start := time.Now()
+	conn, err := d.DialContext(context.Background(), "tcp", "example.com:443")
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.2:443", conn.(*fakeConn).addr)
+	assert.Less(t, time.Since(start), 1*time.Second)
+}
+
+func TestLosersAreClosed(t *testing.T) {
+	network := &fakeNetwork{
+		connectAfter: map[string]time.Duration{
+			"192.0.2.1:443":     50 * time.Millisecond,
+			"[2001:db8::1]:443": 0,
+		},
+		stubborn: map[string]bool{"192.0.2.1:443": true},
+	}
+	d := &Dialer{Resolver: dualStack, AttemptDelay: 10 * time.Millisecond, dialAddr: network.dial}
+	conn, err := d.DialContext(context.Background(), "tcp", "example.com:443")
+	require.NoError(t, err)
+	assert.Equal(t, "[2001:db8::1]:443", conn.(*fakeConn).addr)
+	// the first attempt connects too late and should be closed
+	time.Sleep(100 * time.Millisecond)
+	network.mx.Lock()
+	defer network.mx.Unlock()
+	assert.Equal(t, 1, network.closed)
+}
+
+func TestAllFail(t *testing.T) {
+	network := &fakeNetwork{}
+	d := &Dialer{Resolver: dualStack, AttemptDelay: 10 * time.Millisecond, Timeout: 100 * time.Millisecond, dialAddr: network.dial}
+	start := time.Now()
+	_, err := d.DialContext(context.Background(), "tcp", "example.com:443")
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 1*time.Second)
+	assert.Len(t, network.dialed(), 4)
+
+	d.Resolver = staticResolver{net.ParseIP("192.0.2.1")}
+	d.Preference = IPv6Only
+	_, err = d.DialContext(context.Background(), "tcp", "192.0.2.1:443")
+	assert.ErrorContains(t, err, "no usable addresses")
+}
+
+func TestResolved(t *testing.T) {
+	network := &fakeNetwork{
+		refused:      map[string]bool{"[2001:db8::9]:443": true},
+		connectAfter: map[string]time.Duration{"192.0.2.9:443": 0, "192.0.2.1:443": 0},
+	}
+	d := &Dialer{Resolver: dualStack, Preference: PreferIPv6, AttemptDelay: 10 * time.Second, dialAddr: network.dial}
+	ctx := WithResolved(context.Background(), "Example.com", []net.IP{net.ParseIP("192.0.2.9"), net.ParseIP("2001:db8::9")})
+	conn, err := d.DialContext(ctx, "tcp", "example.com:443")
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.9:443", conn.(*fakeConn).addr)
+	assert.Equal(t, []string{"[2001:db8::9]:443", "192.0.2.9:443"}, network.dialed())
+
+	// other hosts are still resolved
+	conn, err = d.DialContext(ctx, "tcp4", "other.example.com:443")
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.1:443", conn.(*fakeConn).addr)
+}
+
+func TestParsePreference(t *testing.T) {
+	for s, expected := range map[string]Preference{"": PreferIPv4, "ipv4": PreferIPv4, "ipv6": PreferIPv6, "ipv4only": IPv4Only, "ipv6only": IPv6Only} {
+		p, err := ParsePreference(s)
+		require.NoError(t, err)
+		assert.Equal(t, expected, p)
+	}
+	_, err := ParsePreference("ipv5")
+	assert.Error(t, err)
+}
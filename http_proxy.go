@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"crypto/tls"
@@ -15,6 +16,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/getlantern/cmux/v2"
@@ -36,6 +38,7 @@ import (
 	"github.com/getlantern/http-proxy-lantern/v2/starbridge"
 	"github.com/getlantern/http-proxy-lantern/v2/v2ray/vmess"
 
+	"github.com/Jigsaw-Code/outline-ss-server/service"
 	"github.com/xtaci/smux"
 
 	"github.com/getlantern/multipath"
@@ -51,22 +54,32 @@ import (
 	"github.com/getlantern/http-proxy-lantern/v2/proxyfilters"
 	"github.com/getlantern/http-proxy-lantern/v2/server"
 
+	"github.com/getlantern/http-proxy-lantern/v2/abuse"
 	"github.com/getlantern/http-proxy-lantern/v2/analytics"
 	"github.com/getlantern/http-proxy-lantern/v2/blacklist"
+	"github.com/getlantern/http-proxy-lantern/v2/budget"
+	"github.com/getlantern/http-proxy-lantern/v2/certmanager"
 	"github.com/getlantern/http-proxy-lantern/v2/cleanheadersfilter"
 	"github.com/getlantern/http-proxy-lantern/v2/devicefilter"
 	"github.com/getlantern/http-proxy-lantern/v2/diffserv"
 	"github.com/getlantern/http-proxy-lantern/v2/domains"
+	"github.com/getlantern/http-proxy-lantern/v2/egress"
 	"github.com/getlantern/http-proxy-lantern/v2/googlefilter"
+	"github.com/getlantern/http-proxy-lantern/v2/happyeyeballs"
 	"github.com/getlantern/http-proxy-lantern/v2/httpsupgrade"
 	"github.com/getlantern/http-proxy-lantern/v2/instrument"
 	"github.com/getlantern/http-proxy-lantern/v2/lampshade"
 	"github.com/getlantern/http-proxy-lantern/v2/mimic"
 	"github.com/getlantern/http-proxy-lantern/v2/obfs4listener"
 	"github.com/getlantern/http-proxy-lantern/v2/ping"
+	"github.com/getlantern/http-proxy-lantern/v2/resolver"
+	"github.com/getlantern/http-proxy-lantern/v2/sniff"
 	"github.com/getlantern/http-proxy-lantern/v2/tlslistener"
 	"github.com/getlantern/http-proxy-lantern/v2/tlsmasq"
 	"github.com/getlantern/http-proxy-lantern/v2/tokenfilter"
+	"github.com/getlantern/http-proxy-lantern/v2/udprelay"
+	"github.com/getlantern/http-proxy-lantern/v2/upgrade"
+	"github.com/getlantern/http-proxy-lantern/v2/upstream"
 	"github.com/getlantern/http-proxy-lantern/v2/wss"
 
 	algeneva "github.com/getlantern/lantern-algeneva"
@@ -92,6 +105,7 @@ var (
 // Proxy is an HTTP proxy.
 type Proxy struct {
 	TestingLocal                       bool
+	TestingListeners                   bool
 	HTTPAddr                           string
 	HTTPMultiplexAddr                  string
 	TracesSampleRate                   int
@@ -113,6 +127,8 @@ type Proxy struct {
 	ProxiedSitesSamplePercentage       float64
 	ProxiedSitesTrackingID             string
 	Token                              string
+	TokenVerifyKey                     string
+	Mimic                              string
 	TunnelPorts                        string
 	Obfs4Addr                          string
 	Obfs4MultiplexAddr                 string
@@ -132,6 +148,15 @@ type Proxy struct {
 	BlacklistMaxConnectInterval        time.Duration
 	BlacklistAllowedFailures           int
 	BlacklistExpiration                time.Duration
+	BlacklistEnforce                   bool
+	BlacklistAllow                     string
+	BlacklistDeny                      string
+	BlacklistFile                      string
+	EgressPolicyFile                   string
+	Upstream                           string
+	DNSServers                         string
+	DNSCacheSize                       int
+	OriginIPPreference                 string
 	ProxyName                          string
 	ProxyProtocol                      string
 	Provider                           string
@@ -162,6 +187,7 @@ type Proxy struct {
 	ShadowsocksSecret                  string
 	ShadowsocksCipher                  string
 	ShadowsocksReplayHistory           int
+	ShadowsocksKeysFile                string
 	StarbridgeAddr                     string
 	StarbridgePrivateKey               string
 	CountryLookup                      geo.CountryLookup
@@ -213,13 +239,114 @@ type Proxy struct {
 	VMessAddr  string
 	VMessUUIDs []string
 
+	// SniffAddr serves the transports in SniffTransports on one address,
+	// telling them apart by the first bytes clients send (see
+	// parseSniffTransports for the format).
+	SniffAddr       string
+	SniffTransports string
+
+	// SNICertificates are extra certificates for the TLS listeners, served to
+	// clients asking for server names they're valid for (see
+	// tlslistener.ParseCertificates). SNIPassthrough relays the connections
+	// for some server names to other backends instead, e.g. a real website
+	// for a decoy hostname (see tlslistener.ParsePassthrough).
+	SNICertificates string
+	SNIPassthrough  string
+
+	// ACMEHosts get their certificates from the ACME server at
+	// ACMEDirectoryURL, Let's Encrypt's if empty, cached in ACMECacheDir.
+	ACMEHosts        []string
+	ACMEDirectoryURL string
+	ACMEEmail        string
+	ACMECacheDir     string
+
+	// UDPRelay enables relaying UDP for shadowsocks and vmess clients, on the
+	// shadowsocks ports and inside vmess sessions respectively. Sessions are
+	// closed after UDPIdleTimeout without packets, or to make room once
+	// UDPMaxSessions are open, or UDPMaxClientSessions for one client IP.
+	UDPRelay             bool
+	UDPIdleTimeout       time.Duration
+	UDPMaxSessions       int
+	UDPMaxClientSessions int
+
 	// DatacapURL is the base URL of the local datacap sidecar. When set, byte
 	// accounting and data-cap throttling run through the sidecar.
 	DatacapURL            string
 	DatacapReportInterval time.Duration
+	// DatacapJournalFile, if set, is where usage the sidecar hasn't accepted
+	// yet is persisted across restarts. DatacapFailurePolicy is what happens
+	// to throttling while the sidecar is down, see datacap.FailurePolicy.
+	DatacapJournalFile   string
+	DatacapFailurePolicy string
+	// UploadLimits are the upload rates non-pro devices are held to by
+	// cohort, in Kbps, see datacap.ParseUploadLimits. UploadConnLimit is the
+	// most any one of their connections may upload, in bytes per second.
+	UploadLimits    string
+	UploadConnLimit int64
+
+	// FairShare shares the host's egress capacity fairly among active devices
+	// instead of holding each of them to DefaultThrottleRate. EgressCapacity
+	// is that capacity in bytes per second, measured if zero.
+	FairShare      bool
+	EgressCapacity int64
+
+	// BudgetQuota is how many bytes the host may transfer per billing cycle
+	// starting on BudgetCycleDay, disabled if zero. Past the BudgetSoft share
+	// of it the default rate is lowered, and past BudgetHard new non-pro
+	// sessions are refused. Usage is persisted in BudgetFile, if set.
+	BudgetQuota    int64
+	BudgetSoft     float64
+	BudgetHard     float64
+	BudgetCycleDay int
+	BudgetFile     string
+
+	// AbuseResponses are the harshest responses to each abusive traffic
+	// pattern, see abuse.ParseResponses, abuse detection being disabled if
+	// empty. AbusePenalty is how long a response lasts after the last
+	// detection.
+	AbuseResponses string
+	AbusePenalty   time.Duration
+
+	// AdminAddr is where to serve the local admin/status API, disabled if
+	// empty. See serveAdmin.
+	AdminAddr string
+
+	// DrainTimeout is how long to wait for active connections to finish once
+	// the context passed to ListenAndServe is done. Zero stops immediately.
+	DrainTimeout time.Duration
+
+	// Upgrader, if set, creates the proxy's listeners so that they can be
+	// handed over to a new binary, and is told when the proxy is ready.
+	Upgrader *upgrade.Upgrader
 
 	datacapTracker *datacap.Tracker
+	scheduler      *listeners.Scheduler
+	budget         *budget.Budget
+	abuse          *abuse.Detector
+	udpRelay       *udprelay.Relay
 	instrument     instrument.Instrument
+	resolver       *resolver.Resolver
+
+	// Filters that run goroutines of their own, created once by
+	// createSharedFilters and shared by the filter chains Reload builds.
+	pingFilter      filters.Filter
+	analyticsFilter filters.Filter
+
+	// State rebuilt or reconfigured by Reload. srv is only set once all
+	// listeners are up, and both it and the settings above are guarded by
+	// reloadMx from then on.
+	reloadMx    sync.Mutex
+	srv         *server.Server
+	blacklist   *blacklist.Blacklist
+	muxProtocol *reloadableProtocol
+	ssCiphers   service.CipherList
+	decoy       *reloadableMimic
+
+	// Reported by the admin API, populated while starting up.
+	activeListeners []activeListener
+	tlsListeners    []net.Listener
+	certs           *certmanager.Manager
+	sni             *tlslistener.SNIOptions
 }
 
 type listenerBuilderFN func(addr string) (net.Listener, error)
@@ -246,6 +373,15 @@ func (p *Proxy) ListenAndServe(ctx context.Context) error {
 		return errors.New("Unable to configure instrumentation: %v", err)
 	}
 
+	p.resolver, err = resolver.New(resolver.Options{
+		Servers:    p.dnsServers(),
+		CacheSize:  p.DNSCacheSize,
+		Instrument: p.instrument,
+	})
+	if err != nil {
+		return errors.New("Unable to configure DNS resolver: %v", err)
+	}
+
 	// Per-arm bandit callback emitter. New is cheap and safe to call
 	// with empty token/URL — Enabled() reports false in that case and
 	// createFilterChain skips appending the filter entirely, so a
@@ -254,33 +390,40 @@ func (p *Proxy) ListenAndServe(ctx context.Context) error {
 		p.BanditCallbackToken, p.BanditCallbackURL, p.BanditCallbackTTL,
 	)
 
+	if err := p.createSharedFilters(); err != nil {
+		return err
+	}
+
 	var onServerError func(conn net.Conn, err error)
 	if err := p.setupPacketForward(); err != nil {
 		log.Errorf("Unable to set up packet forwarding, will continue to start up: %v", err)
 	}
 	p.setBenchmarkMode()
-	p.loadDatacapTracker()
+	p.loadScheduler()
+	if err := p.loadDatacapTracker(); err != nil {
+		return err
+	}
+	if err := p.loadBudget(); err != nil {
+		return err
+	}
+	if err := p.loadAbuseDetector(); err != nil {
+		return err
+	}
 
 	if p.ENHTTPAddr != "" {
 		return p.ListenAndServeENHTTP()
 	}
 
 	// Only allow connections from remote IPs that are not blacklisted
-	blacklist := p.createBlacklist()
-	filterChain, dial, err := p.createFilterChain(blacklist)
+	p.blacklist, err = p.createBlacklist()
 	if err != nil {
 		return err
 	}
-
-	if p.WSSAddr != "" {
-		filterChain = filterChain.Append(wss.NewMiddleware())
-	}
-	filterChain = filterChain.Prepend(opsfilter.New())
-
-	instrumentedFilter, err := p.instrument.WrapFilter("proxy", filterChain)
+	instrumentedFilter, dial, err := p.buildFilter()
 	if err != nil {
-		return errors.New("unable to instrument filter: %v", err)
+		return err
 	}
+
 	instrumentedErrorHandler, err := p.instrument.WrapConnErrorHandler("proxy_serve", onServerError)
 	if err != nil {
 		return errors.New("unable to instrument error handler: %v", err)
@@ -292,7 +435,14 @@ func (p *Proxy) ListenAndServe(ctx context.Context) error {
 		OKDoesNotWaitForUpstream: !p.ConnectOKWaitsForUpstream,
 		OnError:                  instrumentedErrorHandler,
 		OnActive: func(conn net.Conn) {
-			clientIP := conn.RemoteAddr().(*net.TCPAddr).IP
+			// QUIC connections come from UDP addresses
+			var clientIP net.IP
+			switch addr := conn.RemoteAddr().(type) {
+			case *net.TCPAddr:
+				clientIP = addr.IP
+			case *net.UDPAddr:
+				clientIP = addr.IP
+			}
 			// count the connection only when a connection is established and becomes active
 			p.instrument.Connection(ctx, clientIP)
 		},
@@ -309,15 +459,39 @@ func (p *Proxy) ListenAndServe(ctx context.Context) error {
 	}
 	defer stopMetrics()
 
+	if p.budget != nil {
+		defer p.budget.Save()
+	}
+	if p.datacapTracker != nil {
+		defer p.datacapTracker.Close()
+	}
+
 	bwReporting := p.configureBandwidthReporting()
 	// Throttle connections when signaled
 	srv.AddListenerWrappers(listeners.NewBitrateListener, bwReporting.wrapper)
 
+	if p.UDPRelay {
+		p.udpRelay = udprelay.New(udprelay.Options{
+			IdleTimeout:       p.UDPIdleTimeout,
+			MaxSessions:       p.UDPMaxSessions,
+			MaxClientSessions: p.UDPMaxClientSessions,
+			AllowLocal:        p.TestingLocal,
+			AllowedLocalAddrs: p.allowedLocalAddrs(),
+			Resolver:          p.resolver,
+			Report:            bwReporting.reporter,
+			ReportInterval:    measuredReportingInterval,
+			Admit:             p.admitUDP,
+			Limiter:           p.udpLimiter,
+			Observe:           p.observeUDP,
+		})
+		defer p.udpRelay.Close()
+	}
+
 	// Add listeners for all protocols
 	allListeners := make([]net.Listener, 0)
 	listenerProtocols := make([]string, 0)
 
-	listenerArgs := getProtoListenersArgs(p)
+	listenerArgs := append(getProtoListenersArgs(p), getTestingProtoListenersArgs(p)...)
 	for _, args := range listenerArgs {
 		if args.addr == "" {
 			continue
@@ -329,9 +503,21 @@ func (p *Proxy) ListenAndServe(ctx context.Context) error {
 		}
 
 		listenerProtocols = append(listenerProtocols, args.protocol)
-		// Although we include blacklist functionality, it's currently only used to
-		// track potential blacklisting ad doesn't actually blacklist anyone.
-		allListeners = append(allListeners, listeners.NewAllowingListener(l, blacklist.OnConnect))
+		p.activeListeners = append(p.activeListeners, activeListener{args.protocol, l.Addr().String()})
+		// Unless BlacklistEnforce is set, the blacklist only tracks potential
+		// blacklisting and refuses nobody but explicitly denied IPs.
+		allListeners = append(allListeners, listeners.NewAllowingListener(l, p.blacklist.OnConnect))
+	}
+
+	// From here on, Reload can swap the filter chain into the running server.
+	p.reloadMx.Lock()
+	p.srv = srv
+	p.reloadMx.Unlock()
+
+	if p.AdminAddr != "" {
+		if err := p.serveAdmin(); err != nil {
+			return err
+		}
 	}
 
 	errCh := make(chan error, len(allListeners))
@@ -353,12 +539,33 @@ func (p *Proxy) ListenAndServe(ctx context.Context) error {
 			}()
 		}
 	}
+	if p.Upgrader != nil {
+		if err := p.Upgrader.Ready(); err != nil {
+			return err
+		}
+	}
 	select {
 	case err := <-errCh:
 		return err
 	case <-ctx.Done():
 		// this is an expected path for closing, no error
-		return err
+		p.drain(srv)
+		return nil
+	}
+}
+
+// drain stops accepting connections and gives active ones up to DrainTimeout
+// to finish, so that stopping or upgrading the proxy doesn't cut off
+// downloads and tunnels that are in flight.
+func (p *Proxy) drain(srv *server.Server) {
+	if p.DrainTimeout <= 0 {
+		return
+	}
+	log.Debugf("Draining connections for up to %v", p.DrainTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), p.DrainTimeout)
+	defer cancel()
+	if err := srv.Drain(ctx); err != nil {
+		log.Errorf("Unable to drain all connections: %v", err)
 	}
 }
 
@@ -368,11 +575,11 @@ func (p *Proxy) ListenAndServeENHTTP() error {
 		return errors.New("Unable to listen for encapsulated HTTP at %v: %v", p.ENHTTPAddr, err)
 	}
 	log.Debugf("Listening for encapsulated HTTP at %v", el.Addr())
-	instrumentedPingFilter, err := p.instrument.WrapFilter("proxy_http_ping", ping.New(0))
+	tokenFilter, err := p.createTokenFilter()
 	if err != nil {
-		return errors.New("unable to instrument ping filter: %v", err)
+		return err
 	}
-	filterChain := filters.Join(tokenfilter.New(p.Token, p.instrument), instrumentedPingFilter)
+	filterChain := filters.Join(tokenFilter, p.pingFilter)
 	enhttpHandler := enhttp.NewServerHandler(p.ENHTTPReapIdleTime, p.ENHTTPServerURL)
 	instrumentedProxyFilter, err := p.instrument.WrapFilter("proxy", filterChain)
 	if err != nil {
@@ -392,13 +599,24 @@ func (p *Proxy) wrapTLSIfNecessary(fn listenerBuilderFN) listenerBuilderFN {
 		}
 
 		if p.HTTPS {
+			var certs *certmanager.Manager
+			certs, err = p.certManager(l.Addr().String())
+			if err != nil {
+				return nil, err
+			}
+			var sni *tlslistener.SNIOptions
+			sni, err = p.sniOptions(certs)
+			if err != nil {
+				return nil, err
+			}
 			l, err = tlslistener.Wrap(
-				l, p.KeyFile, p.CertFile, p.SessionTicketKeyFile, p.FirstSessionTicketKey, p.SessionTicketKeys,
+				l, certs, p.SessionTicketKeyFile, p.FirstSessionTicketKey, p.SessionTicketKeys,
 				p.RequireSessionTickets, p.MissingTicketReaction, p.TLSListenerAllowTLS13,
-				p.instrument)
+				p.instrument, sni)
 			if err != nil {
 				return nil, err
 			}
+			p.tlsListeners = append(p.tlsListeners, l)
 
 			log.Debugf("Using TLS on %v", l.Addr())
 		}
@@ -407,6 +625,55 @@ func (p *Proxy) wrapTLSIfNecessary(fn listenerBuilderFN) listenerBuilderFN {
 	}
 }
 
+// certManager returns the certificate manager shared by all listeners on
+// TLS, creating it on first use, with a self-signed certificate for the host
+// of addr if there's none yet.
+func (p *Proxy) certManager(addr string) (*certmanager.Manager, error) {
+	if p.certs != nil {
+		return p.certs, nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, errors.New("unable to split host and port for %v: %v", addr, err)
+	}
+	certs, err := certmanager.New(certmanager.Options{
+		CertFile:         p.CertFile,
+		KeyFile:          p.KeyFile,
+		Host:             host,
+		ACMEHosts:        p.ACMEHosts,
+		ACMEDirectoryURL: p.ACMEDirectoryURL,
+		ACMEEmail:        p.ACMEEmail,
+		ACMECacheDir:     p.ACMECacheDir,
+	})
+	if err != nil {
+		return nil, errors.New("unable to load certificates: %v", err)
+	}
+	p.certs = certs
+	return certs, nil
+}
+
+// sniOptions returns the per server name options shared by all TLS
+// listeners, building them on first use.
+func (p *Proxy) sniOptions(certs *certmanager.Manager) (*tlslistener.SNIOptions, error) {
+	if p.sni != nil {
+		return p.sni, nil
+	}
+	sniCerts, err := tlslistener.ParseCertificates(p.SNICertificates)
+	if err != nil {
+		return nil, errors.New("unable to load SNI certificates: %v", err)
+	}
+	passthrough, err := tlslistener.ParsePassthrough(p.SNIPassthrough)
+	if err != nil {
+		return nil, errors.New("unable to parse SNI passthrough: %v", err)
+	}
+	p.sni = &tlslistener.SNIOptions{
+		Certificates:   sniCerts,
+		ACMEChallenges: len(certs.ACMEHosts()) > 0,
+		Passthrough:    passthrough,
+	}
+	return p.sni, nil
+}
+
 func (p *Proxy) wrapMultiplexing(fn listenerBuilderFN) listenerBuilderFN {
 	return func(addr string) (net.Listener, error) {
 		l, err := fn(addr)
@@ -414,15 +681,7 @@ func (p *Proxy) wrapMultiplexing(fn listenerBuilderFN) listenerBuilderFN {
 			return nil, err
 		}
 
-		var proto cmux.Protocol
-		// smux is the default, but can be explicitly specified also
-		if p.MultiplexProtocol == "" || p.MultiplexProtocol == "smux" {
-			proto, err = p.buildSmuxProtocol()
-		} else if p.MultiplexProtocol == "psmux" {
-			proto, err = p.buildPsmuxProtocol()
-		} else {
-			err = errors.New("unknown multiplex protocol: %v", p.MultiplexProtocol)
-		}
+		proto, err := p.multiplexProtocol()
 		if err != nil {
 			return nil, err
 		}
@@ -437,6 +696,31 @@ func (p *Proxy) wrapMultiplexing(fn listenerBuilderFN) listenerBuilderFN {
 	}
 }
 
+// multiplexProtocol returns the cmux.Protocol shared by all multiplexed
+// listeners, building it on first use. Reload swaps its configuration in place.
+func (p *Proxy) multiplexProtocol() (cmux.Protocol, error) {
+	if p.muxProtocol == nil {
+		proto, err := p.buildMultiplexProtocol()
+		if err != nil {
+			return nil, err
+		}
+		p.muxProtocol = newReloadableProtocol(proto)
+	}
+	return p.muxProtocol, nil
+}
+
+func (p *Proxy) buildMultiplexProtocol() (cmux.Protocol, error) {
+	// smux is the default, but can be explicitly specified also
+	switch p.MultiplexProtocol {
+	case "", "smux":
+		return p.buildSmuxProtocol()
+	case "psmux":
+		return p.buildPsmuxProtocol()
+	default:
+		return nil, errors.New("unknown multiplex protocol: %v", p.MultiplexProtocol)
+	}
+}
+
 func (p *Proxy) buildSmuxProtocol() (cmux.Protocol, error) {
 	config := smux.DefaultConfig()
 	if p.SmuxVersion > 0 {
@@ -511,18 +795,100 @@ func (p *Proxy) setBenchmarkMode() {
 	}
 }
 
-func (p *Proxy) createBlacklist() *blacklist.Blacklist {
-	return blacklist.New(blacklist.Options{
+func (p *Proxy) createBlacklist() (*blacklist.Blacklist, error) {
+	opts, err := p.blacklistOptions()
+	if err != nil {
+		return nil, err
+	}
+	return blacklist.New(opts), nil
+}
+
+func (p *Proxy) blacklistOptions() (blacklist.Options, error) {
+	allow, err := blacklist.ParseNetworks(p.BlacklistAllow)
+	if err != nil {
+		return blacklist.Options{}, errors.New("invalid blacklist allow list: %v", err)
+	}
+	deny, err := blacklist.ParseNetworks(p.BlacklistDeny)
+	if err != nil {
+		return blacklist.Options{}, errors.New("invalid blacklist deny list: %v", err)
+	}
+	return blacklist.Options{
 		MaxIdleTime:        p.BlacklistMaxIdleTime,        // 30 * time.Second,
 		MaxConnectInterval: p.BlacklistMaxConnectInterval, // 5 * time.Second,
 		AllowedFailures:    p.BlacklistAllowedFailures,    // 10,
 		Expiration:         p.BlacklistExpiration,         // 6 * time.Hour,
-	})
+		Enforce:            p.BlacklistEnforce,
+		Allow:              allow,
+		Deny:               deny,
+		File:               p.BlacklistFile,
+	}, nil
+}
+
+// buildFilter creates the instrumented filter chain and dial function the
+// server proxies with. It runs once at startup and again on every Reload.
+func (p *Proxy) buildFilter() (filters.Filter, proxy.DialFunc, error) {
+	filterChain, dial, err := p.createFilterChain(p.blacklist)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if p.WSSAddr != "" {
+		filterChain = filterChain.Append(wss.NewMiddleware())
+	}
+	filterChain = filterChain.Prepend(opsfilter.New())
+
+	instrumentedFilter, err := p.instrument.WrapFilter("proxy", filterChain)
+	if err != nil {
+		return nil, nil, errors.New("unable to instrument filter: %v", err)
+	}
+	return instrumentedFilter, dial, nil
+}
+
+// createSharedFilters creates the filters that run goroutines of their own,
+// and the decoy web server, once rather than on every Reload. Changes to the
+// proxied sites tracking settings therefore only take effect on restart.
+func (p *Proxy) createSharedFilters() error {
+	var err error
+	p.pingFilter, err = p.instrument.WrapFilter("proxy_http_ping", ping.New(0))
+	if err != nil {
+		return errors.New("unable to instrument proxy ping filter: %v", err)
+	}
+	if p.ProxiedSitesSamplePercentage > 0 && p.ProxiedSitesTrackingID != "" {
+		log.Debugf("Tracking proxied sites in Google Analytics")
+		p.analyticsFilter = analytics.New(&analytics.Options{
+			TrackingID:       p.ProxiedSitesTrackingID,
+			SamplePercentage: p.ProxiedSitesSamplePercentage,
+		})
+	} else {
+		log.Debugf("Not tracking proxied sites in Google Analytics")
+	}
+	decoy, err := mimic.Parse(p.Mimic)
+	if err != nil {
+		return err
+	}
+	p.decoy = newReloadableMimic(decoy)
+	return nil
+}
+
+// createTokenFilter creates the filter that authenticates clients with the
+// tokens in p.Token (see tokenfilter.ParseTokens for the format) or with
+// signed tokens verified with p.TokenVerifyKey, showing everyone else the
+// decoy web server configured by p.Mimic (see mimic.Parse).
+func (p *Proxy) createTokenFilter() (filters.Filter, error) {
+	tokens, err := tokenfilter.ParseTokens(p.Token)
+	if err != nil {
+		return nil, errors.New("invalid token: %v", err)
+	}
+	verifier, err := tokenfilter.ParseVerifier(p.TokenVerifyKey)
+	if err != nil {
+		return nil, errors.New("invalid token verification key: %v", err)
+	}
+	return tokenfilter.New(tokens, verifier, p.decoy, p.instrument), nil
 }
 
 // createFilterChain creates a chain of filters that modify the default behavior
 // of proxy.Proxy to implement Lantern-specific logic like authentication,
-// Apache mimicry, bandwidth throttling, BBR metric reporting, etc. The actual
+// web server mimicry, bandwidth throttling, BBR metric reporting, etc. The actual
 // work of proxying plain HTTP and CONNECT requests is handled by proxy.Proxy
 // itself.
 func (p *Proxy) createFilterChain(bl *blacklist.Blacklist) (filters.Chain, proxy.DialFunc, error) {
@@ -538,7 +904,11 @@ func (p *Proxy) createFilterChain(bl *blacklist.Blacklist) (filters.Chain, proxy
 			"ping-chained-server": 1 * time.Nanosecond, // Internal ping-chained-server protocol
 		}))
 	} else {
-		filterChain = filterChain.Append(proxy.OnFirstOnly(tokenfilter.New(p.Token, p.instrument)))
+		tokenFilter, err := p.createTokenFilter()
+		if err != nil {
+			return nil, nil, err
+		}
+		filterChain = filterChain.Append(proxy.OnFirstOnly(tokenFilter))
 	}
 
 	// Per-arm bandit callback emitter. Appended only when the
@@ -560,6 +930,10 @@ func (p *Proxy) createFilterChain(bl *blacklist.Blacklist) (filters.Chain, proxy
 		)
 	}
 
+	if p.budget != nil && !p.Pro {
+		filterChain = filterChain.Append(proxy.OnFirstOnly(budget.NewFilter(p.budget, p.instrument)))
+	}
+
 	if p.datacapTracker != nil {
 		filterChain = filterChain.Append(
 			proxy.OnFirstOnly(devicefilter.NewDatacapPre(p.datacapTracker, !p.Pro, p.instrument)),
@@ -567,54 +941,94 @@ func (p *Proxy) createFilterChain(bl *blacklist.Blacklist) (filters.Chain, proxy
 	} else {
 		log.Debug("Not enabling bandwidth limiting")
 	}
+	if p.scheduler != nil {
+		filterChain = filterChain.Append(proxy.OnFirstOnly(devicefilter.NewSchedule(p.scheduler)))
+	}
+	// Every request rather than only the first, so that an offender's
+	// persistent connections are blocked as soon as it's detected.
+	recordOp := proxyfilters.RecordOp
+	if p.abuse != nil {
+		filterChain = filterChain.Append(abuse.NewFilter(p.abuse, p.instrument))
+		recordOp = proxyfilters.RecordOpObserved(p.abuse.ObserveOp)
+	}
 
 	filterChain = filterChain.Append(
 		proxy.OnFirstOnly(googlefilter.New(p.GoogleSearchRegex, p.GoogleCaptchaRegex)),
 	)
-	if p.ProxiedSitesSamplePercentage > 0 && p.ProxiedSitesTrackingID != "" {
-		log.Debugf("Tracking proxied sites in Google Analytics")
-		filterChain = filterChain.Append(analytics.New(&analytics.Options{
-			TrackingID:       p.ProxiedSitesTrackingID,
-			SamplePercentage: p.ProxiedSitesSamplePercentage,
-		}),
-		)
-	} else {
-		log.Debugf("Not tracking proxied sites in Google Analytics")
+	if p.analyticsFilter != nil {
+		filterChain = filterChain.Append(p.analyticsFilter)
 	}
 	filterChain = filterChain.Append(proxy.OnFirstOnly(devicefilter.NewPost(bl)))
 
+	vetted := &proxyfilters.VettedAddrs{}
 	if !p.TestingLocal {
-		allowedLocalAddrs := []string{"127.0.0.1:7300"}
-		if p.PacketForwardAddr != "" {
-			allowedLocalAddrs = append(allowedLocalAddrs, p.PacketForwardAddr)
+		filterChain = filterChain.Append(proxyfilters.BlockLocal(p.allowedLocalAddrs(), p.resolver, vetted))
+	}
+	filterChain = filterChain.Append(p.pingFilter)
+
+	var egressPolicy *egress.Policy
+	if p.EgressPolicyFile != "" {
+		var err error
+		egressPolicy, err = egress.Load(p.EgressPolicyFile)
+		if err != nil {
+			return nil, nil, err
 		}
-		allowedLocalAddrs = append(allowedLocalAddrs, p.legacyAPIHostExceptions()...)
-		filterChain = filterChain.Append(proxyfilters.BlockLocal(allowedLocalAddrs, &proxyfilters.Resolver{}))
 	}
-	instrumentedProxyPingFilter, err := p.instrument.WrapFilter("proxy_http_ping", ping.New(0))
+	routes := &egress.Routes{}
+	if egressPolicy != nil {
+		filterChain = filterChain.Append(proxyfilters.EgressPolicy(egressPolicy, routes, p.CountryLookup))
+	}
+
+	tunnelPorts, err := p.allowedTunnelPorts()
 	if err != nil {
-		return nil, nil, errors.New("unable to instrument proxy ping filter: %v", err)
+		return nil, nil, errors.New("unable to parse tunnel ports %q: %v", p.TunnelPorts, err)
 	}
-	filterChain = filterChain.Append(instrumentedProxyPingFilter)
 
-	dialer := func(ctx context.Context, network, addr string) (net.Conn, error) {
-		// resolve separately so that we can track the DNS resolution time
-		resolvedAddr, resolveErr := net.ResolveTCPAddr(network, addr)
-		if resolveErr != nil {
-			return nil, resolveErr
-		}
+	ipPreference, err := happyeyeballs.ParsePreference(p.OriginIPPreference)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Resolving with p.resolver caches and times lookups, and racing the
+	// resolved addresses keeps a single dead one from failing the dial.
+	originDialer := &happyeyeballs.Dialer{
+		Resolver:   p.resolver,
+		Preference: ipPreference,
+		Timeout:    timeoutToDialOriginSite,
+	}
+	dialer := originDialer.DialContext
+	dialerForPforward := dialer
 
-		d := net.Dialer{
-			Deadline: time.Now().Add(timeoutToDialOriginSite),
+	// Upstream proxies are reached directly. The timeout covers the handshake
+	// with the upstream too.
+	viaUpstream := func(proxyURL string) (upstream.DialFunc, error) {
+		dialUpstream, err := upstream.New(proxyURL, dialer)
+		if err != nil {
+			return nil, err
 		}
-		conn, dialErr := d.DialContext(ctx, network, resolvedAddr.String())
-		if dialErr != nil {
-			return nil, dialErr
+		return func(ctx context.Context, network, addr string) (net.Conn, error) {
+			ctx, cancel := context.WithTimeout(ctx, timeoutToDialOriginSite)
+			defer cancel()
+			return dialUpstream(ctx, network, addr)
+		}, nil
+	}
+	routeDialers := map[string]upstream.DialFunc{
+		egress.Direct: dialer,
+	}
+	if egressPolicy != nil {
+		for route, proxyURL := range egressPolicy.Upstreams {
+			routeDialers[route], err = viaUpstream(proxyURL)
+			if err != nil {
+				return nil, nil, errors.New("invalid upstream %v in egress policy: %v", route, err)
+			}
 		}
-
-		return conn, nil
 	}
-	dialerForPforward := dialer
+	if p.Upstream != "" {
+		dialer, err = viaUpstream(p.Upstream)
+		if err != nil {
+			return nil, nil, errors.New("invalid upstream: %v", err)
+		}
+		dialerForPforward = dialer
+	}
 
 	filterChain = filterChain.Append(
 		proxyfilters.DiscardInitialPersistentRequest,
@@ -626,12 +1040,24 @@ func (p *Proxy) createFilterChain(bl *blacklist.Blacklist) (filters.Chain, proxy
 			return next(cs, req)
 		}),
 		httpsupgrade.NewHTTPSUpgrade(p.CfgSvrAuthToken),
-		proxyfilters.RestrictConnectPorts(p.allowedTunnelPorts()),
-		proxyfilters.RecordOp,
+		proxyfilters.RestrictConnectPorts(tunnelPorts),
+		recordOp,
 		cleanheadersfilter.New(), // IMPORTANT, this should be the last filter in the chain to avoid stripping any headers that other filters might need
 	)
 
 	return filterChain, func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+		route, ok := egress.RouteFromContext(ctx)
+		if isCONNECT {
+			if downstream := server.DownstreamFromContext(ctx); downstream != nil {
+				ctx = vetted.Take(ctx, downstream)
+				if !ok {
+					route, ok = routes.Take(downstream)
+				}
+			}
+		}
+		if ok {
+			return routeDialers[route](ctx, network, addr)
+		}
 		if isCONNECT {
 			return dialer(ctx, network, addr)
 		}
@@ -726,23 +1152,206 @@ func (p *Proxy) buildOTELOpts(includeProxyName bool) *otel.Opts {
 }
 
 func (p *Proxy) configureBandwidthReporting() *reportingConfig {
-	return newReportingConfig(p.instrument, p.datacapTracker)
+	return newReportingConfig(p.instrument, p.datacapTracker, p.budget)
+}
+
+// loadScheduler starts the egress scheduler if FairShare is set. It must run
+// before loadDatacapTracker, which no longer imposes a flat rate once there's
+// a scheduler.
+func (p *Proxy) loadScheduler() {
+	if !p.FairShare {
+		return
+	}
+	p.scheduler = listeners.NewScheduler(p.EgressCapacity)
+	if p.EgressCapacity > 0 {
+		log.Debugf("Sharing %d bytes per second of egress capacity fairly among devices", p.EgressCapacity)
+	} else {
+		log.Debug("Sharing the measured egress capacity fairly among devices")
+	}
 }
 
 // loadDatacapTracker starts the sidecar-backed accounting pipeline. Pro tracks
 // are gated server-side — the provisioner simply omits DatacapURL from their
 // config — so an unset URL is the normal case there, not a misconfiguration.
-func (p *Proxy) loadDatacapTracker() {
+func (p *Proxy) loadDatacapTracker() error {
 	if p.Pro || p.DatacapURL == "" {
-		return
+		return nil
+	}
+	failurePolicy, err := datacap.ParseFailurePolicy(p.DatacapFailurePolicy)
+	if err != nil {
+		return errors.New("unable to report to the datacap sidecar: %v", err)
+	}
+	uploadLimits, err := p.uploadLimits()
+	if err != nil {
+		return err
+	}
+	defaultRate := devicefilter.DefaultThrottleRate
+	if p.scheduler != nil {
+		// the scheduler decides how fast devices go until they're capped
+		defaultRate = 0
 	}
 	p.datacapTracker = datacap.NewTracker(datacap.TrackerOpts{
 		Client:         datacap.NewClient(p.DatacapURL, datacap.DefaultHTTPTimeout),
 		CountryLookup:  p.CountryLookup,
-		DefaultRate:    devicefilter.DefaultThrottleRate,
+		DefaultRate:    defaultRate,
 		ReportInterval: p.DatacapReportInterval,
+		JournalFile:    p.DatacapJournalFile,
+		FailurePolicy:  failurePolicy,
+		UploadLimits:   uploadLimits,
+		OnVerdictAge: func(age time.Duration) {
+			p.instrument.DatacapVerdictAge(context.Background(), age)
+		},
+	})
+	tracker := p.datacapTracker
+	p.instrument.ObserveDatacap(func() (pendingBytes int64, maxStaleness float64, staleDevices int, breakerOpen bool) {
+		h := tracker.Health()
+		return h.PendingBytes, h.MaxStalenessSeconds, h.StaleDevices, h.Breaker != datacap.BreakerClosed
 	})
 	log.Debugf("Reporting bandwidth usage to the datacap sidecar at %v", p.DatacapURL)
+	return nil
+}
+
+func (p *Proxy) uploadLimits() (datacap.UploadLimits, error) {
+	limits, err := datacap.ParseUploadLimits(p.UploadLimits, p.UploadConnLimit)
+	if err != nil {
+		return limits, errors.New("unable to parse upload limits: %v", err)
+	}
+	return limits, nil
+}
+
+// budgetOptions are the options the bandwidth budget is created or
+// reconfigured with.
+func (p *Proxy) budgetOptions() budget.Options {
+	return budget.Options{
+		Quota:        p.BudgetQuota,
+		Soft:         p.BudgetSoft,
+		Hard:         p.BudgetHard,
+		CycleDay:     p.BudgetCycleDay,
+		File:         p.BudgetFile,
+		OnRateFactor: p.applyBudgetRate,
+	}
+}
+
+// loadBudget starts tracking the host's bandwidth budget if it has a quota.
+// It must run after loadDatacapTracker, as it lowers the default rate of the
+// tracker's limiters.
+func (p *Proxy) loadBudget() error {
+	if p.BudgetQuota <= 0 {
+		return nil
+	}
+	b, err := budget.New(p.budgetOptions())
+	if err != nil {
+		return errors.New("unable to track bandwidth budget: %v", err)
+	}
+	p.budget = b
+	p.instrument.ObserveBudget(func() (used, quota int64, projected float64) {
+		st := b.Status()
+		return st.Used, st.Quota, st.Projected
+	})
+	log.Debugf("Tracking a bandwidth budget of %d bytes per billing cycle", p.BudgetQuota)
+	return nil
+}
+
+// applyBudgetRate lowers the default rate devices are held to by factor as
+// the host runs through its bandwidth budget. With fair-share, devices only
+// get a default rate at all once the budget is running low.
+func (p *Proxy) applyBudgetRate(factor float64) {
+	if p.datacapTracker == nil {
+		return
+	}
+	rate := int64(float64(devicefilter.DefaultThrottleRate) * factor)
+	if factor == 1 && p.scheduler != nil {
+		rate = 0
+	}
+	p.datacapTracker.SetDefaultRate(rate)
+}
+
+// abuseOptions are the options the abuse detector is created or reconfigured
+// with.
+func (p *Proxy) abuseOptions() (abuse.Options, error) {
+	responses, err := abuse.ParseResponses(p.AbuseResponses)
+	if err != nil {
+		return abuse.Options{}, errors.New("unable to parse abuse responses: %v", err)
+	}
+	return abuse.Options{Responses: responses, Penalty: p.AbusePenalty}, nil
+}
+
+// loadAbuseDetector starts detecting abusive traffic patterns if any pattern
+// has a response.
+func (p *Proxy) loadAbuseDetector() error {
+	opts, err := p.abuseOptions()
+	if err != nil {
+		return err
+	}
+	if len(opts.Responses) == 0 {
+		return nil
+	}
+	p.abuse, err = abuse.New(opts, p.instrument)
+	if err != nil {
+		return errors.New("unable to detect abuse: %v", err)
+	}
+	log.Debugf("Detecting abusive traffic with responses %v", p.AbuseResponses)
+	return nil
+}
+
+// admitUDP vets a UDP client before a session is opened for it, the way the
+// blacklisting listener and the budget and abuse filters vet connections. UDP
+// clients carry no token to vouch for them, so they're never taken for pro.
+func (p *Proxy) admitUDP(ctx map[string]interface{}) error {
+	deviceID, _ := ctx[common.DeviceID].(string)
+	clientIP, _ := ctx[common.ClientIP].(string)
+	if !p.blacklist.OnConnect(clientIP) {
+		return errors.New("%v is blacklisted", clientIP)
+	}
+	// Clients only get this far with packets that authenticated.
+	p.blacklist.Succeed(clientIP)
+	if p.budget != nil && !p.Pro && p.budget.Exhausted() {
+		p.instrument.BudgetRefused(context.Background())
+		return errors.New("bandwidth budget exhausted")
+	}
+	if p.abuse != nil && p.abuse.Response(deviceID, clientIP) == abuse.Block {
+		p.instrument.AbuseEnforced(context.Background(), abuse.Block.String())
+		return errors.New("blocked for abuse")
+	}
+	return nil
+}
+
+// udpLimiter returns the limiter a UDP session is held to: the abuse
+// detector's for throttled offenders and otherwise the device's datacap
+// limiter, like the filter chain attaches to connections. Sessions without a
+// device, like those of vmess, aren't accounted to one, so they have no
+// datacap limiter.
+func (p *Proxy) udpLimiter(ctx map[string]interface{}) *listeners.RateLimiter {
+	deviceID, _ := ctx[common.DeviceID].(string)
+	clientIP, _ := ctx[common.ClientIP].(string)
+	if p.abuse != nil && p.abuse.Response(deviceID, clientIP) == abuse.Throttle {
+		p.instrument.AbuseEnforced(context.Background(), abuse.Throttle.String())
+		return p.abuse.Limiter()
+	}
+	if p.datacapTracker != nil && deviceID != "" {
+		limiter, _, _ := p.datacapTracker.LimiterAndUsage(deviceID)
+		return limiter
+	}
+	return nil
+}
+
+// observeUDP counts the destinations of UDP sessions towards abuse detection.
+func (p *Proxy) observeUDP(ctx map[string]interface{}, host string, port int) {
+	if p.abuse == nil {
+		return
+	}
+	deviceID, _ := ctx[common.DeviceID].(string)
+	clientIP, _ := ctx[common.ClientIP].(string)
+	p.abuse.Observe(abuse.Event{DeviceID: deviceID, ClientIP: clientIP, Host: host, Port: port})
+}
+
+// allowedLocalAddrs are the local addresses clients may still reach.
+func (p *Proxy) allowedLocalAddrs() []string {
+	allowedLocalAddrs := []string{"127.0.0.1:7300"}
+	if p.PacketForwardAddr != "" {
+		allowedLocalAddrs = append(allowedLocalAddrs, p.PacketForwardAddr)
+	}
+	return append(allowedLocalAddrs, p.legacyAPIHostExceptions()...)
 }
 
 func (p *Proxy) legacyAPIHostExceptions() []string {
@@ -770,16 +1379,23 @@ func (p *Proxy) legacyAPIHostExceptions() []string {
 	return hosts
 }
 
-func (p *Proxy) allowedTunnelPorts() []int {
+// dnsServers parses the comma-separated DNSServers.
+func (p *Proxy) dnsServers() []string {
+	var servers []string
+	for _, s := range strings.Split(p.DNSServers, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			servers = append(servers, s)
+		}
+	}
+	return servers
+}
+
+func (p *Proxy) allowedTunnelPorts() ([]int, error) {
 	if p.TunnelPorts == "" {
 		log.Debug("tunnelling all ports")
-		return nil
+		return nil, nil
 	}
-	ports, err := portsFromCSV(p.TunnelPorts)
-	if err != nil {
-		log.Fatal(err)
-	}
-	return ports
+	return portsFromCSV(p.TunnelPorts)
 }
 
 func (p *Proxy) listenHTTP(baseListen func(string) (net.Listener, error)) listenerBuilderFN {
@@ -851,8 +1467,24 @@ func (p *Proxy) listenTLSMasq(baseListen func(string) (net.Listener, error)) lis
 	}
 }
 
+// listen is like net.Listen but goes through the Upgrader, if any, so that
+// the listener survives upgrades.
+func (p *Proxy) listen(network, addr string) (net.Listener, error) {
+	if p.Upgrader != nil {
+		return p.Upgrader.Listen(network, addr)
+	}
+	return net.Listen(network, addr)
+}
+
+func (p *Proxy) listenPacket(network, addr string) (net.PacketConn, error) {
+	if p.Upgrader != nil {
+		return p.Upgrader.ListenPacket(network, addr)
+	}
+	return net.ListenPacket(network, addr)
+}
+
 func (p *Proxy) listenTCP(addr string) (net.Listener, error) {
-	l, err := net.Listen("tcp", addr)
+	l, err := p.listen("tcp", addr)
 	if err != nil {
 		return nil, err
 	}
@@ -893,71 +1525,164 @@ func (p *Proxy) listenKCP(kcpConf string) (net.Listener, error) {
 }
 
 func (p *Proxy) listenQUICIETF(addr string) (net.Listener, error) {
-	tlsConf, err := tlsdefaults.BuildListenerConfig(addr, p.KeyFile, p.CertFile)
+	certs, err := p.certManager(addr)
 	if err != nil {
 		return nil, err
 	}
+	tlsConf := tlsdefaults.Server()
+	tlsConf.GetCertificate = certs.GetCertificate
 
 	config := &quicwrapper.Config{
 		MaxIncomingStreams:      1000,
 		DisablePathMTUDiscovery: true,
 	}
 
-	l, err := quicwrapper.ListenAddr(p.QUICIETFAddr, tlsConf, config)
-	if err != nil {
-		return nil, err
+	var l net.Listener
+	if p.Upgrader != nil {
+		pc, err := p.Upgrader.ListenPacket("udp", p.QUICIETFAddr)
+		if err != nil {
+			return nil, err
+		}
+		l, err = quicwrapper.Listen(pc, tlsConf, config)
+		if err != nil {
+			pc.Close()
+			return nil, err
+		}
+		// quicwrapper leaves closing the packet conn to us
+		l = &packetConnListener{l, pc}
+	} else {
+		l, err = quicwrapper.ListenAddr(p.QUICIETFAddr, tlsConf, config)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	log.Debugf("Listening for quic at %v", l.Addr())
 	return l, err
 }
 
-func (p *Proxy) listenShadowsocks(addr string) (net.Listener, error) {
-	// This is not using p.ListenTCP on purpose to avoid additional wrapping with idle timing.
-	// The idea here is to be as close to what outline shadowsocks does without any intervention,
-	// especially with respect to draining connections and the timing of closures.
+// packetConnListener is a listener on top of a net.PacketConn that it closes
+// along with itself.
+type packetConnListener struct {
+	net.Listener
+	pc net.PacketConn
+}
 
-	configs := []shadowsocks.CipherConfig{
-		{
+func (l *packetConnListener) Close() error {
+	err := l.Listener.Close()
+	l.pc.Close()
+	return err
+}
+
+// shadowsocksCipherList returns the access keys shared by all shadowsocks
+// listeners, loading them on first use. Reload updates them in place.
+func (p *Proxy) shadowsocksCipherList() (service.CipherList, error) {
+	if p.ssCiphers == nil {
+		configs, err := p.shadowsocksKeys()
+		if err != nil {
+			return nil, err
+		}
+		ciphers, err := shadowsocks.NewCipherListWithConfigs(configs)
+		if err != nil {
+			return nil, errors.New("Unable to create shadowsocks cipher: %v", err)
+		}
+		p.ssCiphers = ciphers
+	}
+	return p.ssCiphers, nil
+}
+
+// shadowsocksKeys are the access keys clients may authenticate with: the
+// "default" key made of ShadowsocksSecret and ShadowsocksCipher, if there's a
+// secret, and those in ShadowsocksKeysFile.
+func (p *Proxy) shadowsocksKeys() ([]shadowsocks.CipherConfig, error) {
+	var configs []shadowsocks.CipherConfig
+	if p.ShadowsocksSecret != "" {
+		configs = append(configs, shadowsocks.CipherConfig{
 			ID:     "default",
 			Secret: p.ShadowsocksSecret,
 			Cipher: p.ShadowsocksCipher,
-		},
+		})
 	}
-	ciphers, err := shadowsocks.NewCipherListWithConfigs(configs)
-	if err != nil {
-		return nil, errors.New("Unable to create shadowsocks cipher: %v", err)
+	if p.ShadowsocksKeysFile != "" {
+		keys, err := shadowsocks.LoadKeys(p.ShadowsocksKeysFile)
+		if err != nil {
+			return nil, errors.New("unable to load shadowsocks keys: %v", err)
+		}
+		configs = append(configs, keys...)
 	}
-	var tlsConfig *tls.Config
-	if p.ShadowsocksWithTLS {
-		var cert tls.Certificate
-		cert, err = tls.LoadX509KeyPair(p.CertFile, p.KeyFile)
+	if len(configs) == 0 {
+		return nil, errors.New("no shadowsocks secret or keys file configured")
+	}
+	if err := shadowsocks.ValidateKeys(configs); err != nil {
+		return nil, errors.New("invalid shadowsocks keys: %v", err)
+	}
+	return configs, nil
+}
+
+func (p *Proxy) listenShadowsocks(addr string) (net.Listener, error) {
+	// This is not using p.ListenTCP on purpose to avoid additional wrapping with idle timing.
+	// The idea here is to be as close to what outline shadowsocks does without any intervention,
+	// especially with respect to draining connections and the timing of closures.
+	return p.wrapShadowsocks(func(addr string) (net.Listener, error) {
+		return p.listen("tcp", addr)
+	}, true)(addr)
+}
+
+// wrapShadowsocks returns a listenerBuilderFN serving shadowsocks on the
+// listener returned by baseListen, and relaying UDP on the same address if
+// relayUDP and the UDP relay is enabled.
+func (p *Proxy) wrapShadowsocks(baseListen func(string) (net.Listener, error), relayUDP bool) listenerBuilderFN {
+	return func(addr string) (net.Listener, error) {
+		ciphers, err := p.shadowsocksCipherList()
 		if err != nil {
-			return nil, errors.New("unable to load cert: %v", err)
+			return nil, err
+		}
+		var tlsConfig *tls.Config
+		if p.ShadowsocksWithTLS {
+			var certs *certmanager.Manager
+			certs, err = p.certManager(addr)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig = certs.TLSConfig()
 		}
 
-		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
-	}
+		base, err := baseListen(addr)
+		if err != nil {
+			return nil, err
+		}
 
-	base, err := net.Listen("tcp", addr)
-	if err != nil {
-		return nil, err
-	}
+		l, err := shadowsocks.ListenLocalTCP(
+			base, ciphers,
+			p.ShadowsocksReplayHistory,
+		)
+		if err != nil {
+			return nil, errors.New("Unable to listen for shadowsocks: %v", err)
+		}
 
-	l, err := shadowsocks.ListenLocalTCP(
-		base, ciphers,
-		p.ShadowsocksReplayHistory,
-	)
-	if err != nil {
-		return nil, errors.New("Unable to listen for shadowsocks: %v", err)
-	}
+		if tlsConfig != nil {
+			l = tls.NewListener(l, tlsConfig)
+		}
 
-	if tlsConfig != nil {
-		l = tls.NewListener(l, tlsConfig)
-	}
+		if relayUDP && p.udpRelay != nil {
+			pc, err := p.listenPacket("udp", addr)
+			if err != nil {
+				l.Close()
+				return nil, errors.New("Unable to listen for shadowsocks UDP: %v", err)
+			}
+			go func() {
+				if err := shadowsocks.ServeUDP(pc, ciphers, p.udpRelay); err != nil {
+					log.Errorf("Error relaying shadowsocks UDP: %v", err)
+				}
+			}()
+			// the UDP relay stops with the TCP listener
+			l = &packetConnListener{l, pc}
+			log.Debugf("Relaying shadowsocks UDP at %v", pc.LocalAddr())
+		}
 
-	log.Debugf("Listening for shadowsocks at %v", l.Addr())
-	return l, nil
+		log.Debugf("Listening for shadowsocks at %v", l.Addr())
+		return l, nil
+	}
 }
 
 func (p *Proxy) listenStarbridge(baseListen func(string) (net.Listener, error)) listenerBuilderFN {
@@ -982,54 +1707,64 @@ func (p *Proxy) listenStarbridge(baseListen func(string) (net.Listener, error))
 	}
 }
 
-func (p *Proxy) listenWSS(addr string) (net.Listener, error) {
-	l, err := p.listenTCP(addr)
-	if err != nil {
-		return nil, errors.New("Unable to listen for wss: %v", err)
-	}
+func (p *Proxy) listenWSS(baseListen func(string) (net.Listener, error)) listenerBuilderFN {
+	return func(addr string) (net.Listener, error) {
+		l, err := baseListen(addr)
+		if err != nil {
+			return nil, errors.New("Unable to listen for wss: %v", err)
+		}
 
-	if p.HTTPS {
-		l, err = tlslistener.Wrap(
-			l, p.KeyFile, p.CertFile, p.SessionTicketKeyFile, p.FirstSessionTicketKey, p.SessionTicketKeys,
-			p.RequireSessionTickets, p.MissingTicketReaction, p.TLSListenerAllowTLS13, p.instrument)
+		if p.HTTPS {
+			var certs *certmanager.Manager
+			certs, err = p.certManager(l.Addr().String())
+			if err != nil {
+				return nil, err
+			}
+			var sni *tlslistener.SNIOptions
+			sni, err = p.sniOptions(certs)
+			if err != nil {
+				return nil, err
+			}
+			l, err = tlslistener.Wrap(
+				l, certs, p.SessionTicketKeyFile, p.FirstSessionTicketKey, p.SessionTicketKeys,
+				p.RequireSessionTickets, p.MissingTicketReaction, p.TLSListenerAllowTLS13,
+				p.instrument, sni)
+			if err != nil {
+				return nil, err
+			}
+			p.tlsListeners = append(p.tlsListeners, l)
+			log.Debugf("Using TLS on %v", l.Addr())
+		}
+		opts := &tinywss.ListenOpts{
+			Listener: l,
+		}
+
+		l, err = tinywss.ListenAddr(opts)
 		if err != nil {
 			return nil, err
 		}
-		log.Debugf("Using TLS on %v", l.Addr())
-	}
-	opts := &tinywss.ListenOpts{
-		Listener: l,
-	}
 
-	l, err = tinywss.ListenAddr(opts)
-	if err != nil {
-		return nil, err
+		log.Debugf("Listening for wss at %v", l.Addr())
+		return l, err
 	}
-
-	log.Debugf("Listening for wss at %v", l.Addr())
-	return l, err
 }
 
 func (p *Proxy) listenBroflake(baseListen func(string) (net.Listener, error)) listenerBuilderFN {
 	return func(addr string) (net.Listener, error) {
-		l, err := baseListen(addr)
+		certs, err := p.certManager(addr)
 		if err != nil {
-			return nil, err
+			return nil, errors.New("Unable to listen for broflake: %v", err)
 		}
 
-		certPEM, err := os.ReadFile(p.CertFile)
+		l, err := baseListen(addr)
 		if err != nil {
-			log.Fatalf("Unable to read certificate file: %v", err)
+			return nil, err
 		}
 
-		keyPEM, err := os.ReadFile(p.KeyFile)
+		wrapped, err := broflake.Wrap(l, certs.GetCertificate)
 		if err != nil {
-			log.Fatalf("Unable to read key file: %v", err)
-		}
-
-		wrapped, wrapErr := broflake.Wrap(l, string(certPEM), string(keyPEM))
-		if wrapErr != nil {
-			log.Fatalf("Unable to initialize broflake with tcp: %v", wrapErr)
+			l.Close()
+			return nil, errors.New("Unable to initialize broflake with tcp: %v", err)
 		}
 		log.Debugf("Listening for broflake at %v", wrapped.Addr())
 
@@ -1046,12 +1781,11 @@ func (p *Proxy) listenAlgeneva(baseListen func(string) (net.Listener, error)) li
 	return func(addr string) (net.Listener, error) {
 		var tlsConfig *tls.Config
 		if p.KeyFile != "" && p.CertFile != "" {
-			cert, err := tls.LoadX509KeyPair(p.CertFile, p.KeyFile)
+			certs, err := p.certManager(addr)
 			if err != nil {
-				return nil, errors.New("Unable to load cert: %v", err)
+				return nil, err
 			}
-
-			tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+			tlsConfig = certs.TLSConfig()
 		}
 
 		base, err := baseListen(addr)
@@ -1079,7 +1813,7 @@ func (p *Proxy) listenVMess(baseListen func(string) (net.Listener, error)) liste
 			return nil, err
 		}
 		log.Debugf("Listening for vmess at %v", base.Addr())
-		wrapper, err := vmess.NewVMessListener(base, p.VMessUUIDs)
+		wrapper, err := vmess.NewVMessListener(base, p.VMessUUIDs, p.udpRelay)
 		if err != nil {
 			_ = base.Close()
 			return nil, fmt.Errorf("vmess wrapping error: %w", err)
@@ -1089,6 +1823,165 @@ func (p *Proxy) listenVMess(baseListen func(string) (net.Listener, error)) liste
 	}
 }
 
+// sniffTransport is a transport served on SniffAddr.
+type sniffTransport struct {
+	name        string
+	serverNames []string
+}
+
+// parseSniffTransports parses the comma separated list of transports to serve
+// on SniffAddr, in the order they're tried, e.g.
+//
+//	tlsmasq=cdn.example.com|*.example.org,https,shadowsocks,vmess
+//
+// The transports are https, tlsmasq, wss, shadowsocks and vmess. Those on TLS
+// can be limited to ClientHellos for the | separated server names following an
+// =, so that several of them can share the port.
+func parseSniffTransports(s string) ([]sniffTransport, error) {
+	var transports []sniffTransport
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, names, hasNames := strings.Cut(entry, "=")
+		t := sniffTransport{name: strings.ToLower(strings.TrimSpace(name))}
+		if hasNames {
+			for _, serverName := range strings.Split(names, "|") {
+				if serverName = strings.TrimSpace(serverName); serverName != "" {
+					t.serverNames = append(t.serverNames, serverName)
+				}
+			}
+			if len(t.serverNames) == 0 {
+				return nil, errors.New("no server names given for %v", t.name)
+			}
+		}
+		if seen[t.name] {
+			return nil, errors.New("%v is listed more than once", t.name)
+		}
+		seen[t.name] = true
+		transports = append(transports, t)
+	}
+	if len(transports) == 0 {
+		return nil, errors.New("no transports to sniff")
+	}
+	return transports, nil
+}
+
+// sniffedTransport returns how to recognize the transport t and how to build
+// its usual stack of listeners on the listener of its route.
+func (p *Proxy) sniffedTransport(t sniffTransport) (sniff.Matcher, func(func(string) (net.Listener, error)) listenerBuilderFN, error) {
+	onTLS := t.name == "tlsmasq" || (p.HTTPS && (t.name == "https" || t.name == "wss")) ||
+		(p.ShadowsocksWithTLS && t.name == "shadowsocks")
+	if len(t.serverNames) > 0 && !onTLS {
+		return nil, nil, errors.New("server names can only be given for transports on TLS, not %v", t.name)
+	}
+	httpMatcher := sniff.HTTP
+	if onTLS {
+		httpMatcher = sniff.TLS(t.serverNames...)
+	}
+
+	switch t.name {
+	case "https":
+		return httpMatcher, func(baseListen func(string) (net.Listener, error)) listenerBuilderFN {
+			return p.wrapTLSIfNecessary(p.listenHTTP(baseListen))
+		}, nil
+	case "tlsmasq":
+		return httpMatcher, func(baseListen func(string) (net.Listener, error)) listenerBuilderFN {
+			return p.wrapMultiplexing(p.listenTLSMasq(baseListen))
+		}, nil
+	case "wss":
+		return httpMatcher, p.listenWSS, nil
+	case "shadowsocks":
+		ciphers, err := p.shadowsocksCipherList()
+		if err != nil {
+			return nil, nil, err
+		}
+		matcher := shadowsocks.Matcher(ciphers)
+		if onTLS {
+			// the shadowsocks stream only starts after the TLS handshake
+			matcher = sniff.TLS(t.serverNames...)
+		}
+		// UDP is only relayed on ShadowsocksAddr
+		return matcher, func(baseListen func(string) (net.Listener, error)) listenerBuilderFN {
+			return p.wrapShadowsocks(baseListen, false)
+		}, nil
+	case "vmess":
+		matcher, err := vmess.NewMatcher(p.VMessUUIDs)
+		if err != nil {
+			return nil, nil, errors.New("unable to recognize vmess: %v", err)
+		}
+		return matcher, func(baseListen func(string) (net.Listener, error)) listenerBuilderFN {
+			return p.wrapMultiplexing(p.listenVMess(baseListen))
+		}, nil
+	default:
+		return nil, nil, errors.New("unable to sniff unknown transport %v", t.name)
+	}
+}
+
+// listenSniffing serves the transports in SniffTransports on addr, dispatching
+// each connection to the first one that recognizes its first bytes. Plain
+// HTTP requests that none of them recognize are answered by the decoy web
+// server, and anything else is closed.
+func (p *Proxy) listenSniffing(addr string) (net.Listener, error) {
+	transports, err := parseSniffTransports(p.SniffTransports)
+	if err != nil {
+		return nil, errors.New("invalid transports to sniff: %v", err)
+	}
+	routes := make([]sniff.Route, 0, len(transports))
+	builders := make([]func(func(string) (net.Listener, error)) listenerBuilderFN, 0, len(transports))
+	for _, t := range transports {
+		matcher, builder, err := p.sniffedTransport(t)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, sniff.Route{Name: t.name, Match: matcher})
+		builders = append(builders, builder)
+	}
+	base, err := p.listen("tcp", addr)
+	if err != nil {
+		return nil, errors.New("Unable to listen for sniffing: %v", err)
+	}
+	if p.DiffServTOS > 0 {
+		base = diffserv.Wrap(base, p.DiffServTOS)
+	}
+	mux := sniff.New(base, sniff.Options{Routes: routes, Fallback: p.sniffFallback})
+
+	stacks := make([]net.Listener, 0, len(transports))
+	for i, l := range mux.Listeners() {
+		routeListener := l
+		if transports[i].name != "shadowsocks" && p.IdleTimeout > 0 {
+			// like listenTCP, except for shadowsocks
+			routeListener = listeners.NewIdleConnListener(routeListener, p.IdleTimeout)
+		}
+		stack, err := builders[i](func(string) (net.Listener, error) { return routeListener, nil })(addr)
+		if err != nil {
+			for _, stack := range stacks {
+				stack.Close()
+			}
+			mux.Close()
+			return nil, errors.New("Unable to serve %v on %v: %v", transports[i].name, addr, err)
+		}
+		stacks = append(stacks, stack)
+	}
+	log.Debugf("Sniffing %v at %v", p.SniffTransports, mux.Addr())
+	return mux.Join(stacks...), nil
+}
+
+// sniffFallback answers connections that none of the sniffed transports
+// recognize like the decoy web server would.
+func (p *Proxy) sniffFallback(conn net.Conn) {
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(sniff.DefaultTimeout))
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	p.decoy.Respond(conn, req)
+}
+
 // listenWATER start a WATER listener and return it
 // Currently water doesn't support customized TCP connections and we need to listen and receive requests directly from the WATER listener
 func (p *Proxy) listenWATER(addr string) (net.Listener, error) {
@@ -1132,21 +2025,12 @@ func (p *Proxy) listenWATER(addr string) (net.Listener, error) {
 		log.Debugf("Listening for water at %v", listener.Addr())
 		return listener, nil
 	case "PROTOCOL_UTLS":
-		certPEM, err := os.ReadFile(p.CertFile)
-		if err != nil {
-			log.Fatalf("Unable to read certificate file: %v", err)
-		}
-
-		keyPEM, err := os.ReadFile(p.KeyFile)
-		if err != nil {
-			log.Fatalf("Unable to read key file: %v", err)
-		}
-		cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+		certs, err := p.certManager(addr)
 		if err != nil {
 			return nil, log.Errorf("failed to load cert: %w", err)
 		}
 
-		return tls.Listen("tcp", addr, &tls.Config{Certificates: []tls.Certificate{cert}})
+		return tls.Listen("tcp", addr, certs.TLSConfig())
 	default:
 		return nil, log.Errorf("unsupported mismatch protocol provided: %s", p.WaterMismatchProtocol)
 	}
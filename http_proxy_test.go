@@ -11,19 +11,24 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/getlantern/keyman"
 	"github.com/getlantern/measured"
 
+	"github.com/getlantern/http-proxy-lantern/v2/blacklist"
+	"github.com/getlantern/http-proxy-lantern/v2/budget"
 	"github.com/getlantern/http-proxy-lantern/v2/common"
 	"github.com/getlantern/http-proxy-lantern/v2/listeners"
 	"github.com/getlantern/http-proxy-lantern/v2/server"
+	"github.com/getlantern/http-proxy-lantern/v2/sniff"
 
 	"github.com/getlantern/http-proxy-lantern/v2/instrument"
 	"github.com/getlantern/http-proxy-lantern/v2/tokenfilter"
@@ -620,6 +625,57 @@ func TestPortsFromCSV(t *testing.T) {
 	}
 }
 
+func TestParseSniffTransports(t *testing.T) {
+	transports, err := parseSniffTransports(" tlsmasq=cdn.example.com|*.example.org, HTTPS,shadowsocks,,vmess ")
+	require.NoError(t, err)
+	assert.Equal(t, []sniffTransport{
+		{name: "tlsmasq", serverNames: []string{"cdn.example.com", "*.example.org"}},
+		{name: "https"},
+		{name: "shadowsocks"},
+		{name: "vmess"},
+	}, transports)
+
+	for _, s := range []string{"", " , ", "https,https", "tlsmasq=", "tlsmasq=|"} {
+		_, err := parseSniffTransports(s)
+		assert.Error(t, err, s)
+	}
+
+	p := &Proxy{HTTPS: true}
+	for _, s := range []string{"obfs4", "vmess=example.com", "shadowsocks=example.com"} {
+		transports, err := parseSniffTransports(s)
+		require.NoError(t, err)
+		_, _, err = p.sniffedTransport(transports[0])
+		assert.Error(t, err, s)
+	}
+	_, _, err = (&Proxy{}).sniffedTransport(sniffTransport{name: "https", serverNames: []string{"example.com"}})
+	assert.Error(t, err, "server names need TLS")
+}
+
+func TestSniffedShadowsocksWithTLS(t *testing.T) {
+	p := &Proxy{ShadowsocksWithTLS: true, ShadowsocksSecret: "secret", ShadowsocksCipher: "chacha20-ietf-poly1305"}
+	matcher, _, err := p.sniffedTransport(sniffTransport{name: "shadowsocks", serverNames: []string{"ss.example.com"}})
+	require.NoError(t, err, "shadowsocks with TLS can be told apart by server name")
+
+	hello := func(serverName string) []byte {
+		clientConn, serverConn := net.Pipe()
+		defer serverConn.Close()
+		go tls.Client(clientConn, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+		defer clientConn.Close()
+		b := make([]byte, sniff.MaxPeek)
+		n := 0
+		for {
+			read, err := serverConn.Read(b[n:])
+			require.NoError(t, err)
+			n += read
+			if _, result := sniff.ServerName(b[:n]); result != sniff.NeedMore {
+				return b[:n]
+			}
+		}
+	}
+	assert.Equal(t, sniff.Match, matcher(hello("ss.example.com")), "the ClientHello should be recognized")
+	assert.Equal(t, sniff.NoMatch, matcher(hello("other.example.com")))
+}
+
 //
 // Auxiliary functions
 //
@@ -665,7 +721,7 @@ func basicServer(maxConns uint64, idleTimeout time.Duration) *server.Server {
 	// Create server
 	srv := server.New(&server.Opts{
 		IdleTimeout: idleTimeout,
-		Filter:      tokenfilter.New(validToken, instrument.NoInstrument{}),
+		Filter:      tokenfilter.New([]tokenfilter.Token{{Value: validToken}}, nil, nil, instrument.NoInstrument{}),
 	})
 
 	// Add net.Listener wrappers for inbound connections
@@ -809,3 +865,39 @@ func (mr *mockReporter) Report(ctx map[string]interface{}, stats *measured.Stats
 	}
 	mr.traffic[deviceID] = stats
 }
+
+func TestAdmitUDP(t *testing.T) {
+	deny, err := blacklist.ParseNetworks("10.9.9.9/32")
+	require.NoError(t, err)
+	b, err := budget.New(budget.Options{Quota: 1000, Soft: 0.5, Hard: 1, CycleDay: 1})
+	require.NoError(t, err)
+	p := &Proxy{
+		blacklist:  blacklist.New(blacklist.Options{Deny: deny}),
+		budget:     b,
+		instrument: instrument.NoInstrument{},
+	}
+	ctx := func(ip string) map[string]interface{} {
+		return map[string]interface{}{common.ClientIP: ip, common.DeviceID: deviceId}
+	}
+
+	assert.Error(t, p.admitUDP(ctx("10.9.9.9")), "denied IPs should be refused")
+	assert.NoError(t, p.admitUDP(ctx("10.9.9.10")))
+	assert.Nil(t, p.udpLimiter(ctx("10.9.9.10")), "there's no limiter without datacaps or abuse detection")
+
+	b.Reporter()(nil, &measured.Stats{}, &measured.Stats{SentTotal: 1000}, false)
+	assert.Error(t, p.admitUDP(ctx("10.9.9.10")), "new sessions should be refused once the budget is exhausted")
+	p.Pro = true
+	assert.NoError(t, p.admitUDP(ctx("10.9.9.10")), "pro proxies don't refuse anyone for the budget")
+}
+
+func TestListenBroflakeCertificateError(t *testing.T) {
+	dir := t.TempDir()
+	p := &Proxy{CertFile: filepath.Join(dir, "cert.pem"), KeyFile: filepath.Join(dir, "key.pem")}
+	require.NoError(t, os.WriteFile(p.CertFile, []byte("not a certificate"), 0600))
+	require.NoError(t, os.WriteFile(p.KeyFile, []byte("not a key"), 0600))
+
+	_, err := p.listenBroflake(func(addr string) (net.Listener, error) {
+		return net.Listen("tcp", addr)
+	})("127.0.0.1:0")
+	assert.Error(t, err, "bad certificates should fail the listener rather than exit")
+}
@@ -31,7 +31,7 @@ type Instrument interface {
 	WrapFilter(prefix string, f filters.Filter) (filters.Filter, error)
 	WrapConnErrorHandler(prefix string, f func(conn net.Conn, err error)) (func(conn net.Conn, err error), error)
 	Blacklist(ctx context.Context, b bool)
-	Mimic(ctx context.Context, m bool)
+	Mimic(ctx context.Context, m bool, tokenLabel string)
 	MultipathStats([]string) []multipath.StatsTracker
 	Throttle(ctx context.Context, m bool, reason string)
 	XBQHeaderSent(ctx context.Context)
@@ -39,6 +39,14 @@ type Instrument interface {
 	ProxiedBytes(ctx context.Context, sent, recv int, platform, platformVersion, libVersion, appVersion, app, locale, dataCapCohort, probingError string, clientIP net.IP, deviceID, originHost, arch string)
 	SessionGoodput(ctx context.Context, recvBytes int, duration time.Duration, clientIP net.IP)
 	Connection(ctx context.Context, clientIP net.IP)
+	DNSLookup(ctx context.Context, server, result string, duration time.Duration)
+	BudgetRefused(ctx context.Context)
+	AbuseDetected(ctx context.Context, pattern, subject, response string)
+	AbuseEnforced(ctx context.Context, response string)
+	AccessKeyBytes(ctx context.Context, keyID string, sent, recv int)
+	ObserveBudget(observe func() (used, quota int64, projected float64))
+	ObserveDatacap(observe func() (pendingBytes int64, maxStaleness float64, staleDevices int, breakerOpen bool))
+	DatacapVerdictAge(ctx context.Context, age time.Duration)
 	ReportProxiedBytesPeriodically(interval time.Duration, tp *sdktrace.TracerProvider)
 	ReportProxiedBytes(tp *sdktrace.TracerProvider)
 	ReportOriginBytesPeriodically(interval time.Duration, tp *sdktrace.TracerProvider)
@@ -60,8 +68,8 @@ func (i NoInstrument) WrapFilter(prefix string, f filters.Filter) (filters.Filte
 func (i NoInstrument) WrapConnErrorHandler(prefix string, f func(conn net.Conn, err error)) (func(conn net.Conn, err error), error) {
 	return f, nil
 }
-func (i NoInstrument) Blacklist(ctx context.Context, b bool) {}
-func (i NoInstrument) Mimic(ctx context.Context, m bool)     {}
+func (i NoInstrument) Blacklist(ctx context.Context, b bool)                {}
+func (i NoInstrument) Mimic(ctx context.Context, m bool, tokenLabel string) {}
 func (i NoInstrument) MultipathStats(protocols []string) (trackers []multipath.StatsTracker) {
 	for range protocols {
 		trackers = append(trackers, multipath.NullTracker{})
@@ -80,6 +88,16 @@ func (i NoInstrument) ReportProxiedBytesPeriodically(interval time.Duration, tp
 }
 func (i NoInstrument) ReportProxiedBytes(tp *sdktrace.TracerProvider)  {}
 func (i NoInstrument) Connection(ctx context.Context, clientIP net.IP) {}
+func (i NoInstrument) DNSLookup(ctx context.Context, server, result string, duration time.Duration) {
+}
+func (i NoInstrument) BudgetRefused(ctx context.Context)                                    {}
+func (i NoInstrument) AbuseDetected(ctx context.Context, pattern, subject, response string) {}
+func (i NoInstrument) AbuseEnforced(ctx context.Context, response string)                   {}
+func (i NoInstrument) AccessKeyBytes(ctx context.Context, keyID string, sent, recv int)     {}
+func (i NoInstrument) ObserveBudget(observe func() (used, quota int64, projected float64))  {}
+func (i NoInstrument) ObserveDatacap(observe func() (pendingBytes int64, maxStaleness float64, staleDevices int, breakerOpen bool)) {
+}
+func (i NoInstrument) DatacapVerdictAge(ctx context.Context, age time.Duration) {}
 func (i NoInstrument) ReportOriginBytesPeriodically(interval time.Duration, tp *sdktrace.TracerProvider) {
 }
 func (i NoInstrument) ReportOriginBytes(tp *sdktrace.TracerProvider) {}
@@ -100,7 +118,6 @@ type CommonLabels struct {
 type defaultInstrument struct {
 	countryLookup geo.CountryLookup
 	ispLookup     geo.ISPLookup
-	filters       map[string]filters.Filter
 	errorHandlers map[string]func(conn net.Conn, err error)
 	clientStats   map[clientDetails]*usage
 	originStats   map[originDetails]*usage
@@ -117,7 +134,6 @@ func NewDefault(countryLookup geo.CountryLookup, ispLookup geo.ISPLookup, proxyN
 	p := &defaultInstrument{
 		countryLookup: countryLookup,
 		ispLookup:     ispLookup,
-		filters:       make(map[string]filters.Filter),
 		errorHandlers: make(map[string]func(conn net.Conn, err error)),
 		clientStats:   make(map[clientDetails]*usage),
 		originStats:   make(map[originDetails]*usage),
@@ -129,18 +145,11 @@ func NewDefault(countryLookup geo.CountryLookup, ispLookup geo.ISPLookup, proxyN
 }
 
 // WrapFilter wraps a filter to instrument the requests/errors/duration
-// (so-called RED) of processed requests.
+// (so-called RED) of processed requests. Wrapping another filter under the same
+// prefix, as happens when the filter chain is rebuilt on a config reload,
+// records into the same instruments.
 func (ins *defaultInstrument) WrapFilter(prefix string, f filters.Filter) (filters.Filter, error) {
-	wrapped := ins.filters[prefix]
-	if wrapped == nil {
-		var err error
-		wrapped, err = otelinstrument.WrapFilter(prefix, f)
-		if err != nil {
-			return nil, err
-		}
-		ins.filters[prefix] = wrapped
-	}
-	return wrapped, nil
+	return otelinstrument.WrapFilter(prefix, f)
 }
 
 // WrapConnErrorHandler wraps an error handler to instrument the error count.
@@ -191,10 +200,12 @@ func (ins *defaultInstrument) Blacklist(ctx context.Context, b bool) {
 		metric.WithAttributes(attribute.Bool("blacklisted", b)))
 }
 
-// Mimic instruments the Apache mimicry.
-func (ins *defaultInstrument) Mimic(ctx context.Context, m bool) {
+// Mimic instruments the Apache mimicry. tokenLabel is the label of the token
+// that authenticated the request, if any.
+func (ins *defaultInstrument) Mimic(ctx context.Context, m bool, tokenLabel string) {
 	otelinstrument.Mimicked.Add(ctx, 1, metric.WithAttributes(
-		attribute.Bool("mimicked", m)))
+		attribute.Bool("mimicked", m),
+		attribute.String("token", tokenLabel)))
 
 	if m {
 		otelinstrument.Mimicked.Add(ctx, 1)
@@ -361,6 +372,70 @@ func (ins *defaultInstrument) Connection(ctx context.Context, clientIP net.IP) {
 		))
 }
 
+// BudgetRefused counts sessions refused because the host's bandwidth budget
+// is exhausted.
+func (ins *defaultInstrument) BudgetRefused(ctx context.Context) {
+	otelinstrument.BudgetRefused.Add(ctx, 1)
+}
+
+// AbuseDetected counts detections of an abusive traffic pattern by pattern,
+// kind of subject (device or client IP) and the response they got.
+func (ins *defaultInstrument) AbuseDetected(ctx context.Context, pattern, subject, response string) {
+	otelinstrument.AbuseDetected.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("pattern", pattern),
+		attribute.String("subject", subject),
+		attribute.String("response", response)))
+}
+
+// AbuseEnforced counts requests throttled or blocked for abuse.
+func (ins *defaultInstrument) AbuseEnforced(ctx context.Context, response string) {
+	otelinstrument.AbuseEnforced.Add(ctx, 1, metric.WithAttributes(attribute.String("response", response)))
+}
+
+// AccessKeyBytes counts the bytes proxied for clients that authenticated with
+// the shadowsocks access key keyID, the way Outline servers report them.
+func (ins *defaultInstrument) AccessKeyBytes(ctx context.Context, keyID string, sent, recv int) {
+	otelinstrument.AccessKeyIO.Add(ctx, int64(sent), metric.WithAttributes(
+		attribute.String("access_key", keyID),
+		semconv.NetworkIODirectionKey.String("transmit")))
+	otelinstrument.AccessKeyIO.Add(ctx, int64(recv), metric.WithAttributes(
+		attribute.String("access_key", keyID),
+		semconv.NetworkIODirectionKey.String("receive")))
+}
+
+// ObserveBudget reports the bytes used in the current billing cycle, the quota
+// and the share of it projected to be used by the end of the cycle, as
+// returned by observe, whenever metrics are collected.
+func (ins *defaultInstrument) ObserveBudget(observe func() (used, quota int64, projected float64)) {
+	otelinstrument.SetBudgetObserver(observe)
+}
+
+// ObserveDatacap reports the usage the datacap sidecar hasn't accepted yet,
+// how many seconds the oldest of it has been waiting, how many devices have
+// had some waiting for long and whether reporting is held off because the sidecar is
+// down, as returned by observe, whenever metrics are collected.
+func (ins *defaultInstrument) ObserveDatacap(observe func() (pendingBytes int64, maxStaleness float64, staleDevices int, breakerOpen bool)) {
+	otelinstrument.SetDatacapObserver(observe)
+}
+
+// DatacapVerdictAge records how old the datacap verdict a device was held to
+// was, each time its usage is reported or it gets a new verdict.
+func (ins *defaultInstrument) DatacapVerdictAge(ctx context.Context, age time.Duration) {
+	otelinstrument.DatacapVerdictAge.Record(ctx, age.Seconds())
+}
+
+// DNSLookup records the outcome of resolving an origin's hostname: cached for
+// answers served from the cache, otherwise ok, not_found or error along with
+// how long the given server took to answer.
+func (ins *defaultInstrument) DNSLookup(ctx context.Context, server, result string, duration time.Duration) {
+	otelinstrument.DNSLookups.Add(ctx, 1, metric.WithAttributes(attribute.String("result", result)))
+	if result != "cached" {
+		otelinstrument.DNSLookupDuration.Record(ctx, duration.Seconds(), metric.WithAttributes(
+			attribute.String("server", server),
+			attribute.String("result", result)))
+	}
+}
+
 // quicPackets is used by QuicTracer to update QUIC retransmissions mainly for block detection.
 func (ins *defaultInstrument) quicSentPacket(ctx context.Context) {
 	otelinstrument.QuicPackets.Add(ctx, 1, metric.WithAttributes(attribute.String("state", "sent")))
@@ -11,6 +11,7 @@ import (
 	"flag"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.opentelemetry.io/otel"
@@ -35,10 +36,50 @@ var (
 	SuspectedProbing                                         metric.Int64Counter
 	Connections                                              metric.Int64Counter
 	SessionGoodput                                           metric.Float64Histogram
+	DNSLookups                                               metric.Int64Counter
+	DNSLookupDuration                                        metric.Float64Histogram
+	DatacapVerdictAge                                        metric.Float64Histogram
+	BudgetRefused                                            metric.Int64Counter
+	AbuseDetected, AbuseEnforced                             metric.Int64Counter
+	AccessKeyIO                                              metric.Int64Counter
 	DistinctClients1m, DistinctClients10m, DistinctClients1h *distinct.SlidingWindowDistinctCount
 	distinctClients                                          metric.Int64ObservableGauge
+	budgetUsed, budgetQuota                                  metric.Int64ObservableGauge
+	budgetProjected                                          metric.Float64ObservableGauge
+	datacapPending, datacapStaleDevices, datacapBreakerOpen  metric.Int64ObservableGauge
+	datacapStaleness                                         metric.Float64ObservableGauge
+
+	budgetObserver  atomic.Pointer[func() (used, quota int64, projected float64)]
+	datacapObserver atomic.Pointer[func() (pendingBytes int64, maxStaleness float64, staleDevices int, breakerOpen bool)]
 )
 
+// SetBudgetObserver sets the function the proxy.budget gauges are observed
+// through. They aren't reported until it's set.
+func SetBudgetObserver(observe func() (used, quota int64, projected float64)) {
+	budgetObserver.Store(&observe)
+}
+
+// observeBudget calls the budget observer, if there is one, with its results.
+func observeBudget(report func(used, quota int64, projected float64)) {
+	if observe := budgetObserver.Load(); observe != nil {
+		report((*observe)())
+	}
+}
+
+// SetDatacapObserver sets the function the proxy.datacap gauges are observed
+// through. They aren't reported until it's set.
+func SetDatacapObserver(observe func() (pendingBytes int64, maxStaleness float64, staleDevices int, breakerOpen bool)) {
+	datacapObserver.Store(&observe)
+}
+
+// observeDatacap calls the datacap observer, if there is one, with its
+// results.
+func observeDatacap(report func(pendingBytes int64, maxStaleness float64, staleDevices int, breakerOpen bool)) {
+	if observe := datacapObserver.Load(); observe != nil {
+		report((*observe)())
+	}
+}
+
 // goodputBucketBoundaries are the explicit bucket boundaries, in bytes/s, for
 // the proxy.session.goodput histogram: a half-decade log scale from 1 B/s to
 // 10 MB/s. Session goodput spans ~6 decades — idle keepalive sessions sit
@@ -62,6 +103,19 @@ var goodputBucketBoundaries = []float64{
 	1_000_000, 3_000_000, 10_000_000,
 }
 
+// dnsLookupBucketBoundaries are the bucket boundaries, in seconds, for the
+// proxy.dns.lookup.duration histogram. Answers from a nearby recursive
+// resolver's cache take a millisecond or so while timeouts take seconds.
+var dnsLookupBucketBoundaries = []float64{
+	0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5,
+}
+
+// verdictAgeBucketBoundaries (seconds) span from a report interval or two to
+// the hours a sidecar outage may last.
+var verdictAgeBucketBoundaries = []float64{
+	5, 10, 15, 30, 60, 120, 300, 600, 1800, 3600, 7200, 21600,
+}
+
 // Note - we don't use package-level init() because we want to defer initialization of
 // OTEL metrics until after we've configured the global meter provider.
 func Initialize() error {
@@ -141,6 +195,113 @@ func initialize() error {
 		metric.WithExplicitBucketBoundaries(goodputBucketBoundaries...)); err != nil {
 		return err
 	}
+	if DNSLookups, err = meter.Int64Counter("proxy.dns.lookups",
+		metric.WithDescription("Lookups of origin hostnames by result, including answers from the cache")); err != nil {
+		return err
+	}
+	if DNSLookupDuration, err = meter.Float64Histogram("proxy.dns.lookup.duration",
+		metric.WithUnit("s"),
+		metric.WithDescription("Time taken by DNS servers to answer lookups of origin hostnames"),
+		metric.WithExplicitBucketBoundaries(dnsLookupBucketBoundaries...)); err != nil {
+		return err
+	}
+	if BudgetRefused, err = meter.Int64Counter("proxy.budget.refused",
+		metric.WithDescription("Sessions refused because the host's bandwidth budget is exhausted")); err != nil {
+		return err
+	}
+	if AbuseDetected, err = meter.Int64Counter("proxy.abuse.detected",
+		metric.WithDescription("Abusive traffic patterns detected, by pattern, subject and response")); err != nil {
+		return err
+	}
+	if AbuseEnforced, err = meter.Int64Counter("proxy.abuse.enforced",
+		metric.WithDescription("Requests throttled or blocked for abuse")); err != nil {
+		return err
+	}
+	if AccessKeyIO, err = meter.Int64Counter("proxy.shadowsocks.access_key.io",
+		metric.WithUnit("bytes"),
+		metric.WithDescription("Bytes proxied for clients by the shadowsocks access key they authenticated with")); err != nil {
+		return err
+	}
+	// Used and quota are gauges rather than counters since usage starts from
+	// zero with every billing cycle.
+	if budgetUsed, err = meter.Int64ObservableGauge("proxy.budget.used",
+		metric.WithUnit("bytes"),
+		metric.WithDescription("Bytes transferred in the current billing cycle"),
+		metric.WithInt64Callback(func(ctx context.Context, io metric.Int64Observer) error {
+			observeBudget(func(used, quota int64, projected float64) { io.Observe(used) })
+			return nil
+		})); err != nil {
+		return err
+	}
+	if budgetQuota, err = meter.Int64ObservableGauge("proxy.budget.quota",
+		metric.WithUnit("bytes"),
+		metric.WithDescription("Bytes the host may transfer per billing cycle"),
+		metric.WithInt64Callback(func(ctx context.Context, io metric.Int64Observer) error {
+			observeBudget(func(used, quota int64, projected float64) { io.Observe(quota) })
+			return nil
+		})); err != nil {
+		return err
+	}
+	if budgetProjected, err = meter.Float64ObservableGauge("proxy.budget.projected",
+		metric.WithDescription("Share of the quota that will have been used by the end of the billing cycle at the average rate so far"),
+		metric.WithFloat64Callback(func(ctx context.Context, io metric.Float64Observer) error {
+			observeBudget(func(used, quota int64, projected float64) { io.Observe(projected) })
+			return nil
+		})); err != nil {
+		return err
+	}
+	if DatacapVerdictAge, err = meter.Float64Histogram("proxy.datacap.verdict.age",
+		metric.WithUnit("s"),
+		metric.WithDescription("How old the datacap verdict a device was held to was, observed whenever its usage is reported or it gets a new verdict"),
+		metric.WithExplicitBucketBoundaries(verdictAgeBucketBoundaries...)); err != nil {
+		return err
+	}
+	if datacapPending, err = meter.Int64ObservableGauge("proxy.datacap.pending",
+		metric.WithUnit("bytes"),
+		metric.WithDescription("Usage the datacap sidecar hasn't accepted yet"),
+		metric.WithInt64Callback(func(ctx context.Context, io metric.Int64Observer) error {
+			observeDatacap(func(pendingBytes int64, maxStaleness float64, staleDevices int, breakerOpen bool) {
+				io.Observe(pendingBytes)
+			})
+			return nil
+		})); err != nil {
+		return err
+	}
+	if datacapStaleness, err = meter.Float64ObservableGauge("proxy.datacap.staleness.max",
+		metric.WithUnit("s"),
+		metric.WithDescription("How long the oldest usage the datacap sidecar hasn't accepted yet has been waiting"),
+		metric.WithFloat64Callback(func(ctx context.Context, io metric.Float64Observer) error {
+			observeDatacap(func(pendingBytes int64, maxStaleness float64, staleDevices int, breakerOpen bool) {
+				io.Observe(maxStaleness)
+			})
+			return nil
+		})); err != nil {
+		return err
+	}
+	if datacapStaleDevices, err = meter.Int64ObservableGauge("proxy.datacap.stale_devices",
+		metric.WithDescription("Devices whose usage has gone unreported to the datacap sidecar for several report intervals"),
+		metric.WithInt64Callback(func(ctx context.Context, io metric.Int64Observer) error {
+			observeDatacap(func(pendingBytes int64, maxStaleness float64, staleDevices int, breakerOpen bool) {
+				io.Observe(int64(staleDevices))
+			})
+			return nil
+		})); err != nil {
+		return err
+	}
+	if datacapBreakerOpen, err = meter.Int64ObservableGauge("proxy.datacap.breaker.open",
+		metric.WithDescription("1 while reports are held off because the datacap sidecar is down, 0 otherwise"),
+		metric.WithInt64Callback(func(ctx context.Context, io metric.Int64Observer) error {
+			observeDatacap(func(pendingBytes int64, maxStaleness float64, staleDevices int, breakerOpen bool) {
+				if breakerOpen {
+					io.Observe(1)
+				} else {
+					io.Observe(0)
+				}
+			})
+			return nil
+		})); err != nil {
+		return err
+	}
 
 	DistinctClients1m = distinct.NewSlidingWindowDistinctCount(time.Minute, time.Second)
 	DistinctClients10m = distinct.NewSlidingWindowDistinctCount(10*time.Minute, 10*time.Second)
@@ -0,0 +1,138 @@
+package integration
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/http-proxy-lantern/v2/common"
+)
+
+const corpusFile = "testdata/corpus.jsonl"
+
+// maxRecordedBody is the longest body recorded verbatim, longer ones are
+// recorded as their SHA-256.
+const maxRecordedBody = 512
+
+// volatileHeaders change from run to run and are never recorded.
+var volatileHeaders = map[string]bool{
+	"Date":             true,
+	"Etag":             true,
+	"Last-Modified":    true,
+	"Server-Timing":    true,
+	common.XBQHeader:   true,
+	common.XBQHeaderv2: true,
+}
+
+// entry is one recorded request and what the proxy is expected to do with it.
+type entry struct {
+	Name    string  `json:"name"`
+	Request request `json:"request"`
+	Expect  expect  `json:"expect"`
+}
+
+type request struct {
+	Method string `json:"method"`
+	// Origin is "http" for requests proxied directly or "https" for ones
+	// tunneled to the TLS origin through CONNECT.
+	Origin  string            `json:"origin"`
+	Path    string            `json:"path"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+	// NoAuth leaves out the token and device ID a client would send, as a
+	// prober would.
+	NoAuth bool `json:"noAuth,omitempty"`
+}
+
+type expect struct {
+	Status     int               `json:"status"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	Body       *string           `json:"body,omitempty"`
+	BodySHA256 string            `json:"bodySHA256,omitempty"`
+	// IgnoreBody leaves the body, and its length, unchecked for responses
+	// that vary between runs, such as ones naming the proxy's port.
+	IgnoreBody bool `json:"ignoreBody,omitempty"`
+	// XBQ requires the usage headers, which only appear once the sidecar has
+	// answered for the device, so the request is retried until they do.
+	XBQ     bool          `json:"xbq,omitempty"`
+	Metrics []metricDelta `json:"metrics,omitempty"`
+}
+
+// metricDelta is how much a metric should grow while replaying an entry,
+// summed over the data points carrying all the given attributes. Histograms
+// count observations.
+type metricDelta struct {
+	Name       string            `json:"name"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Delta      float64           `json:"delta"`
+}
+
+func loadCorpus(t *testing.T) []*entry {
+	f, err := os.Open(corpusFile)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var entries []*entry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		e := &entry{}
+		require.NoError(t, json.Unmarshal(line, e), "Unable to parse %v", string(line))
+		entries = append(entries, e)
+	}
+	require.NoError(t, scanner.Err())
+	require.NotEmpty(t, entries, "No entries in %v", corpusFile)
+	return entries
+}
+
+func saveCorpus(t *testing.T, entries []*entry) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	for _, e := range entries {
+		require.NoError(t, enc.Encode(e))
+	}
+	require.NoError(t, os.WriteFile(corpusFile, buf.Bytes(), 0644))
+}
+
+// record replaces what e expects of the response with what resp is.
+func (e *entry) record(resp *http.Response, body []byte) {
+	e.Expect.Status = resp.StatusCode
+	e.Expect.Headers = make(map[string]string)
+	names := make([]string, 0, len(resp.Header))
+	for name := range resp.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !volatileHeaders[name] {
+			e.Expect.Headers[name] = resp.Header.Get(name)
+		}
+	}
+	e.Expect.Body, e.Expect.BodySHA256 = nil, ""
+	if e.Expect.IgnoreBody {
+		delete(e.Expect.Headers, "Content-Length")
+	} else if len(body) <= maxRecordedBody {
+		s := string(body)
+		e.Expect.Body = &s
+	} else {
+		e.Expect.BodySHA256 = sha256Hex(body)
+	}
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,15 @@
+// Package integration holds end-to-end tests that run a complete Proxy, as
+// started by ListenAndServe, on loopback.
+//
+// The tests replay the requests recorded in testdata/corpus.jsonl over every
+// transport that works without network access, against stub origins and a
+// stub datacap sidecar, and check the responses, the XBQ usage headers and the
+// metrics recorded along the way. After changing how the proxy responds,
+// re-record the expected responses with
+//
+//	go test ./integration -run TestReplay -record
+//
+// and review the diff to testdata/corpus.jsonl. Recording only rewrites the
+// status, headers and body of each entry; the XBQ and metric expectations are
+// written by hand.
+package integration
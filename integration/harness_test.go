@@ -0,0 +1,504 @@
+package integration
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/OperatorFoundation/Replicant-go/Replicant/v3"
+	"github.com/OperatorFoundation/Replicant-go/Replicant/v3/polish"
+	"github.com/OperatorFoundation/Replicant-go/Replicant/v3/toneburst"
+	"github.com/OperatorFoundation/Starbridge-go/Starbridge/v3"
+	"github.com/getlantern/cmux/v2"
+	"github.com/getlantern/keyman"
+	"github.com/getlantern/lampshade"
+	"github.com/getlantern/quicwrapper"
+	vmess "github.com/getlantern/sing-vmess"
+	"github.com/getlantern/tinywss"
+	"github.com/getlantern/tlsmasq"
+	"github.com/getlantern/tlsmasq/ptlshs"
+	"github.com/sagernet/sing/common/metadata"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/yawning/obfs4.git/transports/obfs4"
+	sdkotel "go.opentelemetry.io/otel"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+
+	pt "git.torproject.org/pluggable-transports/goptlib.git"
+	sstransport "github.com/Jigsaw-Code/outline-sdk/transport"
+	ssclient "github.com/Jigsaw-Code/outline-sdk/transport/shadowsocks"
+
+	proxy "github.com/getlantern/http-proxy-lantern/v2"
+	"github.com/getlantern/http-proxy-lantern/v2/common"
+	"github.com/getlantern/http-proxy-lantern/v2/datacap"
+	"github.com/getlantern/http-proxy-lantern/v2/instrument/otelinstrument"
+	"github.com/getlantern/http-proxy-lantern/v2/shadowsocks"
+	"github.com/getlantern/http-proxy-lantern/v2/tlslistener"
+)
+
+const (
+	testToken         = "integration-token"
+	shadowsocksSecret = "integration-secret"
+	vmessUUID         = "3fed9a96-900c-4dd4-9fd2-f333a566768c"
+
+	// tlsmasqServerName tells tlsmasq apart from HTTPS where they share a
+	// port.
+	tlsmasqServerName = "masq.example.com"
+
+	// capLimit is the data cap the stub sidecar reports for every device.
+	capLimit = 500 * 1024 * 1024
+
+	startupTimeout = 10 * time.Second
+	requestTimeout = 10 * time.Second
+)
+
+// dialFN opens a fresh connection to the proxy, over which the client speaks
+// plain HTTP proxy requests.
+type dialFN func(ctx context.Context) (net.Conn, error)
+
+// transport is one way of reaching a running proxy.
+type transport struct {
+	name string
+	dial dialFN
+	// periodicUsage is set for transports whose connections the proxy only
+	// learns have closed when it next times them out, so that their usage
+	// reaches the sidecar with the periodic reports rather than promptly.
+	periodicUsage bool
+}
+
+// harness is a pair of running proxies, one serving plain HTTP and the other
+// everything that's encrypted, together with the stubs they talk to.
+type harness struct {
+	httpOrigin  *httptest.Server
+	httpsOrigin *httptest.Server
+	sidecar     *sidecar
+	metrics     *sdkmetric.ManualReader
+	transports  []*transport
+}
+
+func startHarness(t *testing.T) *harness {
+	h := &harness{
+		httpOrigin:  httptest.NewServer(http.HandlerFunc(serveOrigin)),
+		httpsOrigin: httptest.NewTLSServer(http.HandlerFunc(serveOrigin)),
+		sidecar:     &sidecar{used: make(map[string]int64)},
+	}
+	t.Cleanup(h.httpOrigin.Close)
+	t.Cleanup(h.httpsOrigin.Close)
+	sidecarServer := httptest.NewServer(h.sidecar)
+	t.Cleanup(sidecarServer.Close)
+
+	// Bind the proxy's instruments to a reader we can collect from. The proxy
+	// later installs its own exporting meter provider, but instruments stay
+	// bound to the provider that was global when they were created.
+	h.metrics = sdkmetric.NewManualReader()
+	sdkotel.SetMeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(h.metrics)))
+	require.NoError(t, otelinstrument.ResetForTest())
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	serverKey := writeKeyPair(t, certFile, keyFile)
+
+	var tlsmasqSecret ptlshs.Secret
+	_, err := rand.Read(tlsmasqSecret[:])
+	require.NoError(t, err)
+	starbridgePublicKey, starbridgePrivateKey, err := Starbridge.GenerateKeys()
+	require.NoError(t, err)
+
+	base := func(adminAddr string) *proxy.Proxy {
+		return &proxy.Proxy{
+			TestingLocal:          true,
+			TestingListeners:      true,
+			Token:                 testToken,
+			CertFile:              certFile,
+			KeyFile:               keyFile,
+			IdleTimeout:           30 * time.Second,
+			DatacapURL:            sidecarServer.URL,
+			DatacapReportInterval: 100 * time.Millisecond,
+			AdminAddr:             adminAddr,
+		}
+	}
+
+	httpProxy := base(freeAddr(t))
+	httpProxy.HTTPAddr = "127.0.0.1:0"
+	httpListeners := startProxy(t, httpProxy)
+
+	obfs4Dir := filepath.Join(dir, "obfs4")
+	tlsProxy := base(freeAddr(t))
+	tlsProxy.HTTPS = true
+	tlsProxy.MissingTicketReaction = tlslistener.None
+	tlsProxy.HTTPAddr = "127.0.0.1:0"
+	tlsProxy.Obfs4Addr = "127.0.0.1:0"
+	tlsProxy.Obfs4Dir = obfs4Dir
+	tlsProxy.LampshadeAddr = "127.0.0.1:0"
+	tlsProxy.ShadowsocksAddr = "127.0.0.1:0"
+	tlsProxy.ShadowsocksSecret = shadowsocksSecret
+	tlsProxy.ShadowsocksCipher = shadowsocks.DefaultCipher
+	tlsProxy.TLSMasqAddr = "127.0.0.1:0"
+	tlsProxy.TLSMasqOriginAddr = h.httpsOrigin.Listener.Addr().String()
+	tlsProxy.TLSMasqSecret = hex.EncodeToString(tlsmasqSecret[:])
+	tlsProxy.TLSMasqTLSMinVersion = tls.VersionTLS12
+	tlsProxy.StarbridgeAddr = "127.0.0.1:0"
+	tlsProxy.StarbridgePrivateKey = *starbridgePrivateKey
+	tlsProxy.QUICIETFAddr = "127.0.0.1:0"
+	tlsProxy.WSSAddr = "127.0.0.1:0"
+	tlsProxy.VMessAddr = "127.0.0.1:0"
+	tlsProxy.VMessUUIDs = []string{vmessUUID}
+	tlsProxy.SniffAddr = "127.0.0.1:0"
+	tlsProxy.SniffTransports = "tlsmasq=" + tlsmasqServerName + ",https,shadowsocks,vmess"
+	tlsListeners := startProxy(t, tlsProxy)
+
+	insecure := &tls.Config{InsecureSkipVerify: true}
+	// tlsmasq can't hijack handshakes that use post-quantum key exchange
+	tlsmasqTLS := &tls.Config{
+		InsecureSkipVerify: true,
+		CurvePreferences:   []tls.CurveID{tls.X25519, tls.CurveP256},
+	}
+	sniffedTLSMasqTLS := tlsmasqTLS.Clone()
+	sniffedTLSMasqTLS.ServerName = tlsmasqServerName
+	multiplexed := func(dial cmux.DialFN) dialFN {
+		d := cmux.Dialer(&cmux.DialerOpts{Dial: dial})
+		return func(ctx context.Context) (net.Conn, error) {
+			return d(ctx, "tcp", "")
+		}
+	}
+
+	h.add("http", func(ctx context.Context) (net.Conn, error) {
+		return dialTCP(ctx, httpListeners["https"])
+	})
+
+	h.add("tls", func(ctx context.Context) (net.Conn, error) {
+		return (&tls.Dialer{Config: insecure}).DialContext(ctx, "tcp", tlsListeners["https"])
+	})
+	h.add("sniffed-tls", func(ctx context.Context) (net.Conn, error) {
+		return (&tls.Dialer{Config: insecure}).DialContext(ctx, "tcp", tlsListeners["sniff"])
+	})
+
+	obfs4Args := readObfs4Args(t, obfs4Dir)
+	obfs4Factory, err := (&obfs4.Transport{}).ClientFactory("")
+	require.NoError(t, err)
+	obfs4ClientArgs, err := obfs4Factory.ParseArgs(obfs4Args)
+	require.NoError(t, err)
+	h.add("obfs4", func(ctx context.Context) (net.Conn, error) {
+		return obfs4Factory.Dial("tcp", tlsListeners["obfs4"], func(network, addr string) (net.Conn, error) {
+			return dialTCP(ctx, addr)
+		}, obfs4ClientArgs)
+	})
+
+	lampshadeDialer := lampshade.NewDialer(&lampshade.DialerOpts{
+		MaxPadding:      32,
+		Pool:            lampshade.NewBufferPool(100 * lampshade.MaxDataLen),
+		Cipher:          lampshade.AES128GCM,
+		ServerPublicKey: serverKey,
+	})
+	h.add("lampshade", func(ctx context.Context) (net.Conn, error) {
+		return lampshadeDialer.DialContext(ctx, func() (net.Conn, error) {
+			return dialTCP(ctx, tlsListeners["lampshade"])
+		})
+	})
+
+	shadowsocksKey, err := ssclient.NewEncryptionKey(shadowsocks.DefaultCipher, shadowsocksSecret)
+	require.NoError(t, err)
+	shadowsocksDialer, err := ssclient.NewStreamDialer(&sstransport.TCPEndpoint{Address: tlsListeners["shadowsocks"]}, shadowsocksKey)
+	require.NoError(t, err)
+	// Closing a shadowsocks stream only half-closes the proxy's end of it.
+	h.add("shadowsocks", func(ctx context.Context) (net.Conn, error) {
+		// the proxy ignores the target and serves the stream itself
+		return shadowsocksDialer.DialStream(ctx, "127.0.0.1:443")
+	}).periodicUsage = true
+	sniffedShadowsocksDialer, err := ssclient.NewStreamDialer(&sstransport.TCPEndpoint{Address: tlsListeners["sniff"]}, shadowsocksKey)
+	require.NoError(t, err)
+	h.add("sniffed-shadowsocks", func(ctx context.Context) (net.Conn, error) {
+		return sniffedShadowsocksDialer.DialStream(ctx, "127.0.0.1:443")
+	}).periodicUsage = true
+
+	tlsmasqDialer := tlsmasq.WrapDialer(&net.Dialer{}, tlsmasq.DialerConfig{
+		ProxiedHandshakeConfig: ptlshs.DialerConfig{
+			Handshaker: ptlshs.StdLibHandshaker{Config: tlsmasqTLS},
+			Secret:     tlsmasqSecret,
+		},
+		TLSConfig: tlsmasqTLS,
+	})
+	h.add("tlsmasq", multiplexed(func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return tlsmasqDialer.DialContext(ctx, network, tlsListeners["tlsmasq"])
+	}))
+	sniffedTLSMasqDialer := tlsmasq.WrapDialer(&net.Dialer{}, tlsmasq.DialerConfig{
+		ProxiedHandshakeConfig: ptlshs.DialerConfig{
+			Handshaker: ptlshs.StdLibHandshaker{Config: sniffedTLSMasqTLS},
+			Secret:     tlsmasqSecret,
+		},
+		TLSConfig: sniffedTLSMasqTLS,
+	})
+	h.add("sniffed-tlsmasq", multiplexed(func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return sniffedTLSMasqDialer.DialContext(ctx, network, tlsListeners["sniff"])
+	}))
+
+	starbridgeConfig := replicant.ClientConfig{
+		Toneburst: toneburst.StarburstConfig{Mode: "SMTPClient"},
+		Polish: polish.DarkStarPolishClientConfig{
+			// the address the starbridge listener claims, whatever it's bound to
+			ServerAddress:   "1.2.3.4:5678",
+			ServerPublicKey: *starbridgePublicKey,
+		},
+	}
+	h.add("starbridge", multiplexed(func(ctx context.Context, network, _ string) (net.Conn, error) {
+		conn, err := dialTCP(ctx, tlsListeners["starbridge"])
+		if err != nil {
+			return nil, err
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+		}
+		sconn, err := Starbridge.NewClientConnection(starbridgeConfig, conn)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn.SetDeadline(time.Time{})
+		return sconn, nil
+	}))
+
+	quicClient := quicwrapper.NewClient(tlsListeners["quic_ietf"], insecure, &quicwrapper.Config{}, nil)
+	t.Cleanup(func() { quicClient.Close() })
+	h.add("quic", quicClient.DialContext)
+
+	wssClient := tinywss.NewClient(&tinywss.ClientOpts{
+		URL: "wss://" + tlsListeners["wss"] + "/",
+		RoundTrip: tinywss.NewRoundTripper(func(network, addr string) (net.Conn, error) {
+			return tls.Dial(network, addr, insecure)
+		}),
+	})
+	t.Cleanup(func() { wssClient.Close() })
+	h.add("wss", wssClient.DialContext)
+
+	vmessClient, err := vmess.NewClient(vmessUUID, "auto", 0)
+	require.NoError(t, err)
+	h.add("vmess", multiplexed(func(ctx context.Context, network, _ string) (net.Conn, error) {
+		conn, err := dialTCP(ctx, tlsListeners["vmess"])
+		if err != nil {
+			return nil, err
+		}
+		// like shadowsocks, the proxy serves the stream whatever the target
+		return vmessClient.DialEarlyConn(conn, metadata.ParseSocksaddrHostPort("127.0.0.1", 443)), nil
+	}))
+	h.add("sniffed-vmess", multiplexed(func(ctx context.Context, network, _ string) (net.Conn, error) {
+		conn, err := dialTCP(ctx, tlsListeners["sniff"])
+		if err != nil {
+			return nil, err
+		}
+		return vmessClient.DialEarlyConn(conn, metadata.ParseSocksaddrHostPort("127.0.0.1", 443)), nil
+	}))
+
+	return h
+}
+
+func (h *harness) add(name string, dial dialFN) *transport {
+	tr := &transport{name: name, dial: dial}
+	h.transports = append(h.transports, tr)
+	return tr
+}
+
+// transport returns the transport with the given name.
+func (h *harness) transport(name string) *transport {
+	for _, tr := range h.transports {
+		if tr.name == name {
+			return tr
+		}
+	}
+	return nil
+}
+
+// startProxy runs p until the test finishes and returns the addresses of its
+// listeners by protocol, as reported by the admin API once they're all up.
+func startProxy(t *testing.T, p *proxy.Proxy) map[string]string {
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- p.ListenAndServe(ctx)
+	}()
+	t.Cleanup(cancel)
+
+	deadline := time.Now().Add(startupTimeout)
+	for {
+		select {
+		case err := <-errCh:
+			t.Fatalf("Proxy stopped while starting up: %v", err)
+		default:
+		}
+		resp, err := http.Get("http://" + p.AdminAddr + "/listeners")
+		if err == nil {
+			var active []struct {
+				Protocol string `json:"protocol"`
+				Addr     string `json:"addr"`
+			}
+			err = json.NewDecoder(resp.Body).Decode(&active)
+			resp.Body.Close()
+			require.NoError(t, err)
+			addrs := make(map[string]string, len(active))
+			for _, l := range active {
+				addrs[l.Protocol] = l.Addr
+			}
+			return addrs
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Proxy didn't start within %v: %v", startupTimeout, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// freeAddr returns a loopback address nothing is listening on. The admin API
+// has to be given a fixed address since it's how we learn the others.
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func dialTCP(ctx context.Context, addr string) (net.Conn, error) {
+	return (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+}
+
+// writeKeyPair writes a self-signed certificate and its key, returning the
+// public key for the transports that pin it.
+func writeKeyPair(t *testing.T, certFile, keyFile string) *rsa.PublicKey {
+	pk, err := keyman.GeneratePK(2048)
+	require.NoError(t, err)
+	cert, err := pk.TLSCertificateFor(time.Now().Add(24*time.Hour), false, nil, "org", "name")
+	require.NoError(t, err)
+	require.NoError(t, cert.WriteToFile(certFile))
+	require.NoError(t, pk.WriteToFile(keyFile))
+	return cert.X509().PublicKey.(*rsa.PublicKey)
+}
+
+// readObfs4Args reads the client arguments from the bridge line the obfs4
+// listener wrote to its state directory.
+func readObfs4Args(t *testing.T, dir string) *pt.Args {
+	f, err := os.Open(filepath.Join(dir, "obfs4_bridgeline.txt"))
+	require.NoError(t, err)
+	defer f.Close()
+	args := &pt.Args{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "Bridge obfs4") {
+			continue
+		}
+		for _, field := range strings.Fields(line) {
+			if k, v, ok := strings.Cut(field, "="); ok {
+				args.Add(k, v)
+			}
+		}
+	}
+	require.NoError(t, scanner.Err())
+	_, ok := args.Get("cert")
+	require.True(t, ok, "No obfs4 bridge line in %v", dir)
+	return args
+}
+
+// serveOrigin is the stub origin behind the proxy:
+//
+//	/              a short greeting
+//	/echo          the request body, with what the origin saw in X-Origin-*
+//	/status/<code> an empty response with that status
+//	/bytes/<n>     n bytes of a repeating pattern
+//	/redirect      a redirect to /
+func serveOrigin(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(w, "hello from the origin\n")
+	case r.URL.Path == "/echo":
+		lanternHeaders := 0
+		for name := range r.Header {
+			if strings.HasPrefix(name, "X-Lantern-") {
+				lanternHeaders++
+			}
+		}
+		w.Header().Set("X-Origin-Method", r.Method)
+		w.Header().Set("X-Origin-Lantern-Headers", strconv.Itoa(lanternHeaders))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		io.Copy(w, r.Body)
+	case strings.HasPrefix(r.URL.Path, "/status/"):
+		code, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/status/"))
+		if err != nil {
+			code = http.StatusBadRequest
+		}
+		w.WriteHeader(code)
+	case strings.HasPrefix(r.URL.Path, "/bytes/"):
+		n, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/bytes/"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(n))
+		pattern := []byte("0123456789abcdef")
+		for ; n > 0; n -= len(pattern) {
+			w.Write(pattern[:min(n, len(pattern))])
+		}
+	case r.URL.Path == "/redirect":
+		http.Redirect(w, r, "/", http.StatusFound)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// sidecar is a stub datacap sidecar that caps every device at capLimit and
+// never throttles.
+type sidecar struct {
+	mx   sync.Mutex
+	used map[string]int64
+}
+
+func (s *sidecar) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.URL.Path != "/data-cap/" {
+		http.NotFound(w, r)
+		return
+	}
+	var report datacap.Report
+	if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mx.Lock()
+	s.used[report.DeviceID] += report.BytesUsed
+	used := s.used[report.DeviceID]
+	s.mx.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&datacap.Status{
+		CapLimit:   capLimit,
+		ExpiryTime: time.Now().Add(24 * time.Hour).Unix(),
+		BytesUsed:  used,
+	})
+}
+
+// deviceID is the device each transport's requests are made as, so that
+// each starts out unknown to the sidecar.
+func deviceID(tr *transport) string {
+	return fmt.Sprintf("integration-%v", tr.name)
+}
+
+// authHeaders are the headers a Lantern client sends with every request.
+func authHeaders(tr *transport) http.Header {
+	return http.Header{
+		common.TokenHeader:    {testToken},
+		common.DeviceIdHeader: {deviceID(tr)},
+		common.PlatformHeader: {"linux"},
+	}
+}
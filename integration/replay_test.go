@@ -0,0 +1,270 @@
+package integration
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"flag"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+
+	"github.com/getlantern/http-proxy-lantern/v2/common"
+)
+
+var record = flag.Bool("record", false, "re-record the expected responses in "+corpusFile+" over plain HTTP before replaying")
+
+const (
+	// xbqTimeout bounds how long to wait for the sidecar to learn of a device.
+	xbqTimeout = 5 * time.Second
+
+	// metricsTimeout bounds how long to wait for metrics recorded once
+	// connections have closed.
+	metricsTimeout = 5 * time.Second
+)
+
+func TestReplay(t *testing.T) {
+	h := startHarness(t)
+	entries := loadCorpus(t)
+
+	if *record {
+		tr := h.transport("http")
+		for _, e := range entries {
+			resp, body, err := h.roundTrip(tr, e)
+			require.NoError(t, err, "Unable to record %v", e.Name)
+			e.record(resp, body)
+		}
+		saveCorpus(t, entries)
+	}
+
+	for _, tr := range h.transports {
+		t.Run(tr.name, func(t *testing.T) {
+			for _, e := range entries {
+				t.Run(e.Name, func(t *testing.T) {
+					h.replay(t, tr, e)
+				})
+			}
+		})
+	}
+}
+
+// replay replays e over tr and checks the outcome against what it expects.
+func (h *harness) replay(t *testing.T, tr *transport, e *entry) {
+	if e.Expect.XBQ && tr.periodicUsage {
+		t.Skipf("%v only reports usage periodically", tr.name)
+	}
+	before := h.collect(t)
+
+	resp, body, err := h.roundTrip(tr, e)
+	require.NoError(t, err)
+	if e.Expect.XBQ {
+		deadline := time.Now().Add(xbqTimeout)
+		for resp.Header.Get(common.XBQHeader) == "" && time.Now().Before(deadline) {
+			time.Sleep(50 * time.Millisecond)
+			resp, body, err = h.roundTrip(tr, e)
+			require.NoError(t, err)
+		}
+		xbq := resp.Header.Get(common.XBQHeader)
+		if assert.NotEmpty(t, xbq, "No XBQ header within %v", xbqTimeout) {
+			parts := strings.Split(xbq, "/")
+			if assert.Len(t, parts, 3, "Malformed XBQ header %v", xbq) {
+				assert.Equal(t, "500", parts[1], "XBQ header should carry the cap in MiB")
+			}
+			assert.True(t, strings.HasPrefix(resp.Header.Get(common.XBQHeaderv2), xbq+"/"),
+				"XBQv2 header should extend XBQ header")
+		}
+	}
+
+	assert.Equal(t, e.Expect.Status, resp.StatusCode, "Unexpected status")
+	for name, value := range e.Expect.Headers {
+		assert.Equal(t, value, resp.Header.Get(name), "Unexpected value for header %v", name)
+	}
+	if e.Expect.Body != nil {
+		assert.Equal(t, *e.Expect.Body, string(body), "Unexpected body")
+	}
+	if e.Expect.BodySHA256 != "" {
+		assert.Equal(t, e.Expect.BodySHA256, sha256Hex(body), "Unexpected body of length %d", len(body))
+	}
+
+	if len(e.Expect.Metrics) == 0 {
+		return
+	}
+	deltas := func(after *metricdata.ResourceMetrics) []float64 {
+		result := make([]float64, len(e.Expect.Metrics))
+		for i, m := range e.Expect.Metrics {
+			result[i] = sumMetric(after, m) - sumMetric(before, m)
+		}
+		return result
+	}
+	want := make([]float64, len(e.Expect.Metrics))
+	for i, m := range e.Expect.Metrics {
+		want[i] = m.Delta
+	}
+	var got []float64
+	deadline := time.Now().Add(metricsTimeout)
+	for {
+		got = deltas(h.collect(t))
+		if assert.ObjectsAreEqual(want, got) || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	for i, m := range e.Expect.Metrics {
+		assert.Equal(t, m.Delta, got[i], "Unexpected change in %v %v", m.Name, m.Attributes)
+	}
+}
+
+// roundTrip makes e's request over a fresh connection through tr. For
+// requests to the TLS origin, it returns the response to the CONNECT request
+// if the tunnel wasn't opened, and otherwise the response from the origin with
+// the headers on the CONNECT response, such as XBQ, merged in.
+func (h *harness) roundTrip(tr *transport, e *entry) (*http.Response, []byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	conn, err := tr.dial(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(requestTimeout))
+
+	proxyHeaders := http.Header{}
+	if !e.Request.NoAuth {
+		proxyHeaders = authHeaders(tr)
+	}
+	origin := h.httpOrigin
+	if e.Request.Origin == "https" {
+		origin = h.httpsOrigin
+	}
+	req, err := http.NewRequest(e.Request.Method, origin.URL+e.Request.Path, strings.NewReader(e.Request.Body))
+	if err != nil {
+		return nil, nil, err
+	}
+	for name, value := range e.Request.Headers {
+		req.Header.Set(name, value)
+	}
+
+	br := bufio.NewReader(conn)
+	if e.Request.Origin != "https" {
+		for name, values := range proxyHeaders {
+			req.Header[name] = values
+		}
+		if err := req.WriteProxy(conn); err != nil {
+			return nil, nil, err
+		}
+		return readResponse(br, req)
+	}
+
+	host := req.URL.Host
+	connectReq := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: host},
+		Host:   host,
+		Header: proxyHeaders,
+	}
+	if err := connectReq.Write(conn); err != nil {
+		return nil, nil, err
+	}
+	connectResp, connectBody, err := readResponse(br, connectReq)
+	if err != nil || connectResp.StatusCode != http.StatusOK {
+		return connectResp, connectBody, err
+	}
+
+	tlsConn := tls.Client(&bufferedConn{conn, br}, &tls.Config{InsecureSkipVerify: true})
+	if err := req.Write(tlsConn); err != nil {
+		return nil, nil, err
+	}
+	resp, body, err := readResponse(bufio.NewReader(tlsConn), req)
+	if err != nil {
+		return nil, nil, err
+	}
+	for name, values := range connectResp.Header {
+		if _, found := resp.Header[name]; !found {
+			resp.Header[name] = values
+		}
+	}
+	return resp, body, nil
+}
+
+func readResponse(br *bufio.Reader, req *http.Request) (*http.Response, []byte, error) {
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if req.Method == http.MethodConnect && resp.StatusCode == http.StatusOK {
+		// the body is the tunnel
+		return resp, nil, nil
+	}
+	body, err := io.ReadAll(resp.Body)
+	return resp, body, err
+}
+
+// bufferedConn is a net.Conn whose reads start with whatever was buffered
+// from it while reading the response to CONNECT.
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (h *harness) collect(t *testing.T) *metricdata.ResourceMetrics {
+	rm := &metricdata.ResourceMetrics{}
+	require.NoError(t, h.metrics.Collect(context.Background(), rm))
+	return rm
+}
+
+// sumMetric sums the data points of the metric m names that carry all of its
+// attributes.
+func sumMetric(rm *metricdata.ResourceMetrics, m metricDelta) float64 {
+	matches := func(set attribute.Set) bool {
+		for k, v := range m.Attributes {
+			value, found := set.Value(attribute.Key(k))
+			if !found || value.Emit() != v {
+				return false
+			}
+		}
+		return true
+	}
+	total := 0.0
+	for _, sm := range rm.ScopeMetrics {
+		for _, metric := range sm.Metrics {
+			if metric.Name != m.Name {
+				continue
+			}
+			switch data := metric.Data.(type) {
+			case metricdata.Sum[int64]:
+				for _, dp := range data.DataPoints {
+					if matches(dp.Attributes) {
+						total += float64(dp.Value)
+					}
+				}
+			case metricdata.Sum[float64]:
+				for _, dp := range data.DataPoints {
+					if matches(dp.Attributes) {
+						total += dp.Value
+					}
+				}
+			case metricdata.Histogram[float64]:
+				for _, dp := range data.DataPoints {
+					if matches(dp.Attributes) {
+						total += float64(dp.Count)
+					}
+				}
+			}
+		}
+	}
+	return total
+}
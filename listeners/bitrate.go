@@ -66,22 +66,38 @@ func (l *RateLimiter) GetRateWrite() int64 {
 	return l.buckets.Load().rateWrite
 }
 
-func (b *rateBuckets) waitRead(n int) {
+func (b *rateBuckets) delayRead(n int) time.Duration {
 	if b.r == nil {
-		return
-	}
-	if d := b.r.Take(int64(n)); d > 0 {
-		sleep(d)
+		return 0
 	}
+	return b.r.Take(int64(n))
 }
 
-func (b *rateBuckets) waitWrite(n int) {
+func (b *rateBuckets) delayWrite(n int) time.Duration {
 	if b.w == nil {
-		return
+		return 0
 	}
-	if d := b.w.Take(int64(n)); d > 0 {
-		sleep(d)
+	return b.w.Take(int64(n))
+}
+
+// AllowRead reports whether n more bytes may be read right now, taking them
+// from the read rate if so. Unlike connections, which wait for their rate,
+// datagrams over it are dropped, as a router's policer drops them.
+func (l *RateLimiter) AllowRead(n int) bool {
+	return allow(l.buckets.Load().r, n)
+}
+
+// AllowWrite is AllowRead for the write rate.
+func (l *RateLimiter) AllowWrite(n int) bool {
+	return allow(l.buckets.Load().w, n)
+}
+
+func allow(b *ratelimit.Bucket, n int) bool {
+	if b == nil {
+		return true
 	}
+	_, ok := b.TakeMaxDuration(int64(n), 0)
+	return ok
 }
 
 // In order to avoid lots of very short (and relatively expensive) sleeps, never sleep for
@@ -127,30 +143,46 @@ type bitrateConn struct {
 	WrapConnEmbeddable
 	net.Conn
 	limiter atomic.Pointer[RateLimiter]
+	// flow is the device's place in the egress Scheduler, if any. Writes
+	// wait for both it and the limiter, so the limiter stays a hard ceiling.
+	flow atomic.Pointer[Flow]
+	// upload, if set, limits the reads of this connection alone, on top of
+	// the limiter it shares with the device's other connections.
+	upload atomic.Pointer[RateLimiter]
 }
 
 func (c *bitrateConn) Read(p []byte) (n int, err error) {
 	b := c.limiter.Load().buckets.Load()
-	if b.rateRead == 0 {
+	u := c.upload.Load()
+	if b.rateRead == 0 && u == nil {
 		return c.Conn.Read(p)
 	}
 
 	n, err = c.Conn.Read(p)
 	if err == nil {
-		b.waitRead(n)
+		d := b.delayRead(n)
+		if u != nil {
+			d = max(d, u.buckets.Load().delayRead(n))
+		}
+		if d > 0 {
+			sleep(d)
+		}
 	}
 	return
 }
 
 func (c *bitrateConn) Write(p []byte) (n int, err error) {
 	b := c.limiter.Load().buckets.Load()
-	if b.rateWrite == 0 {
+	f := c.flow.Load()
+	if b.rateWrite == 0 && f == nil {
 		return c.Conn.Write(p)
 	}
 
 	n, err = c.Conn.Write(p)
 	if err == nil {
-		b.waitWrite(n)
+		if d := max(b.delayWrite(n), f.delay(n)); d > 0 {
+			sleep(d)
+		}
 	}
 	return
 }
@@ -164,8 +196,22 @@ func (c *bitrateConn) OnState(s http.ConnState) {
 
 func (c *bitrateConn) ControlMessage(msgType string, data interface{}) {
 	// per user message always overrides the active flag
-	if msgType == "throttle" {
+	switch msgType {
+	case "throttle":
 		c.limiter.Store(data.(*RateLimiter))
+	case "schedule":
+		c.flow.Store(data.(*Flow))
+	case "upload":
+		// Sent with every request on the connection, so keep the bucket
+		// unless the rate changed.
+		rate := data.(int64)
+		if cur := c.upload.Load(); cur == nil || cur.GetRateRead() != rate {
+			if rate > 0 {
+				c.upload.Store(NewRateLimiter(rate, 0))
+			} else {
+				c.upload.Store(nil)
+			}
+		}
 	}
 
 	if c.WrapConnEmbeddable != nil {
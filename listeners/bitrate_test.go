@@ -254,3 +254,57 @@ func TestSetRatesKeepsBucketsWhenUnchanged(t *testing.T) {
 	assert.Equal(t, int64(500), l.GetRateWrite())
 	assert.Equal(t, int64(1000), l.GetRateRead())
 }
+
+func TestAllowDropsOverTheRate(t *testing.T) {
+	l := NewRateLimiter(1000, 0)
+	assert.True(t, l.AllowRead(600))
+	assert.False(t, l.AllowRead(600), "a packet over the rate should be dropped")
+	assert.True(t, l.AllowRead(400), "a smaller one should still fit")
+	for i := 0; i < 10; i++ {
+		assert.True(t, l.AllowWrite(100000), "an unlimited rate should allow anything")
+	}
+}
+
+func TestPerConnectionUploadLimit(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error creating listener: %v", err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	bl := NewBitrateListener(ln)
+	go func() {
+		c, _ := bl.Accept()
+		accepted <- c
+	}()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Error connecting to local server: %v", err)
+	}
+	defer client.Close()
+	conn := (<-accepted).(*bitrateConn)
+	defer conn.Close()
+
+	conn.ControlMessage("throttle", NewRateLimiter(0, 0))
+	conn.ControlMessage("upload", int64(8192))
+	limiter := conn.upload.Load()
+	conn.ControlMessage("upload", int64(8192))
+	assert.Same(t, limiter, conn.upload.Load(), "an unchanged rate should keep the bucket")
+
+	go client.Write(make([]byte, 4*4096))
+	b := make([]byte, 4096)
+	start := time.Now()
+	for read := 0; read < 4*4096; {
+		n, err := conn.Read(b)
+		if err != nil {
+			t.Fatalf("Error reading: %v", err)
+		}
+		read += n
+	}
+	assert.Greater(t, time.Since(start), 500*time.Millisecond, "reads should be held to the connection's upload rate")
+
+	conn.ControlMessage("upload", int64(0))
+	assert.Nil(t, conn.upload.Load(), "a zero rate should lift the limit")
+}
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/getlantern/measured"
+	"github.com/getlantern/netx"
 )
 
 const (
@@ -124,3 +125,20 @@ func (c *wrapMeasuredConn) ControlMessage(msgType string, data interface{}) {
 func (c *wrapMeasuredConn) Wrapped() net.Conn {
 	return c.Conn
 }
+
+// MeasuredContext returns the context conn is reported to the measured
+// listener's MeasuredReportFN with, or nil if conn isn't measured. It must not
+// be modified.
+func MeasuredContext(conn net.Conn) map[string]interface{} {
+	var ctx map[string]interface{}
+	netx.WalkWrapped(conn, func(conn net.Conn) bool {
+		if mc, ok := conn.(*wrapMeasuredConn); ok {
+			mc.ctxMx.RLock()
+			ctx = mc.ctx
+			mc.ctxMx.RUnlock()
+			return false
+		}
+		return true
+	})
+	return ctx
+}
@@ -0,0 +1,343 @@
+package listeners
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// scheduleInterval is how often the Scheduler measures what each device
+	// wrote and divides the capacity anew.
+	scheduleInterval = 250 * time.Millisecond
+
+	// contentionThreshold is the share of the capacity the devices must be
+	// writing at, all together, before any of them is held to a fair share.
+	// Below it, every device writes as fast as its own limiter allows.
+	contentionThreshold = 0.9
+
+	// saturationThreshold is how much of its share a device must have used to
+	// count as held back by it, and so as wanting more than it got.
+	saturationThreshold = 0.9
+
+	// demandHeadroom is how far a device that wasn't held back may speed up
+	// before the next division notices.
+	demandHeadroom = 1.25
+
+	// probeHeadroom is how much more than a measured capacity the shares add
+	// up to. The busiest moment so far might not have saturated the link, and
+	// without some slack the estimate could never grow past it.
+	probeHeadroom = 1.1
+
+	// peakDecay is applied to the measured capacity on every division, so
+	// that a link that got slower (e.g. to a noisy neighbor) is eventually
+	// noticed. It halves about every 45 seconds without traffic.
+	peakDecay = 0.996
+
+	// minFlowRate is the smallest share a device gets under contention, so
+	// that one that was idle during the last interval can start again.
+	minFlowRate = 16 * 1024
+
+	// idleFlowTTL is how long a device that hasn't written anything is kept
+	// around. Like the datacap tracker's device TTL, it must comfortably
+	// exceed the proxy's idle-close timeout, as connections keep the Flow
+	// they were attached with while a re-appearing device gets a new one.
+	idleFlowTTL = 30 * time.Minute
+)
+
+// Scheduler shares the host's egress capacity among the devices writing
+// through it by weighted max-min fairness. As long as all of them together
+// stay clear of the capacity, no one is slowed down. Under contention, each
+// device gets a share of the capacity in proportion to its weight, and what a
+// device doesn't use of its share is lent to the ones that want more.
+//
+// The capacity is either configured or, by default, the highest rate the
+// devices have written at so far. Either way the Scheduler only ever slows
+// devices down: their own limiters, such as the datacap throttle, still apply
+// on top of their shares.
+type Scheduler struct {
+	mx        sync.Mutex
+	flows     map[string]*Flow
+	capacity  int64
+	peak      float64
+	rate      float64
+	contended bool
+	last      time.Time
+}
+
+// Flow is one device's place in the Scheduler, shared by all of its
+// connections. Its rate is changed in place as the shares are divided anew.
+type Flow struct {
+	mx      sync.Mutex
+	written int64
+	// share is in bytes per second, zero meaning unlimited.
+	share  float64
+	tokens float64
+	refill time.Time
+
+	// Only accessed by the Scheduler while holding its lock.
+	weight     float64
+	measured   float64
+	lastActive time.Time
+}
+
+// FlowStatus is a snapshot of one device's Flow, for introspection.
+type FlowStatus struct {
+	DeviceID string  `json:"deviceId"`
+	Weight   float64 `json:"weight"`
+	// Rate is how fast the device wrote during the last interval and Share how
+	// fast it may write now, both in bytes per second. A zero Share means
+	// unlimited.
+	Rate  int64 `json:"rate"`
+	Share int64 `json:"share"`
+}
+
+// SchedulerStatus is a snapshot of a Scheduler, for introspection.
+type SchedulerStatus struct {
+	// Capacity is the egress capacity being shared in bytes per second, and
+	// Measured whether it was measured rather than configured.
+	Capacity  int64        `json:"capacity"`
+	Measured  bool         `json:"measured"`
+	Rate      int64        `json:"rate"`
+	Contended bool         `json:"contended"`
+	Flows     []FlowStatus `json:"flows"`
+}
+
+// NewScheduler starts a Scheduler sharing capacity bytes per second, or the
+// measured capacity if capacity is zero.
+func NewScheduler(capacity int64) *Scheduler {
+	s := newScheduler(capacity, time.Now())
+	go s.schedulePeriodically()
+	return s
+}
+
+func newScheduler(capacity int64, now time.Time) *Scheduler {
+	return &Scheduler{
+		flows:    make(map[string]*Flow),
+		capacity: capacity,
+		last:     now,
+	}
+}
+
+// SetCapacity changes the capacity being shared, e.g. after a config reload.
+// Zero measures it instead.
+func (s *Scheduler) SetCapacity(capacity int64) {
+	s.mx.Lock()
+	s.capacity = capacity
+	s.mx.Unlock()
+}
+
+// Flow returns the Flow to attach to the connections of deviceID, with the
+// given weight relative to other devices. Weights that aren't positive count
+// as 1.
+func (s *Scheduler) Flow(deviceID string, weight float64) *Flow {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	f, exists := s.flows[deviceID]
+	if !exists {
+		f = &Flow{lastActive: time.Now()}
+		s.flows[deviceID] = f
+	}
+	if weight <= 0 {
+		weight = 1
+	}
+	// the device may have just become pro
+	f.weight = weight
+	return f
+}
+
+// Status returns a snapshot of the Scheduler with its flows sorted by device
+// ID.
+func (s *Scheduler) Status() SchedulerStatus {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	capacity, measured := s.effectiveCapacity()
+	status := SchedulerStatus{
+		Capacity:  int64(capacity),
+		Measured:  measured,
+		Rate:      int64(s.rate),
+		Contended: s.contended,
+		Flows:     make([]FlowStatus, 0, len(s.flows)),
+	}
+	for deviceID, f := range s.flows {
+		f.mx.Lock()
+		share := f.share
+		f.mx.Unlock()
+		status.Flows = append(status.Flows, FlowStatus{
+			DeviceID: deviceID,
+			Weight:   f.weight,
+			Rate:     int64(f.measured),
+			Share:    int64(share),
+		})
+	}
+	sort.Slice(status.Flows, func(i, j int) bool { return status.Flows[i].DeviceID < status.Flows[j].DeviceID })
+	return status
+}
+
+func (s *Scheduler) effectiveCapacity() (capacity float64, measured bool) {
+	if s.capacity > 0 {
+		return float64(s.capacity), false
+	}
+	return s.peak, true
+}
+
+func (s *Scheduler) schedulePeriodically() {
+	ticker := time.NewTicker(scheduleInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		s.schedule(now)
+	}
+}
+
+// schedule measures what every device wrote since the last call and divides
+// the capacity among them accordingly.
+func (s *Scheduler) schedule(now time.Time) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	elapsed := now.Sub(s.last).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	s.last = now
+
+	flows := make([]*Flow, 0, len(s.flows))
+	total := 0.0
+	for deviceID, f := range s.flows {
+		written := f.takeWritten()
+		if written > 0 {
+			f.lastActive = now
+		} else if now.Sub(f.lastActive) > idleFlowTTL {
+			delete(s.flows, deviceID)
+			continue
+		}
+		f.measured = float64(written) / elapsed
+		total += f.measured
+		flows = append(flows, f)
+	}
+	s.rate = total
+	if s.capacity <= 0 {
+		s.peak = math.Max(s.peak*peakDecay, total)
+	}
+
+	capacity, measured := s.effectiveCapacity()
+	contended := capacity > 0 && total >= contentionThreshold*capacity
+	if contended != s.contended {
+		s.contended = contended
+		log.Debugf("Egress contended: %v, writing %.0f of %.0f bytes per second", contended, total, capacity)
+	}
+	if !contended {
+		for _, f := range flows {
+			f.setShare(0, now)
+		}
+		return
+	}
+
+	if measured {
+		capacity *= probeHeadroom
+	}
+	wants := make([]float64, len(flows))
+	weights := make([]float64, len(flows))
+	for i, f := range flows {
+		weights[i] = f.weight
+		prevShare := f.currentShare()
+		switch {
+		case f.measured == 0:
+			wants[i] = minFlowRate
+		case prevShare == 0 || f.measured >= saturationThreshold*prevShare:
+			// Held back, whether by its share or, while there were no shares,
+			// by the link itself.
+			wants[i] = math.Inf(1)
+		default:
+			wants[i] = math.Max(minFlowRate, f.measured*demandHeadroom)
+		}
+	}
+	for i, share := range fairShares(capacity, wants, weights) {
+		flows[i].setShare(math.Max(share, 1), now)
+	}
+}
+
+// fairShares divides capacity among flows wanting wants by weighted max-min
+// fairness: flows wanting less than their weighted share get what they want,
+// and the rest is divided among the others in proportion to their weights.
+func fairShares(capacity float64, wants, weights []float64) []float64 {
+	order := make([]int, len(wants))
+	totalWeight := 0.0
+	for i := range order {
+		order[i] = i
+		totalWeight += weights[i]
+	}
+	sort.Slice(order, func(a, b int) bool {
+		i, j := order[a], order[b]
+		return wants[i]/weights[i] < wants[j]/weights[j]
+	})
+
+	shares := make([]float64, len(wants))
+	remaining := capacity
+	for _, i := range order {
+		share := math.Min(wants[i], remaining*weights[i]/totalWeight)
+		shares[i] = share
+		remaining -= share
+		totalWeight -= weights[i]
+	}
+	return shares
+}
+
+func (f *Flow) takeWritten() int64 {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	written := f.written
+	f.written = 0
+	return written
+}
+
+func (f *Flow) currentShare() float64 {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	return f.share
+}
+
+// setShare re-rates the flow. Tokens accrued at the old rate are kept, so
+// that re-rating every interval doesn't hand out a fresh burst every time.
+func (f *Flow) setShare(share float64, now time.Time) {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	if f.share > 0 {
+		f.refillTokens(now)
+	} else {
+		f.tokens = share * scheduleInterval.Seconds()
+	}
+	f.share = share
+	f.refill = now
+}
+
+// refillTokens adds the tokens accrued since the last refill, up to one
+// interval's worth.
+func (f *Flow) refillTokens(now time.Time) {
+	f.tokens += now.Sub(f.refill).Seconds() * f.share
+	if burst := f.share * scheduleInterval.Seconds(); f.tokens > burst {
+		f.tokens = burst
+	}
+	f.refill = now
+}
+
+// delay records that n bytes were written and returns how long the writer
+// should wait to stay within the flow's share. It's safe to call on a nil
+// Flow.
+func (f *Flow) delay(n int) time.Duration {
+	if f == nil {
+		return 0
+	}
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	f.written += int64(n)
+	if f.share == 0 {
+		return 0
+	}
+	f.refillTokens(time.Now())
+	f.tokens -= float64(n)
+	if f.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-f.tokens / f.share * float64(time.Second))
+}
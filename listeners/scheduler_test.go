@@ -0,0 +1,165 @@
+package listeners
+
+import (
+	"io"
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFairShares(t *testing.T) {
+	inf := math.Inf(1)
+	assert.Equal(t, []float64{100, 200}, fairShares(300, []float64{inf, inf}, []float64{1, 2}),
+		"hungry flows should split the capacity by weight")
+	assert.Equal(t, []float64{125, 50, 125}, fairShares(300, []float64{inf, 50, inf}, []float64{1, 1, 1}),
+		"what one flow doesn't want should be lent to the others")
+	assert.Equal(t, []float64{10, 20}, fairShares(300, []float64{10, 20}, []float64{1, 1}),
+		"flows should never get more than they want")
+}
+
+// write records n bytes written through f as a connection would.
+func write(f *Flow, n int) {
+	f.delay(n)
+}
+
+func TestScheduleUncontended(t *testing.T) {
+	start := time.Now()
+	s := newScheduler(10e6, start)
+	a, b := s.Flow("a", 1), s.Flow("b", 1)
+	write(a, 3e6)
+	write(b, 3e6)
+	s.schedule(start.Add(time.Second))
+
+	status := s.Status()
+	assert.False(t, status.Contended)
+	assert.EqualValues(t, 6e6, status.Rate)
+	for _, f := range status.Flows {
+		assert.Zero(t, f.Share, "%v should be unlimited while the capacity isn't contended", f.DeviceID)
+	}
+}
+
+func TestScheduleContended(t *testing.T) {
+	start := time.Now()
+	s := newScheduler(12e6, start)
+	a, b, c := s.Flow("a", 1), s.Flow("b", 1), s.Flow("c", 2)
+	write(a, 6e6)
+	write(b, 4e6)
+	write(c, 4e6)
+	s.schedule(start.Add(time.Second))
+	assert.True(t, s.Status().Contended)
+	assert.EqualValues(t, 3e6, a.currentShare())
+	assert.EqualValues(t, 3e6, b.currentShare())
+	assert.EqualValues(t, 6e6, c.currentShare(), "c should get twice the share for twice the weight")
+
+	// b no longer uses its whole share, so what it leaves is lent to a and c
+	write(a, 3e6)
+	write(b, 2e6)
+	write(c, 6e6)
+	s.schedule(start.Add(2 * time.Second))
+	assert.True(t, s.Status().Contended)
+	assert.EqualValues(t, 2.5e6, b.currentShare(), "b should be given some room to speed up again")
+	assert.InDelta(t, 9.5e6/3, a.currentShare(), 1)
+	assert.InDelta(t, 2*9.5e6/3, c.currentShare(), 1)
+
+	// once the load drops, everyone is unlimited again
+	write(a, 1e6)
+	s.schedule(start.Add(3 * time.Second))
+	assert.False(t, s.Status().Contended)
+	assert.Zero(t, a.currentShare())
+	assert.Zero(t, b.currentShare())
+	assert.Zero(t, c.currentShare())
+}
+
+func TestScheduleMeasuredCapacity(t *testing.T) {
+	start := time.Now()
+	s := newScheduler(0, start)
+	a, b := s.Flow("a", 1), s.Flow("b", 1)
+	write(a, 1e6)
+	write(b, 1e6)
+	s.schedule(start.Add(time.Second))
+
+	status := s.Status()
+	assert.True(t, status.Measured)
+	assert.EqualValues(t, 2e6, status.Capacity)
+	assert.True(t, status.Contended, "writing at the fastest rate seen so far should count as contended")
+	assert.InDelta(t, 1.1e6, a.currentShare(), 1, "shares should leave room to find out the link is faster")
+
+	s.SetCapacity(100e6)
+	write(a, 1e6)
+	write(b, 1e6)
+	s.schedule(start.Add(2 * time.Second))
+	status = s.Status()
+	assert.False(t, status.Measured)
+	assert.False(t, status.Contended)
+}
+
+func TestScheduleEvictsIdleFlows(t *testing.T) {
+	start := time.Now()
+	s := newScheduler(10e6, start)
+	a := s.Flow("a", 1)
+	s.Flow("b", 1)
+	s.schedule(start.Add(idleFlowTTL / 2))
+	write(a, 1)
+	s.schedule(start.Add(idleFlowTTL + time.Minute))
+
+	flows := s.Status().Flows
+	if assert.Len(t, flows, 1) {
+		assert.Equal(t, "a", flows[0].DeviceID)
+	}
+	assert.Same(t, a, s.Flow("a", 1))
+}
+
+func TestFlowDelay(t *testing.T) {
+	f := &Flow{}
+	assert.Zero(t, f.delay(1e6), "an unlimited flow should never delay")
+
+	f.setShare(1000, time.Now())
+	assert.Zero(t, f.delay(250), "a burst of one interval should go through")
+	assert.InDelta(t, time.Second, f.delay(1000), float64(50*time.Millisecond))
+
+	var nilFlow *Flow
+	assert.Zero(t, nilFlow.delay(1000))
+}
+
+func TestScheduledConn(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	type accept struct {
+		conn net.Conn
+		err  error
+	}
+	accepted := make(chan accept, 1)
+	bl := NewBitrateListener(ln)
+	go func() {
+		c, err := bl.Accept()
+		accepted <- accept{c, err}
+	}()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	go io.Copy(io.Discard, client)
+
+	res := <-accepted
+	require.NoError(t, res.err)
+	defer res.conn.Close()
+
+	f := &Flow{}
+	res.conn.(*bitrateConn).ControlMessage("schedule", f)
+	f.setShare(8192, time.Now())
+
+	payload := make([]byte, 4096)
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		_, err := res.conn.Write(payload)
+		require.NoError(t, err)
+	}
+	assert.Greater(t, time.Since(start), 1500*time.Millisecond, "the conn should be held to its flow's share")
+	assert.EqualValues(t, 4*4096, f.takeWritten())
+}
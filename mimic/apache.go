@@ -1,8 +1,3 @@
-/*
-Package mimic mimics popular web servers to keep the server from being detected
-Currently it only mimics Apache web server.
-*/
-
 package mimic
 
 import (
@@ -11,15 +6,8 @@ import (
 	"fmt"
 	"net"
 	"net/http"
-	"sync"
 	"text/template"
 	"time"
-
-	"github.com/getlantern/golog"
-)
-
-var (
-	log = golog.LoggerFor("apache")
 )
 
 type apacheMimic struct {
@@ -31,38 +19,17 @@ type apacheMimic struct {
 const timeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
 
 var (
-	Host         string
-	Port         string
 	lastModified = time.Now().Format(timeFormat)
 	etag         = makeETag()
-	mutex        = &sync.Mutex{}
 )
 
-func SetServerAddr(addr string) {
-	host, port, err := net.SplitHostPort(addr)
-	if err != nil {
-		panic("should not happen")
-	}
-	mutex.Lock()
-	Host = host
-	Port = port
-	mutex.Unlock()
-}
-
 // Apache mimics the behaviour of an unconfigured Apache web server 2.4.7
 // (the one installed by 'apt-get install apache2') running on Ubuntu 14.04.
 // Set 'Host' and 'Port' before calling it.
 func Apache(conn net.Conn, req *http.Request) {
 	ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
 	log.Tracef("Mimicking apache to client at %v", ip)
-	path := req.URL.Path
-	// remove extra leading slash
-	if len(path) > 0 && path[0] == '/' {
-		i := 1
-		for ; i < len(path) && path[i] == '/'; i++ {
-		}
-		path = path[i-1:]
-	}
+	path := trimLeadingSlashes(req.URL.Path)
 	m := apacheMimic{conn, req, path}
 	if req.Host == "" {
 		m.writeError(badRequestHeader, badRequestBody)
@@ -155,13 +122,14 @@ type vars struct {
 }
 
 func (f *apacheMimic) collectVars() *vars {
+	host, port := serverAddr()
 	return &vars{
 		Date:         time.Now().Format(timeFormat),
 		LastModified: lastModified,
 		ETag:         etag,
 		Path:         f.path,
-		Host:         Host,
-		Port:         Port,
+		Host:         host,
+		Port:         port,
 	}
 }
 
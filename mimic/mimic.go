@@ -0,0 +1,107 @@
+/*
+Package mimic mimics popular web servers to keep the server from being detected.
+
+Each persona answers like a freshly installed web server: an unconfigured
+Apache 2.4.7 on Ubuntu 14.04 (the original persona), Apache on Debian, nginx
+on Ubuntu, Caddy or a static site served by nginx from a directory of files.
+Alternatively, requests can be passed on to a real website.
+*/
+package mimic
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/golog"
+)
+
+var (
+	log = golog.LoggerFor("mimic")
+)
+
+var (
+	Host  string
+	Port  string
+	mutex = &sync.Mutex{}
+)
+
+func SetServerAddr(addr string) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		panic("should not happen")
+	}
+	mutex.Lock()
+	Host = host
+	Port = port
+	mutex.Unlock()
+}
+
+// serverAddr returns the Host and Port set with SetServerAddr.
+func serverAddr() (host, port string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return Host, Port
+}
+
+// Mimic answers requests the way some web server would, so that probing the
+// proxy without authenticating reveals nothing but that web server.
+type Mimic interface {
+	// Respond writes the response to req to conn. The caller closes conn.
+	Respond(conn net.Conn, req *http.Request)
+}
+
+// Func adapts an ordinary function to a Mimic.
+type Func func(conn net.Conn, req *http.Request)
+
+func (f Func) Respond(conn net.Conn, req *http.Request) {
+	f(conn, req)
+}
+
+// Parse returns the persona named by spec, one of:
+//
+//	apache         Apache 2.4.7 on Ubuntu 14.04, the default
+//	apache-debian  Apache 2.4 on Debian 12
+//	nginx          nginx 1.24 on Ubuntu 24.04
+//	caddy          Caddy 2
+//	static:<dir>   nginx serving the files in dir, with dir/404.html, if
+//	               present, as its 404 page
+//	site:<target>  the website at target, an http(s):// URL to relay
+//	               requests to or a directory to serve files from
+func Parse(spec string) (Mimic, error) {
+	switch spec {
+	case "", "apache":
+		return Func(Apache), nil
+	case "apache-debian":
+		return newPersona(apacheDebian, builtinSite("apache-debian")), nil
+	case "nginx":
+		return newPersona(nginx, builtinSite("nginx")), nil
+	case "caddy":
+		return newPersona(caddy, builtinSite("caddy")), nil
+	}
+	if dir, ok := strings.CutPrefix(spec, "static:"); ok {
+		s, err := loadSite(dir)
+		if err != nil {
+			return nil, err
+		}
+		return newPersona(nginx, s), nil
+	}
+	if target, ok := strings.CutPrefix(spec, "site:"); ok {
+		return newReverseProxy(target)
+	}
+	return nil, errors.New("unknown mimic persona %q, must be apache, apache-debian, nginx, caddy, static:<dir> or site:<target>", spec)
+}
+
+// trimLeadingSlashes collapses the leading slashes of path into one, like
+// web servers do when mapping paths to files.
+func trimLeadingSlashes(path string) string {
+	if len(path) > 0 && path[0] == '/' {
+		i := 1
+		for ; i < len(path) && path[i] == '/'; i++ {
+		}
+		path = path[i-1:]
+	}
+	return path
+}
@@ -0,0 +1,413 @@
+package mimic
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"html"
+	"io/fs"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getlantern/errors"
+)
+
+//go:embed pages
+var pages embed.FS
+
+// installTime is when the built-in pages claim to have been last modified.
+// Using the modification time of our own executable keeps it stable across
+// restarts and plausibly close to when the web server was installed.
+var installTime = func() time.Time {
+	if exe, err := os.Executable(); err == nil {
+		if fi, err := os.Stat(exe); err == nil {
+			return fi.ModTime().Truncate(time.Second)
+		}
+	}
+	return time.Now().Truncate(time.Second)
+}()
+
+// page is a file served by a persona.
+type page struct {
+	body        []byte
+	contentType string // without parameters
+	modTime     time.Time
+}
+
+// site maps request paths to the pages served at them.
+type site map[string]*page
+
+// builtinSite returns the pages embedded for the named persona.
+func builtinSite(name string) site {
+	s, err := readSite(pages, "pages/"+name, func(fs.FileInfo) time.Time { return installTime })
+	if err != nil {
+		panic(fmt.Sprintf("unable to read built-in pages for %v: %v", name, err))
+	}
+	return s
+}
+
+// loadSite reads the files under dir into a site.
+func loadSite(dir string) (site, error) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return nil, errors.New("unable to load static site: %v", err)
+	}
+	if !fi.IsDir() {
+		return nil, errors.New("unable to load static site: %v is not a directory", dir)
+	}
+	s, err := readSite(os.DirFS(dir), ".", fs.FileInfo.ModTime)
+	if err != nil {
+		return nil, errors.New("unable to load static site from %v: %v", dir, err)
+	}
+	if len(s) == 0 {
+		return nil, errors.New("static site directory %v is empty", dir)
+	}
+	return s, nil
+}
+
+func readSite(fsys fs.FS, root string, modTime func(fs.FileInfo) time.Time) (site, error) {
+	s := make(site)
+	err := fs.WalkDir(fsys, root, func(name string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		body, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel := name
+		if root != "." {
+			rel = strings.TrimPrefix(name, root+"/")
+		}
+		contentType, _, _ := strings.Cut(mime.TypeByExtension(filepath.Ext(name)), ";")
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		s["/"+rel] = &page{body: body, contentType: contentType, modTime: modTime(fi)}
+		return nil
+	})
+	return s, err
+}
+
+// lookup returns the page at the request path p, serving index.html for
+// directories, or nil if there is none.
+func (s site) lookup(p string) *page {
+	if !strings.HasPrefix(p, "/") {
+		return nil
+	}
+	clean := path.Clean(p)
+	if strings.HasSuffix(p, "/") {
+		return s[path.Join(clean, "index.html")]
+	}
+	return s[clean]
+}
+
+// response is a raw HTTP response, with its headers in the order a
+// particular server would send them.
+type response struct {
+	status  string
+	headers []string
+	body    []byte
+
+	// bodyOnHead sends the body even in response to HEAD.
+	bodyOnHead bool
+}
+
+func newResponse(code int, statusText string) *response {
+	return &response{status: strconv.Itoa(code) + " " + statusText}
+}
+
+func (r *response) add(name, value string) {
+	r.headers = append(r.headers, name+": "+value)
+}
+
+func (r *response) write(conn net.Conn, head bool) {
+	var buf bytes.Buffer
+	buf.WriteString("HTTP/1.1 " + r.status + "\r\n")
+	for _, h := range r.headers {
+		buf.WriteString(h + "\r\n")
+	}
+	buf.WriteString("\r\n")
+	if !head || r.bodyOnHead {
+		buf.Write(r.body)
+	}
+	// ignore any errors writing back to connection
+	_, _ = buf.WriteTo(conn)
+}
+
+// server is the web server software a persona claims to be, deciding how
+// requests are answered, how pages are tagged and what errors look like.
+type server interface {
+	respond(req *http.Request, s site) *response
+}
+
+// persona is a Mimic serving a site the way a particular server would.
+type persona struct {
+	server server
+	site   site
+}
+
+func newPersona(server server, s site) *persona {
+	return &persona{server: server, site: s}
+}
+
+func (m *persona) Respond(conn net.Conn, req *http.Request) {
+	ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	log.Tracef("Mimicking %T to client at %v", m.server, ip)
+	m.server.respond(req, m.site).write(conn, req.Method == http.MethodHead)
+}
+
+func httpDate(t time.Time) string {
+	return t.UTC().Format(http.TimeFormat)
+}
+
+// notModified reports whether a conditional request may be answered with 304
+// Not Modified, giving If-None-Match precedence over If-Modified-Since.
+func notModified(req *http.Request, etag string, modTime time.Time) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == etag {
+				return true
+			}
+		}
+		return false
+	}
+	if ims, err := http.ParseTime(req.Header.Get("If-Modified-Since")); err == nil {
+		return !modTime.After(ims)
+	}
+	return false
+}
+
+// apacheServer is a stock Apache 2.4 with its default configuration.
+type apacheServer struct {
+	version string
+}
+
+var apacheDebian = &apacheServer{version: "Apache/2.4.62 (Debian)"}
+
+func (a *apacheServer) respond(req *http.Request, s site) *response {
+	p := trimLeadingSlashes(req.URL.Path)
+	if req.Host == "" || req.Method == http.MethodConnect {
+		return a.error(req, http.StatusBadRequest, "Bad Request",
+			"<p>Your browser sent a request that this server could not understand.<br />\n</p>")
+	}
+	pg := s.lookup(p)
+	switch {
+	case !KNOWN_METHODS[req.Method]:
+		return a.error(req, http.StatusNotImplemented, "Not Implemented",
+			fmt.Sprintf("<p>%v not supported for current URL.<br />\n</p>", html.EscapeString(req.Method)))
+	case req.Method == http.MethodOptions:
+		resp := newResponse(http.StatusOK, "OK")
+		resp.add("Date", httpDate(time.Now()))
+		resp.add("Server", a.version)
+		resp.add("Allow", "GET,POST,OPTIONS,HEAD")
+		resp.add("Content-Length", "0")
+		if pg != nil {
+			resp.add("Content-Type", pg.contentType)
+		}
+		return resp
+	case !ALLOWED_METHODS[req.Method]:
+		return a.error(req, http.StatusMethodNotAllowed, "Method Not Allowed",
+			fmt.Sprintf("<p>The requested method %v is not allowed for this URL.</p>", html.EscapeString(req.Method)))
+	case pg == nil:
+		return a.error(req, http.StatusNotFound, "Not Found",
+			"<p>The requested URL was not found on this server.</p>")
+	}
+
+	etag := fmt.Sprintf(`"%x-%x"`, len(pg.body), pg.modTime.UnixMicro())
+	if notModified(req, etag, pg.modTime) {
+		resp := newResponse(http.StatusNotModified, "Not Modified")
+		resp.add("Date", httpDate(time.Now()))
+		resp.add("Server", a.version)
+		resp.add("ETag", etag)
+		return resp
+	}
+	resp := newResponse(http.StatusOK, "OK")
+	resp.add("Date", httpDate(time.Now()))
+	resp.add("Server", a.version)
+	resp.add("Last-Modified", httpDate(pg.modTime))
+	resp.add("ETag", etag)
+	resp.add("Accept-Ranges", "bytes")
+	resp.add("Content-Length", strconv.Itoa(len(pg.body)))
+	if strings.HasPrefix(pg.contentType, "text/") {
+		resp.add("Vary", "Accept-Encoding")
+	}
+	resp.add("Content-Type", pg.contentType)
+	resp.body = pg.body
+	return resp
+}
+
+func (a *apacheServer) error(req *http.Request, code int, title, message string) *response {
+	resp := newResponse(code, http.StatusText(code))
+	host, port := serverAddr()
+	resp.body = []byte(fmt.Sprintf(`<!DOCTYPE HTML PUBLIC "-//IETF//DTD HTML 2.0//EN">
+<html><head>
+<title>%d %v</title>
+</head><body>
+<h1>%v</h1>
+%v
+<hr>
+<address>%v Server at %v Port %v</address>
+</body></html>
+`, code, http.StatusText(code), title, message, a.version, host, port))
+	resp.add("Date", httpDate(time.Now()))
+	resp.add("Server", a.version)
+	if code == http.StatusMethodNotAllowed || code == http.StatusNotImplemented {
+		resp.add("Allow", "GET,POST,OPTIONS,HEAD")
+	}
+	if req.Method != http.MethodHead {
+		resp.add("Content-Length", strconv.Itoa(len(resp.body)))
+	}
+	if code == http.StatusBadRequest || code == http.StatusNotImplemented {
+		resp.add("Connection", "close")
+	}
+	resp.add("Content-Type", "text/html; charset=iso-8859-1")
+	return resp
+}
+
+// nginxServer is nginx serving static files with its default configuration.
+type nginxServer struct {
+	version string
+}
+
+var nginx = &nginxServer{version: "nginx/1.24.0 (Ubuntu)"}
+
+func (n *nginxServer) respond(req *http.Request, s site) *response {
+	if req.Host == "" || strings.IndexFunc(req.Method, func(r rune) bool { return (r < 'A' || r > 'Z') && r != '_' && r != '-' }) >= 0 {
+		return n.error(s, http.StatusBadRequest)
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead && req.Method != http.MethodPost {
+		return n.error(s, http.StatusMethodNotAllowed)
+	}
+	pg := s.lookup(trimLeadingSlashes(req.URL.Path))
+	if pg == nil {
+		return n.error(s, http.StatusNotFound)
+	}
+	if req.Method == http.MethodPost {
+		return n.error(s, http.StatusMethodNotAllowed)
+	}
+
+	etag := fmt.Sprintf(`"%x-%x"`, pg.modTime.Unix(), len(pg.body))
+	if notModified(req, etag, pg.modTime) {
+		resp := newResponse(http.StatusNotModified, "Not Modified")
+		resp.add("Server", n.version)
+		resp.add("Date", httpDate(time.Now()))
+		resp.add("Last-Modified", httpDate(pg.modTime))
+		resp.add("Connection", "keep-alive")
+		resp.add("ETag", etag)
+		return resp
+	}
+	resp := newResponse(http.StatusOK, "OK")
+	resp.add("Server", n.version)
+	resp.add("Date", httpDate(time.Now()))
+	resp.add("Content-Type", pg.contentType)
+	resp.add("Content-Length", strconv.Itoa(len(pg.body)))
+	resp.add("Last-Modified", httpDate(pg.modTime))
+	resp.add("Connection", "keep-alive")
+	resp.add("ETag", etag)
+	resp.add("Accept-Ranges", "bytes")
+	resp.body = pg.body
+	return resp
+}
+
+func (n *nginxServer) error(s site, code int) *response {
+	statusText := http.StatusText(code)
+	if code == http.StatusMethodNotAllowed {
+		statusText = "Not Allowed"
+	}
+	resp := newResponse(code, statusText)
+	contentType := "text/html"
+	if custom := s["/404.html"]; code == http.StatusNotFound && custom != nil {
+		resp.body = custom.body
+		contentType = custom.contentType
+	} else {
+		resp.body = []byte(fmt.Sprintf("<html>\r\n<head><title>%d %v</title></head>\r\n<body>\r\n"+
+			"<center><h1>%d %v</h1></center>\r\n<hr><center>%v</center>\r\n</body>\r\n</html>\r\n",
+			code, statusText, code, statusText, n.version))
+	}
+	resp.add("Server", n.version)
+	resp.add("Date", httpDate(time.Now()))
+	resp.add("Content-Type", contentType)
+	resp.add("Content-Length", strconv.Itoa(len(resp.body)))
+	if code == http.StatusBadRequest {
+		resp.add("Connection", "close")
+	} else {
+		resp.add("Connection", "keep-alive")
+	}
+	return resp
+}
+
+// caddyServer is Caddy 2 running its file server. Being written in Go, it
+// sends the headers its handlers set in sorted order, followed by the ones
+// net/http adds itself.
+type caddyServer struct{}
+
+var caddy = &caddyServer{}
+
+func (c *caddyServer) respond(req *http.Request, s site) *response {
+	if req.Host == "" {
+		// net/http's own response, sent before Caddy sees the request
+		resp := newResponse(http.StatusBadRequest, "Bad Request")
+		resp.add("Content-Type", "text/plain; charset=utf-8")
+		resp.add("Connection", "close")
+		resp.body = []byte("400 Bad Request: missing required Host header")
+		resp.bodyOnHead = true
+		return resp
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		resp := newResponse(http.StatusMethodNotAllowed, "Method Not Allowed")
+		resp.add("Allow", "GET, HEAD")
+		resp.add("Server", "Caddy")
+		resp.add("Date", httpDate(time.Now()))
+		resp.add("Content-Length", "0")
+		return resp
+	}
+	pg := s.lookup(trimLeadingSlashes(req.URL.Path))
+	if pg == nil {
+		resp := newResponse(http.StatusNotFound, "Not Found")
+		resp.add("Server", "Caddy")
+		resp.add("Date", httpDate(time.Now()))
+		resp.add("Content-Length", "0")
+		return resp
+	}
+
+	etag := `"` + strconv.FormatInt(pg.modTime.Unix(), 36) + strconv.FormatInt(int64(len(pg.body)), 36) + `"`
+	if notModified(req, etag, pg.modTime) {
+		resp := newResponse(http.StatusNotModified, "Not Modified")
+		resp.add("Etag", etag)
+		resp.add("Server", "Caddy")
+		resp.add("Vary", "Accept-Encoding")
+		resp.add("Date", httpDate(time.Now()))
+		return resp
+	}
+	contentType := pg.contentType
+	if strings.HasPrefix(contentType, "text/") {
+		contentType += "; charset=utf-8"
+	}
+	resp := newResponse(http.StatusOK, "OK")
+	resp.add("Accept-Ranges", "bytes")
+	resp.add("Content-Length", strconv.Itoa(len(pg.body)))
+	resp.add("Content-Type", contentType)
+	resp.add("Etag", etag)
+	resp.add("Last-Modified", httpDate(pg.modTime))
+	resp.add("Server", "Caddy")
+	resp.add("Vary", "Accept-Encoding")
+	resp.add("Date", httpDate(time.Now()))
+	resp.body = pg.body
+	return resp
+}
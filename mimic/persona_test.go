@@ -0,0 +1,159 @@
+package mimic
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// roundTrip has m respond to a request and returns the raw response.
+func roundTrip(t *testing.T, m Mimic, method, path string, headers ...string) string {
+	raw := method + " " + path + " HTTP/1.1\r\nHost: example.com\r\n" + strings.Join(headers, "") + "\r\n"
+	req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(raw)))
+	require.NoError(t, err)
+	client, server := net.Pipe()
+	go func() {
+		m.Respond(server, req)
+		server.Close()
+	}()
+	b, err := io.ReadAll(client)
+	require.NoError(t, err)
+	return string(b)
+}
+
+func parse(t *testing.T, raw, method string) (*http.Response, string) {
+	resp, err := http.ReadResponse(bufio.NewReader(strings.NewReader(raw)), &http.Request{Method: method})
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(body)
+}
+
+// headerNames returns the names of the headers in a raw response, in order.
+func headerNames(raw string) []string {
+	head, _, _ := strings.Cut(raw, "\r\n\r\n")
+	var names []string
+	for _, line := range strings.Split(head, "\r\n")[1:] {
+		name, _, _ := strings.Cut(line, ":")
+		names = append(names, name)
+	}
+	return names
+}
+
+func TestNginx(t *testing.T) {
+	m, err := Parse("nginx")
+	require.NoError(t, err)
+
+	raw := roundTrip(t, m, "GET", "/")
+	resp, body := parse(t, raw, "GET")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, body, "Welcome to nginx!")
+	assert.Equal(t, []string{"Server", "Date", "Content-Type", "Content-Length", "Last-Modified", "Connection", "ETag", "Accept-Ranges"}, headerNames(raw))
+	assert.Equal(t, "nginx/1.24.0 (Ubuntu)", resp.Header.Get("Server"))
+	assert.Regexp(t, `^"[0-9a-f]+-267"$`, resp.Header.Get("ETag"), "should tag with hex mtime and size")
+
+	resp, _ = parse(t, roundTrip(t, m, "GET", "/index.html", "If-None-Match: "+resp.Header.Get("ETag")+"\r\n"), "GET")
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+
+	resp, body = parse(t, roundTrip(t, m, "GET", "/wp-login.php"), "GET")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Contains(t, body, "<hr><center>nginx/1.24.0 (Ubuntu)</center>")
+
+	for _, method := range []string{"POST", "PUT", "OPTIONS", "CONNECT"} {
+		resp, _ = parse(t, roundTrip(t, m, method, "/"), method)
+		assert.Equal(t, "405 Not Allowed", resp.Status, method)
+	}
+
+	raw = roundTrip(t, m, "HEAD", "/")
+	resp, body = parse(t, raw, "HEAD")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.True(t, strings.HasSuffix(raw, "\r\n\r\n"), "should not send a body in response to HEAD")
+	assert.Equal(t, "615", resp.Header.Get("Content-Length"))
+}
+
+func TestApacheDebian(t *testing.T) {
+	m, err := Parse("apache-debian")
+	require.NoError(t, err)
+	SetServerAddr("192.0.2.1:443")
+
+	raw := roundTrip(t, m, "GET", "//index.html")
+	resp, body := parse(t, raw, "GET")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, body, "Apache2 Debian Default Page")
+	assert.Equal(t, []string{"Date", "Server", "Last-Modified", "ETag", "Accept-Ranges", "Content-Length", "Vary", "Content-Type"}, headerNames(raw))
+
+	resp, _ = parse(t, roundTrip(t, m, "GET", "/", "If-Modified-Since: "+resp.Header.Get("Last-Modified")+"\r\n"), "GET")
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+
+	resp, body = parse(t, roundTrip(t, m, "GET", "/cgi-bin/php"), "GET")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Contains(t, body, "<address>Apache/2.4.62 (Debian) Server at 192.0.2.1 Port 443</address>")
+
+	resp, _ = parse(t, roundTrip(t, m, "PUT", "/"), "PUT")
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	resp, _ = parse(t, roundTrip(t, m, "INVALID", "/"), "INVALID")
+	assert.Equal(t, http.StatusNotImplemented, resp.StatusCode)
+	resp, _ = parse(t, roundTrip(t, m, "OPTIONS", "/"), "OPTIONS")
+	assert.Equal(t, "GET,POST,OPTIONS,HEAD", resp.Header.Get("Allow"))
+}
+
+func TestCaddy(t *testing.T) {
+	m, err := Parse("caddy")
+	require.NoError(t, err)
+
+	raw := roundTrip(t, m, "GET", "/")
+	resp, body := parse(t, raw, "GET")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, body, "Caddy works!")
+	assert.Equal(t, []string{"Accept-Ranges", "Content-Length", "Content-Type", "Etag", "Last-Modified", "Server", "Vary", "Date"}, headerNames(raw))
+	assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+
+	raw = roundTrip(t, m, "GET", "/missing")
+	resp, body = parse(t, raw, "GET")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Empty(t, body)
+
+	resp, _ = parse(t, roundTrip(t, m, "POST", "/"), "POST")
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	assert.Equal(t, "GET, HEAD", resp.Header.Get("Allow"))
+}
+
+func TestStatic(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "index.html"), []byte("<h1>Hello</h1>"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "404.html"), []byte("<h1>Gone fishing</h1>"), 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "css"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "css", "site.css"), []byte("body {}"), 0644))
+
+	m, err := Parse("static:" + dir)
+	require.NoError(t, err)
+
+	_, body := parse(t, roundTrip(t, m, "GET", "/"), "GET")
+	assert.Equal(t, "<h1>Hello</h1>", body)
+	resp, body := parse(t, roundTrip(t, m, "GET", "/css/site.css"), "GET")
+	assert.Equal(t, "text/css", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "body {}", body)
+	resp, body = parse(t, roundTrip(t, m, "GET", "/css/"), "GET")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Equal(t, "<h1>Gone fishing</h1>", body)
+}
+
+func TestParse(t *testing.T) {
+	for _, spec := range []string{"", "apache"} {
+		m, err := Parse(spec)
+		require.NoError(t, err)
+		assert.IsType(t, Func(nil), m)
+	}
+	for _, spec := range []string{"iis", "static:", "static:/nonexistent"} {
+		_, err := Parse(spec)
+		assert.Error(t, err, spec)
+	}
+}
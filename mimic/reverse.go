@@ -0,0 +1,155 @@
+package mimic
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/getlantern/errors"
+)
+
+const (
+	// reverseProxyTimeout bounds how long the site we pass requests to may
+	// take to respond, so that probers can't tie up connections through it.
+	reverseProxyTimeout = 10 * time.Second
+
+	// lanternHeaderPrefix starts the names of the headers our clients send,
+	// which are never passed on to the site.
+	lanternHeaderPrefix = "X-Lantern-"
+)
+
+// reverseProxy is a Mimic that serves a real website, either one hosted
+// elsewhere that it relays requests to or the files in a local directory.
+// Unlike the other personas, it's whatever that site is that probers see, and
+// it changes as the site does.
+type reverseProxy struct {
+	handler http.Handler
+}
+
+// newReverseProxy creates a reverseProxy for target, an http(s):// URL or a
+// directory.
+func newReverseProxy(target string) (*reverseProxy, error) {
+	if !strings.HasPrefix(target, "http://") && !strings.HasPrefix(target, "https://") {
+		fi, err := os.Stat(target)
+		if err != nil {
+			return nil, errors.New("unable to serve site: %v", err)
+		}
+		if !fi.IsDir() {
+			return nil, errors.New("unable to serve site: %v is neither an http(s):// URL nor a directory", target)
+		}
+		return &reverseProxy{handler: http.FileServer(http.Dir(target))}, nil
+	}
+
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" {
+		return nil, errors.New("invalid site URL %v", target)
+	}
+	transport := &http.Transport{
+		DialContext:           (&net.Dialer{Timeout: reverseProxyTimeout}).DialContext,
+		TLSHandshakeTimeout:   reverseProxyTimeout,
+		ResponseHeaderTimeout: reverseProxyTimeout,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConnsPerHost:   10,
+	}
+	rp := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(u)
+			for name := range r.Out.Header {
+				if strings.HasPrefix(name, lanternHeaderPrefix) {
+					r.Out.Header.Del(name)
+				}
+			}
+		},
+		Transport: transport,
+		ModifyResponse: func(resp *http.Response) error {
+			// keep redirects on the site pointing at us rather than at the site
+			if loc, err := resp.Location(); err == nil && loc.Host == u.Host {
+				loc.Scheme, loc.Host = "", ""
+				resp.Header.Set("Location", loc.String())
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			log.Debugf("Unable to relay request for %v to %v: %v", req.URL.Path, u.Host, err)
+			w.Header().Set("Content-Length", "0")
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+	return &reverseProxy{handler: rp}, nil
+}
+
+func (m *reverseProxy) Respond(conn net.Conn, req *http.Request) {
+	ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	log.Tracef("Serving site to client at %v", ip)
+	w := newConnResponseWriter(conn, req.Method == http.MethodHead)
+	if req.Method == http.MethodConnect {
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(http.StatusBadRequest)
+	} else {
+		// requests to proxies carry absolute URLs, which sites don't expect
+		req.URL.Scheme, req.URL.Host = "", ""
+		m.handler.ServeHTTP(w, req)
+	}
+	w.Flush()
+}
+
+// connResponseWriter is an http.ResponseWriter writing straight to a
+// connection. Responses without a Content-Length are delimited by closing the
+// connection, which the caller does once we're done.
+type connResponseWriter struct {
+	bw          *bufio.Writer
+	header      http.Header
+	head        bool
+	wroteHeader bool
+}
+
+func newConnResponseWriter(conn net.Conn, head bool) *connResponseWriter {
+	return &connResponseWriter{bw: bufio.NewWriter(conn), header: make(http.Header), head: head}
+}
+
+func (w *connResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *connResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if w.header.Get("Date") == "" {
+		w.header.Set("Date", httpDate(time.Now()))
+	}
+	if w.header.Get("Content-Length") == "" {
+		w.header.Set("Connection", "close")
+	}
+	fmt.Fprintf(w.bw, "HTTP/1.1 %d %v\r\n", code, http.StatusText(code))
+	// ignore any errors writing back to connection
+	_ = w.header.Write(w.bw)
+	_, _ = w.bw.WriteString("\r\n")
+}
+
+func (w *connResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.header.Get("Content-Type") == "" {
+			w.header.Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.head {
+		return len(b), nil
+	}
+	return w.bw.Write(b)
+}
+
+func (w *connResponseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	_ = w.bw.Flush()
+}
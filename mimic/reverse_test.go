@@ -0,0 +1,75 @@
+package mimic
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSiteURL(t *testing.T) {
+	var received http.Header
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received = req.Header.Clone()
+		switch req.URL.Path {
+		case "/blog/":
+			w.Header().Set("Server", "nginx")
+			w.Write([]byte("<h1>My blog</h1>"))
+		case "/blog/old":
+			http.Redirect(w, req, "http://"+req.Host+"/blog/new", http.StatusMovedPermanently)
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer origin.Close()
+
+	m, err := Parse("site:" + origin.URL + "/blog/")
+	require.NoError(t, err)
+
+	resp, body := parse(t, roundTrip(t, m, "GET", "/", "X-Lantern-Device-Id: abc\r\nAccept-Language: en\r\n"), "GET")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "<h1>My blog</h1>", body)
+	assert.Equal(t, "nginx", resp.Header.Get("Server"))
+	assert.Equal(t, "en", received.Get("Accept-Language"))
+	assert.Empty(t, received.Get("X-Lantern-Device-Id"), "should not pass on our headers")
+	assert.Empty(t, received.Get("X-Forwarded-For"), "should not reveal the prober")
+
+	resp, _ = parse(t, roundTrip(t, m, "GET", "/old"), "GET")
+	assert.Equal(t, http.StatusMovedPermanently, resp.StatusCode)
+	assert.Equal(t, "/blog/new", resp.Header.Get("Location"), "should point redirects at us")
+
+	resp, body = parse(t, roundTrip(t, m, "GET", "http://proxy.example/nothing"), "GET")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Contains(t, body, "404 page not found")
+
+	origin.Close()
+	resp, _ = parse(t, roundTrip(t, m, "GET", "/"), "GET")
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+}
+
+func TestSiteDirectory(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "index.html"), []byte("<h1>Home</h1>"), 0644))
+
+	m, err := Parse("site:" + dir)
+	require.NoError(t, err)
+	raw := roundTrip(t, m, "GET", "/")
+	resp, body := parse(t, raw, "GET")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "<h1>Home</h1>", body)
+	assert.NotEmpty(t, resp.Header.Get("Last-Modified"))
+
+	resp, _ = parse(t, roundTrip(t, m, "HEAD", "/"), "HEAD")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _ = parse(t, roundTrip(t, m, "CONNECT", "example.com:443"), "CONNECT")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	_, err = Parse("site:" + filepath.Join(dir, "index.html"))
+	assert.Error(t, err, "should only accept directories")
+	_, err = Parse("site:https://")
+	assert.Error(t, err)
+}
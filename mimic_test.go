@@ -95,7 +95,7 @@ type entryWithHeaders struct {
 }
 
 func TestMimicApache(t *testing.T) {
-	tf := tokenfilter.New("arbitrary-token", instrument.NoInstrument{})
+	tf := tokenfilter.New([]tokenfilter.Token{{Value: "arbitrary-token"}}, nil, nil, instrument.NoInstrument{})
 	s := server.New(&server.Opts{
 		IdleTimeout: 30 * time.Second,
 		Filter:      filters.Join(tf),
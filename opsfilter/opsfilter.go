@@ -10,6 +10,7 @@ import (
 
 	"github.com/getlantern/http-proxy-lantern/v2/common"
 	"github.com/getlantern/http-proxy-lantern/v2/listeners"
+	"github.com/getlantern/http-proxy-lantern/v2/shadowsocks"
 	"github.com/getlantern/http-proxy-lantern/v2/tlslistener"
 )
 
@@ -81,6 +82,18 @@ func (f *opsfilter) Apply(cs *filters.ConnectionState, req *http.Request, next f
 	addStringHeader(common.TimeZone, common.TimeZoneHeader)
 	addArrayHeader(common.SupportedDataCaps, common.SupportedDataCapsHeader)
 
+	// Traffic through a shadowsocks access key is attributed to the key, and
+	// to the key as a device if the client doesn't identify itself. On
+	// persistent connections, a device ID from the first request is kept.
+	if keyID := shadowsocks.AccessKeyID(cs.Downstream()); keyID != "" {
+		addVal(common.AccessKeyID, keyID)
+		if _, known := measuredCtx[common.DeviceID]; !known {
+			if ctx := listeners.MeasuredContext(cs.Downstream()); ctx[common.DeviceID] == nil {
+				addVal(common.DeviceID, common.AccessKeyDevicePrefix+keyID)
+			}
+		}
+	}
+
 	netx.WalkWrapped(cs.Downstream(), func(conn net.Conn) bool {
 		pdc, ok := conn.(tlslistener.ProbingDetectingConn)
 		if ok {
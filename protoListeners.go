@@ -31,5 +31,20 @@ func getProtoListenersArgs(p *Proxy) []protoListenerArgs {
 		},
 		{"water", p.WaterAddr, p.wrapMultiplexing(p.listenWATER)},
 		{"vmess", p.VMessAddr, p.wrapMultiplexing(p.listenVMess(p.listenTCP))},
+		{"sniff", p.SniffAddr, p.listenSniffing},
+	}
+}
+
+// getTestingProtoListenersArgs returns the listeners that are only served
+// with TestingListeners, for transports that tests still cover.
+func getTestingProtoListenersArgs(p *Proxy) []protoListenerArgs {
+	if !p.TestingListeners {
+		return nil
+	}
+	return []protoListenerArgs{
+		{"obfs4", p.Obfs4Addr, p.listenOBFS4(p.listenTCP)},
+		{"obfs4_multiplex", p.Obfs4MultiplexAddr, p.wrapMultiplexing(p.listenOBFS4(p.listenTCP))},
+		{"lampshade", p.LampshadeAddr, p.listenLampshade(nil, p.listenTCP)},
+		{"wss", p.WSSAddr, p.listenWSS(p.listenTCP)},
 	}
 }
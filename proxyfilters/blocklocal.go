@@ -1,27 +1,58 @@
 package proxyfilters
 
 import (
-	"fmt"
+	"context"
 	"net"
 	"net/http"
 	"strings"
+	"sync"
 
 	"github.com/getlantern/proxy/v3/filters"
+
+	"github.com/getlantern/http-proxy-lantern/v2/happyeyeballs"
 )
 
 type resolver interface {
-	ResolveIPAddr(network string, address string) (*net.IPAddr, error)
+	LookupIP(ctx context.Context, host string) ([]net.IP, error)
 }
 
 type Resolver struct{}
 
-func (r *Resolver) ResolveIPAddr(network string, address string) (*net.IPAddr, error) {
-	return net.ResolveIPAddr(network, address)
+func (r *Resolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	return net.DefaultResolver.LookupIP(ctx, "ip", host)
+}
+
+// VettedAddrs hands the addresses BlockLocal vetted for CONNECT requests to
+// the dialer. Plain HTTP requests are dialed with their own context and carry
+// their addresses in it, see happyeyeballs.WithResolved, but CONNECT requests
+// are dialed with the context of the connection they arrived on, so their
+// addresses are kept per downstream connection until it's dialed, like
+// egress.Routes does for routes.
+type VettedAddrs struct {
+	byConn sync.Map
+}
+
+type vettedAddrs struct {
+	host string
+	ips  []net.IP
+}
+
+// Take returns ctx carrying the addresses vetted for the next dial on behalf
+// of downstream, if any, and forgets them.
+func (v *VettedAddrs) Take(ctx context.Context, downstream net.Conn) context.Context {
+	addrs, ok := v.byConn.LoadAndDelete(downstream)
+	if !ok {
+		return ctx
+	}
+	return happyeyeballs.WithResolved(ctx, addrs.(*vettedAddrs).host, addrs.(*vettedAddrs).ips)
 }
 
 // BlockLocal blocks attempted accesses to localhost unless they're one of the
-// listed exceptions.
-func BlockLocal(exceptions []string, r resolver) filters.Filter {
+// listed exceptions. Hosts are blocked if any of their addresses is local, and
+// the addresses are handed to the dialer, in vetted for CONNECT requests and
+// in the request's context for plain HTTP ones, so that it dials those rather
+// than resolving the host again.
+func BlockLocal(exceptions []string, r resolver, vetted *VettedAddrs) filters.Filter {
 	isException := func(host string) bool {
 		for _, exception := range exceptions {
 			if strings.EqualFold(host, exception) {
@@ -40,7 +71,7 @@ func BlockLocal(exceptions []string, r resolver) filters.Filter {
 			targetHost = req.Host
 		}
 
-		host, port, err := net.SplitHostPort(targetHost)
+		host, _, err := net.SplitHostPort(targetHost)
 		if err != nil {
 			// host didn't have a port, thus splitting didn't work
 			host = targetHost
@@ -52,25 +83,31 @@ func BlockLocal(exceptions []string, r resolver) filters.Filter {
 			return next(cs, req)
 		}
 
-		ipAddr, err := r.ResolveIPAddr("ip", host)
-
-		// If there was an error resolving is probably because it wasn't an address
-		// in the form host or host:port
-		if err == nil {
-			if ipAddr.IP.IsPrivate() || !ipAddr.IP.IsGlobalUnicast() {
-				return fail(cs, req, http.StatusForbidden, "%v requested local address %v (%v)", req.RemoteAddr, req.Host, ipAddr)
+		ips, err := r.LookupIP(req.Context(), host)
+		if err != nil {
+			// If there was an error resolving is probably because it wasn't an
+			// address in the form host or host:port, and dialing it will fail
+			return next(cs, req)
+		}
+		for _, ip := range ips {
+			if ip.IsPrivate() || !ip.IsGlobalUnicast() {
+				return fail(cs, req, http.StatusForbidden, "%v requested local address %v (%v)", req.RemoteAddr, req.Host, ip)
 			}
 		}
 
-		// Note: It is important to pass Host as an already resolved and vetted IP in order to avoid
-		// DNS rebind attacks should there be any other dialers, that attempt to resolve the host down in the execution path
-		addr := ipAddr.String()
-		if port != "" && addr != "" {
-			req.URL.Host = fmt.Sprintf("%s:%s", addr, port)
-		} else if addr != "" {
-			req.URL.Host = addr
+		// Note: It is important to dial the addresses vetted here in order to avoid DNS rebind
+		// attacks, which is why they're passed on instead of resolving the host again.
+		req = req.WithContext(happyeyeballs.WithResolved(req.Context(), host, ips))
+		if req.Method != http.MethodConnect || vetted == nil {
+			return next(cs, req)
 		}
-
-		return next(cs, req)
+		downstream := cs.Downstream()
+		vetted.byConn.Store(downstream, &vettedAddrs{host: host, ips: ips})
+		resp, nextCS, err := next(cs, req)
+		if err != nil || resp == nil || resp.StatusCode != http.StatusOK {
+			// the tunnel won't be dialed
+			vetted.byConn.Delete(downstream)
+		}
+		return resp, nextCS, err
 	})
 }
@@ -1,6 +1,7 @@
 package proxyfilters
 
 import (
+	"context"
 	"net"
 	"net/http"
 	"testing"
@@ -8,16 +9,22 @@ import (
 	"github.com/stretchr/testify/assert"
 
 	"github.com/getlantern/proxy/v3/filters"
+
+	"github.com/getlantern/http-proxy-lantern/v2/happyeyeballs"
 )
 
 type testResolver struct {
 	a, b, c, d byte
 }
 
-func (r *testResolver) ResolveIPAddr(network string, address string) (*net.IPAddr, error) {
-	return &net.IPAddr{
-		IP: net.IPv4(r.a, r.b, r.c, r.d),
-	}, nil
+func (r *testResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	return []net.IP{net.IPv4(r.a, r.b, r.c, r.d)}, nil
+}
+
+type dualStackResolver []net.IP
+
+func (r dualStackResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	return r, nil
 }
 
 func TestBlockLocalBlocked(t *testing.T) {
@@ -61,11 +68,38 @@ func TestBlockLocalExceptionForOriginFormRequest(t *testing.T) {
 }
 
 func TestBlockLocalNotLocal(t *testing.T) {
-	modifiedReq, resp := doTestBlockLocal(t, []string{"localhost"}, "http://example.com/index.html", &testResolver{93, 184, 215, 16})
+	ips := dualStackResolver{net.ParseIP("93.184.215.16"), net.ParseIP("2606:2800:21f:cb07:6820:80da:af6b:8b2c")}
+	modifiedReq, resp := doTestBlockLocal(t, []string{"localhost"}, "http://example.com:8080/index.html", ips)
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
-	// assert that block local filter did the resolving and modified req.URL.Host
-	exampleDotComIP := "93.184.215.16"
-	assert.Equal(t, exampleDotComIP, modifiedReq.URL.Host)
+	// assert that block local filter did the resolving and passed on all addresses
+	assert.Equal(t, "example.com:8080", modifiedReq.URL.Host)
+	resolved, ok := happyeyeballs.ResolvedFromContext(modifiedReq.Context(), "example.com")
+	assert.True(t, ok)
+	assert.Equal(t, []net.IP(ips), resolved)
+}
+
+func TestBlockLocalAnyLocal(t *testing.T) {
+	ips := dualStackResolver{net.ParseIP("93.184.215.16"), net.ParseIP("::1")}
+	_, resp := doTestBlockLocal(t, []string{"localhost"}, "http://example.com/index.html", ips)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestBlockLocalConnect(t *testing.T) {
+	ips := dualStackResolver{net.ParseIP("93.184.215.16")}
+	vetted := &VettedAddrs{}
+	for _, status := range []int{http.StatusForbidden, http.StatusOK} {
+		req, _ := http.NewRequest(http.MethodConnect, "http://example.com:443", nil)
+		downstream := &net.TCPConn{}
+		next := func(cs *filters.ConnectionState, req *http.Request) (*http.Response, *filters.ConnectionState, error) {
+			return &http.Response{StatusCode: status}, cs, nil
+		}
+		BlockLocal(nil, ips, vetted).Apply(filters.NewConnectionState(req, nil, downstream), req, next)
+
+		_, ok := happyeyeballs.ResolvedFromContext(vetted.Take(context.Background(), downstream), "example.com")
+		assert.Equal(t, status == http.StatusOK, ok, "addresses should only be kept for tunnels that are dialed")
+		_, ok = happyeyeballs.ResolvedFromContext(vetted.Take(context.Background(), downstream), "example.com")
+		assert.False(t, ok, "addresses should only be taken once")
+	}
 }
 
 func doTestBlockLocal(t *testing.T, exceptions []string, urlStr string, r resolver) (*http.Request, *http.Response) {
@@ -76,15 +110,17 @@ func doTestBlockLocal(t *testing.T, exceptions []string, urlStr string, r resolv
 
 func doTestBlockLocalRequest(t *testing.T, exceptions []string, req *http.Request, r resolver) (*http.Request, *http.Response) {
 	t.Helper()
+	modifiedReq := req
 	next := func(cs *filters.ConnectionState, req *http.Request) (*http.Response, *filters.ConnectionState, error) {
+		modifiedReq = req
 		return &http.Response{
 			StatusCode: http.StatusOK,
 		}, cs, nil
 	}
 
-	filter := BlockLocal(exceptions, r)
+	filter := BlockLocal(exceptions, r, &VettedAddrs{})
 	log.Debug(req.URL.Host)
 	cs := filters.NewConnectionState(req, nil, nil)
 	resp, _, _ := filter.Apply(cs, req, next)
-	return req, resp
+	return modifiedReq, resp
 }
@@ -0,0 +1,67 @@
+package proxyfilters
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/getlantern/geo"
+	"github.com/getlantern/proxy/v3/filters"
+
+	"github.com/getlantern/http-proxy-lantern/v2/egress"
+	"github.com/getlantern/http-proxy-lantern/v2/happyeyeballs"
+)
+
+// EgressPolicy applies the given egress policy to requests. Denied requests
+// get a 403. Routed requests proceed with their route recorded for the dialer,
+// in routes for CONNECT requests and in the request's context for plain HTTP
+// ones.
+//
+// It should come after BlockLocal, which passes on the IP addresses it
+// resolved, so that CIDR rules match hostnames as well.
+func EgressPolicy(policy *egress.Policy, routes *egress.Routes, countryLookup geo.CountryLookup) filters.Filter {
+	return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		defaultPort := 80
+		if req.Method == http.MethodConnect || req.URL.Scheme == "https" {
+			defaultPort = 443
+		}
+		host, port := egress.ParseAddr(req.Host, defaultPort)
+		targetHost := req.URL.Host
+		if targetHost == "" {
+			targetHost = req.Host
+		}
+		targetHost, _ = egress.ParseAddr(targetHost, defaultPort)
+		ips, ok := happyeyeballs.ResolvedFromContext(req.Context(), targetHost)
+		if ip := net.ParseIP(targetHost); !ok && ip != nil {
+			ips = []net.IP{ip}
+		}
+		dest := egress.Destination{
+			Host: host,
+			IPs:  ips,
+			Port: port,
+			Country: func() string {
+				clientIP, _, _ := net.SplitHostPort(req.RemoteAddr)
+				return countryLookup.CountryCode(net.ParseIP(clientIP))
+			},
+		}
+
+		action, route := policy.Decide(dest)
+		switch action {
+		case egress.Deny:
+			return fail(cs, req, http.StatusForbidden, "%v denied access to %v by egress policy", req.RemoteAddr, req.Host)
+		case egress.Route:
+			log.Tracef("Routing %v via %v", req.Host, route)
+			if req.Method != http.MethodConnect {
+				return next(cs, req.WithContext(egress.WithRoute(req.Context(), route)))
+			}
+			downstream := cs.Downstream()
+			routes.Set(downstream, route)
+			resp, nextCS, err := next(cs, req)
+			if err != nil || resp == nil || resp.StatusCode != http.StatusOK {
+				// the tunnel won't be dialed
+				routes.Forget(downstream)
+			}
+			return resp, nextCS, err
+		}
+		return next(cs, req)
+	})
+}
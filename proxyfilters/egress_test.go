@@ -0,0 +1,100 @@
+package proxyfilters
+
+import (
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/getlantern/geo"
+	"github.com/getlantern/proxy/v3/filters"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/http-proxy-lantern/v2/egress"
+	"github.com/getlantern/http-proxy-lantern/v2/happyeyeballs"
+)
+
+type testCountryLookup string
+
+func (l testCountryLookup) CountryCode(ip net.IP) string {
+	return string(l)
+}
+
+func TestEgressPolicy(t *testing.T) {
+	policy, err := egress.Parse([]byte(`
+rules:
+  - action: deny
+    ports: [25]
+  - action: deny
+    cidrs: [203.0.113.0/24]
+    countries: [IR]
+  - action: route
+    route: exit
+    domains: ["*.example.org"]
+  - action: route
+    route: exit-failing
+    domains: [failing.example.net]
+upstreams:
+  exit: socks5://192.0.2.10:1080
+  exit-failing: socks5://192.0.2.11:1080
+`))
+	require.NoError(t, err)
+	routes := &egress.Routes{}
+
+	var nextReq *http.Request
+	next := func(cs *filters.ConnectionState, req *http.Request) (*http.Response, *filters.ConnectionState, error) {
+		nextReq = req
+		status := http.StatusOK
+		if req.Host == "failing.example.net:443" {
+			status = http.StatusForbidden
+		}
+		return &http.Response{StatusCode: status}, cs, nil
+	}
+	do := func(method, url, host string, lookup geo.CountryLookup, ips ...net.IP) (*http.Response, net.Conn) {
+		nextReq = nil
+		req, _ := http.NewRequest(method, url, nil)
+		req.Host = host
+		if len(ips) > 0 {
+			req = req.WithContext(happyeyeballs.WithResolved(req.Context(), req.URL.Hostname(), ips))
+		}
+		req.RemoteAddr = "198.51.100.1:51234"
+		downstream := &net.TCPConn{}
+		cs := filters.NewConnectionState(req, nil, downstream)
+		resp, _, _ := EgressPolicy(policy, routes, lookup).Apply(cs, req, next)
+		return resp, downstream
+	}
+
+	resp, _ := do(http.MethodGet, "http://smtp.example.com:25/", "smtp.example.com:25", geo.NoLookup{})
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Nil(t, nextReq)
+
+	// BlockLocal has resolved the host by now, and any of its addresses matches
+	blockedIPs := []net.IP{net.ParseIP("198.51.100.7"), net.ParseIP("203.0.113.5")}
+	resp, _ = do(http.MethodConnect, "http://blocked.example.com:443", "blocked.example.com:443", testCountryLookup("IR"), blockedIPs...)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp, _ = do(http.MethodConnect, "http://203.0.113.5:443", "203.0.113.5:443", testCountryLookup("IR"))
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp, downstream := do(http.MethodConnect, "http://blocked.example.com:443", "blocked.example.com:443", testCountryLookup("US"), blockedIPs...)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	_, ok := routes.Take(downstream)
+	assert.False(t, ok)
+
+	resp, _ = do(http.MethodGet, "http://www.example.org/", "www.example.org", geo.NoLookup{})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	route, ok := egress.RouteFromContext(nextReq.Context())
+	assert.True(t, ok)
+	assert.Equal(t, "exit", route)
+
+	resp, downstream = do(http.MethodConnect, "http://www.example.org:443", "www.example.org:443", geo.NoLookup{})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	_, ok = egress.RouteFromContext(nextReq.Context())
+	assert.False(t, ok, "CONNECT requests should have their route recorded per connection")
+	route, ok = routes.Take(downstream)
+	assert.True(t, ok)
+	assert.Equal(t, "exit", route)
+
+	resp, downstream = do(http.MethodConnect, "http://failing.example.net:443", "failing.example.net:443", geo.NoLookup{})
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	_, ok = routes.Take(downstream)
+	assert.False(t, ok, "route of failed CONNECT should be forgotten")
+}
@@ -10,21 +10,35 @@ import (
 	"github.com/getlantern/proxy/v3/filters"
 )
 
+// OpObserver is told about every op RecordOpObserved records once the rest of
+// the chain has handled it, with the response and error it returned. For
+// CONNECT requests, that's once the tunnel has been dialed.
+type OpObserver func(cs *filters.ConnectionState, req *http.Request, resp *http.Response, err error)
+
 // RecordOp records the proxy_http op.
-var RecordOp = filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
-	name := "proxy_http"
-	if req.Method == http.MethodConnect {
-		name += "s"
-	}
-	op := ops.Begin(name)
-	resp, nextCtx, err := next(cs, req)
-	if err != nil {
-		op.FailIf(err)
-		logFilterError(err)
-	}
-	op.End()
-	return resp, nextCtx, err
-})
+var RecordOp = RecordOpObserved()
+
+// RecordOpObserved records the proxy_http op like RecordOp, and passes every op
+// to observers as well.
+func RecordOpObserved(observers ...OpObserver) filters.Filter {
+	return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		name := "proxy_http"
+		if req.Method == http.MethodConnect {
+			name += "s"
+		}
+		op := ops.Begin(name)
+		resp, nextCtx, err := next(cs, req)
+		if err != nil {
+			op.FailIf(err)
+			logFilterError(err)
+		}
+		op.End()
+		for _, observe := range observers {
+			observe(cs, req, resp, err)
+		}
+		return resp, nextCtx, err
+	})
+}
 
 func logFilterError(err error) {
 	var (
@@ -0,0 +1,398 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/cmux/v2"
+	"github.com/getlantern/errors"
+
+	"github.com/getlantern/http-proxy-lantern/v2/banditcallback"
+	"github.com/getlantern/http-proxy-lantern/v2/datacap"
+	"github.com/getlantern/http-proxy-lantern/v2/mimic"
+	"github.com/getlantern/http-proxy-lantern/v2/shadowsocks"
+)
+
+// Reload applies configuration changes to a running proxy without restarting
+// its listeners. update is called to change the Proxy's settings, those in
+// settings, after which each part of the proxy is reconfigured by its
+// reloader and the filter chain and dialer are rebuilt and swapped into the
+// server: new connections use the new settings while existing ones drain on
+// the chain they were accepted with.
+//
+// Listener addresses, instrumentation and proxied sites tracking only take
+// effect on restart, while certificates are reloaded from their files as they
+// change, see certmanager. If the new settings can't be applied, nothing is
+// reconfigured, the settings are restored to what they were and an error is
+// returned.
+func (p *Proxy) Reload(update func(p *Proxy)) (err error) {
+	p.reloadMx.Lock()
+	defer p.reloadMx.Unlock()
+	if p.srv == nil {
+		return errors.New("proxy is not serving yet, unable to reload")
+	}
+
+	old := p.settings()
+	defer func() {
+		if err != nil {
+			p.restoreSettings(old)
+		}
+	}()
+	update(p)
+
+	var applies []func()
+	for _, reload := range reloaders {
+		apply, err := reload(p, &old)
+		if err != nil {
+			return err
+		}
+		if apply != nil {
+			applies = append(applies, apply)
+		}
+	}
+	for _, apply := range applies {
+		apply()
+	}
+
+	log.Debug("Reloaded configuration")
+	return nil
+}
+
+// A reloader reconfigures one part of a running proxy for Reload. It checks
+// and prepares the new settings of p, old being the previous ones, without
+// changing anything in use, and returns the function putting them in use,
+// which can't fail, or nil if there's nothing to do.
+type reloader func(p *Proxy, old *settings) (apply func(), err error)
+
+// reloaders are run by Reload, in order. The filter chain goes last so that
+// it's only rebuilt once everything else checked out.
+var reloaders = []reloader{
+	reloadBlacklist,
+	reloadUploadLimits,
+	reloadEgressCapacity,
+	reloadBudget,
+	reloadAbuse,
+	reloadShadowsocksKeys,
+	reloadDecoy,
+	reloadMultiplexing,
+	reloadDatacapClient,
+	reloadFilterChain,
+}
+
+func reloadBlacklist(p *Proxy, old *settings) (func(), error) {
+	opts, err := p.blacklistOptions()
+	if err != nil {
+		return nil, err
+	}
+	return func() { p.blacklist.Reconfigure(opts) }, nil
+}
+
+func reloadUploadLimits(p *Proxy, old *settings) (func(), error) {
+	limits, err := p.uploadLimits()
+	if err != nil || p.datacapTracker == nil {
+		return nil, err
+	}
+	return func() { p.datacapTracker.SetUploadLimits(limits) }, nil
+}
+
+func reloadEgressCapacity(p *Proxy, old *settings) (func(), error) {
+	if p.scheduler == nil {
+		return nil, nil
+	}
+	return func() { p.scheduler.SetCapacity(p.EgressCapacity) }, nil
+}
+
+func reloadBudget(p *Proxy, old *settings) (func(), error) {
+	if (p.budget == nil) != (p.BudgetQuota <= 0) {
+		log.Error("Enabling or disabling the bandwidth budget requires a restart")
+	}
+	if p.budget == nil || p.BudgetQuota <= 0 {
+		return nil, nil
+	}
+	opts := p.budgetOptions()
+	if err := opts.Validate(); err != nil {
+		return nil, errors.New("unable to reconfigure bandwidth budget: %v", err)
+	}
+	// already validated
+	return func() { _ = p.budget.Reconfigure(opts) }, nil
+}
+
+func reloadAbuse(p *Proxy, old *settings) (func(), error) {
+	opts, err := p.abuseOptions()
+	if err != nil {
+		return nil, err
+	}
+	if (p.abuse == nil) != (len(opts.Responses) == 0) {
+		log.Error("Enabling or disabling abuse detection requires a restart")
+	}
+	if p.abuse == nil || len(opts.Responses) == 0 {
+		return nil, nil
+	}
+	if err := opts.Validate(); err != nil {
+		return nil, errors.New("unable to reconfigure abuse detection: %v", err)
+	}
+	// already validated
+	return func() { _ = p.abuse.Reconfigure(opts) }, nil
+}
+
+func reloadShadowsocksKeys(p *Proxy, old *settings) (func(), error) {
+	if p.ssCiphers == nil {
+		return nil, nil
+	}
+	keys, err := p.shadowsocksKeys()
+	if err != nil {
+		return nil, err
+	}
+	// already validated, and connections that are already authenticated keep
+	// going with the key they matched
+	return func() { _ = shadowsocks.UpdateCipherList(p.ssCiphers, keys) }, nil
+}
+
+// reloadDecoy only replaces the decoy when the persona changed, so that the
+// site it may be relaying to keeps its connections.
+func reloadDecoy(p *Proxy, old *settings) (func(), error) {
+	if p.Mimic == old.Mimic {
+		return nil, nil
+	}
+	decoy, err := mimic.Parse(p.Mimic)
+	if err != nil {
+		return nil, err
+	}
+	return func() { p.decoy.set(decoy) }, nil
+}
+
+func reloadMultiplexing(p *Proxy, old *settings) (func(), error) {
+	if p.muxProtocol == nil {
+		return nil, nil
+	}
+	proto, err := p.buildMultiplexProtocol()
+	if err != nil {
+		return nil, errors.New("unable to rebuild multiplex protocol: %v", err)
+	}
+	return func() { p.muxProtocol.set(proto) }, nil
+}
+
+func reloadDatacapClient(p *Proxy, old *settings) (func(), error) {
+	if p.DatacapURL == old.DatacapURL {
+		return nil, nil
+	}
+	if p.datacapTracker == nil || p.DatacapURL == "" {
+		log.Errorf("Enabling or disabling the datacap sidecar requires a restart, still using %q", old.DatacapURL)
+		return nil, nil
+	}
+	return func() {
+		p.datacapTracker.SetClient(datacap.NewClient(p.DatacapURL, datacap.DefaultHTTPTimeout))
+		log.Debugf("Reporting bandwidth usage to the datacap sidecar at %v", p.DatacapURL)
+	}, nil
+}
+
+// reloadFilterChain rebuilds the filter chain and dialer, along with the
+// bandit callback emitter they use. The emitter is only replaced when its
+// settings changed, so that its dedup window and counters survive unrelated
+// reloads.
+func reloadFilterChain(p *Proxy, old *settings) (func(), error) {
+	current := p.banditCallbackEmitter
+	emitter := current
+	if p.BanditCallbackToken != old.BanditCallbackToken || p.BanditCallbackURL != old.BanditCallbackURL || p.BanditCallbackTTL != old.BanditCallbackTTL {
+		emitter = banditcallback.New(p.BanditCallbackToken, p.BanditCallbackURL, p.BanditCallbackTTL)
+	}
+	p.banditCallbackEmitter = emitter
+	filter, dial, err := p.buildFilter()
+	p.banditCallbackEmitter = current
+	if err != nil {
+		return nil, errors.New("unable to rebuild filter chain: %v", err)
+	}
+	return func() {
+		p.banditCallbackEmitter = emitter
+		p.srv.SetFilter(filter, dial)
+	}, nil
+}
+
+// settings are the fields of a Proxy that Reload may change, and that
+// http-proxy sets in applyReloadableFlags. Only these are restored when a
+// reload fails.
+type settings struct {
+	Token                         string
+	TokenVerifyKey                string
+	Mimic                         string
+	CfgSvrAuthToken               string
+	TunnelPorts                   string
+	LegacyAPIHosts                string
+	GoogleSearchRegex             string
+	GoogleCaptchaRegex            string
+	BlacklistMaxIdleTime          time.Duration
+	BlacklistMaxConnectInterval   time.Duration
+	BlacklistAllowedFailures      int
+	BlacklistExpiration           time.Duration
+	BlacklistEnforce              bool
+	BlacklistAllow                string
+	BlacklistDeny                 string
+	EgressPolicyFile              string
+	Upstream                      string
+	OriginIPPreference            string
+	DatacapURL                    string
+	UploadLimits                  string
+	UploadConnLimit               int64
+	EgressCapacity                int64
+	BudgetQuota                   int64
+	BudgetSoft                    float64
+	BudgetHard                    float64
+	BudgetCycleDay                int
+	AbuseResponses                string
+	AbusePenalty                  time.Duration
+	ShadowsocksSecret             string
+	ShadowsocksCipher             string
+	ShadowsocksKeysFile           string
+	BanditCallbackToken           string
+	BanditCallbackURL             string
+	BanditCallbackTTL             time.Duration
+	PsmuxDisablePadding           bool
+	PsmuxMaxPaddingRatio          float64
+	PsmuxMaxPaddedSize            int
+	PsmuxDisableAggressivePadding bool
+	PsmuxAggressivePadding        int
+	PsmuxAggressivePaddingRatio   float64
+}
+
+func (p *Proxy) settings() settings {
+	return settings{
+		Token:                         p.Token,
+		TokenVerifyKey:                p.TokenVerifyKey,
+		Mimic:                         p.Mimic,
+		CfgSvrAuthToken:               p.CfgSvrAuthToken,
+		TunnelPorts:                   p.TunnelPorts,
+		LegacyAPIHosts:                p.LegacyAPIHosts,
+		GoogleSearchRegex:             p.GoogleSearchRegex,
+		GoogleCaptchaRegex:            p.GoogleCaptchaRegex,
+		BlacklistMaxIdleTime:          p.BlacklistMaxIdleTime,
+		BlacklistMaxConnectInterval:   p.BlacklistMaxConnectInterval,
+		BlacklistAllowedFailures:      p.BlacklistAllowedFailures,
+		BlacklistExpiration:           p.BlacklistExpiration,
+		BlacklistEnforce:              p.BlacklistEnforce,
+		BlacklistAllow:                p.BlacklistAllow,
+		BlacklistDeny:                 p.BlacklistDeny,
+		EgressPolicyFile:              p.EgressPolicyFile,
+		Upstream:                      p.Upstream,
+		OriginIPPreference:            p.OriginIPPreference,
+		DatacapURL:                    p.DatacapURL,
+		UploadLimits:                  p.UploadLimits,
+		UploadConnLimit:               p.UploadConnLimit,
+		EgressCapacity:                p.EgressCapacity,
+		BudgetQuota:                   p.BudgetQuota,
+		BudgetSoft:                    p.BudgetSoft,
+		BudgetHard:                    p.BudgetHard,
+		BudgetCycleDay:                p.BudgetCycleDay,
+		AbuseResponses:                p.AbuseResponses,
+		AbusePenalty:                  p.AbusePenalty,
+		ShadowsocksSecret:             p.ShadowsocksSecret,
+		ShadowsocksCipher:             p.ShadowsocksCipher,
+		ShadowsocksKeysFile:           p.ShadowsocksKeysFile,
+		BanditCallbackToken:           p.BanditCallbackToken,
+		BanditCallbackURL:             p.BanditCallbackURL,
+		BanditCallbackTTL:             p.BanditCallbackTTL,
+		PsmuxDisablePadding:           p.PsmuxDisablePadding,
+		PsmuxMaxPaddingRatio:          p.PsmuxMaxPaddingRatio,
+		PsmuxMaxPaddedSize:            p.PsmuxMaxPaddedSize,
+		PsmuxDisableAggressivePadding: p.PsmuxDisableAggressivePadding,
+		PsmuxAggressivePadding:        p.PsmuxAggressivePadding,
+		PsmuxAggressivePaddingRatio:   p.PsmuxAggressivePaddingRatio,
+	}
+}
+
+func (p *Proxy) restoreSettings(s settings) {
+	p.Token = s.Token
+	p.TokenVerifyKey = s.TokenVerifyKey
+	p.Mimic = s.Mimic
+	p.CfgSvrAuthToken = s.CfgSvrAuthToken
+	p.TunnelPorts = s.TunnelPorts
+	p.LegacyAPIHosts = s.LegacyAPIHosts
+	p.GoogleSearchRegex = s.GoogleSearchRegex
+	p.GoogleCaptchaRegex = s.GoogleCaptchaRegex
+	p.BlacklistMaxIdleTime = s.BlacklistMaxIdleTime
+	p.BlacklistMaxConnectInterval = s.BlacklistMaxConnectInterval
+	p.BlacklistAllowedFailures = s.BlacklistAllowedFailures
+	p.BlacklistExpiration = s.BlacklistExpiration
+	p.BlacklistEnforce = s.BlacklistEnforce
+	p.BlacklistAllow = s.BlacklistAllow
+	p.BlacklistDeny = s.BlacklistDeny
+	p.EgressPolicyFile = s.EgressPolicyFile
+	p.Upstream = s.Upstream
+	p.OriginIPPreference = s.OriginIPPreference
+	p.DatacapURL = s.DatacapURL
+	p.UploadLimits = s.UploadLimits
+	p.UploadConnLimit = s.UploadConnLimit
+	p.EgressCapacity = s.EgressCapacity
+	p.BudgetQuota = s.BudgetQuota
+	p.BudgetSoft = s.BudgetSoft
+	p.BudgetHard = s.BudgetHard
+	p.BudgetCycleDay = s.BudgetCycleDay
+	p.AbuseResponses = s.AbuseResponses
+	p.AbusePenalty = s.AbusePenalty
+	p.ShadowsocksSecret = s.ShadowsocksSecret
+	p.ShadowsocksCipher = s.ShadowsocksCipher
+	p.ShadowsocksKeysFile = s.ShadowsocksKeysFile
+	p.BanditCallbackToken = s.BanditCallbackToken
+	p.BanditCallbackURL = s.BanditCallbackURL
+	p.BanditCallbackTTL = s.BanditCallbackTTL
+	p.PsmuxDisablePadding = s.PsmuxDisablePadding
+	p.PsmuxMaxPaddingRatio = s.PsmuxMaxPaddingRatio
+	p.PsmuxMaxPaddedSize = s.PsmuxMaxPaddedSize
+	p.PsmuxDisableAggressivePadding = s.PsmuxDisableAggressivePadding
+	p.PsmuxAggressivePadding = s.PsmuxAggressivePadding
+	p.PsmuxAggressivePaddingRatio = s.PsmuxAggressivePaddingRatio
+}
+
+// reloadableProtocol is a cmux.Protocol whose configuration can be replaced
+// while listeners are using it. Sessions that are already established keep the
+// configuration they were created with.
+type reloadableProtocol struct {
+	current atomic.Pointer[cmux.Protocol]
+}
+
+func newReloadableProtocol(proto cmux.Protocol) *reloadableProtocol {
+	r := &reloadableProtocol{}
+	r.set(proto)
+	return r
+}
+
+func (r *reloadableProtocol) set(proto cmux.Protocol) {
+	r.current.Store(&proto)
+}
+
+func (r *reloadableProtocol) get() cmux.Protocol {
+	return *r.current.Load()
+}
+
+func (r *reloadableProtocol) Client(conn net.Conn) (cmux.Session, error) {
+	return r.get().Client(conn)
+}
+
+func (r *reloadableProtocol) Server(conn net.Conn) (cmux.Session, error) {
+	return r.get().Server(conn)
+}
+
+func (r *reloadableProtocol) TranslateError(err error) error {
+	return r.get().TranslateError(err)
+}
+
+// reloadableMimic is a mimic.Mimic whose persona can be replaced while
+// listeners are using it.
+type reloadableMimic struct {
+	current atomic.Pointer[mimic.Mimic]
+}
+
+func newReloadableMimic(m mimic.Mimic) *reloadableMimic {
+	r := &reloadableMimic{}
+	r.set(m)
+	return r
+}
+
+func (r *reloadableMimic) set(m mimic.Mimic) {
+	r.current.Store(&m)
+}
+
+func (r *reloadableMimic) Respond(conn net.Conn, req *http.Request) {
+	(*r.current.Load()).Respond(conn, req)
+}
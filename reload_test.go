@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/http-proxy-lantern/v2/blacklist"
+	"github.com/getlantern/http-proxy-lantern/v2/instrument"
+	"github.com/getlantern/http-proxy-lantern/v2/server"
+)
+
+func TestReloadRestoresSettingsOnError(t *testing.T) {
+	p := &Proxy{
+		TestingLocal: true,
+		Token:        "old",
+		TunnelPorts:  "443",
+		srv:          server.New(&server.Opts{}),
+		blacklist:    blacklist.New(blacklist.Options{}),
+		instrument:   instrument.NoInstrument{},
+	}
+	require.NoError(t, p.createSharedFilters())
+	require.NoError(t, p.Reload(func(p *Proxy) { p.Token = "new" }))
+	assert.Equal(t, "new", p.Token)
+
+	err := p.Reload(func(p *Proxy) {
+		p.Token = "newer"
+		p.TunnelPorts = "not a port"
+		// not a setting, e.g. assigned by main in the meantime
+		p.HTTPAddr = "127.0.0.1:8080"
+	})
+	require.Error(t, err)
+	assert.Equal(t, "new", p.Token)
+	assert.Equal(t, "443", p.TunnelPorts)
+	assert.Equal(t, "127.0.0.1:8080", p.HTTPAddr)
+}
@@ -6,6 +6,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/getlantern/http-proxy-lantern/v2/budget"
 	"github.com/getlantern/http-proxy-lantern/v2/common"
 	"github.com/getlantern/http-proxy-lantern/v2/datacap"
 	"github.com/getlantern/http-proxy-lantern/v2/listeners"
@@ -19,11 +20,12 @@ var (
 )
 
 type reportingConfig struct {
-	enabled bool
-	wrapper func(ls net.Listener) net.Listener
+	enabled  bool
+	reporter listeners.MeasuredReportFN
+	wrapper  func(ls net.Listener) net.Listener
 }
 
-func newReportingConfig(instrument instrument.Instrument, datacapTracker *datacap.Tracker) *reportingConfig {
+func newReportingConfig(instrument instrument.Instrument, datacapTracker *datacap.Tracker, budget *budget.Budget) *reportingConfig {
 	proxiedBytesReporter := func(ctx map[string]interface{}, stats *measured.Stats, deltaStats *measured.Stats, final bool) {
 		noDelta := deltaStats.SentTotal == 0 && deltaStats.RecvTotal == 0
 		if noDelta && !final {
@@ -61,6 +63,9 @@ func newReportingConfig(instrument instrument.Instrument, datacapTracker *dataca
 		probingError := fromContext(ctx, common.ProbingError)
 		arch := fromContext(ctx, common.KernelArch)
 
+		if keyID := fromContext(ctx, common.AccessKeyID); keyID != "" {
+			instrument.AccessKeyBytes(context.Background(), keyID, deltaStats.SentTotal, deltaStats.RecvTotal)
+		}
 		instrument.ProxiedBytes(context.Background(), deltaStats.SentTotal, deltaStats.RecvTotal, platform, platformVersion, libraryVersion, appVersion, app, locale, "", probingError, client_ip, deviceID, originHost, arch)
 	}
 
@@ -71,11 +76,14 @@ func newReportingConfig(instrument instrument.Instrument, datacapTracker *dataca
 	if datacapTracker != nil {
 		reporter = datacapTracker.Reporter()
 	}
+	if budget != nil {
+		reporter = combineReporter(reporter, budget.Reporter())
+	}
 	reporter = combineReporter(reporter, proxiedBytesReporter)
 	wrapper := func(ls net.Listener) net.Listener {
 		return listeners.NewMeasuredListener(ls, measuredReportingInterval, reporter)
 	}
-	return &reportingConfig{true, wrapper}
+	return &reportingConfig{true, reporter, wrapper}
 }
 
 func fromContext(ctx map[string]interface{}, key string) string {
@@ -0,0 +1,289 @@
+// Package resolver resolves the hostnames of origins for the proxy. It can
+// query plain DNS, DNS-over-TLS and DNS-over-HTTPS servers or fall back to the
+// system resolver, caches answers for their TTL (and failures to find a name
+// for a fixed time) and records the latency and outcome of every lookup.
+package resolver
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/golog"
+	lru "github.com/hashicorp/golang-lru"
+	"golang.org/x/sync/singleflight"
+
+	"github.com/getlantern/http-proxy-lantern/v2/instrument"
+)
+
+const (
+	// DefaultCacheSize is the default number of names whose answers are
+	// cached.
+	DefaultCacheSize = 10000
+
+	// DefaultNegativeTTL is how long failures to find a name are cached by
+	// default.
+	DefaultNegativeTTL = 30 * time.Second
+
+	// DefaultTimeout is how long a lookup may take by default, across all
+	// servers.
+	DefaultTimeout = 5 * time.Second
+
+	// systemTTL is how long answers from the system resolver are cached, since
+	// it doesn't tell us their TTL.
+	systemTTL = 30 * time.Second
+
+	minTTL = 1 * time.Second
+	maxTTL = 1 * time.Hour
+
+	// Values of the result attribute of lookup metrics.
+	resultOK       = "ok"
+	resultNotFound = "not_found"
+	resultError    = "error"
+	resultCached   = "cached"
+)
+
+var log = golog.LoggerFor("resolver")
+
+// Options configures a Resolver.
+type Options struct {
+	// Servers are the DNS servers to query, in order of preference. Each is
+	// host[:port] or udp://host[:port] for plain DNS, tls://host[:port] for
+	// DNS-over-TLS or an https:// URL for DNS-over-HTTPS. If empty, the system
+	// resolver is used.
+	Servers []string
+
+	// CacheSize is how many names to cache answers for. Zero disables
+	// caching.
+	CacheSize int
+
+	// NegativeTTL is how long to remember that a name doesn't exist or has no
+	// addresses. Defaults to DefaultNegativeTTL.
+	NegativeTTL time.Duration
+
+	// Timeout bounds each lookup. Defaults to DefaultTimeout.
+	Timeout time.Duration
+
+	Instrument instrument.Instrument
+}
+
+// Resolver looks up IP addresses of hosts.
+type Resolver struct {
+	servers     []server
+	cache       *lru.Cache
+	negativeTTL time.Duration
+	timeout     time.Duration
+	instrument  instrument.Instrument
+	group       singleflight.Group
+	now         func() time.Time
+}
+
+type answer struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+// New creates a Resolver.
+func New(opts Options) (*Resolver, error) {
+	r := &Resolver{
+		negativeTTL: opts.NegativeTTL,
+		timeout:     opts.Timeout,
+		instrument:  opts.Instrument,
+		now:         time.Now,
+	}
+	if r.negativeTTL <= 0 {
+		r.negativeTTL = DefaultNegativeTTL
+	}
+	if r.timeout <= 0 {
+		r.timeout = DefaultTimeout
+	}
+	if r.instrument == nil {
+		r.instrument = instrument.NoInstrument{}
+	}
+	for _, s := range opts.Servers {
+		server, err := parseServer(s)
+		if err != nil {
+			return nil, err
+		}
+		r.servers = append(r.servers, server)
+	}
+	if opts.CacheSize > 0 {
+		cache, err := lru.New(opts.CacheSize)
+		if err != nil {
+			return nil, errors.New("unable to create DNS cache: %v", err)
+		}
+		r.cache = cache
+	}
+	return r, nil
+}
+
+// LookupIP looks up the IPv4 and IPv6 addresses of host.
+func (r *Resolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	name := strings.ToLower(strings.TrimSuffix(host, "."))
+	if name == "" {
+		return nil, notFound(host)
+	}
+
+	if r.cache != nil {
+		if cached, ok := r.cache.Get(name); ok {
+			a := cached.(*answer)
+			if r.now().Before(a.expires) {
+				r.instrument.DNSLookup(ctx, "", resultCached, 0)
+				if len(a.ips) == 0 {
+					return nil, notFound(host)
+				}
+				return a.ips, nil
+			}
+			r.cache.Remove(name)
+		}
+	}
+
+	// Concurrent lookups of the same name share a single query, which isn't
+	// tied to any one of the callers' contexts.
+	ch := r.group.DoChan(name, func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+		defer cancel()
+		a, err := r.resolve(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		if r.cache != nil {
+			r.cache.Add(name, a)
+		}
+		return a, nil
+	})
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, &net.DNSError{Err: res.Err.Error(), Name: host}
+		}
+		a := res.Val.(*answer)
+		if len(a.ips) == 0 {
+			return nil, notFound(host)
+		}
+		return a.ips, nil
+	case <-ctx.Done():
+		return nil, &net.DNSError{Err: ctx.Err().Error(), Name: host, IsTimeout: true}
+	}
+}
+
+// resolve queries the servers in order until one of them answers.
+func (r *Resolver) resolve(ctx context.Context, name string) (*answer, error) {
+	if len(r.servers) == 0 {
+		return r.resolveWithSystem(ctx, name)
+	}
+	var lastErr error
+	for _, s := range r.servers {
+		start := time.Now()
+		ips, ttl, err := lookup(ctx, s, name)
+		elapsed := time.Since(start)
+		switch {
+		case err != nil:
+			r.instrument.DNSLookup(ctx, s.String(), resultError, elapsed)
+			log.Debugf("Unable to resolve %v with %v: %v", name, s, err)
+			lastErr = err
+			if ctx.Err() != nil {
+				return nil, lastErr
+			}
+			continue
+		case len(ips) == 0:
+			r.instrument.DNSLookup(ctx, s.String(), resultNotFound, elapsed)
+			return &answer{expires: r.now().Add(r.negativeTTL)}, nil
+		default:
+			r.instrument.DNSLookup(ctx, s.String(), resultOK, elapsed)
+			return &answer{ips: ips, expires: r.now().Add(clampTTL(ttl))}, nil
+		}
+	}
+	return nil, lastErr
+}
+
+func (r *Resolver) resolveWithSystem(ctx context.Context, name string) (*answer, error) {
+	start := time.Now()
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", name)
+	elapsed := time.Since(start)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			r.instrument.DNSLookup(ctx, "system", resultNotFound, elapsed)
+			return &answer{expires: r.now().Add(r.negativeTTL)}, nil
+		}
+		r.instrument.DNSLookup(ctx, "system", resultError, elapsed)
+		return nil, err
+	}
+	r.instrument.DNSLookup(ctx, "system", resultOK, elapsed)
+	return &answer{ips: ips, expires: r.now().Add(systemTTL)}, nil
+}
+
+// ResolveIPAddr is like net.ResolveIPAddr, preferring IPv4 addresses for the
+// ip network.
+func (r *Resolver) ResolveIPAddr(network, address string) (*net.IPAddr, error) {
+	ips, err := r.LookupIP(context.Background(), address)
+	if err != nil {
+		return nil, err
+	}
+	ip := pick(ips, strings.TrimPrefix(network, "ip"))
+	if ip == nil {
+		return nil, notFound(address)
+	}
+	return &net.IPAddr{IP: ip}, nil
+}
+
+// ResolveTCPAddr is like net.ResolveTCPAddr, preferring IPv4 addresses for
+// the tcp network.
+func (r *Resolver) ResolveTCPAddr(ctx context.Context, network, addr string) (*net.TCPAddr, error) {
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		port, err = net.DefaultResolver.LookupPort(ctx, network, portString)
+		if err != nil {
+			return nil, err
+		}
+	}
+	ips, err := r.LookupIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ip := pick(ips, strings.TrimPrefix(network, "tcp"))
+	if ip == nil {
+		return nil, notFound(host)
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// pick returns the first address of the given family ("4", "6" or "" for
+// either, preferring IPv4).
+func pick(ips []net.IP, family string) net.IP {
+	var first net.IP
+	for _, ip := range ips {
+		isV4 := ip.To4() != nil
+		switch {
+		case family == "4" && isV4, family == "6" && !isV4, family == "" && isV4:
+			return ip
+		case family == "" && first == nil:
+			first = ip
+		}
+	}
+	return first
+}
+
+func clampTTL(ttl time.Duration) time.Duration {
+	if ttl < minTTL {
+		return minTTL
+	}
+	if ttl > maxTTL {
+		return maxTTL
+	}
+	return ttl
+}
+
+func notFound(host string) error {
+	return &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
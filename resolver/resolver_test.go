@@ -0,0 +1,299 @@
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/getlantern/http-proxy-lantern/v2/instrument"
+)
+
+// stubServer is a DNS server answering from a fixed set of records.
+type stubServer struct {
+	ttl      uint32
+	records  map[string][]net.IP
+	truncate bool
+
+	mx      sync.Mutex
+	queries int
+}
+
+func newStubServer() *stubServer {
+	return &stubServer{
+		ttl: 60,
+		records: map[string][]net.IP{
+			"example.com.":   {net.ParseIP("93.184.215.14"), net.ParseIP("2606:2800:21f:cb07:6820:80da:af6b:8b2c")},
+			"v4only.com.":    {net.ParseIP("192.0.2.1")},
+			"other.example.": {net.ParseIP("192.0.2.2")},
+		},
+	}
+}
+
+func (s *stubServer) queryCount() int {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.queries
+}
+
+func (s *stubServer) answer(query []byte, overUDP bool) []byte {
+	s.mx.Lock()
+	s.queries++
+	s.mx.Unlock()
+
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		return nil
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil
+	}
+	h.Response = true
+	ips, found := s.records[q.Name.String()]
+	if !found {
+		h.RCode = dnsmessage.RCodeNameError
+	}
+	if overUDP && s.truncate {
+		h.Truncated = true
+		ips = nil
+	}
+	b := dnsmessage.NewBuilder(nil, h)
+	b.StartQuestions()
+	b.Question(q)
+	b.StartAnswers()
+	rh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: s.ttl}
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil && q.Type == dnsmessage.TypeA {
+			var r dnsmessage.AResource
+			copy(r.A[:], ip4)
+			b.AResource(rh, r)
+		} else if ip4 == nil && q.Type == dnsmessage.TypeAAAA {
+			var r dnsmessage.AAAAResource
+			copy(r.AAAA[:], ip)
+			b.AAAAResource(rh, r)
+		}
+	}
+	resp, _ := b.Finish()
+	return resp
+}
+
+// serveUDPAndTCP serves plain DNS on the same port over UDP and TCP.
+func (s *stubServer) serveUDPAndTCP(t *testing.T) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		b := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(s.answer(b[:n], true), addr)
+		}
+	}()
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go s.serveStream(l)
+	return pc.LocalAddr().String()
+}
+
+func (s *stubServer) serveStream(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				var length [2]byte
+				if _, err := io.ReadFull(conn, length[:]); err != nil {
+					return
+				}
+				query := make([]byte, binary.BigEndian.Uint16(length[:]))
+				if _, err := io.ReadFull(conn, query); err != nil {
+					return
+				}
+				resp := s.answer(query, false)
+				msg := make([]byte, 2+len(resp))
+				binary.BigEndian.PutUint16(msg, uint16(len(resp)))
+				copy(msg[2:], resp)
+				conn.Write(msg)
+			}
+		}()
+	}
+}
+
+type lookupRecorder struct {
+	instrument.NoInstrument
+	mx      sync.Mutex
+	results []string
+}
+
+func (r *lookupRecorder) DNSLookup(ctx context.Context, server, result string, duration time.Duration) {
+	r.mx.Lock()
+	r.results = append(r.results, result)
+	r.mx.Unlock()
+}
+
+func (r *lookupRecorder) recorded() []string {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return append([]string(nil), r.results...)
+}
+
+func TestLookupAndCache(t *testing.T) {
+	stub := newStubServer()
+	recorder := &lookupRecorder{}
+	r, err := New(Options{
+		Servers:     []string{stub.serveUDPAndTCP(t)},
+		CacheSize:   10,
+		NegativeTTL: 10 * time.Second,
+		Instrument:  recorder,
+	})
+	require.NoError(t, err)
+	now := time.Now()
+	r.now = func() time.Time { return now }
+
+	ips, err := r.LookupIP(context.Background(), "Example.com.")
+	require.NoError(t, err)
+	assert.Len(t, ips, 2)
+	assert.Equal(t, 2, stub.queryCount(), "should have queried A and AAAA")
+
+	_, err = r.LookupIP(context.Background(), "example.com")
+	require.NoError(t, err)
+	assert.Equal(t, 2, stub.queryCount(), "should have answered from cache")
+
+	now = now.Add(61 * time.Second)
+	_, err = r.LookupIP(context.Background(), "example.com")
+	require.NoError(t, err)
+	assert.Equal(t, 4, stub.queryCount(), "should have queried again after TTL expired")
+
+	_, err = r.LookupIP(context.Background(), "nonexistent.example")
+	assert.True(t, err.(*net.DNSError).IsNotFound)
+	_, err = r.LookupIP(context.Background(), "nonexistent.example")
+	assert.True(t, err.(*net.DNSError).IsNotFound)
+	assert.Equal(t, 6, stub.queryCount(), "should have cached negative answer")
+	now = now.Add(11 * time.Second)
+	_, err = r.LookupIP(context.Background(), "nonexistent.example")
+	assert.Error(t, err)
+	assert.Equal(t, 8, stub.queryCount(), "should have queried again after negative TTL expired")
+
+	assert.Equal(t, []string{"ok", "cached", "ok", "not_found", "cached", "not_found"}, recorder.recorded())
+
+	ips, err = r.LookupIP(context.Background(), "192.0.2.200")
+	require.NoError(t, err)
+	assert.Equal(t, []net.IP{net.ParseIP("192.0.2.200")}, ips)
+	assert.Equal(t, 8, stub.queryCount(), "shouldn't query for IP literals")
+}
+
+func TestResolveAddr(t *testing.T) {
+	stub := newStubServer()
+	r, err := New(Options{Servers: []string{stub.serveUDPAndTCP(t)}})
+	require.NoError(t, err)
+
+	addr, err := r.ResolveTCPAddr(context.Background(), "tcp", "example.com:443")
+	require.NoError(t, err)
+	assert.Equal(t, "93.184.215.14:443", addr.String(), "should prefer IPv4")
+	addr, err = r.ResolveTCPAddr(context.Background(), "tcp6", "example.com:https")
+	require.NoError(t, err)
+	assert.Equal(t, "[2606:2800:21f:cb07:6820:80da:af6b:8b2c]:443", addr.String())
+	_, err = r.ResolveTCPAddr(context.Background(), "tcp6", "v4only.com:443")
+	assert.Error(t, err)
+
+	ipAddr, err := r.ResolveIPAddr("ip", "v4only.com")
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.1", ipAddr.String())
+}
+
+func TestTruncatedFallsBackToTCP(t *testing.T) {
+	stub := newStubServer()
+	stub.truncate = true
+	r, err := New(Options{Servers: []string{"udp://" + stub.serveUDPAndTCP(t)}})
+	require.NoError(t, err)
+	ips, err := r.LookupIP(context.Background(), "v4only.com")
+	require.NoError(t, err)
+	assert.Equal(t, []net.IP{net.ParseIP("192.0.2.1").To4()}, ips)
+}
+
+func TestFallsBackToNextServer(t *testing.T) {
+	// nothing listening here
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	dead := pc.LocalAddr().String()
+	pc.Close()
+
+	stub := newStubServer()
+	recorder := &lookupRecorder{}
+	r, err := New(Options{Servers: []string{dead, stub.serveUDPAndTCP(t)}, Instrument: recorder})
+	require.NoError(t, err)
+	_, err = r.LookupIP(context.Background(), "example.com")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"error", "ok"}, recorder.recorded())
+}
+
+func TestDNSOverTLS(t *testing.T) {
+	// borrow httptest's self-signed certificate
+	certServer := httptest.NewTLSServer(http.NotFoundHandler())
+	defer certServer.Close()
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: certServer.TLS.Certificates})
+	require.NoError(t, err)
+	defer l.Close()
+	stub := newStubServer()
+	go stub.serveStream(l)
+
+	r, err := New(Options{Servers: []string{"tls://" + l.Addr().String()}})
+	require.NoError(t, err)
+	s := r.servers[0].(*tlsServer)
+	s.config.RootCAs = certServer.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	s.config.ServerName = "example.com"
+
+	ips, err := r.LookupIP(context.Background(), "v4only.com")
+	require.NoError(t, err)
+	assert.Equal(t, []net.IP{net.ParseIP("192.0.2.1").To4()}, ips)
+}
+
+func TestDNSOverHTTPS(t *testing.T) {
+	stub := newStubServer()
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost || req.Header.Get("Content-Type") != dnsMessageType {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		query, _ := io.ReadAll(req.Body)
+		w.Header().Set("Content-Type", dnsMessageType)
+		w.Write(stub.answer(query, false))
+	}))
+	defer srv.Close()
+
+	r, err := New(Options{Servers: []string{srv.URL + "/dns-query"}})
+	require.NoError(t, err)
+	r.servers[0].(*httpsServer).client = srv.Client()
+
+	ips, err := r.LookupIP(context.Background(), "other.example")
+	require.NoError(t, err)
+	assert.Equal(t, []net.IP{net.ParseIP("192.0.2.2").To4()}, ips)
+	_, err = r.LookupIP(context.Background(), "nonexistent.example")
+	assert.True(t, err.(*net.DNSError).IsNotFound)
+}
+
+func TestInvalidServers(t *testing.T) {
+	for _, s := range []string{"ftp://example.com", "https://"} {
+		_, err := New(Options{Servers: []string{s}})
+		assert.Error(t, err, s)
+	}
+}
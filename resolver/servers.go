@@ -0,0 +1,305 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/getlantern/errors"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	maxMessageSize = 65535
+	dnsMessageType = "application/dns-message"
+)
+
+var errNameError = errors.New("no such domain")
+
+// server exchanges DNS messages with a DNS server.
+type server interface {
+	exchange(ctx context.Context, query []byte) ([]byte, error)
+	String() string
+}
+
+func parseServer(s string) (server, error) {
+	scheme, rest, found := strings.Cut(s, "://")
+	if !found {
+		scheme, rest = "udp", s
+	}
+	switch scheme {
+	case "udp":
+		return &udpServer{addr: withDefaultPort(rest, "53")}, nil
+	case "tls":
+		addr := withDefaultPort(rest, "853")
+		host, _, _ := net.SplitHostPort(addr)
+		return &tlsServer{addr: addr, config: &tls.Config{ServerName: host}}, nil
+	case "https":
+		u, err := url.Parse(s)
+		if err != nil || u.Host == "" {
+			return nil, errors.New("invalid DNS-over-HTTPS URL %v", s)
+		}
+		return &httpsServer{url: s, client: http.DefaultClient}, nil
+	default:
+		return nil, errors.New("unsupported DNS server %v, must be host[:port], udp://, tls:// or https://", s)
+	}
+}
+
+func withDefaultPort(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(strings.Trim(addr, "[]"), port)
+}
+
+// udpServer is a plain DNS server, queried over UDP and, if the answer
+// doesn't fit, TCP.
+type udpServer struct {
+	addr string
+}
+
+func (s *udpServer) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	b := make([]byte, maxMessageSize)
+	for {
+		n, err := conn.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		var p dnsmessage.Parser
+		h, err := p.Start(b[:n])
+		if err != nil || h.ID != binary.BigEndian.Uint16(query) {
+			// not a response to our query, keep waiting
+			continue
+		}
+		if h.Truncated {
+			tcpConn, err := d.DialContext(ctx, "tcp", s.addr)
+			if err != nil {
+				return nil, err
+			}
+			defer tcpConn.Close()
+			return exchangeOverStream(ctx, tcpConn, query)
+		}
+		return b[:n], nil
+	}
+}
+
+func (s *udpServer) String() string {
+	return "udp://" + s.addr
+}
+
+// tlsServer is a DNS-over-TLS server (RFC 7858).
+type tlsServer struct {
+	addr   string
+	config *tls.Config
+}
+
+func (s *tlsServer) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	d := tls.Dialer{Config: s.config}
+	conn, err := d.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return exchangeOverStream(ctx, conn, query)
+}
+
+func (s *tlsServer) String() string {
+	return "tls://" + s.addr
+}
+
+// exchangeOverStream exchanges a query using the length-prefixed framing of
+// DNS over TCP (RFC 1035 section 4.2.2).
+func exchangeOverStream(ctx context.Context, conn net.Conn, query []byte) ([]byte, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// httpsServer is a DNS-over-HTTPS server (RFC 8484).
+type httpsServer struct {
+	url    string
+	client *http.Client
+}
+
+func (s *httpsServer) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dnsMessageType)
+	req.Header.Set("Accept", dnsMessageType)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("unexpected response status %v", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxMessageSize))
+}
+
+func (s *httpsServer) String() string {
+	return s.url
+}
+
+// lookup queries s for the A and AAAA records of name in parallel. It returns
+// no addresses and no error if the name doesn't exist or has no addresses.
+func lookup(ctx context.Context, s server, name string) ([]net.IP, time.Duration, error) {
+	type result struct {
+		ips []net.IP
+		ttl time.Duration
+		err error
+	}
+	types := []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	results := make(chan result, len(types))
+	for _, qtype := range types {
+		go func(qtype dnsmessage.Type) {
+			ips, ttl, err := query(ctx, s, name, qtype)
+			results <- result{ips, ttl, err}
+		}(qtype)
+	}
+
+	var ips []net.IP
+	ttl := time.Duration(math.MaxInt64)
+	var err error
+	for range types {
+		r := <-results
+		switch {
+		case r.err == errNameError:
+		case r.err != nil:
+			err = r.err
+		case len(r.ips) > 0:
+			ips = append(ips, r.ips...)
+			if r.ttl < ttl {
+				ttl = r.ttl
+			}
+		}
+	}
+	if len(ips) > 0 {
+		// one family is enough
+		return ips, ttl, nil
+	}
+	return nil, 0, err
+}
+
+func query(ctx context.Context, s server, name string, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	id := uint16(rand.Uint32())
+	q, err := buildQuery(id, name, qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := s.exchange(ctx, q)
+	if err != nil {
+		return nil, 0, err
+	}
+	return parseResponse(id, resp)
+}
+
+func buildQuery(id uint16, name string, qtype dnsmessage.Type) ([]byte, error) {
+	qname, err := dnsmessage.NewName(name + ".")
+	if err != nil {
+		return nil, errors.New("invalid name %v: %v", name, err)
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(dnsmessage.Question{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+// parseResponse returns the addresses in a response and the lowest TTL of the
+// records in its answer section.
+func parseResponse(id uint16, msg []byte) ([]net.IP, time.Duration, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil {
+		return nil, 0, errors.New("unable to parse response: %v", err)
+	}
+	if h.ID != id || !h.Response {
+		return nil, 0, errors.New("not a response to our query")
+	}
+	switch h.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, 0, errNameError
+	default:
+		return nil, 0, errors.New("server responded with %v", h.RCode)
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, 0, errors.New("unable to parse response: %v", err)
+	}
+
+	var ips []net.IP
+	ttl := uint32(math.MaxUint32)
+	for {
+		ah, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, 0, errors.New("unable to parse response: %v", err)
+		}
+		if ah.TTL < ttl {
+			ttl = ah.TTL
+		}
+		switch ah.Type {
+		case dnsmessage.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return nil, 0, errors.New("unable to parse A record: %v", err)
+			}
+			ips = append(ips, net.IP(r.A[:]))
+		case dnsmessage.TypeAAAA:
+			r, err := p.AAAAResource()
+			if err != nil {
+				return nil, 0, errors.New("unable to parse AAAA record: %v", err)
+			}
+			ips = append(ips, net.IP(r.AAAA[:]))
+		default:
+			if err := p.SkipAnswer(); err != nil {
+				return nil, 0, errors.New("unable to parse response: %v", err)
+			}
+		}
+	}
+	return ips, time.Duration(ttl) * time.Second, nil
+}
@@ -8,6 +8,7 @@ import (
 	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/getlantern/errors"
@@ -23,6 +24,10 @@ import (
 var (
 	testingLocal = false
 	log          = golog.LoggerFor("server")
+
+	// ErrDraining is returned by Serve and friends once the server has started
+	// draining.
+	ErrDraining = errors.New("server is draining")
 )
 
 // A ListenerGenerator generates a new listener from an existing one.
@@ -62,17 +67,30 @@ type Opts struct {
 type Server struct {
 	// Allow is a function that determines whether or not to allow connections
 	// from the given IP address. If unspecified, all connections are allowed.
-	Allow              func(string) bool
-	proxy              proxy.Proxy
+	Allow func(string) bool
+	// proxy holds the current proxy.Proxy. It's swapped by SetFilter and loaded
+	// once per connection, so a connection keeps the filter chain it was
+	// accepted with for its whole lifetime.
+	proxy              atomic.Value
+	proxyOpts          proxy.Opts
 	listenerGenerators []ListenerGenerator
 	onError            func(conn net.Conn, err error)
 	onAcceptError      func(err error) (fatalErr error)
 	onActive           func(conn net.Conn)
+
+	// mx protects the listeners being served and the connections being
+	// handled, which Drain closes.
+	mx        sync.Mutex
+	listeners map[net.Listener]bool
+	conns     map[net.Conn]bool
+	draining  bool
+	drained   chan struct{}
+	drainOnce sync.Once
 }
 
 // New constructs a new HTTP proxy server using the given options
 func New(opts *Opts) *Server {
-	p := proxy.New(&proxy.Opts{
+	proxyOpts := proxy.Opts{
 		IdleTimeout:         opts.IdleTimeout,
 		Dial:                opts.Dial,
 		Filter:              opts.Filter,
@@ -90,7 +108,7 @@ func New(opts *Opts) *Server {
 				Body:       ioutil.NopCloser(strings.NewReader(err.Error())),
 			}
 		},
-	})
+	}
 
 	if opts.OnError == nil {
 		opts.OnError = func(conn net.Conn, err error) {}
@@ -101,12 +119,27 @@ func New(opts *Opts) *Server {
 	if opts.OnActive == nil {
 		opts.OnActive = func(conn net.Conn) {}
 	}
-	return &Server{
-		proxy:         p,
+	s := &Server{
+		proxyOpts:     proxyOpts,
 		onError:       opts.OnError,
 		onAcceptError: opts.OnAcceptError,
 		onActive:      opts.OnActive,
+		listeners:     make(map[net.Listener]bool),
+		conns:         make(map[net.Conn]bool),
+		drained:       make(chan struct{}),
 	}
+	s.proxy.Store(proxy.New(&proxyOpts))
+	return s
+}
+
+// SetFilter atomically replaces the filter chain and dial function used for
+// new connections. Connections that are already being handled drain on the
+// chain they were accepted with.
+func (s *Server) SetFilter(filter filters.Filter, dial proxy.DialFunc) {
+	opts := s.proxyOpts
+	opts.Filter = filter
+	opts.Dial = dial
+	s.proxy.Store(proxy.New(&opts))
 }
 
 func (s *Server) AddListenerWrappers(listenerGens ...ListenerGenerator) {
@@ -149,6 +182,12 @@ func (s *Server) serve(listener net.Listener, readyCb func(addr string)) error {
 		l = wrap(l)
 	}
 
+	if !s.trackListener(l) {
+		l.Close()
+		return ErrDraining
+	}
+	defer s.untrackListener(l)
+
 	if readyCb != nil {
 		readyCb(l.Addr().String())
 	}
@@ -157,6 +196,9 @@ func (s *Server) serve(listener net.Listener, readyCb func(addr string)) error {
 	for {
 		conn, err := l.Accept()
 		if err != nil {
+			if s.isDraining() {
+				return ErrDraining
+			}
 			if ne, ok := err.(net.Error); ok && ne.Temporary() {
 				// delay code based on net/http.Server
 				if tempDelay == 0 {
@@ -182,6 +224,9 @@ func (s *Server) serve(listener net.Listener, readyCb func(addr string)) error {
 }
 
 func (s *Server) handle(conn net.Conn) {
+	s.mx.Lock()
+	s.conns[conn] = true
+	s.mx.Unlock()
 	wrapConn, isWrapConn := conn.(listeners.WrapConn)
 	if isWrapConn {
 		wrapConn.OnState(http.StateNew)
@@ -197,6 +242,7 @@ func (s *Server) doHandle(conn net.Conn, isWrapConn bool, wrapConn listeners.Wra
 	}
 	op := ops.Begin("http_proxy_handle").Set("client_ip", clientIP)
 	defer op.End()
+	defer s.untrackConn(conn)
 
 	defer func() {
 		p := recover()
@@ -209,7 +255,8 @@ func (s *Server) doHandle(conn net.Conn, isWrapConn bool, wrapConn listeners.Wra
 		}
 	}()
 
-	err := s.proxy.Handle(context.Background(), conn, conn)
+	p := s.proxy.Load().(proxy.Proxy)
+	err := p.Handle(context.WithValue(context.Background(), downstreamKey{}, conn), conn, conn)
 	if err != nil {
 		op.FailIf(errors.New("Error handling connection from %v: %v", conn.RemoteAddr(), err))
 		s.onError(conn, err)
@@ -219,6 +266,93 @@ func (s *Server) doHandle(conn net.Conn, isWrapConn bool, wrapConn listeners.Wra
 	}
 }
 
+type downstreamKey struct{}
+
+// DownstreamFromContext returns the client connection on whose behalf a CONNECT
+// tunnel is being dialed with the given context, or nil if unknown. Plain HTTP
+// requests are dialed with their own context, which doesn't carry it.
+func DownstreamFromContext(ctx context.Context) net.Conn {
+	conn, _ := ctx.Value(downstreamKey{}).(net.Conn)
+	return conn
+}
+
+// Drain stops accepting connections on all listeners the server is serving
+// and waits for the connections it's handling to finish. If they haven't
+// finished by the time ctx is done, the remaining connections are closed and
+// an error is returned. Serve and friends return ErrDraining once draining has
+// started.
+func (s *Server) Drain(ctx context.Context) error {
+	s.mx.Lock()
+	if !s.draining {
+		s.draining = true
+		for l := range s.listeners {
+			if err := l.Close(); err != nil {
+				log.Errorf("Unable to close listener at %v: %v", l.Addr(), err)
+			}
+		}
+	}
+	active := len(s.conns)
+	if active == 0 {
+		s.drainOnce.Do(func() { close(s.drained) })
+	}
+	s.mx.Unlock()
+
+	log.Debugf("Draining %d active connections", active)
+	select {
+	case <-s.drained:
+		log.Debug("Drained all connections")
+		return nil
+	case <-ctx.Done():
+		s.mx.Lock()
+		remaining := len(s.conns)
+		for conn := range s.conns {
+			safeClose(conn)
+		}
+		s.mx.Unlock()
+		return errors.New("closed %d connections that didn't finish draining: %v", remaining, ctx.Err())
+	}
+}
+
+// ActiveConnections returns the number of connections the server is handling.
+func (s *Server) ActiveConnections() int {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return len(s.conns)
+}
+
+func (s *Server) isDraining() bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.draining
+}
+
+// trackListener records a listener being served so that Drain can close it.
+// It returns false if the server is already draining.
+func (s *Server) trackListener(l net.Listener) bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.draining {
+		return false
+	}
+	s.listeners[l] = true
+	return true
+}
+
+func (s *Server) untrackListener(l net.Listener) {
+	s.mx.Lock()
+	delete(s.listeners, l)
+	s.mx.Unlock()
+}
+
+func (s *Server) untrackConn(conn net.Conn) {
+	s.mx.Lock()
+	delete(s.conns, conn)
+	if s.draining && len(s.conns) == 0 {
+		s.drainOnce.Do(func() { close(s.drained) })
+	}
+	s.mx.Unlock()
+}
+
 func safeClose(conn net.Conn) {
 	defer func() {
 		p := recover()
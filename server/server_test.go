@@ -3,6 +3,7 @@ package server
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"flag"
 	"fmt"
@@ -23,6 +24,7 @@ import (
 	"github.com/getlantern/mockconn"
 	"github.com/getlantern/proxy/v3/filters"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/getlantern/http-proxy-lantern/v2/listeners"
 )
@@ -454,6 +456,103 @@ func TestPanicRecover(t *testing.T) {
 	assert.True(t, conn.Closed(), "Connection should have been closed after recovering from panic")
 }
 
+func TestSetFilter(t *testing.T) {
+	req := "GET / HTTP/1.1\r\nHost: thehost.com\r\n\r\n"
+	respondWith := func(status int) filters.Filter {
+		return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, _ filters.Next) (*http.Response, *filters.ConnectionState, error) {
+			return &http.Response{Request: req, StatusCode: status, Body: ioutil.NopCloser(strings.NewReader(""))}, cs, nil
+		})
+	}
+	statusFor := func(server *Server) int {
+		var out bytes.Buffer
+		conn := mockconn.New(&out, strings.NewReader(req))
+		server.doHandle(conn, false, nil)
+		resp, err := http.ReadResponse(bufio.NewReader(&out), nil)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		return resp.StatusCode
+	}
+
+	server := New(&Opts{Filter: respondWith(http.StatusOK)})
+	assert.Equal(t, http.StatusOK, statusFor(server))
+
+	server.SetFilter(respondWith(http.StatusForbidden), nil)
+	assert.Equal(t, http.StatusForbidden, statusFor(server), "new connections should use the replaced filter")
+}
+
+func TestDrain(t *testing.T) {
+	release := make(chan struct{})
+	server := New(&Opts{
+		Filter: filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, _ filters.Next) (*http.Response, *filters.ConnectionState, error) {
+			<-release
+			return &http.Response{Request: req, StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(""))}, cs, nil
+		}),
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(l, nil)
+	}()
+
+	inFlight := func() net.Conn {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: thehost.com\r\n\r\n"))
+		require.NoError(t, err)
+		return conn
+	}
+	conn := inFlight()
+	defer conn.Close()
+	require.Eventually(t, func() bool { return server.ActiveConnections() == 1 }, time.Second, 5*time.Millisecond)
+
+	drainErr := make(chan error, 1)
+	go func() {
+		drainErr <- server.Drain(context.Background())
+	}()
+	assert.Equal(t, ErrDraining, <-serveErr, "Serve should return once draining")
+	_, err = net.Dial("tcp", l.Addr().String())
+	assert.Error(t, err, "should no longer accept connections")
+	select {
+	case <-drainErr:
+		t.Fatal("Drain returned before the in-flight request finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "in-flight request should complete")
+	conn.Close()
+	assert.NoError(t, <-drainErr)
+	assert.Equal(t, ErrDraining, server.Serve(l, nil), "should refuse to serve once drained")
+}
+
+func TestDrainDeadline(t *testing.T) {
+	server := New(&Opts{
+		Filter: filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, _ filters.Next) (*http.Response, *filters.ConnectionState, error) {
+			select {}
+		}),
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.Serve(l, nil)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: thehost.com\r\n\r\n"))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return server.ActiveConnections() == 1 }, time.Second, 5*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Error(t, server.Drain(ctx), "should give up on connections that don't finish in time")
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(t, err, "remaining connections should be closed")
+}
+
 //
 // Auxiliary functions
 //
@@ -6,9 +6,11 @@ package shadowsocks
 import (
 	"container/list"
 	"fmt"
+	"os"
 
 	"github.com/Jigsaw-Code/outline-sdk/transport/shadowsocks"
 	"github.com/Jigsaw-Code/outline-ss-server/service"
+	"gopkg.in/yaml.v3"
 )
 
 const (
@@ -17,10 +19,66 @@ const (
 	DefaultMaxPending    = 1000
 )
 
+// CipherConfig is an access key: the cipher and secret a client authenticates
+// with, and the ID its connections are attributed to.
 type CipherConfig struct {
-	ID     string
-	Cipher string
-	Secret string
+	ID     string `yaml:"id"`
+	Cipher string `yaml:"cipher"`
+	Secret string `yaml:"secret"`
+}
+
+// keysFile is the format of access key files, the same as the keys section
+// of an Outline server's config.
+type keysFile struct {
+	Keys []CipherConfig `yaml:"keys"`
+}
+
+// LoadKeys reads the access keys in the YAML file at filename, e.g.
+//
+//	keys:
+//	  - id: user-0
+//	    cipher: chacha20-ietf-poly1305
+//	    secret: Secret0
+//
+// The cipher defaults to DefaultCipher.
+func LoadKeys(filename string) ([]CipherConfig, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read shadowsocks keys: %w", err)
+	}
+	return ParseKeys(b)
+}
+
+// ParseKeys parses access keys in the format LoadKeys reads, checking that
+// their IDs are unique and that they can be used.
+func ParseKeys(b []byte) ([]CipherConfig, error) {
+	var f keysFile
+	if err := yaml.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("unable to parse shadowsocks keys: %w", err)
+	}
+	if err := ValidateKeys(f.Keys); err != nil {
+		return nil, err
+	}
+	return f.Keys, nil
+}
+
+// ValidateKeys checks that configs have unique IDs and can all be turned into
+// cipher entries, so that UpdateCipherList won't fail with them.
+func ValidateKeys(configs []CipherConfig) error {
+	ids := make(map[string]bool, len(configs))
+	for _, config := range configs {
+		if config.ID == "" {
+			return fmt.Errorf("shadowsocks key without an ID")
+		}
+		if ids[config.ID] {
+			return fmt.Errorf("duplicate shadowsocks key ID %v", config.ID)
+		}
+		ids[config.ID] = true
+		if _, err := newCipherEntry(config); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // NewCipherListWithConfigs creates a CipherList with the given
@@ -39,20 +97,27 @@ func NewCipherListWithConfigs(configs []CipherConfig) (service.CipherList, error
 func UpdateCipherList(cipherList service.CipherList, configs []CipherConfig) error {
 	list := list.New()
 	for _, config := range configs {
-		cipher := config.Cipher
-		if cipher == "" {
-			cipher = DefaultCipher
-		}
-		if config.Secret == "" {
-			return fmt.Errorf("Secret was not specified for cipher %s", config.ID)
-		}
-		ci, err := shadowsocks.NewEncryptionKey(cipher, config.Secret)
+		entry, err := newCipherEntry(config)
 		if err != nil {
-			return fmt.Errorf("Failed to create cipher entry (%v, %v, %v) : %w", config.ID, config.Cipher, config.Secret, err)
+			return err
 		}
-		entry := service.MakeCipherEntry(config.ID, ci, config.Secret)
 		list.PushBack(&entry)
 	}
 	cipherList.Update(list)
 	return nil
 }
+
+func newCipherEntry(config CipherConfig) (service.CipherEntry, error) {
+	cipher := config.Cipher
+	if cipher == "" {
+		cipher = DefaultCipher
+	}
+	if config.Secret == "" {
+		return service.CipherEntry{}, fmt.Errorf("Secret was not specified for cipher %s", config.ID)
+	}
+	ci, err := shadowsocks.NewEncryptionKey(cipher, config.Secret)
+	if err != nil {
+		return service.CipherEntry{}, fmt.Errorf("Failed to create cipher entry (%v, %v) : %w", config.ID, config.Cipher, err)
+	}
+	return service.MakeCipherEntry(config.ID, ci, config.Secret), nil
+}
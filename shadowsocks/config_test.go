@@ -0,0 +1,35 @@
+package shadowsocks
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseKeys(t *testing.T) {
+	keys, err := ParseKeys([]byte(`
+keys:
+  - id: user-0
+    cipher: chacha20-ietf-poly1305
+    secret: Secret0
+  - id: user-1
+    secret: Secret1
+`))
+	require.NoError(t, err)
+	assert.Equal(t, []CipherConfig{
+		{ID: "user-0", Cipher: "chacha20-ietf-poly1305", Secret: "Secret0"},
+		{ID: "user-1", Secret: "Secret1"},
+	}, keys)
+
+	for name, yml := range map[string]string{
+		"not yaml":       "keys: [",
+		"missing id":     "keys: [{secret: Secret0}]",
+		"missing secret": "keys: [{id: user-0}]",
+		"duplicate id":   "keys: [{id: user-0, secret: Secret0}, {id: user-0, secret: Secret1}]",
+		"unknown cipher": "keys: [{id: user-0, cipher: rot13, secret: Secret0}]",
+	} {
+		_, err := ParseKeys([]byte(yml))
+		assert.Error(t, err, name)
+	}
+}
@@ -32,6 +32,9 @@ func (d *LocalDialer) DialStream(ctx context.Context, addr string) (transport.St
 		clientTCPConn:  cliConn,
 		upstreamTarget: addr,
 	}
+	if key, ok := ctx.Value(accessKeyCtxKey{}).(*accessKey); ok {
+		b.accessKeyID = key.id
+	}
 	d.connections <- b
 
 	return a, nil
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/getlantern/golog"
@@ -74,7 +75,20 @@ func ListenLocalTCPOptions(options *ListenerOptions) net.Listener {
 		validator = onet.RequirePublicIP
 	}
 
-	authFunc := service.NewShadowsocksStreamAuthenticator(options.Ciphers, options.ReplayCache, options.ShadowsocksMetrics)
+	authenticate := service.NewShadowsocksStreamAuthenticator(options.Ciphers, options.ReplayCache, options.ShadowsocksMetrics)
+	// The handler only learns which access key a client authenticated with
+	// through its metrics, so note it on the connection's accessKey for the
+	// LocalDialer to pick up. Both run on the connection's goroutine.
+	var accessKeys sync.Map
+	authFunc := func(clientConn transport.StreamConn) (string, transport.StreamConn, *onet.ConnectionError) {
+		id, conn, err := authenticate(clientConn)
+		if err == nil {
+			if key, ok := accessKeys.Load(clientConn.RemoteAddr().String()); ok {
+				key.(*accessKey).id = id
+			}
+		}
+		return id, conn, err
+	}
 	tcpHandler := service.NewTCPHandler(options.Listener.Addr().(*net.TCPAddr).Port, authFunc, options.ShadowsocksMetrics, timeout)
 	tcpHandler.SetTargetDialer(&LocalDialer{connections: l.connections})
 
@@ -93,8 +107,13 @@ func ListenLocalTCPOptions(options *ListenerOptions) net.Listener {
 	}
 
 	handler := func(ctx context.Context, conn transport.StreamConn) {
+		key := &accessKey{}
+		addr := conn.RemoteAddr().String()
+		accessKeys.Store(addr, key)
+		defer accessKeys.Delete(addr)
 		// Add the client connection to the context so it can be used by the LocalDialer
 		ctx = context.WithValue(ctx, clientConnCtxKey{}, conn)
+		ctx = context.WithValue(ctx, accessKeyCtxKey{}, key)
 		tcpHandler.Handle(ctx, conn)
 	}
 
@@ -105,6 +124,34 @@ func ListenLocalTCPOptions(options *ListenerOptions) net.Listener {
 // clientConnCtxKey is a context key being used to share the client connection
 type clientConnCtxKey struct{}
 
+// accessKeyCtxKey is a context key being used to share the accessKey of the
+// client connection
+type accessKeyCtxKey struct{}
+
+// accessKey is the access key a client connection authenticated with.
+type accessKey struct {
+	id string
+}
+
+// AccessKeyID returns the ID of the access key the shadowsocks connection conn
+// wraps authenticated with, or "" if it doesn't wrap one.
+func AccessKeyID(conn net.Conn) string {
+	for conn != nil {
+		switch c := conn.(type) {
+		case interface{ AccessKeyID() string }:
+			return c.AccessKeyID()
+		case netx.WrappedConn:
+			conn = c.Wrapped()
+		case interface{ NetConn() net.Conn }:
+			// e.g. *tls.Conn, with shadowsocks-with-tls
+			conn = c.NetConn()
+		default:
+			return ""
+		}
+	}
+	return ""
+}
+
 // Accept implements Accept() from net.Listener
 func (l *llistener) Accept() (net.Conn, error) {
 	select {
@@ -209,6 +256,7 @@ type lfwd struct {
 	clientTCPConn  net.Conn
 	remoteAddr     net.Addr
 	upstreamTarget string
+	accessKeyID    string
 }
 
 func (l *lfwd) RemoteAddr() net.Addr {
@@ -219,6 +267,11 @@ func (l *lfwd) UpstreamTarget() string {
 	return l.upstreamTarget
 }
 
+// AccessKeyID is the ID of the access key the client authenticated with.
+func (l *lfwd) AccessKeyID() string {
+	return l.accessKeyID
+}
+
 func (l *lfwd) Wrapped() net.Conn {
 	return l.clientTCPConn.(*tcpConnAdapter).Wrapped()
 }
@@ -5,6 +5,7 @@ import (
 	"context"
 	crand "crypto/rand"
 	"fmt"
+	"io"
 	"net"
 	"testing"
 	"time"
@@ -239,3 +240,77 @@ func TestConcurrentLocalUpstreamHandling(t *testing.T) {
 	require.Nil(t, fdc.AssertDelta(0), "After closing listener, there should be no lingering file descriptors")
 	grtracker.Check(t)
 }
+
+func TestAccessKeys(t *testing.T) {
+	l0, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	require.NoError(t, err)
+	configs := []CipherConfig{{ID: "key-0", Secret: "secret-0"}, {ID: "key-1", Secret: "secret-1"}}
+	cipherList, err := NewCipherListWithConfigs(configs)
+	require.NoError(t, err)
+
+	replayCache := service.NewReplayCache(10)
+	l1 := ListenLocalTCPOptions(&ListenerOptions{
+		Listener:           &tcpListenerAdapter{l0},
+		Ciphers:            cipherList,
+		Timeout:            200 * time.Millisecond,
+		ReplayCache:        &replayCache,
+		ShadowsocksMetrics: &service.NoOpTCPMetrics{},
+	})
+	defer l1.Close()
+
+	accessKeyIDs := make(chan string, 1)
+	go func() {
+		for {
+			c, err := l1.Accept()
+			if err != nil {
+				return
+			}
+			accessKeyIDs <- AccessKeyID(c)
+			go func(c net.Conn) {
+				defer c.Close()
+				buf := make([]byte, 5)
+				for {
+					n, err := c.Read(buf)
+					if err != nil {
+						return
+					}
+					c.Write(buf[:n])
+				}
+			}(c)
+		}
+	}()
+
+	dial := func(config CipherConfig) transport.StreamConn {
+		key, err := shadowsocks.NewEncryptionKey(DefaultCipher, config.Secret)
+		require.NoError(t, err)
+		client, err := shadowsocks.NewStreamDialer(&transport.TCPEndpoint{Address: l1.Addr().String()}, key)
+		require.NoError(t, err)
+		conn, err := client.DialStream(context.Background(), "127.0.0.1:443")
+		require.NoError(t, err)
+		return conn
+	}
+	echo := func(conn transport.StreamConn) error {
+		if _, err := conn.Write([]byte("hello")); err != nil {
+			return err
+		}
+		buf := make([]byte, 5)
+		_, err := io.ReadFull(conn, buf)
+		return err
+	}
+
+	conn := dial(configs[1])
+	defer conn.Close()
+	require.NoError(t, echo(conn))
+	assert.Equal(t, "key-1", <-accessKeyIDs)
+
+	// Replacing the keys leaves connections that are already open alone.
+	require.NoError(t, UpdateCipherList(cipherList, []CipherConfig{{ID: "key-2", Secret: "secret-2"}}))
+	assert.NoError(t, echo(conn), "existing connections should survive a key update")
+
+	conn2 := dial(CipherConfig{Secret: "secret-2"})
+	defer conn2.Close()
+	require.NoError(t, echo(conn2))
+	assert.Equal(t, "key-2", <-accessKeyIDs)
+
+	assert.Equal(t, "", AccessKeyID(&net.TCPConn{}))
+}
@@ -0,0 +1,35 @@
+package shadowsocks
+
+import (
+	"github.com/Jigsaw-Code/outline-ss-server/service"
+
+	"github.com/getlantern/http-proxy-lantern/v2/sniff"
+)
+
+// Matcher recognizes shadowsocks stream connections by decrypting the length
+// of their first chunk with each of the ciphers in ciphers, which may be
+// updated meanwhile. Only the salt and the encrypted length are needed.
+func Matcher(ciphers service.CipherList) sniff.Matcher {
+	return func(b []byte) sniff.Result {
+		result := sniff.NoMatch
+		for _, entry := range ciphers.SnapshotForClientIP(nil) {
+			key := entry.Value.(*service.CipherEntry).CryptoKey
+			saltSize := key.SaltSize()
+			chunkLen := saltSize + 2 + key.TagSize()
+			if len(b) < chunkLen {
+				result = sniff.NeedMore
+				continue
+			}
+			aead, err := key.NewAEAD(b[:saltSize])
+			if err != nil {
+				continue
+			}
+			// The first chunk is sealed with a zero nonce.
+			nonce := make([]byte, aead.NonceSize())
+			if _, err := aead.Open(nil, nonce, b[saltSize:chunkLen], nil); err == nil {
+				return sniff.Match
+			}
+		}
+		return result
+	}
+}
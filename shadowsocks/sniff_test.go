@@ -0,0 +1,38 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport/shadowsocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/http-proxy-lantern/v2/sniff"
+)
+
+func TestMatcher(t *testing.T) {
+	cipherList, err := makeTestCiphers(makeTestSecrets(3))
+	require.NoError(t, err)
+	match := Matcher(cipherList)
+
+	for _, secret := range []string{"secret-2", "unknown secret"} {
+		key, err := shadowsocks.NewEncryptionKey(DefaultCipher, secret)
+		require.NoError(t, err)
+		var buf bytes.Buffer
+		_, err = shadowsocks.NewWriter(&buf, key).Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		require.NoError(t, err)
+		b := buf.Bytes()
+
+		assert.Equal(t, sniff.NeedMore, match(b[:key.SaltSize()+1]), secret)
+		if secret == "unknown secret" {
+			assert.Equal(t, sniff.NoMatch, match(b), secret)
+		} else {
+			assert.Equal(t, sniff.Match, match(b), secret)
+		}
+	}
+	assert.Equal(t, sniff.NoMatch, match(bytes.Repeat([]byte("GET / HTTP/1.1\r\n"), 10)))
+
+	require.NoError(t, UpdateCipherList(cipherList, nil))
+	assert.Equal(t, sniff.NoMatch, match(nil), "nothing should match without any keys")
+}
@@ -0,0 +1,138 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport/shadowsocks"
+	"github.com/Jigsaw-Code/outline-ss-server/service"
+	M "github.com/sagernet/sing/common/metadata"
+
+	"github.com/getlantern/http-proxy-lantern/v2/common"
+	"github.com/getlantern/http-proxy-lantern/v2/udprelay"
+)
+
+// udpServer relays the UDP packets of shadowsocks clients.
+type udpServer struct {
+	pc      net.PacketConn
+	ciphers service.CipherList
+	relay   *udprelay.Relay
+	// clients maps relay session keys to the udpClient of their session.
+	clients sync.Map
+}
+
+// udpClient is a client that's been matched with an access key.
+type udpClient struct {
+	keyID     string
+	cryptoKey *shadowsocks.EncryptionKey
+}
+
+// ServeUDP relays the shadowsocks UDP packets clients send to pc until pc is
+// closed. Like with stream connections, clients may use any of the ciphers,
+// and each client address gets a session of its own in relay, attributed to
+// the access key it used.
+func ServeUDP(pc net.PacketConn, ciphers service.CipherList, relay *udprelay.Relay) error {
+	s := &udpServer{pc: pc, ciphers: ciphers, relay: relay}
+	packet := make([]byte, udprelay.MaxPacketSize)
+	text := make([]byte, udprelay.MaxPacketSize)
+	for {
+		n, clientAddr, err := pc.ReadFrom(packet)
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			log.Debugf("Unable to read UDP packet: %v", err)
+			continue
+		}
+		if err := s.forward(clientAddr.(*net.UDPAddr), packet[:n], text); err != nil {
+			log.Debugf("Dropping UDP packet from %v: %v", clientAddr, err)
+		}
+	}
+}
+
+func (s *udpServer) forward(clientAddr *net.UDPAddr, packet, text []byte) error {
+	key := "shadowsocks " + s.pc.LocalAddr().String() + " " + clientAddr.String()
+	session := s.relay.Session(key)
+	var client *udpClient
+	var plaintext []byte
+	var err error
+	if v, ok := s.clients.Load(key); ok && session != nil {
+		client = v.(*udpClient)
+		plaintext, err = shadowsocks.Unpack(text, packet, client.cryptoKey)
+		if err != nil {
+			return err
+		}
+	} else {
+		client, plaintext, err = s.findAccessKey(clientAddr.IP, text, packet)
+		if err != nil {
+			return err
+		}
+		session, err = s.relay.Open(key, udprelay.Client{
+			Reply:   s.replier(clientAddr, client.cryptoKey),
+			Context: udpContext(clientAddr, client.keyID),
+			OnClose: func() { s.clients.CompareAndDelete(key, client) },
+		})
+		if err != nil {
+			return err
+		}
+		s.clients.Store(key, client)
+	}
+
+	reader := bytes.NewReader(plaintext)
+	dst, err := M.SocksaddrSerializer.ReadAddrPort(reader)
+	if err != nil {
+		return fmt.Errorf("unable to read destination: %w", err)
+	}
+	payload := plaintext[len(plaintext)-reader.Len():]
+	return session.Forward(payload, dst.String())
+}
+
+// findAccessKey decrypts packet into dst with the first cipher it
+// authenticates with, the way the stream authenticator does.
+func (s *udpServer) findAccessKey(clientIP net.IP, dst, packet []byte) (*udpClient, []byte, error) {
+	for _, entry := range s.ciphers.SnapshotForClientIP(clientIP) {
+		cipher := entry.Value.(*service.CipherEntry)
+		plaintext, err := shadowsocks.Unpack(dst, packet, cipher.CryptoKey)
+		if err != nil {
+			continue
+		}
+		// Move the cipher to the front, so that it's found faster next time.
+		s.ciphers.MarkUsedByClientIP(entry, clientIP)
+		return &udpClient{keyID: cipher.ID, cryptoKey: cipher.CryptoKey}, plaintext, nil
+	}
+	return nil, nil, errors.New("no matching cipher")
+}
+
+// replier returns a function encrypting replies to clientAddr with cryptoKey.
+// It reuses its buffers, relying on the session only replying from one
+// goroutine.
+func (s *udpServer) replier(clientAddr *net.UDPAddr, cryptoKey *shadowsocks.EncryptionKey) func([]byte, *net.UDPAddr) error {
+	var plaintext bytes.Buffer
+	packed := make([]byte, udprelay.MaxPacketSize+cryptoKey.SaltSize()+cryptoKey.TagSize()+256)
+	return func(b []byte, from *net.UDPAddr) error {
+		plaintext.Reset()
+		if err := M.SocksaddrSerializer.WriteAddrPort(&plaintext, M.SocksaddrFromNet(from).Unwrap()); err != nil {
+			return err
+		}
+		plaintext.Write(b)
+		packet, err := shadowsocks.Pack(packed, plaintext.Bytes(), cryptoKey)
+		if err != nil {
+			return err
+		}
+		_, err = s.pc.WriteTo(packet, clientAddr)
+		return err
+	}
+}
+
+// udpContext is the context a client's bytes are reported with, the same as
+// for its stream connections without a device ID.
+func udpContext(clientAddr *net.UDPAddr, keyID string) map[string]interface{} {
+	return map[string]interface{}{
+		common.ClientIP:    clientAddr.IP.String(),
+		common.AccessKeyID: keyID,
+		common.DeviceID:    common.AccessKeyDevicePrefix + keyID,
+	}
+}
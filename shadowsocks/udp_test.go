@@ -0,0 +1,98 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport/shadowsocks"
+	"github.com/getlantern/measured"
+	M "github.com/sagernet/sing/common/metadata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/http-proxy-lantern/v2/common"
+	"github.com/getlantern/http-proxy-lantern/v2/udprelay"
+)
+
+func TestUDPRelay(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer echo.Close()
+	go func() {
+		b := make([]byte, udprelay.MaxPacketSize)
+		for {
+			n, addr, err := echo.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(b[:n], addr)
+		}
+	}()
+
+	configs := []CipherConfig{{ID: "key-0", Secret: "secret-0"}, {ID: "key-1", Secret: "secret-1"}}
+	cipherList, err := NewCipherListWithConfigs(configs)
+	require.NoError(t, err)
+
+	var mx sync.Mutex
+	var reportedCtx map[string]interface{}
+	var reportedRecv int
+	relay := udprelay.New(udprelay.Options{
+		AllowLocal: true,
+		Report: func(ctx map[string]interface{}, stats *measured.Stats, deltaStats *measured.Stats, final bool) {
+			mx.Lock()
+			defer mx.Unlock()
+			reportedCtx = ctx
+			reportedRecv += deltaStats.RecvTotal
+		},
+	})
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go ServeUDP(pc, cipherList, relay)
+
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer client.Close()
+	key, err := shadowsocks.NewEncryptionKey(DefaultCipher, "secret-1")
+	require.NoError(t, err)
+
+	var plaintext bytes.Buffer
+	target := M.SocksaddrFromNet(echo.LocalAddr())
+	for _, msg := range []string{"hello", "world"} {
+		plaintext.Reset()
+		require.NoError(t, M.SocksaddrSerializer.WriteAddrPort(&plaintext, target))
+		plaintext.WriteString(msg)
+		packet, err := shadowsocks.Pack(make([]byte, udprelay.MaxPacketSize), plaintext.Bytes(), key)
+		require.NoError(t, err)
+		_, err = client.WriteTo(packet, pc.LocalAddr())
+		require.NoError(t, err)
+
+		b := make([]byte, udprelay.MaxPacketSize)
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := client.ReadFrom(b)
+		require.NoError(t, err)
+		reply, err := shadowsocks.Unpack(nil, b[:n], key)
+		require.NoError(t, err)
+		reader := bytes.NewReader(reply)
+		from, err := M.SocksaddrSerializer.ReadAddrPort(reader)
+		require.NoError(t, err)
+		assert.Equal(t, target.String(), from.String())
+		assert.Equal(t, msg, string(reply[len(reply)-reader.Len():]))
+	}
+	assert.Equal(t, 1, relay.Len(), "a client should keep its session")
+
+	// Packets that don't authenticate are dropped.
+	_, err = client.WriteTo([]byte("garbage that doesn't authenticate with any key"), pc.LocalAddr())
+	require.NoError(t, err)
+
+	pc.Close()
+	relay.Close()
+	mx.Lock()
+	defer mx.Unlock()
+	assert.Equal(t, "key-1", reportedCtx[common.AccessKeyID])
+	assert.Equal(t, common.AccessKeyDevicePrefix+"key-1", reportedCtx[common.DeviceID])
+	assert.Equal(t, "127.0.0.1", reportedCtx[common.ClientIP])
+	assert.Equal(t, 10, reportedRecv)
+}
@@ -0,0 +1,153 @@
+package sniff
+
+import (
+	"strings"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+const (
+	recordHeaderLen      = 5
+	recordTypeHandshake  = 0x16
+	handshakeClientHello = 1
+	maxRecordLen         = 16384 + 2048
+)
+
+var httpMethods = []string{"GET ", "HEAD ", "POST ", "PUT ", "DELETE ", "CONNECT ", "OPTIONS ", "TRACE ", "PATCH "}
+
+// HTTP matches plain HTTP requests with any of the standard methods.
+func HTTP(b []byte) Result {
+	for _, method := range httpMethods {
+		n := min(len(b), len(method))
+		if string(b[:n]) == method[:n] {
+			if n == len(method) {
+				return Match
+			}
+			return NeedMore
+		}
+	}
+	return NoMatch
+}
+
+// TLS matches TLS connections. With serverNames, it only matches ClientHellos
+// for one of them, which may be wildcards like *.example.com.
+func TLS(serverNames ...string) Matcher {
+	return func(b []byte) Result {
+		if len(serverNames) == 0 {
+			return tlsRecord(b)
+		}
+		name, result := ServerName(b)
+		if result != Match {
+			return result
+		}
+		if MatchServerName(name, serverNames...) {
+			return Match
+		}
+		return NoMatch
+	}
+}
+
+// Hello is what matchers get to see of a TLS ClientHello.
+type Hello struct {
+	ServerName string
+	ALPN       []string
+}
+
+// ParseHello parses the TLS ClientHello that b starts with, which may be split
+// across records. It returns NoMatch if b doesn't start with a ClientHello and
+// NeedMore if b only has part of one.
+func ParseHello(b []byte) (*Hello, Result) {
+	hello, result := clientHello(b)
+	if result != Match {
+		return nil, result
+	}
+	msg := utls.UnmarshalClientHello(hello)
+	if msg == nil {
+		return nil, NoMatch
+	}
+	return &Hello{ServerName: msg.ServerName, ALPN: msg.AlpnProtocols}, Match
+}
+
+// ServerName returns the server name indicated in the TLS ClientHello that b
+// starts with, see ParseHello.
+func ServerName(b []byte) (string, Result) {
+	hello, result := ParseHello(b)
+	if result != Match {
+		return "", result
+	}
+	return hello.ServerName, Match
+}
+
+// MatchServerName reports whether name matches any of patterns, either
+// exactly or, for patterns like *.example.com, by having a single label in
+// place of the wildcard.
+func MatchServerName(name string, patterns ...string) bool {
+	for _, pattern := range patterns {
+		if matchServerName(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// tlsRecord matches the header of the TLS handshake record b starts with.
+func tlsRecord(b []byte) Result {
+	switch {
+	case len(b) > 0 && b[0] != recordTypeHandshake:
+		return NoMatch
+	case len(b) > 1 && b[1] != 3:
+		return NoMatch
+	case len(b) > 2 && b[2] > 4:
+		return NoMatch
+	case len(b) < 3:
+		return NeedMore
+	}
+	return Match
+}
+
+// clientHello returns the ClientHello message that b starts with, taken out of
+// its records.
+func clientHello(b []byte) ([]byte, Result) {
+	var hello []byte
+	for {
+		if result := tlsRecord(b); result != Match {
+			return nil, result
+		}
+		if len(b) < recordHeaderLen {
+			return nil, NeedMore
+		}
+		length := int(b[3])<<8 | int(b[4])
+		if length == 0 || length > maxRecordLen {
+			return nil, NoMatch
+		}
+		if len(b) < recordHeaderLen+length {
+			return nil, NeedMore
+		}
+		hello = append(hello, b[recordHeaderLen:recordHeaderLen+length]...)
+		b = b[recordHeaderLen+length:]
+		if hello[0] != handshakeClientHello {
+			return nil, NoMatch
+		}
+		if len(hello) >= 4 {
+			msgLen := 4 + (int(hello[1])<<16 | int(hello[2])<<8 | int(hello[3]))
+			if msgLen > MaxPeek {
+				return nil, NoMatch
+			}
+			if len(hello) >= msgLen {
+				return hello[:msgLen], Match
+			}
+		}
+	}
+}
+
+func matchServerName(pattern, name string) bool {
+	if strings.EqualFold(pattern, name) {
+		return true
+	}
+	suffix, ok := strings.CutPrefix(pattern, "*")
+	if !ok || !strings.HasPrefix(suffix, ".") || len(name) <= len(suffix) {
+		return false
+	}
+	label := name[:len(name)-len(suffix)]
+	return strings.EqualFold(name[len(label):], suffix) && !strings.Contains(label, ".")
+}
@@ -0,0 +1,87 @@
+package sniff
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testClientHello returns the ClientHello a TLS client sends for serverName.
+func testClientHello(t *testing.T, serverName string) []byte {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	go tls.Client(clientConn, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+	defer clientConn.Close()
+	b := make([]byte, MaxPeek)
+	var n int
+	for {
+		read, err := serverConn.Read(b[n:])
+		require.NoError(t, err)
+		n += read
+		if _, result := ServerName(b[:n]); result != NeedMore {
+			return b[:n]
+		}
+	}
+}
+
+// fragment splits the single record hello into records of at most size bytes.
+func fragment(hello []byte, size int) []byte {
+	var result []byte
+	for payload := hello[recordHeaderLen:]; len(payload) > 0; {
+		n := min(size, len(payload))
+		result = append(result, hello[0], hello[1], hello[2], byte(n>>8), byte(n))
+		result = append(result, payload[:n]...)
+		payload = payload[n:]
+	}
+	return result
+}
+
+func TestHTTP(t *testing.T) {
+	for b, expected := range map[string]Result{
+		"":                    NeedMore,
+		"P":                   NeedMore,
+		"PU":                  NeedMore,
+		"PUT":                 NeedMore,
+		"PUT ":                Match,
+		"GET / HTTP/1.1\r\n":  Match,
+		"CONNECT example.com": Match,
+		"GETS / HTTP/1.1":     NoMatch,
+		"get / HTTP/1.1":      NoMatch,
+		"\x16\x03\x01":        NoMatch,
+	} {
+		assert.Equal(t, expected, HTTP([]byte(b)), "%q", b)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	hello := testClientHello(t, "www.example.com")
+	name, result := ServerName(hello)
+	require.Equal(t, Match, result)
+	assert.Equal(t, "www.example.com", name)
+
+	name, result = ServerName(fragment(hello, 100))
+	assert.Equal(t, Match, result, "fragmented ClientHellos should be reassembled")
+	assert.Equal(t, "www.example.com", name)
+
+	assert.Equal(t, Match, TLS()(hello[:3]), "only the record header is needed without server names")
+	assert.Equal(t, NeedMore, TLS()(hello[:1]))
+	assert.Equal(t, NeedMore, TLS("www.example.com")(hello[:len(hello)-1]))
+	assert.Equal(t, NoMatch, TLS()([]byte("GET / HTTP/1.1")))
+	assert.Equal(t, NoMatch, TLS()([]byte{0x16, 0x02}))
+
+	for pattern, expected := range map[string]Result{
+		"www.example.com":   Match,
+		"WWW.EXAMPLE.COM":   Match,
+		"*.example.com":     Match,
+		"example.com":       NoMatch,
+		"*.www.example.com": NoMatch,
+		"*.com":             NoMatch,
+	} {
+		assert.Equal(t, expected, TLS("other.example.org", pattern)(hello), pattern)
+	}
+	assert.Equal(t, NoMatch, TLS("www.example.com")(testClientHello(t, "")), "ClientHellos without SNI shouldn't match server names")
+}
@@ -0,0 +1,345 @@
+// Package sniff serves several transports on one listener. It peeks at the
+// first bytes clients send on each connection and hands the connection,
+// bytes and all, to the first transport that recognizes them, so that e.g. a
+// single :443 can serve HTTPS, tlsmasq, shadowsocks and vmess.
+//
+// Every transport gets a virtual net.Listener of its own, from which its usual
+// stack of listeners is built. Connections that no transport recognizes are
+// given to a fallback, typically the decoy web server.
+package sniff
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/getlantern/golog"
+)
+
+const (
+	// DefaultTimeout is how long clients have to send enough bytes for their
+	// transport to be recognized.
+	DefaultTimeout = 10 * time.Second
+
+	// MaxPeek is the most bytes read before giving up on recognizing a
+	// connection, enough for any ClientHello seen in practice.
+	MaxPeek = 16 * 1024
+
+	initialPeek = 2 * 1024
+)
+
+var log = golog.LoggerFor("sniff")
+
+// Result is the verdict of a Matcher.
+type Result int
+
+const (
+	// NoMatch means the bytes aren't from the transport.
+	NoMatch Result = iota
+	// Match means the bytes are from the transport.
+	Match
+	// NeedMore means more bytes are needed to tell.
+	NeedMore
+)
+
+// Matcher recognizes a transport from b, the first bytes a client sent. It's
+// called again with more bytes as long as it returns NeedMore, and NeedMore
+// counts as NoMatch once the client's sent MaxPeek bytes or stopped sending.
+type Matcher func(b []byte) Result
+
+// Route is a transport served by a Mux.
+type Route struct {
+	// Name identifies the transport in logs.
+	Name  string
+	Match Matcher
+}
+
+// Options configures a Mux.
+type Options struct {
+	// Routes are tried in order, the first to match getting the connection.
+	// A route that needs more bytes holds up the routes after it, so that the
+	// order is respected.
+	Routes []Route
+
+	// Fallback, if set, takes connections that no route matches, with the
+	// bytes peeked replayed. Otherwise they're closed.
+	Fallback func(conn net.Conn)
+
+	// Timeout defaults to DefaultTimeout.
+	Timeout time.Duration
+}
+
+// Mux dispatches the connections accepted from a listener to the listeners
+// of its routes.
+type Mux struct {
+	base      net.Listener
+	opts      Options
+	listeners []*routeListener
+	closeOnce sync.Once
+	closed    chan struct{}
+	err       error
+}
+
+// New starts dispatching the connections accepted from base.
+func New(base net.Listener, opts Options) *Mux {
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	m := &Mux{
+		base:   base,
+		opts:   opts,
+		closed: make(chan struct{}),
+	}
+	for _, route := range opts.Routes {
+		m.listeners = append(m.listeners, &routeListener{
+			mux:    m,
+			route:  route,
+			conns:  make(chan net.Conn),
+			closed: make(chan struct{}),
+		})
+	}
+	go m.serve()
+	return m
+}
+
+// Listeners returns the listeners of the routes, in order.
+func (m *Mux) Listeners() []net.Listener {
+	result := make([]net.Listener, 0, len(m.listeners))
+	for _, l := range m.listeners {
+		result = append(result, l)
+	}
+	return result
+}
+
+// Addr returns the address of the underlying listener.
+func (m *Mux) Addr() net.Addr {
+	return m.base.Addr()
+}
+
+// Close closes the underlying listener and with it the listeners of all
+// routes.
+func (m *Mux) Close() error {
+	return m.closeWith(net.ErrClosed)
+}
+
+// closeWith closes m, the listeners of its routes failing with err from then
+// on.
+func (m *Mux) closeWith(err error) error {
+	var result error
+	m.closeOnce.Do(func() {
+		m.err = err
+		result = m.base.Close()
+		close(m.closed)
+	})
+	return result
+}
+
+func (m *Mux) serve() {
+	var tempDelay time.Duration
+	for {
+		conn, err := m.base.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				// delay code based on net/http.Server
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				log.Errorf("Accept error: %v; retrying in %v", err, tempDelay)
+				time.Sleep(tempDelay)
+				continue
+			}
+			m.closeWith(err)
+			return
+		}
+		tempDelay = 0
+		go m.sniff(conn)
+	}
+}
+
+// sniff reads from conn until a route matches it, or it's clear that none
+// will.
+func (m *Mux) sniff(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(m.opts.Timeout))
+	buf := make([]byte, 0, initialPeek)
+	var route *routeListener
+	for {
+		if len(buf) == cap(buf) {
+			grown := make([]byte, len(buf), min(2*cap(buf), MaxPeek))
+			copy(grown, buf)
+			buf = grown
+		}
+		n, err := conn.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if len(buf) == 0 && err != nil {
+			// the client went away or never said anything
+			conn.Close()
+			return
+		}
+		var decided bool
+		route, decided = m.route(buf, err != nil || len(buf) == MaxPeek)
+		if decided {
+			break
+		}
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	sniffed := &sniffedConn{Conn: conn, peeked: buf}
+	if route == nil {
+		log.Tracef("No transport recognized for connection from %v", conn.RemoteAddr())
+		if m.opts.Fallback == nil {
+			conn.Close()
+			return
+		}
+		m.opts.Fallback(sniffed)
+		return
+	}
+	log.Tracef("Connection from %v is %v", conn.RemoteAddr(), route.route.Name)
+	route.deliver(sniffed)
+}
+
+// route returns the listener of the first route matching b, or nil if none
+// does. It's undecided while the routes before a match need more bytes,
+// unless final.
+func (m *Mux) route(b []byte, final bool) (route *routeListener, decided bool) {
+	for _, l := range m.listeners {
+		switch l.route.Match(b) {
+		case Match:
+			return l, true
+		case NeedMore:
+			if !final {
+				return nil, false
+			}
+		}
+	}
+	return nil, true
+}
+
+// routeListener is the listener of a route.
+type routeListener struct {
+	mux       *Mux
+	route     Route
+	conns     chan net.Conn
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (l *routeListener) deliver(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.closed:
+		conn.Close()
+	case <-l.mux.closed:
+		conn.Close()
+	}
+}
+
+func (l *routeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	case <-l.mux.closed:
+		return nil, l.mux.err
+	}
+}
+
+// Close stops the route from accepting connections, which are closed from
+// then on. The underlying listener stays open until the Mux is closed.
+func (l *routeListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *routeListener) Addr() net.Addr {
+	return l.mux.Addr()
+}
+
+// sniffedConn replays the bytes peeked before reading from the connection.
+type sniffedConn struct {
+	net.Conn
+	peeked []byte
+}
+
+func (c *sniffedConn) Read(b []byte) (int, error) {
+	if len(c.peeked) > 0 {
+		n := copy(b, c.peeked)
+		c.peeked = c.peeked[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *sniffedConn) Wrapped() net.Conn {
+	return c.Conn
+}
+
+// Join joins the listeners of the transports built on m's routes into one,
+// which closes m when it's closed. Errors accepting from any of them are
+// returned as is.
+func (m *Mux) Join(listeners ...net.Listener) net.Listener {
+	j := &joinedListener{
+		mux:       m,
+		listeners: listeners,
+		accepted:  make(chan accepted),
+	}
+	for _, l := range listeners {
+		go j.acceptFrom(l)
+	}
+	return j
+}
+
+type accepted struct {
+	conn net.Conn
+	err  error
+}
+
+type joinedListener struct {
+	mux       *Mux
+	listeners []net.Listener
+	accepted  chan accepted
+}
+
+func (j *joinedListener) acceptFrom(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		select {
+		case j.accepted <- accepted{conn, err}:
+		case <-j.mux.closed:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+		if err != nil {
+			if ne, ok := err.(net.Error); !ok || !ne.Temporary() {
+				return
+			}
+		}
+	}
+}
+
+func (j *joinedListener) Accept() (net.Conn, error) {
+	select {
+	case a := <-j.accepted:
+		return a.conn, a.err
+	case <-j.mux.closed:
+		return nil, j.mux.err
+	}
+}
+
+func (j *joinedListener) Close() error {
+	for _, l := range j.listeners {
+		l.Close()
+	}
+	return j.mux.Close()
+}
+
+func (j *joinedListener) Addr() net.Addr {
+	return j.mux.Addr()
+}
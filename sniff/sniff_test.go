@@ -0,0 +1,161 @@
+package sniff
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// prefix matches connections starting with p.
+func prefix(p string) Matcher {
+	return func(b []byte) Result {
+		n := min(len(b), len(p))
+		switch {
+		case !bytes.Equal(b[:n], []byte(p[:n])):
+			return NoMatch
+		case n < len(p):
+			return NeedMore
+		}
+		return Match
+	}
+}
+
+func newTestMux(t *testing.T, opts Options) *Mux {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	m := New(l, opts)
+	t.Cleanup(func() { m.Close() })
+	return m
+}
+
+// send dials m and writes each of parts, pausing in between.
+func send(t *testing.T, m *Mux, parts ...string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", m.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	for i, part := range parts {
+		if i > 0 {
+			time.Sleep(50 * time.Millisecond)
+		}
+		_, err := conn.Write([]byte(part))
+		require.NoError(t, err)
+	}
+	return conn
+}
+
+// received accepts a connection from l and reads n bytes from it.
+func received(t *testing.T, l net.Listener, n int) string {
+	t.Helper()
+	conn, err := l.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+	b := make([]byte, n)
+	_, err = io.ReadFull(conn, b)
+	require.NoError(t, err)
+	return string(b)
+}
+
+func TestMux(t *testing.T) {
+	fallback := make(chan string, 10)
+	m := newTestMux(t, Options{
+		Routes: []Route{
+			{Name: "long", Match: prefix("ALPHABET")},
+			{Name: "short", Match: prefix("ALPHA")},
+			{Name: "other", Match: prefix("OTHER")},
+		},
+		Fallback: func(conn net.Conn) {
+			defer conn.Close()
+			b, _ := io.ReadAll(conn)
+			fallback <- string(b)
+		},
+	})
+	ls := m.Listeners()
+	require.Len(t, ls, 3)
+	assert.Equal(t, m.Addr(), ls[0].Addr())
+
+	send(t, m, "ALPH", "ABET SOUP")
+	assert.Equal(t, "ALPHABET SOUP", received(t, ls[0], 13), "peeked bytes should be replayed")
+
+	send(t, m, "ALPHA", "NUMERIC")
+	assert.Equal(t, "ALPHANUMERIC", received(t, ls[1], 12), "later routes should wait for earlier ones to decide")
+
+	send(t, m, "OTHER")
+	assert.Equal(t, "OTHER", received(t, ls[2], 5))
+
+	send(t, m, "unknown").(*net.TCPConn).CloseWrite()
+	select {
+	case b := <-fallback:
+		assert.Equal(t, "unknown", b)
+	case <-time.After(5 * time.Second):
+		t.Fatal("unrecognized connections should go to the fallback")
+	}
+
+	ls[2].Close()
+	_, err := ls[2].Accept()
+	assert.ErrorIs(t, err, net.ErrClosed)
+	send(t, m, "ALPHA!")
+	assert.Equal(t, "ALPHA!", received(t, ls[1], 6), "other routes should be unaffected by closing one")
+
+	m.Close()
+	for _, l := range ls {
+		_, err := l.Accept()
+		assert.ErrorIs(t, err, net.ErrClosed)
+	}
+}
+
+func TestMuxTimeout(t *testing.T) {
+	fallback := make(chan string, 10)
+	m := newTestMux(t, Options{
+		Routes: []Route{{Name: "long", Match: prefix("ALPHABET")}},
+		Fallback: func(conn net.Conn) {
+			defer conn.Close()
+			b := make([]byte, 5)
+			n, _ := conn.Read(b)
+			fallback <- string(b[:n])
+		},
+		Timeout: 100 * time.Millisecond,
+	})
+
+	send(t, m, "ALPHA")
+	select {
+	case b := <-fallback:
+		assert.Equal(t, "ALPHA", b, "routes needing more bytes shouldn't match once clients stop sending")
+	case <-time.After(5 * time.Second):
+		t.Fatal("connections should go to the fallback after the timeout")
+	}
+
+	conn := send(t, m)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err, "silent connections should be closed")
+	assert.Empty(t, fallback)
+}
+
+func TestJoin(t *testing.T) {
+	m := newTestMux(t, Options{
+		Routes: []Route{
+			{Name: "a", Match: prefix("A")},
+			{Name: "b", Match: prefix("B")},
+		},
+	})
+	j := m.Join(m.Listeners()...)
+	assert.Equal(t, m.Addr(), j.Addr())
+
+	send(t, m, "A")
+	send(t, m, "B")
+	got := []string{received(t, j, 1), received(t, j, 1)}
+	assert.ElementsMatch(t, []string{"A", "B"}, got)
+
+	require.NoError(t, j.Close())
+	_, err := j.Accept()
+	assert.ErrorIs(t, err, net.ErrClosed)
+	_, err = net.Dial("tcp", m.Addr().String())
+	assert.Error(t, err, "closing the joined listener should close the underlying one")
+}
@@ -38,8 +38,8 @@ func TestAbortOnHello(t *testing.T) {
 			l, _ := net.Listen("tcp", ":0")
 			defer l.Close()
 			hl, err := Wrap(
-				l, "../test/data/server.key", "../test/data/server.crt", "../test/testtickets", "", "",
-				true, tc.response, false, instrument.NoInstrument{})
+				l, testCertManager(t, ""), "../test/testtickets", "", "",
+				true, tc.response, false, instrument.NoInstrument{}, nil)
 			require.NoError(t, err)
 			defer hl.Close()
 
@@ -116,8 +116,8 @@ func TestSuccess(t *testing.T) {
 	strKeys := base64.StdEncoding.EncodeToString(sessionTicketKeys)
 
 	hl, err := Wrap(
-		l, "../test/data/server.key", "../test/data/server.crt", "", "", strKeys,
-		true, AlertHandshakeFailure, false, instrument.NoInstrument{})
+		l, testCertManager(t, ""), "", "", strKeys,
+		true, AlertHandshakeFailure, false, instrument.NoInstrument{}, nil)
 	require.NoError(t, err)
 	defer hl.Close()
 
@@ -0,0 +1,207 @@
+package tlslistener
+
+import (
+	"crypto/tls"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/netx"
+	"golang.org/x/crypto/acme"
+
+	"github.com/getlantern/http-proxy-lantern/v2/certmanager"
+	"github.com/getlantern/http-proxy-lantern/v2/sniff"
+)
+
+const (
+	passthroughDialTimeout = 10 * time.Second
+	acmeChallengeTimeout   = 10 * time.Second
+)
+
+// SNIOptions configures what a listener does depending on the server name
+// clients indicate in their ClientHello.
+type SNIOptions struct {
+	// Certificates are served to clients asking for a server name they're
+	// valid for. Other clients get the listener's own certificate.
+	Certificates []tls.Certificate
+
+	// ACMEChallenges answers the TLS-ALPN-01 challenges of ACME servers
+	// validating the ACME hosts of the listener's certmanager.Manager.
+	ACMEChallenges bool
+
+	// Passthrough relays the connections for some server names elsewhere,
+	// ClientHello and all, instead of terminating TLS.
+	Passthrough []Passthrough
+}
+
+// Passthrough relays the TLS connections for ServerNames, which may be
+// wildcards like *.example.com, to Backend, a host:port.
+type Passthrough struct {
+	ServerNames []string
+	Backend     string
+}
+
+// ParseCertificates loads the comma separated list of cert:key file pairs in
+// s, e.g. "a.crt:a.key,b.crt:b.key".
+func ParseCertificates(s string) ([]tls.Certificate, error) {
+	var certs []tls.Certificate
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		certFile, keyFile, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, errors.New("expected cert:key, not %v", entry)
+		}
+		cert, err := tls.LoadX509KeyPair(strings.TrimSpace(certFile), strings.TrimSpace(keyFile))
+		if err != nil {
+			return nil, errors.New("unable to load %v: %v", entry, err)
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// ParsePassthrough parses the comma separated list of server names to pass
+// through and their backends in s, e.g.
+//
+//	www.example.com|*.example.org=www.example.com:443,decoy.example.net=10.0.0.1:443
+func ParsePassthrough(s string) ([]Passthrough, error) {
+	var result []Passthrough
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		names, backend, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, errors.New("expected server names=backend, not %v", entry)
+		}
+		p := Passthrough{Backend: strings.TrimSpace(backend)}
+		if _, _, err := net.SplitHostPort(p.Backend); err != nil {
+			return nil, errors.New("invalid backend for %v: %v", names, err)
+		}
+		for _, name := range strings.Split(names, "|") {
+			if name = strings.TrimSpace(name); name != "" {
+				p.ServerNames = append(p.ServerNames, name)
+			}
+		}
+		if len(p.ServerNames) == 0 {
+			return nil, errors.New("no server names given for %v", p.Backend)
+		}
+		result = append(result, p)
+	}
+	return result, nil
+}
+
+// configure sets up cfg to serve the certificates of o before those of
+// certs.
+func (o *SNIOptions) configure(cfg *tls.Config, certs *certmanager.Manager) {
+	if len(o.Certificates) == 0 {
+		return
+	}
+	cfg.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if hello.ServerName != "" && !certs.IsACMEHost(hello.ServerName) {
+			for i := range o.Certificates {
+				if hello.SupportsCertificate(&o.Certificates[i]) == nil {
+					return &o.Certificates[i], nil
+				}
+			}
+		}
+		return certs.GetCertificate(hello)
+	}
+}
+
+// route separates the connections accepted from l that aren't for the
+// listener itself, returning the listener of the remaining ones. It returns
+// l itself if nothing needs separating.
+func (o *SNIOptions) route(l net.Listener, certs *certmanager.Manager) (net.Listener, *sniff.Mux) {
+	if len(o.Passthrough) == 0 && !o.ACMEChallenges {
+		return l, nil
+	}
+
+	var routes []sniff.Route
+	if o.ACMEChallenges {
+		routes = append(routes, sniff.Route{Name: "acme", Match: matchACMEChallenge(certs)})
+	}
+	for _, p := range o.Passthrough {
+		routes = append(routes, sniff.Route{Name: "passthrough to " + p.Backend, Match: sniff.TLS(p.ServerNames...)})
+	}
+	routes = append(routes, sniff.Route{Name: "tls", Match: func([]byte) sniff.Result { return sniff.Match }})
+	mux := sniff.New(l, sniff.Options{Routes: routes})
+
+	listeners := mux.Listeners()
+	if o.ACMEChallenges {
+		go serveACMEChallenges(listeners[0], certs)
+		listeners = listeners[1:]
+	}
+	for i, p := range o.Passthrough {
+		go servePassthrough(listeners[i], p.Backend)
+	}
+	return listeners[len(listeners)-1], mux
+}
+
+// matchACMEChallenge matches the connections of ACME servers validating
+// TLS-ALPN-01 challenges for the ACME hosts of certs.
+func matchACMEChallenge(certs *certmanager.Manager) sniff.Matcher {
+	return func(b []byte) sniff.Result {
+		hello, result := sniff.ParseHello(b)
+		if result != sniff.Match {
+			return result
+		}
+		if slices.Contains(hello.ALPN, acme.ALPNProto) && certs.IsACMEHost(hello.ServerName) {
+			return sniff.Match
+		}
+		return sniff.NoMatch
+	}
+}
+
+// serveACMEChallenges completes the handshakes of ACME challenge connections,
+// which is all the validation takes, with the certificates certs provides for
+// them.
+func serveACMEChallenges(l net.Listener, certs *certmanager.Manager) {
+	cfg := &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		NextProtos:     []string{acme.ALPNProto},
+	}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(acmeChallengeTimeout))
+			if err := tls.Server(conn, cfg).Handshake(); err != nil {
+				log.Debugf("ACME challenge handshake with %v failed: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// servePassthrough relays the connections accepted from l to backend.
+func servePassthrough(l net.Listener, backend string) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			upstream, err := net.DialTimeout("tcp", backend, passthroughDialTimeout)
+			if err != nil {
+				log.Debugf("Unable to pass connection from %v through to %v: %v", conn.RemoteAddr(), backend, err)
+				return
+			}
+			defer upstream.Close()
+			bufOut := bytePool.Get().([]byte)
+			defer bytePool.Put(bufOut)
+			bufIn := bytePool.Get().([]byte)
+			defer bytePool.Put(bufIn)
+			_, _ = netx.BidiCopy(conn, upstream, bufOut, bufIn)
+		}()
+	}
+}
@@ -0,0 +1,146 @@
+package tlslistener
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/getlantern/http-proxy-lantern/v2/certmanager"
+	"github.com/getlantern/http-proxy-lantern/v2/instrument"
+)
+
+func TestParsePassthrough(t *testing.T) {
+	passthrough, err := ParsePassthrough(" www.example.com | *.example.org=www.example.com:443, decoy.example.net=10.0.0.1:8443,")
+	require.NoError(t, err)
+	require.Equal(t, []Passthrough{
+		{ServerNames: []string{"www.example.com", "*.example.org"}, Backend: "www.example.com:443"},
+		{ServerNames: []string{"decoy.example.net"}, Backend: "10.0.0.1:8443"},
+	}, passthrough)
+
+	passthrough, err = ParsePassthrough("")
+	require.NoError(t, err)
+	require.Empty(t, passthrough)
+
+	for _, s := range []string{"www.example.com", "www.example.com=www.example.com", "|=www.example.com:443"} {
+		_, err := ParsePassthrough(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestSNI(t *testing.T) {
+	allowLoopbackForTesting = true
+
+	defaultCert, err := tls.LoadX509KeyPair("../test/data/server.crt", "../test/data/server.key")
+	require.NoError(t, err)
+	alt, _, _ := testCertificate(t, "alt.example.com")
+	decoy, _, _ := testCertificate(t, "decoy.example.com")
+	backend, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{decoy}})
+	require.NoError(t, err)
+	defer backend.Close()
+	go serveTLS(backend)
+
+	acmeCert, keyPEM, certPEM := testCertificate(t, "acme.example.com")
+	cacheDir := t.TempDir()
+	cache := autocert.DirCache(cacheDir)
+	require.NoError(t, cache.Put(context.Background(), "acme.example.com", append(keyPEM, certPEM...)))
+	tokenCert, keyPEM, certPEM := testCertificate(t, "acme.example.com")
+	require.NoError(t, cache.Put(context.Background(), "acme.example.com+token", append(keyPEM, certPEM...)))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	hl, err := Wrap(
+		l, testCertManager(t, cacheDir, "acme.example.com"), "", "", "",
+		false, AlertHandshakeFailure, false, instrument.NoInstrument{},
+		&SNIOptions{
+			Certificates:   []tls.Certificate{alt},
+			ACMEChallenges: true,
+			Passthrough:    []Passthrough{{ServerNames: []string{"decoy.example.com", "*.example.org"}, Backend: backend.Addr().String()}},
+		})
+	require.NoError(t, err)
+	defer hl.Close()
+	go serveTLS(hl)
+
+	peerCertificate := func(serverName string, alpn ...string) *x509.Certificate {
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{ServerName: serverName, NextProtos: alpn, InsecureSkipVerify: true})
+		require.NoError(t, err, serverName)
+		defer conn.Close()
+		if len(alpn) > 0 {
+			require.Equal(t, alpn[0], conn.ConnectionState().NegotiatedProtocol)
+		}
+		return conn.ConnectionState().PeerCertificates[0]
+	}
+	require.Equal(t, "alt.example.com", peerCertificate("alt.example.com").Subject.CommonName)
+	require.Equal(t, acmeCert.Leaf.SerialNumber, peerCertificate("acme.example.com").SerialNumber)
+	require.Equal(t, tokenCert.Leaf.SerialNumber, peerCertificate("acme.example.com", acme.ALPNProto).SerialNumber)
+	require.Equal(t, "decoy.example.com", peerCertificate("decoy.example.com").Subject.CommonName)
+	require.Equal(t, "decoy.example.com", peerCertificate("www.example.org").Subject.CommonName)
+	require.Equal(t, defaultCert.Leaf.SerialNumber, peerCertificate("other.example.net").SerialNumber)
+	require.Equal(t, defaultCert.Leaf.SerialNumber, peerCertificate("").SerialNumber)
+}
+
+// testCertManager returns a certmanager.Manager serving the certificate in
+// test/data by default and those cached in acmeCacheDir for acmeHosts.
+func testCertManager(t *testing.T, acmeCacheDir string, acmeHosts ...string) *certmanager.Manager {
+	certs, err := certmanager.New(certmanager.Options{
+		CertFile:     "../test/data/server.crt",
+		KeyFile:      "../test/data/server.key",
+		ACMEHosts:    acmeHosts,
+		ACMECacheDir: acmeCacheDir,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { certs.Close() })
+	return certs
+}
+
+// serveTLS completes the handshakes of the connections accepted from l, by
+// reading from them.
+func serveTLS(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			conn.Read(make([]byte, 1))
+		}()
+	}
+}
+
+// testCertificate generates a self-signed certificate for names, also
+// returning its key and itself in PEM.
+func testCertificate(t *testing.T, names ...string) (cert tls.Certificate, keyPEM, certPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	cert, err = tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+	return cert, keyPEM, certPEM
+}
@@ -6,6 +6,7 @@ import (
 	"crypto/tls"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/getlantern/errors"
 	"github.com/getlantern/golog"
@@ -13,21 +14,29 @@ import (
 
 	utls "github.com/refraction-networking/utls"
 
+	"github.com/getlantern/http-proxy-lantern/v2/certmanager"
 	"github.com/getlantern/http-proxy-lantern/v2/instrument"
+	"github.com/getlantern/http-proxy-lantern/v2/sniff"
 )
 
 var (
 	log = golog.LoggerFor("tlslistener")
 )
 
-// Wrap wraps the specified listener in our default TLS listener.
-func Wrap(wrapped net.Listener, keyFile, certFile, sessionTicketKeyFile, firstSessionTicketKey, sessionTicketKeys string,
+// Wrap wraps the specified listener in our default TLS listener, serving the
+// certificates of certs. sni, if not nil, adds certificates and backends for
+// specific server names.
+func Wrap(wrapped net.Listener, certs *certmanager.Manager, sessionTicketKeyFile, firstSessionTicketKey, sessionTicketKeys string,
 	requireSessionTickets bool, missingTicketReaction HandshakeReaction, allowTLS13 bool,
-	instrument instrument.Instrument) (net.Listener, error) {
+	instrument instrument.Instrument, sni *SNIOptions) (net.Listener, error) {
 
-	cfg, err := tlsdefaults.BuildListenerConfig(wrapped.Addr().String(), keyFile, certFile)
-	if err != nil {
-		return nil, err
+	cfg := tlsdefaults.Server()
+	cfg.GetCertificate = certs.GetCertificate
+
+	var mux *sniff.Mux
+	if sni != nil {
+		sni.configure(cfg, certs)
+		wrapped, mux = sni.route(wrapped, certs)
 	}
 
 	utlsConfig := &utls.Config{}
@@ -48,6 +57,7 @@ func Wrap(wrapped net.Listener, keyFile, certFile, sessionTicketKeyFile, firstSe
 
 	listener := &tlslistener{
 		wrapped:               wrapped,
+		mux:                   mux,
 		cfg:                   cfg,
 		log:                   log,
 		expectTickets:         expectTickets,
@@ -66,6 +76,7 @@ func Wrap(wrapped net.Listener, keyFile, certFile, sessionTicketKeyFile, firstSe
 		for _, k := range keys {
 			listener.ticketKeys = append(listener.ticketKeys, utls.TicketKeyFromBytes(k))
 		}
+		listener.ticketKeysUpdated = time.Now()
 		log.Debug("Finished setting listener keys")
 	}
 
@@ -84,6 +95,7 @@ func Wrap(wrapped net.Listener, keyFile, certFile, sessionTicketKeyFile, firstSe
 
 type tlslistener struct {
 	wrapped               net.Listener
+	mux                   *sniff.Mux
 	cfg                   *tls.Config
 	log                   golog.Logger
 	expectTickets         bool
@@ -92,9 +104,32 @@ type tlslistener struct {
 	missingTicketReaction HandshakeReaction
 	instrument            instrument.Instrument
 	ticketKeys            utls.TicketKeys
+	ticketKeysUpdated     time.Time
 	ticketKeysMutex       sync.RWMutex
 }
 
+// SessionTicketKeyStatus describes the session ticket keys a TLS listener is
+// currently using.
+type SessionTicketKeyStatus struct {
+	// Keys is the number of keys, zero if session tickets aren't configured.
+	Keys int `json:"keys"`
+	// Updated is when the keys were last set or rotated, so the current
+	// primary key's age is the time elapsed since.
+	Updated time.Time `json:"updated"`
+}
+
+// SessionTicketKeys reports on the session ticket keys of l. ok is false if l
+// wasn't returned by Wrap.
+func SessionTicketKeys(l net.Listener) (status SessionTicketKeyStatus, ok bool) {
+	tl, ok := l.(*tlslistener)
+	if !ok {
+		return status, false
+	}
+	tl.ticketKeysMutex.RLock()
+	defer tl.ticketKeysMutex.RUnlock()
+	return SessionTicketKeyStatus{Keys: len(tl.ticketKeys), Updated: tl.ticketKeysUpdated}, true
+}
+
 func (l *tlslistener) Accept() (net.Conn, error) {
 	conn, err := l.wrapped.Accept()
 	if err != nil {
@@ -119,6 +154,9 @@ func (l *tlslistener) Addr() net.Addr {
 }
 
 func (l *tlslistener) Close() error {
+	if l.mux != nil {
+		return l.mux.Close()
+	}
 	return l.wrapped.Close()
 }
 
@@ -0,0 +1,162 @@
+package tokenfilter
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/getlantern/errors"
+)
+
+// Claims are what a signed token asserts about the device presenting it.
+//
+// A signed token is <claims>.<signature>, where <claims> is the unpadded
+// base64url encoding of the JSON-encoded Claims and <signature> is the
+// unpadded base64url encoding of the HMAC-SHA256 or Ed25519 signature of
+// <claims>. Unlike the shared tokens, signed tokens are issued per device and
+// always expire, so a leaked config stops working on its own.
+type Claims struct {
+	DeviceID string `json:"device"`
+	Pro      bool   `json:"pro,omitempty"`
+	// Expires is when the token stops being honored, in seconds since the
+	// Unix epoch.
+	Expires int64 `json:"exp"`
+}
+
+// ExpiresAt returns the time at which the claims expire.
+func (c Claims) ExpiresAt() time.Time {
+	return time.Unix(c.Expires, 0)
+}
+
+// SignHMAC encodes the claims as a token signed with the given HMAC secret.
+func (c Claims) SignHMAC(secret []byte) (string, error) {
+	return c.sign(func(msg []byte) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(msg)
+		return mac.Sum(nil)
+	})
+}
+
+// SignEd25519 encodes the claims as a token signed with the given Ed25519
+// private key.
+func (c Claims) SignEd25519(key ed25519.PrivateKey) (string, error) {
+	return c.sign(func(msg []byte) []byte {
+		return ed25519.Sign(key, msg)
+	})
+}
+
+func (c Claims) sign(signer func(msg []byte) []byte) (string, error) {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(signer([]byte(payload))), nil
+}
+
+// Verifier verifies signed tokens.
+type Verifier interface {
+	// Verify checks the token's signature and expiry and returns its claims.
+	Verify(token string, now time.Time) (*Claims, error)
+}
+
+type verifier func(msg, sig []byte) bool
+
+// NewHMACVerifier creates a Verifier for tokens signed with HMAC-SHA256 using
+// the given secret.
+func NewHMACVerifier(secret []byte) Verifier {
+	return verifier(func(msg, sig []byte) bool {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(msg)
+		return hmac.Equal(sig, mac.Sum(nil))
+	})
+}
+
+// NewEd25519Verifier creates a Verifier for tokens signed with the private
+// half of the given Ed25519 public key.
+func NewEd25519Verifier(key ed25519.PublicKey) Verifier {
+	return verifier(func(msg, sig []byte) bool {
+		return ed25519.Verify(key, msg, sig)
+	})
+}
+
+// ParseVerifier parses a verification key of the form hmac:<secret> or
+// ed25519:<public key>, both standard base64 encoded. An empty key yields a
+// nil Verifier.
+func ParseVerifier(key string) (Verifier, error) {
+	if key == "" {
+		return nil, nil
+	}
+	kind, encoded, ok := strings.Cut(key, ":")
+	if !ok {
+		return nil, errors.New("token verification key must be prefixed with hmac: or ed25519:")
+	}
+	b, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.New("unable to decode %v token verification key: %v", kind, err)
+	}
+	switch kind {
+	case "hmac":
+		if len(b) == 0 {
+			return nil, errors.New("empty hmac token verification key")
+		}
+		return NewHMACVerifier(b), nil
+	case "ed25519":
+		if len(b) != ed25519.PublicKeySize {
+			return nil, errors.New("ed25519 public key must be %d bytes, not %d", ed25519.PublicKeySize, len(b))
+		}
+		return NewEd25519Verifier(ed25519.PublicKey(b)), nil
+	default:
+		return nil, errors.New("unknown token verification key type %v", kind)
+	}
+}
+
+func (v verifier) Verify(token string, now time.Time) (*Claims, error) {
+	payload, encodedSig, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, errors.New("not a signed token")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(encodedSig)
+	if err != nil {
+		return nil, errors.New("unable to decode signature: %v", err)
+	}
+	if !v([]byte(payload), sig) {
+		return nil, errors.New("invalid signature")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, errors.New("unable to decode claims: %v", err)
+	}
+	claims := &Claims{}
+	if err := json.Unmarshal(b, claims); err != nil {
+		return nil, errors.New("unable to parse claims: %v", err)
+	}
+	if claims.DeviceID == "" {
+		return nil, errors.New("token has no device ID")
+	}
+	if claims.Expires == 0 {
+		return nil, errors.New("token has no expiry")
+	}
+	if now.After(claims.ExpiresAt()) {
+		return nil, errors.New("token for %v expired at %v", claims.DeviceID, claims.ExpiresAt())
+	}
+	return claims, nil
+}
+
+type claimsKey struct{}
+
+// ClaimsFromContext returns the claims of the signed token the request was
+// authenticated with, or nil if it wasn't authenticated with a signed token.
+func ClaimsFromContext(ctx context.Context) *Claims {
+	claims, _ := ctx.Value(claimsKey{}).(*Claims)
+	return claims
+}
+
+func withClaims(ctx context.Context, claims *Claims) context.Context {
+	return context.WithValue(ctx, claimsKey{}, claims)
+}
@@ -0,0 +1,112 @@
+package tokenfilter
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/getlantern/proxy/v3/filters"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/http-proxy-lantern/v2/common"
+)
+
+func TestSignedTokens(t *testing.T) {
+	now := time.Now()
+	claims := Claims{DeviceID: "device1", Pro: true, Expires: now.Add(time.Hour).Unix()}
+
+	secret := []byte("secret")
+	hmacToken, err := claims.SignHMAC(secret)
+	require.NoError(t, err)
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	ed25519Token, err := claims.SignEd25519(priv)
+	require.NoError(t, err)
+
+	hmacVerifier, err := ParseVerifier("hmac:" + base64.StdEncoding.EncodeToString(secret))
+	require.NoError(t, err)
+	ed25519Verifier, err := ParseVerifier("ed25519:" + base64.StdEncoding.EncodeToString(pub))
+	require.NoError(t, err)
+
+	verified, err := hmacVerifier.Verify(hmacToken, now)
+	require.NoError(t, err)
+	assert.Equal(t, claims, *verified)
+	verified, err = ed25519Verifier.Verify(ed25519Token, now)
+	require.NoError(t, err)
+	assert.Equal(t, claims, *verified)
+
+	_, err = hmacVerifier.Verify(ed25519Token, now)
+	assert.Error(t, err, "wrong key")
+	_, err = ed25519Verifier.Verify(hmacToken, now)
+	assert.Error(t, err, "wrong key")
+	_, err = hmacVerifier.Verify(hmacToken, now.Add(2*time.Hour))
+	assert.Error(t, err, "expired")
+	_, err = hmacVerifier.Verify(hmacToken[1:], now)
+	assert.Error(t, err, "tampered")
+	neverExpires, err := Claims{DeviceID: "device1"}.SignHMAC(secret)
+	require.NoError(t, err)
+	_, err = hmacVerifier.Verify(neverExpires, now)
+	assert.Error(t, err, "tokens must expire")
+
+	for _, invalid := range []string{"secret", "rsa:c2VjcmV0", "hmac:!!", "hmac:", "ed25519:c2VjcmV0"} {
+		_, err = ParseVerifier(invalid)
+		assert.Error(t, err, invalid)
+	}
+	v, err := ParseVerifier("")
+	require.NoError(t, err)
+	assert.Nil(t, v)
+}
+
+func TestApplySigned(t *testing.T) {
+	secret := []byte("secret")
+	token, err := Claims{DeviceID: "device1", Pro: true, Expires: time.Now().Add(time.Hour).Unix()}.SignHMAC(secret)
+	require.NoError(t, err)
+	rec := &mimicRecorder{}
+	f := New(nil, NewHMACVerifier(secret), nil, rec)
+
+	apply := func(token, deviceID string) (*Claims, string, bool) {
+		client, server := net.Pipe()
+		defer client.Close()
+		go io.Copy(io.Discard, client)
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+		req.Header.Set(common.TokenHeader, token)
+		if deviceID != "" {
+			req.Header.Set(common.DeviceIdHeader, deviceID)
+		}
+		var claims *Claims
+		var seenDeviceID string
+		passed := false
+		_, _, err := f.Apply(filters.NewConnectionState(req, nil, server), req, func(cs *filters.ConnectionState, req *http.Request) (*http.Response, *filters.ConnectionState, error) {
+			passed = true
+			claims = ClaimsFromContext(req.Context())
+			seenDeviceID = req.Header.Get(common.DeviceIdHeader)
+			return nil, cs, nil
+		})
+		require.NoError(t, err)
+		return claims, seenDeviceID, passed
+	}
+
+	claims, deviceID, passed := apply(token, "device1")
+	require.True(t, passed)
+	assert.Equal(t, "device1", claims.DeviceID)
+	assert.True(t, claims.Pro)
+	assert.Equal(t, "device1", deviceID)
+	assert.Equal(t, signedTokenLabel, rec.label)
+
+	_, deviceID, passed = apply(token, "")
+	require.True(t, passed)
+	assert.Equal(t, "device1", deviceID, "device ID should be filled in from the token")
+
+	_, _, passed = apply(token, "device2")
+	assert.False(t, passed, "device ID must match the token")
+	assert.True(t, rec.mimicked)
+
+	_, _, passed = apply("shared", "")
+	assert.False(t, passed, "shared tokens aren't accepted when none are configured")
+}
@@ -4,7 +4,9 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"strings"
+	"time"
 
+	"github.com/getlantern/errors"
 	"github.com/getlantern/golog"
 	"github.com/getlantern/proxy/v3/filters"
 
@@ -15,14 +17,97 @@ import (
 
 var log = golog.LoggerFor("tokenfilter")
 
+// Token is a token clients may authenticate with. Label, if set, identifies
+// the token in logs and metrics. A token is only honored from NotBefore until
+// NotAfter, either of which may be zero for no bound, which lets a new token
+// be rolled out while the old one is still accepted.
+type Token struct {
+	Value     string
+	Label     string
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// ValidAt reports whether the token is honored at the given time.
+func (t Token) ValidAt(now time.Time) bool {
+	if !t.NotBefore.IsZero() && now.Before(t.NotBefore) {
+		return false
+	}
+	if !t.NotAfter.IsZero() && now.After(t.NotAfter) {
+		return false
+	}
+	return true
+}
+
+// ParseTokens parses a comma-separated list of tokens, each of the form
+//
+//	value[;label=<label>][;notbefore=<RFC 3339 time>][;notafter=<RFC 3339 time>]
+//
+// so a plain single token is still valid.
+func ParseTokens(s string) ([]Token, error) {
+	var tokens []Token
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, ";")
+		token := Token{Value: strings.TrimSpace(parts[0])}
+		if token.Value == "" {
+			return nil, errors.New("missing token value in %q", entry)
+		}
+		for _, part := range parts[1:] {
+			key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+			if !ok {
+				return nil, errors.New("invalid token attribute %q", part)
+			}
+			var err error
+			switch strings.ToLower(key) {
+			case "label":
+				token.Label = value
+			case "notbefore":
+				token.NotBefore, err = time.Parse(time.RFC3339, value)
+			case "notafter":
+				token.NotAfter, err = time.Parse(time.RFC3339, value)
+			default:
+				return nil, errors.New("unknown token attribute %q", key)
+			}
+			if err != nil {
+				return nil, errors.New("invalid %v for token: %v", key, err)
+			}
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
+
+// signedTokenLabel is how requests authenticated with a signed token are
+// labeled in metrics.
+const signedTokenLabel = "signed"
+
 type tokenFilter struct {
-	token      string
+	tokens     []Token
+	verifier   Verifier
+	decoy      mimic.Mimic
 	instrument instrument.Instrument
 }
 
-func New(token string, instrument instrument.Instrument) filters.Filter {
+// New creates a filter that only lets through requests carrying one of the
+// given tokens or, if verifier is not nil, a signed token it verifies. Anything
+// else gets the decoy web server mimicked at it, Apache if decoy is nil. If
+// there are no tokens and no verifier, no token is required.
+//
+// A request authenticated with a signed token must not claim a device ID
+// other than the token's, and the token's claims are made available to later
+// filters through ClaimsFromContext.
+func New(tokens []Token, verifier Verifier, decoy mimic.Mimic, instrument instrument.Instrument) filters.Filter {
+	if decoy == nil {
+		decoy = mimic.Func(mimic.Apache)
+	}
 	return &tokenFilter{
-		token:      token,
+		tokens:     tokens,
+		verifier:   verifier,
+		decoy:      decoy,
 		instrument: instrument,
 	}
 }
@@ -33,38 +118,78 @@ func (f *tokenFilter) Apply(cs *filters.ConnectionState, req *http.Request, next
 		log.Tracef("Token Filter Middleware received request:\n%s", reqStr)
 	}
 
-	if f.token == "" {
+	if len(f.tokens) == 0 && f.verifier == nil {
 		log.Trace("Not checking token")
 		return next(cs, req)
 	}
 
 	tokens := req.Header[common.TokenHeader]
 	if tokens == nil || len(tokens) == 0 || tokens[0] == "" {
-		log.Errorf("No token provided, mimicking apache")
-		f.instrument.Mimic(req.Context(), true)
-		return mimicApache(cs, req)
+		log.Errorf("No token provided, mimicking decoy")
+		f.instrument.Mimic(req.Context(), true, "")
+		return f.mimic(cs, req)
 	}
-	tokenMatched := false
-	for _, candidate := range tokens {
-		if candidate == f.token {
-			tokenMatched = true
-			break
-		}
-	}
-	if tokenMatched {
+	now := time.Now()
+	matched, found := f.match(tokens, now)
+	if found {
 		req.Header.Del(common.TokenHeader)
-		log.Tracef("Allowing connection from %v to %v", req.RemoteAddr, req.Host)
-		f.instrument.Mimic(req.Context(), false)
+		log.Tracef("Allowing connection from %v to %v with token %v", req.RemoteAddr, req.Host, matched.Label)
+		f.instrument.Mimic(req.Context(), false, matched.Label)
 		return next(cs, req)
 	}
-	log.Errorf("Mismatched token(s) %v, mimicking apache", strings.Join(tokens, ","))
-	f.instrument.Mimic(req.Context(), true)
-	return mimicApache(cs, req)
+	if claims := f.verify(tokens, now); claims != nil {
+		deviceID := req.Header.Get(common.DeviceIdHeader)
+		if deviceID != "" && deviceID != claims.DeviceID {
+			log.Errorf("Device ID %v doesn't match signed token for %v, mimicking decoy", deviceID, claims.DeviceID)
+			f.instrument.Mimic(req.Context(), true, "")
+			return f.mimic(cs, req)
+		}
+		req.Header.Set(common.DeviceIdHeader, claims.DeviceID)
+		req.Header.Del(common.TokenHeader)
+		log.Tracef("Allowing connection from %v to %v with signed token for %v", req.RemoteAddr, req.Host, claims.DeviceID)
+		f.instrument.Mimic(req.Context(), false, signedTokenLabel)
+		return next(cs, req.WithContext(withClaims(req.Context(), claims)))
+	}
+	log.Errorf("Mismatched token(s) %v, mimicking decoy", strings.Join(tokens, ","))
+	f.instrument.Mimic(req.Context(), true, "")
+	return f.mimic(cs, req)
+}
+
+// match returns the first configured token that is valid at now and equals
+// one of the candidates.
+func (f *tokenFilter) match(candidates []string, now time.Time) (Token, bool) {
+	for _, token := range f.tokens {
+		if !token.ValidAt(now) {
+			continue
+		}
+		for _, candidate := range candidates {
+			if candidate == token.Value {
+				return token, true
+			}
+		}
+	}
+	return Token{}, false
+}
+
+// verify returns the claims of the first candidate that is a valid signed
+// token, or nil if there is none.
+func (f *tokenFilter) verify(candidates []string, now time.Time) *Claims {
+	if f.verifier == nil {
+		return nil
+	}
+	for _, candidate := range candidates {
+		claims, err := f.verifier.Verify(candidate, now)
+		if err == nil {
+			return claims
+		}
+		log.Debugf("Rejecting signed token: %v", err)
+	}
+	return nil
 }
 
-func mimicApache(cs *filters.ConnectionState, req *http.Request) (*http.Response, *filters.ConnectionState, error) {
+func (f *tokenFilter) mimic(cs *filters.ConnectionState, req *http.Request) (*http.Response, *filters.ConnectionState, error) {
 	conn := cs.Downstream()
-	mimic.Apache(conn, req)
+	f.decoy.Respond(conn, req)
 	conn.Close()
 	return nil, cs, nil
 }
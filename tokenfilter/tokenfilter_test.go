@@ -0,0 +1,85 @@
+package tokenfilter
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/getlantern/proxy/v3/filters"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/http-proxy-lantern/v2/common"
+	"github.com/getlantern/http-proxy-lantern/v2/instrument"
+)
+
+type mimicRecorder struct {
+	instrument.NoInstrument
+	mimicked bool
+	label    string
+}
+
+func (r *mimicRecorder) Mimic(ctx context.Context, m bool, tokenLabel string) {
+	r.mimicked, r.label = m, tokenLabel
+}
+
+func TestParseTokens(t *testing.T) {
+	tokens, err := ParseTokens("")
+	require.NoError(t, err)
+	assert.Empty(t, tokens)
+
+	tokens, err = ParseTokens("plain")
+	require.NoError(t, err)
+	assert.Equal(t, []Token{{Value: "plain"}}, tokens)
+
+	tokens, err = ParseTokens("old;label=2023;notafter=2024-01-01T00:00:00Z, new;label=2024;notbefore=2023-12-01T00:00:00Z")
+	require.NoError(t, err)
+	assert.Equal(t, []Token{
+		{Value: "old", Label: "2023", NotAfter: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{Value: "new", Label: "2024", NotBefore: time.Date(2023, 12, 1, 0, 0, 0, 0, time.UTC)},
+	}, tokens)
+
+	for _, invalid := range []string{";label=x", "a;label", "a;color=red", "a;notafter=tomorrow"} {
+		_, err = ParseTokens(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestApply(t *testing.T) {
+	now := time.Now()
+	rec := &mimicRecorder{}
+	f := New([]Token{
+		{Value: "expired", Label: "old", NotAfter: now.Add(-time.Minute)},
+		{Value: "current", Label: "new"},
+		{Value: "future", NotBefore: now.Add(time.Hour)},
+	}, nil, nil, rec)
+
+	apply := func(token string) bool {
+		client, server := net.Pipe()
+		defer client.Close()
+		go io.Copy(io.Discard, client)
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+		req.Header.Set(common.TokenHeader, token)
+		passed := false
+		_, _, err := f.Apply(filters.NewConnectionState(req, nil, server), req, func(cs *filters.ConnectionState, req *http.Request) (*http.Response, *filters.ConnectionState, error) {
+			passed = true
+			assert.Empty(t, req.Header.Get(common.TokenHeader), "token header should be stripped")
+			return nil, cs, nil
+		})
+		require.NoError(t, err)
+		return passed
+	}
+
+	assert.True(t, apply("current"))
+	assert.False(t, rec.mimicked)
+	assert.Equal(t, "new", rec.label)
+
+	for _, token := range []string{"expired", "future", "bogus", ""} {
+		assert.False(t, apply(token), token)
+		assert.True(t, rec.mimicked, token)
+		assert.Empty(t, rec.label, token)
+	}
+}
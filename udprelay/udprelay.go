@@ -0,0 +1,504 @@
+// Package udprelay relays UDP for clients of the shadowsocks and vmess
+// listeners. Unlike the HTTP proxied traffic of other transports, their UDP
+// sessions carry datagrams straight to the destinations named in each packet,
+// which is what QUIC/HTTP3, DNS and WebRTC need.
+//
+// Every client gets an entry in the relay's NAT table with a UDP socket of its
+// own, so that replies can be told apart, and the entry is dropped once it's
+// been idle for a while. Packets to local addresses are dropped like
+// proxyfilters.BlockLocal refuses requests to them, and the bytes relayed are
+// reported the way measured connections report them, so that they count
+// towards datacaps, the bandwidth budget and the proxied bytes metrics. The
+// proxy vets clients before their sessions are opened and holds their packets
+// to the rates its filters hold connections to, see Options.
+package udprelay
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/golog"
+	"github.com/getlantern/measured"
+
+	"github.com/getlantern/http-proxy-lantern/v2/common"
+	"github.com/getlantern/http-proxy-lantern/v2/listeners"
+)
+
+const (
+	// DefaultIdleTimeout is how long a session may go without packets in
+	// either direction before it's closed, the same as Outline's NAT timeout.
+	DefaultIdleTimeout = 5 * time.Minute
+
+	// DefaultReportInterval is how often the bytes relayed are reported.
+	DefaultReportInterval = 1 * time.Minute
+
+	// DefaultMaxSessions and DefaultMaxClientSessions are how many sessions
+	// may be open at once, in all and for any one client IP, each session
+	// taking a file descriptor.
+	DefaultMaxSessions       = 16384
+	DefaultMaxClientSessions = 256
+
+	// MaxPacketSize is the largest packet relayed.
+	MaxPacketSize = 64 * 1024
+
+	// maxObserved bounds how many destinations a session remembers having
+	// passed to Options.Observe.
+	maxObserved = 1024
+)
+
+var (
+	log = golog.LoggerFor("udprelay")
+
+	// ErrClosed is returned when opening sessions on a closed Relay.
+	ErrClosed = errors.New("relay closed")
+
+	// ErrRefused is returned when Options.Admit refuses a session.
+	ErrRefused = errors.New("session refused")
+)
+
+// Resolver resolves destination hosts, e.g. *resolver.Resolver.
+type Resolver interface {
+	ResolveIPAddr(network string, address string) (*net.IPAddr, error)
+}
+
+type netResolver struct{}
+
+func (netResolver) ResolveIPAddr(network string, address string) (*net.IPAddr, error) {
+	return net.ResolveIPAddr(network, address)
+}
+
+// Options configures a Relay.
+type Options struct {
+	// IdleTimeout is how long sessions are kept without any packets, defaulting
+	// to DefaultIdleTimeout.
+	IdleTimeout time.Duration
+
+	// AllowLocal allows packets to local addresses, for testing.
+	AllowLocal bool
+
+	// AllowedLocalAddrs are the local host or host:port destinations packets
+	// may still be sent to, like the exceptions to proxyfilters.BlockLocal.
+	AllowedLocalAddrs []string
+
+	// Resolver resolves the destination hosts, the system resolver being used
+	// if it's nil.
+	Resolver Resolver
+
+	// Report, if set, is called every ReportInterval with the bytes relayed
+	// for each session and once more when it's closed, with the session's
+	// Client.Context. Bytes sent are those relayed to the client and bytes
+	// received are those relayed from it, as with measured connections.
+	Report listeners.MeasuredReportFN
+
+	// ReportInterval defaults to DefaultReportInterval.
+	ReportInterval time.Duration
+
+	// MaxSessions bounds how many sessions are open at once and
+	// MaxClientSessions how many of them any one client IP, the
+	// common.ClientIP of their Client.Context, has open, so that clients
+	// cycling through source ports can't run the proxy out of file
+	// descriptors. Opening a session past either limit closes the one that's
+	// been idle the longest to make room. They default to DefaultMaxSessions
+	// and DefaultMaxClientSessions.
+	MaxSessions       int
+	MaxClientSessions int
+
+	// Admit, if set, is called with a client's Client.Context before a
+	// session is opened for it, the session being refused if it returns an
+	// error. It's for the checks the proxy's filters make of connections,
+	// like the blacklist and the bandwidth budget.
+	Admit func(ctx map[string]interface{}) error
+
+	// Limiter, if set, returns the limiter a session's packets are held to,
+	// given its Client.Context, or nil for none. Packets from the client count
+	// as reads and replies to it as writes, like with connections, and those
+	// over its rates are dropped. It's looked up again every ReportInterval,
+	// so that throttling catches up with sessions that are already open.
+	Limiter func(ctx map[string]interface{}) *listeners.RateLimiter
+
+	// Observe, if set, is called with a session's Client.Context and the host
+	// and port of each destination it sends packets to, the first time it
+	// does, e.g. for abuse detection.
+	Observe func(ctx map[string]interface{}, host string, port int)
+}
+
+// Client is the client end of a session.
+type Client struct {
+	// Reply sends a packet from the destination at from back to the client.
+	Reply func(b []byte, from *net.UDPAddr) error
+
+	// Context is reported along with the session's bytes, like the context
+	// of a measured connection.
+	Context map[string]interface{}
+
+	// OnClose, if set, is called once the session is closed.
+	OnClose func()
+}
+
+// Relay is a NAT table of sessions relaying clients' packets.
+type Relay struct {
+	opts     Options
+	mx       sync.Mutex
+	sessions map[string]*Session
+	// clientSessions counts the open sessions of each client IP.
+	clientSessions map[string]int
+	closed         bool
+	stop           chan struct{}
+}
+
+// New creates a Relay.
+func New(opts Options) *Relay {
+	if opts.IdleTimeout <= 0 {
+		opts.IdleTimeout = DefaultIdleTimeout
+	}
+	if opts.Resolver == nil {
+		opts.Resolver = netResolver{}
+	}
+	if opts.ReportInterval <= 0 {
+		opts.ReportInterval = DefaultReportInterval
+	}
+	if opts.MaxSessions <= 0 {
+		opts.MaxSessions = DefaultMaxSessions
+	}
+	if opts.MaxClientSessions <= 0 {
+		opts.MaxClientSessions = DefaultMaxClientSessions
+	}
+	r := &Relay{
+		opts:           opts,
+		sessions:       make(map[string]*Session),
+		clientSessions: make(map[string]int),
+		stop:           make(chan struct{}),
+	}
+	if opts.Report != nil || opts.Limiter != nil {
+		go r.refreshPeriodically()
+	}
+	return r
+}
+
+// Session returns the open session for the client identified by key, or nil
+// if there isn't one.
+func (r *Relay) Session(key string) *Session {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return r.sessions[key]
+}
+
+// Open returns the session for the client identified by key, opening one for
+// client if there isn't one yet.
+func (r *Relay) Open(key string, client Client) (*Session, error) {
+	var evicted []*Session
+	defer func() {
+		for _, s := range evicted {
+			s.Close()
+		}
+	}()
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	if r.closed {
+		return nil, ErrClosed
+	}
+	if s := r.sessions[key]; s != nil {
+		return s, nil
+	}
+	if r.opts.Admit != nil {
+		if err := r.opts.Admit(client.Context); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrRefused, err)
+		}
+	}
+	clientIP, _ := client.Context[common.ClientIP].(string)
+	if clientIP != "" && r.clientSessions[clientIP] >= r.opts.MaxClientSessions {
+		evicted = append(evicted, r.evictIdlest(clientIP))
+	}
+	if len(r.sessions) >= r.opts.MaxSessions {
+		evicted = append(evicted, r.evictIdlest(""))
+	}
+	conn, err := net.ListenPacket("udp", "")
+	if err != nil {
+		return nil, fmt.Errorf("unable to open UDP socket: %w", err)
+	}
+	s := &Session{
+		relay:    r,
+		key:      key,
+		client:   client,
+		clientIP: clientIP,
+		conn:     conn,
+		opened:   time.Now(),
+	}
+	s.touch()
+	s.refreshLimiter()
+	r.sessions[key] = s
+	if clientIP != "" {
+		r.clientSessions[clientIP]++
+	}
+	go s.readLoop()
+	return s, nil
+}
+
+// evictIdlest removes the session that's been idle the longest from the NAT
+// table, of those of clientIP or of all if it's empty, returning it to be
+// closed once the relay is unlocked. The relay must be locked.
+func (r *Relay) evictIdlest(clientIP string) *Session {
+	var idlest *Session
+	for _, s := range r.sessions {
+		if clientIP != "" && s.clientIP != clientIP {
+			continue
+		}
+		if idlest == nil || s.lastActive.Load() < idlest.lastActive.Load() {
+			idlest = s
+		}
+	}
+	log.Debugf("Too many UDP sessions, closing the one for %v", idlest.key)
+	r.remove(idlest)
+	return idlest
+}
+
+// remove removes s from the NAT table if it's still in it. The relay must be
+// locked.
+func (r *Relay) remove(s *Session) {
+	if r.sessions[s.key] != s {
+		return
+	}
+	delete(r.sessions, s.key)
+	if s.clientIP != "" {
+		if r.clientSessions[s.clientIP]--; r.clientSessions[s.clientIP] <= 0 {
+			delete(r.clientSessions, s.clientIP)
+		}
+	}
+}
+
+// Len returns the number of open sessions.
+func (r *Relay) Len() int {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return len(r.sessions)
+}
+
+// Close closes all sessions, after which no more can be opened.
+func (r *Relay) Close() error {
+	r.mx.Lock()
+	if r.closed {
+		r.mx.Unlock()
+		return nil
+	}
+	r.closed = true
+	close(r.stop)
+	sessions := make([]*Session, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		sessions = append(sessions, s)
+	}
+	r.mx.Unlock()
+
+	for _, s := range sessions {
+		s.Close()
+	}
+	return nil
+}
+
+// refreshPeriodically reports the bytes relayed and looks up the sessions'
+// limiters every ReportInterval.
+func (r *Relay) refreshPeriodically() {
+	ticker := time.NewTicker(r.opts.ReportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+			r.mx.Lock()
+			sessions := make([]*Session, 0, len(r.sessions))
+			for _, s := range r.sessions {
+				sessions = append(sessions, s)
+			}
+			r.mx.Unlock()
+			for _, s := range sessions {
+				s.report(false)
+				s.refreshLimiter()
+			}
+		}
+	}
+}
+
+// resolve resolves dst, a host:port, refusing local addresses that aren't
+// allowed. Hosts are resolved for every packet, relying on the resolver to
+// cache them, so that they're vetted the same way each time. It also returns
+// the host as given.
+func (r *Relay) resolve(dst string) (*net.UDPAddr, string, error) {
+	host, portString, err := net.SplitHostPort(dst)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid destination %v: %w", dst, err)
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, "", fmt.Errorf("invalid destination port in %v", dst)
+	}
+	ipAddr, err := r.opts.Resolver.ResolveIPAddr("ip", host)
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to resolve %v: %w", host, err)
+	}
+	if !r.opts.AllowLocal && (ipAddr.IP.IsPrivate() || !ipAddr.IP.IsGlobalUnicast()) && !r.isException(dst, host) {
+		return nil, "", fmt.Errorf("%v is a local address (%v)", dst, ipAddr.IP)
+	}
+	return &net.UDPAddr{IP: ipAddr.IP, Port: port, Zone: ipAddr.Zone}, host, nil
+}
+
+func (r *Relay) isException(dst, host string) bool {
+	for _, exception := range r.opts.AllowedLocalAddrs {
+		if strings.EqualFold(dst, exception) || strings.EqualFold(host, exception) {
+			return true
+		}
+	}
+	return false
+}
+
+// Session is a client's entry in the NAT table, relaying its packets through
+// a UDP socket of its own.
+type Session struct {
+	relay      *Relay
+	key        string
+	client     Client
+	clientIP   string
+	conn       net.PacketConn
+	opened     time.Time
+	lastActive atomic.Int64
+	sent       atomic.Int64
+	recv       atomic.Int64
+	reportMx   sync.Mutex
+	reported   measured.Stats
+	final      bool
+	closeOnce  sync.Once
+	limiter    atomic.Pointer[listeners.RateLimiter]
+	// observed are the destinations already passed to Options.Observe.
+	observedMx sync.Mutex
+	observed   map[string]bool
+}
+
+// Forward relays the packet b from the client to dst, a host:port. Packets
+// that can't be relayed are dropped, returning an error, while those over the
+// session's rate are dropped silently, as a router would.
+func (s *Session) Forward(b []byte, dst string) error {
+	addr, host, err := s.relay.resolve(dst)
+	if err != nil {
+		return err
+	}
+	s.touch()
+	if l := s.limiter.Load(); l != nil && !l.AllowRead(len(b)) {
+		return nil
+	}
+	s.observe(dst, host, addr.Port)
+	n, err := s.conn.WriteTo(b, addr)
+	s.recv.Add(int64(n))
+	return err
+}
+
+// Close closes the session and removes it from the NAT table.
+func (s *Session) Close() error {
+	s.closeOnce.Do(func() {
+		s.relay.mx.Lock()
+		s.relay.remove(s)
+		s.relay.mx.Unlock()
+		s.conn.Close()
+		s.report(true)
+		if s.client.OnClose != nil {
+			s.client.OnClose()
+		}
+	})
+	return nil
+}
+
+// observe passes dst to Options.Observe unless it already has been. Sessions
+// scanning more than maxObserved destinations start over, observing them
+// again, rather than remembering them all.
+func (s *Session) observe(dst, host string, port int) {
+	if s.relay.opts.Observe == nil {
+		return
+	}
+	s.observedMx.Lock()
+	if s.observed[dst] {
+		s.observedMx.Unlock()
+		return
+	}
+	if s.observed == nil || len(s.observed) >= maxObserved {
+		s.observed = make(map[string]bool)
+	}
+	s.observed[dst] = true
+	s.observedMx.Unlock()
+	s.relay.opts.Observe(s.client.Context, host, port)
+}
+
+// refreshLimiter looks up the session's limiter.
+func (s *Session) refreshLimiter() {
+	if s.relay.opts.Limiter != nil {
+		s.limiter.Store(s.relay.opts.Limiter(s.client.Context))
+	}
+}
+
+func (s *Session) touch() {
+	s.lastActive.Store(time.Now().UnixNano())
+}
+
+// idleDeadline is when the session expires unless there are more packets.
+func (s *Session) idleDeadline() time.Time {
+	return time.Unix(0, s.lastActive.Load()).Add(s.relay.opts.IdleTimeout)
+}
+
+// readLoop relays replies back to the client until the session is closed or
+// expires.
+func (s *Session) readLoop() {
+	defer s.Close()
+	buf := make([]byte, MaxPacketSize)
+	for {
+		deadline := s.idleDeadline()
+		if !time.Now().Before(deadline) {
+			log.Tracef("UDP session for %v expired", s.key)
+			return
+		}
+		s.conn.SetReadDeadline(deadline)
+		n, from, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				// The client may have sent packets meanwhile.
+				continue
+			}
+			return
+		}
+		s.touch()
+		if l := s.limiter.Load(); l != nil && !l.AllowWrite(n) {
+			continue
+		}
+		if err := s.client.Reply(buf[:n], from.(*net.UDPAddr)); err != nil {
+			log.Debugf("Unable to relay UDP reply to %v: %v", s.key, err)
+			return
+		}
+		s.sent.Add(int64(n))
+	}
+}
+
+// report reports the bytes relayed since the last report.
+func (s *Session) report(final bool) {
+	if s.relay.opts.Report == nil {
+		return
+	}
+	s.reportMx.Lock()
+	defer s.reportMx.Unlock()
+	if s.final {
+		return
+	}
+	s.final = final
+	stats := &measured.Stats{
+		SentTotal: int(s.sent.Load()),
+		RecvTotal: int(s.recv.Load()),
+		Duration:  time.Since(s.opened),
+	}
+	delta := *stats
+	delta.SentTotal -= s.reported.SentTotal
+	delta.RecvTotal -= s.reported.RecvTotal
+	s.reported = *stats
+	s.relay.opts.Report(s.client.Context, stats, &delta, final)
+}
@@ -0,0 +1,229 @@
+package udprelay
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getlantern/measured"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/http-proxy-lantern/v2/common"
+	"github.com/getlantern/http-proxy-lantern/v2/listeners"
+)
+
+// echoServer echoes UDP packets until the test ends.
+func echoServer(t *testing.T) *net.UDPAddr {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		b := make([]byte, MaxPacketSize)
+		for {
+			n, addr, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(b[:n], addr)
+		}
+	}()
+	return pc.LocalAddr().(*net.UDPAddr)
+}
+
+type reports struct {
+	mx         sync.Mutex
+	sent, recv int
+	finals     int
+}
+
+func (r *reports) report(ctx map[string]interface{}, stats *measured.Stats, deltaStats *measured.Stats, final bool) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	r.sent += deltaStats.SentTotal
+	r.recv += deltaStats.RecvTotal
+	if final {
+		r.finals++
+	}
+}
+
+func (r *reports) get() (sent, recv, finals int) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return r.sent, r.recv, r.finals
+}
+
+func TestRelay(t *testing.T) {
+	echo := echoServer(t)
+	var rep reports
+	r := New(Options{AllowLocal: true, Report: rep.report, ReportInterval: 10 * time.Millisecond})
+	defer r.Close()
+
+	replies := make(chan string, 10)
+	closed := make(chan struct{})
+	s, err := r.Open("client1", Client{
+		Reply: func(b []byte, from *net.UDPAddr) error {
+			assert.Equal(t, echo.String(), from.String())
+			replies <- string(b)
+			return nil
+		},
+		OnClose: func() { close(closed) },
+	})
+	require.NoError(t, err)
+	s2, err := r.Open("client1", Client{})
+	require.NoError(t, err)
+	assert.Same(t, s, s2, "clients should keep their session")
+	assert.Equal(t, 1, r.Len())
+
+	require.NoError(t, s.Forward([]byte("hello"), echo.String()))
+	require.NoError(t, s.Forward([]byte("world"), echo.String()))
+	for _, expected := range []string{"hello", "world"} {
+		select {
+		case reply := <-replies:
+			assert.Equal(t, expected, reply)
+		case <-time.After(5 * time.Second):
+			t.Fatal("no reply")
+		}
+	}
+
+	assert.Eventually(t, func() bool {
+		sent, recv, _ := rep.get()
+		return sent == 10 && recv == 10
+	}, 5*time.Second, 10*time.Millisecond, "bytes should be reported periodically")
+
+	s.Close()
+	<-closed
+	assert.Nil(t, r.Session("client1"))
+	_, _, finals := rep.get()
+	assert.Equal(t, 1, finals)
+}
+
+func TestRelayBlocksLocal(t *testing.T) {
+	echo := echoServer(t)
+	r := New(Options{AllowedLocalAddrs: []string{"localhost"}})
+	defer r.Close()
+	s, err := r.Open("client1", Client{Reply: func(b []byte, from *net.UDPAddr) error { return nil }})
+	require.NoError(t, err)
+
+	for _, dst := range []string{echo.String(), "10.0.0.1:53", "[::1]:53", "0.0.0.0:53"} {
+		assert.Error(t, s.Forward([]byte("hello"), dst), dst)
+	}
+	assert.NoError(t, s.Forward([]byte("hello"), net.JoinHostPort("localhost", "53")), "exceptions should be allowed")
+	assert.Error(t, s.Forward([]byte("hello"), "example.com"), "destinations need a port")
+}
+
+func TestRelayIdleTimeout(t *testing.T) {
+	echo := echoServer(t)
+	r := New(Options{AllowLocal: true, IdleTimeout: 200 * time.Millisecond})
+	defer r.Close()
+	s, err := r.Open("client1", Client{Reply: func(b []byte, from *net.UDPAddr) error { return nil }})
+	require.NoError(t, err)
+
+	for i := 0; i < 4; i++ {
+		time.Sleep(100 * time.Millisecond)
+		require.NoError(t, s.Forward([]byte("hello"), echo.String()))
+	}
+	assert.Same(t, s, r.Session("client1"), "active sessions should be kept")
+	assert.Eventually(t, func() bool { return r.Session("client1") == nil }, 2*time.Second, 10*time.Millisecond, "idle sessions should expire")
+
+	r.Close()
+	_, err = r.Open("client2", Client{})
+	assert.ErrorIs(t, err, ErrClosed)
+}
+
+func TestRelayAdmit(t *testing.T) {
+	r := New(Options{AllowLocal: true, Admit: func(ctx map[string]interface{}) error {
+		if ctx[common.ClientIP] == "1.2.3.4" {
+			return errors.New("blacklisted")
+		}
+		return nil
+	}})
+	defer r.Close()
+
+	_, err := r.Open("client1", Client{Context: map[string]interface{}{common.ClientIP: "1.2.3.4"}})
+	assert.ErrorIs(t, err, ErrRefused)
+	assert.Equal(t, 0, r.Len())
+	_, err = r.Open("client2", Client{Context: map[string]interface{}{common.ClientIP: "5.6.7.8"}})
+	assert.NoError(t, err)
+}
+
+func TestRelayLimiter(t *testing.T) {
+	echo := echoServer(t)
+	limiter := listeners.NewRateLimiter(1000, 1000)
+	var observed []string
+	r := New(Options{
+		AllowLocal: true,
+		Limiter:    func(ctx map[string]interface{}) *listeners.RateLimiter { return limiter },
+		Observe: func(ctx map[string]interface{}, host string, port int) {
+			observed = append(observed, net.JoinHostPort(host, strconv.Itoa(port)))
+		},
+	})
+	defer r.Close()
+
+	replies := make(chan int, 10)
+	s, err := r.Open("client1", Client{Reply: func(b []byte, from *net.UDPAddr) error {
+		replies <- len(b)
+		return nil
+	}})
+	require.NoError(t, err)
+
+	require.NoError(t, s.Forward(make([]byte, 600), echo.String()))
+	require.NoError(t, s.Forward(make([]byte, 600), echo.String()), "packets over the rate should be dropped silently")
+	select {
+	case n := <-replies:
+		assert.Equal(t, 600, n)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reply")
+	}
+	select {
+	case <-replies:
+		t.Fatal("packets over the rate should be dropped")
+	case <-time.After(200 * time.Millisecond):
+	}
+	assert.Equal(t, []string{echo.String()}, observed, "destinations should be observed once")
+
+	// Re-rated, packets fit again but their replies don't.
+	limiter.SetRates(1000, 10)
+	require.NoError(t, s.Forward(make([]byte, 600), echo.String()))
+	select {
+	case <-replies:
+		t.Fatal("replies over the rate should be dropped")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestRelaySessionLimits(t *testing.T) {
+	r := New(Options{AllowLocal: true, MaxSessions: 3, MaxClientSessions: 2})
+	defer r.Close()
+	open := func(key, clientIP string) *Session {
+		s, err := r.Open(key, Client{Context: map[string]interface{}{common.ClientIP: clientIP}})
+		require.NoError(t, err)
+		// tells sessions' activity apart
+		time.Sleep(5 * time.Millisecond)
+		return s
+	}
+
+	a1 := open("a1", "1.1.1.1")
+	a2 := open("a2", "1.1.1.1")
+	a1.touch()
+	open("a3", "1.1.1.1")
+	assert.Nil(t, r.Session("a2"), "the client's idlest session should be closed")
+	assert.Same(t, a1, r.Session("a1"))
+	assert.Equal(t, 2, r.Len())
+	assert.Error(t, a2.Forward([]byte("hello"), "127.0.0.1:53"), "closed sessions shouldn't relay")
+
+	open("b1", "2.2.2.2")
+	assert.Equal(t, 3, r.Len())
+	open("c1", "3.3.3.3")
+	assert.Nil(t, r.Session("a1"), "the idlest session of all should be closed")
+	assert.Equal(t, 3, r.Len())
+	r.Session("a3").touch()
+	open("a4", "1.1.1.1")
+	assert.Nil(t, r.Session("b1"))
+	assert.NotNil(t, r.Session("a3"), "the client should have room for another session again")
+	assert.Equal(t, 3, r.Len())
+}
@@ -0,0 +1,362 @@
+// Package upgrade replaces a running proxy with a freshly exec'd binary without
+// refusing connections. The running process hands its listening sockets to the
+// new one over a unix socket and keeps serving until the new process reports
+// that it's ready, after which the old process can drain its connections and
+// exit.
+//
+// The unix socket's path is passed in an environment variable rather than
+// passing the sockets themselves as inherited file descriptors, since the
+// latter don't survive panicwrap re-executing the new binary. A process wrapped
+// by panicwrap should also give the new process its parent's output with
+// SetOutput, see there.
+package upgrade
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/golog"
+)
+
+const (
+	// envSocket names the environment variable holding the path of the unix
+	// socket at which the parent process offers its listeners.
+	envSocket = "HTTP_PROXY_UPGRADE_SOCKET"
+
+	// maxFiles caps how many sockets can be handed over.
+	maxFiles = 64
+
+	readyMsg = "ready"
+)
+
+var log = golog.LoggerFor("upgrade")
+
+type filer interface {
+	File() (*os.File, error)
+}
+
+// Upgrader creates listeners that survive an upgrade. A process started by an
+// upgrade takes over the listeners its parent handed it, and any process can
+// start an upgrade of its own with Upgrade.
+type Upgrader struct {
+	pidFile string
+	pid     int
+	stdout  *os.File
+	stderr  *os.File
+
+	mx        sync.Mutex
+	parent    *net.UnixConn
+	inherited map[string]*os.File
+	active    map[string]filer
+	upgrading bool
+}
+
+// New creates an Upgrader, taking over the listeners of the parent process if
+// this process was started by an upgrade. If pidFile is set, pid is written to
+// it once the process is Ready, so that a supervisor can follow the proxy
+// across upgrades.
+func New(pidFile string, pid int) (*Upgrader, error) {
+	u := &Upgrader{
+		pidFile:   pidFile,
+		pid:       pid,
+		stdout:    os.Stdout,
+		stderr:    os.Stderr,
+		inherited: make(map[string]*os.File),
+		active:    make(map[string]filer),
+	}
+	path := os.Getenv(envSocket)
+	if path == "" {
+		return u, nil
+	}
+	// Don't leak the socket to processes we start ourselves.
+	os.Unsetenv(envSocket)
+	if err := u.inherit(path); err != nil {
+		return nil, errors.New("unable to inherit listeners from parent process: %v", err)
+	}
+	return u, nil
+}
+
+// SetOutput sets the standard output and error of the processes Upgrade
+// starts, which are those of this process by default.
+//
+// The stderr of a process wrapped by panicwrap is the pipe through which the
+// panicwrap parent watches for panics, and the parent only exits once that
+// pipe is closed. A new process inheriting it would keep the old parent
+// around for as long as it runs, so such processes should pass the parent's
+// own output, which panicwrap hands them as extra files.
+func (u *Upgrader) SetOutput(stdout, stderr *os.File) {
+	u.stdout, u.stderr = stdout, stderr
+}
+
+func (u *Upgrader) inherit(path string) error {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return err
+	}
+	u.parent = conn.(*net.UnixConn)
+	b := make([]byte, 64*1024)
+	oob := make([]byte, syscall.CmsgSpace(4*maxFiles))
+	n, oobn, _, _, err := u.parent.ReadMsgUnix(b, oob)
+	if err != nil {
+		return err
+	}
+	var names []string
+	if err := json.Unmarshal(b[:n], &names); err != nil {
+		return err
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return err
+	}
+	var fds []int
+	for _, msg := range msgs {
+		rights, err := syscall.ParseUnixRights(&msg)
+		if err != nil {
+			return err
+		}
+		fds = append(fds, rights...)
+	}
+	if len(fds) != len(names) {
+		return errors.New("received %d sockets for %d listeners", len(fds), len(names))
+	}
+	for i, name := range names {
+		u.inherited[name] = os.NewFile(uintptr(fds[i]), name)
+	}
+	log.Debugf("Inherited %d listeners from parent process", len(names))
+	return nil
+}
+
+// Listen is like net.Listen but takes over the parent's listener for the same
+// network and address if there is one.
+func (u *Upgrader) Listen(network, addr string) (net.Listener, error) {
+	name := network + ":" + addr
+	var l net.Listener
+	var err error
+	if f := u.takeInherited(name); f != nil {
+		l, err = net.FileListener(f)
+		f.Close()
+		if err == nil {
+			log.Debugf("Took over listener at %v", name)
+		}
+	} else {
+		l, err = net.Listen(network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	u.track(name, l)
+	return l, nil
+}
+
+// ListenPacket is like net.ListenPacket but takes over the parent's packet
+// conn for the same network and address if there is one.
+func (u *Upgrader) ListenPacket(network, addr string) (net.PacketConn, error) {
+	name := network + ":" + addr
+	var pc net.PacketConn
+	var err error
+	if f := u.takeInherited(name); f != nil {
+		pc, err = net.FilePacketConn(f)
+		f.Close()
+		if err == nil {
+			log.Debugf("Took over packet conn at %v", name)
+		}
+	} else {
+		pc, err = net.ListenPacket(network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	u.track(name, pc)
+	return pc, nil
+}
+
+func (u *Upgrader) takeInherited(name string) *os.File {
+	u.mx.Lock()
+	defer u.mx.Unlock()
+	f := u.inherited[name]
+	delete(u.inherited, name)
+	return f
+}
+
+func (u *Upgrader) track(name string, l interface{}) {
+	f, ok := l.(filer)
+	if !ok {
+		log.Debugf("Listener at %v can't be handed over on upgrade", name)
+		return
+	}
+	u.mx.Lock()
+	u.active[name] = f
+	u.mx.Unlock()
+}
+
+// Ready is called once the proxy is serving on all its listeners. It writes
+// the PID file and, if this process was started by an upgrade, tells the
+// parent that it can stop serving. Inherited listeners that weren't taken over
+// are closed.
+func (u *Upgrader) Ready() error {
+	u.mx.Lock()
+	defer u.mx.Unlock()
+	for name, f := range u.inherited {
+		log.Debugf("Closing unused inherited listener at %v", name)
+		f.Close()
+	}
+	u.inherited = make(map[string]*os.File)
+
+	if u.pidFile != "" {
+		if err := writeFileAtomically(u.pidFile, []byte(strconv.Itoa(u.pid)+"\n")); err != nil {
+			return errors.New("unable to write PID file: %v", err)
+		}
+	}
+	if u.parent == nil {
+		return nil
+	}
+	defer func() {
+		u.parent.Close()
+		u.parent = nil
+	}()
+	if _, err := u.parent.Write([]byte(readyMsg)); err != nil {
+		return errors.New("unable to tell parent process we're ready: %v", err)
+	}
+	return nil
+}
+
+// Upgrade execs the current binary with the same arguments, hands it the
+// active listeners and waits for it to become Ready. If it returns nil, the
+// new process is serving and the caller should drain and exit. If the new
+// process exits or ctx is done before then, the new process is killed and an
+// error is returned, leaving this process in charge.
+func (u *Upgrader) Upgrade(ctx context.Context) error {
+	u.mx.Lock()
+	if u.upgrading {
+		u.mx.Unlock()
+		return errors.New("already upgrading")
+	}
+	u.upgrading = true
+	u.mx.Unlock()
+	defer func() {
+		u.mx.Lock()
+		u.upgrading = false
+		u.mx.Unlock()
+	}()
+
+	exe, err := os.Executable()
+	if err != nil {
+		return errors.New("unable to determine executable: %v", err)
+	}
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("http-proxy-upgrade-%d.sock", os.Getpid()))
+	os.Remove(path)
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return errors.New("unable to listen for new process: %v", err)
+	}
+	defer l.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), envSocket+"="+path)
+	cmd.Stdout = u.stdout
+	cmd.Stderr = u.stderr
+	if err := cmd.Start(); err != nil {
+		return errors.New("unable to start %v: %v", exe, err)
+	}
+	log.Debugf("Started new process %d from %v", cmd.Process.Pid, exe)
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	result := make(chan error, 1)
+	go func() {
+		result <- u.handOver(l)
+	}()
+	select {
+	case err = <-result:
+	case err = <-exited:
+		err = errors.New("new process exited before becoming ready: %v", err)
+	case <-ctx.Done():
+		err = errors.New("new process didn't become ready in time: %v", ctx.Err())
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		l.Close()
+		return err
+	}
+	log.Debugf("New process %d is ready", cmd.Process.Pid)
+	return nil
+}
+
+// handOver sends the active listeners to the new process connecting at l and
+// waits for it to report that it's ready.
+func (u *Upgrader) handOver(l *net.UnixListener) error {
+	conn, err := l.AcceptUnix()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	u.mx.Lock()
+	var names []string
+	var files []*os.File
+	for name, active := range u.active {
+		f, err := active.File()
+		if err != nil {
+			log.Errorf("Unable to hand over listener at %v: %v", name, err)
+			continue
+		}
+		names = append(names, name)
+		files = append(files, f)
+	}
+	u.mx.Unlock()
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	if len(files) > maxFiles {
+		return errors.New("can't hand over more than %d listeners", maxFiles)
+	}
+
+	b, err := json.Marshal(names)
+	if err != nil {
+		return err
+	}
+	fds := make([]int, 0, len(files))
+	for _, f := range files {
+		fds = append(fds, int(f.Fd()))
+	}
+	if _, _, err := conn.WriteMsgUnix(b, syscall.UnixRights(fds...), nil); err != nil {
+		return errors.New("unable to send listeners: %v", err)
+	}
+	log.Debugf("Handed over %d listeners", len(files))
+
+	ready := make([]byte, len(readyMsg))
+	if _, err := io.ReadFull(conn, ready); err != nil {
+		return errors.New("new process failed to become ready: %v", err)
+	}
+	if string(ready) != readyMsg {
+		return errors.New("unexpected message from new process: %q", ready)
+	}
+	return nil
+}
+
+func writeFileAtomically(path string, b []byte) error {
+	tmp := path + ".tmp." + strconv.FormatInt(time.Now().UnixNano(), 36)
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
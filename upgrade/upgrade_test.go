@@ -0,0 +1,186 @@
+package upgrade
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/panicwrap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	// envTestAddr tells the test binary, when exec'd by Upgrade, which
+	// address to take over.
+	envTestAddr = "UPGRADE_TEST_ADDR"
+
+	// envTestPanicwrap makes the test binary run like http-proxy does under
+	// panicwrap, writing its PID to the file it names.
+	envTestPanicwrap = "UPGRADE_TEST_PANICWRAP"
+)
+
+func TestMain(m *testing.M) {
+	if pidFile := os.Getenv(envTestPanicwrap); pidFile != "" {
+		os.Exit(runWrapped(pidFile))
+	}
+	if addr := os.Getenv(envTestAddr); addr != "" && os.Getenv(envSocket) != "" {
+		os.Exit(runChild(addr))
+	}
+	os.Exit(m.Run())
+}
+
+// runChild acts as the new process: it takes over the listener at addr,
+// reports ready and answers a single connection.
+func runChild(addr string) int {
+	u, err := New("", 0)
+	if err != nil {
+		return 1
+	}
+	l, err := u.Listen("tcp", addr)
+	if err != nil {
+		return 2
+	}
+	if err := u.Ready(); err != nil {
+		return 3
+	}
+	conn, err := l.Accept()
+	if err != nil {
+		return 4
+	}
+	conn.Write([]byte("child"))
+	conn.Close()
+	return 0
+}
+
+// runWrapped acts as http-proxy wrapped by panicwrap: the wrapped process
+// serves until SIGTERM, upgrading itself on SIGUSR2, and the panicwrap parent
+// is the process in the PID file.
+func runWrapped(pidFile string) int {
+	exitStatus, err := panicwrap.Wrap(&panicwrap.WrapConfig{
+		Handler:        func(string) {},
+		ForwardSignals: []os.Signal{syscall.SIGTERM, syscall.SIGUSR2},
+	})
+	if err != nil {
+		return 1
+	}
+	if exitStatus >= 0 {
+		return exitStatus
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGUSR2)
+	u, err := New(pidFile, os.Getppid())
+	if err != nil {
+		return 2
+	}
+	u.SetOutput(os.NewFile(4, "stdout"), os.NewFile(5, "stderr"))
+	l, err := u.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 3
+	}
+	defer l.Close()
+	if err := u.Ready(); err != nil {
+		return 4
+	}
+	for sig := range signals {
+		if sig == syscall.SIGTERM {
+			return 0
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := u.Upgrade(ctx)
+		cancel()
+		if err == nil {
+			return 0
+		}
+	}
+	return 0
+}
+
+func TestUpgrade(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "http-proxy.pid")
+	u, err := New(pidFile, 1234)
+	require.NoError(t, err)
+	l, err := u.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	require.NoError(t, u.Ready())
+	b, err := os.ReadFile(pidFile)
+	require.NoError(t, err)
+	assert.Equal(t, "1234", strings.TrimSpace(string(b)))
+
+	// The child is configured with the same address as we are, so it takes
+	// over our listener rather than picking a new port.
+	addr := l.Addr().String()
+	t.Setenv(envTestAddr, "127.0.0.1:0")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, u.Upgrade(ctx))
+
+	// Stop accepting like a draining proxy would, leaving the child in charge.
+	require.NoError(t, l.Close())
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	greeting, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "child", string(greeting))
+}
+
+func TestUpgradeFailure(t *testing.T) {
+	u, err := New("", 0)
+	require.NoError(t, err)
+	// The new process fails to listen and exits before becoming ready.
+	t.Setenv(envTestAddr, "not an address")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	assert.Error(t, u.Upgrade(ctx))
+}
+
+// The panicwrap parent of the old process must exit once that process is done,
+// rather than waiting for the new process to close its stderr.
+func TestUpgradeWithPanicwrap(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "http-proxy.pid")
+	readPID := func() int {
+		b, _ := os.ReadFile(pidFile)
+		pid, _ := strconv.Atoi(strings.TrimSpace(string(b)))
+		return pid
+	}
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), envTestPanicwrap+"="+pidFile)
+	require.NoError(t, cmd.Start())
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	t.Cleanup(func() {
+		if pid := readPID(); pid > 0 && pid != cmd.Process.Pid {
+			syscall.Kill(pid, syscall.SIGTERM)
+		}
+		cmd.Process.Signal(syscall.SIGTERM)
+	})
+	require.Eventually(t, func() bool { return readPID() == cmd.Process.Pid }, 10*time.Second, 10*time.Millisecond)
+
+	// Upgrade the way a supervisor would, by signalling the process in the
+	// PID file.
+	require.NoError(t, cmd.Process.Signal(syscall.SIGUSR2))
+	require.Eventually(t, func() bool {
+		pid := readPID()
+		return pid > 0 && pid != cmd.Process.Pid
+	}, 10*time.Second, 10*time.Millisecond, "the new panicwrap parent should take over the PID file")
+	select {
+	case err := <-exited:
+		assert.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("the old panicwrap parent didn't exit")
+	}
+}
@@ -0,0 +1,153 @@
+// Package upstream dials origins through a next-hop proxy, so that traffic can
+// leave from a different network (e.g. a residential or other-region exit)
+// than the one this proxy runs in.
+package upstream
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/getlantern/errors"
+	"golang.org/x/net/proxy"
+)
+
+// DialFunc dials the given address.
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// DialContext implements proxy.ContextDialer.
+func (dial DialFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return dial(ctx, network, addr)
+}
+
+// Dial implements proxy.Dialer.
+func (dial DialFunc) Dial(network, addr string) (net.Conn, error) {
+	return dial(context.Background(), network, addr)
+}
+
+// New creates a DialFunc that tunnels connections through the proxy at the
+// given URL, which reaches the proxy itself with dial. Supported URLs are
+//
+//	socks5://[user:password@]host:port
+//	http://[user:password@]host:port
+//	https://[user:password@]host:port
+//
+// where http and https use CONNECT, the latter over TLS.
+func New(proxyURL string, dial DialFunc) (DialFunc, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, errors.New("invalid upstream proxy URL: %v", err)
+	}
+	if u.Host == "" {
+		return nil, errors.New("upstream proxy URL %v has no host", u.Redacted())
+	}
+	switch u.Scheme {
+	case "socks5":
+		var auth *proxy.Auth
+		if u.User != nil {
+			password, _ := u.User.Password()
+			auth = &proxy.Auth{User: u.User.Username(), Password: password}
+		}
+		d, err := proxy.SOCKS5("tcp", u.Host, auth, dial)
+		if err != nil {
+			return nil, errors.New("unable to create SOCKS5 dialer for %v: %v", u.Redacted(), err)
+		}
+		return d.(proxy.ContextDialer).DialContext, nil
+	case "http", "https":
+		c := &connectDialer{dial: dial, addr: u.Host}
+		if u.Scheme == "https" {
+			c.tlsConfig = &tls.Config{ServerName: u.Hostname()}
+		}
+		if u.User != nil {
+			password, _ := u.User.Password()
+			c.authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+password))
+		}
+		return c.DialContext, nil
+	default:
+		return nil, errors.New("unsupported upstream proxy scheme %q, must be socks5, http or https", u.Scheme)
+	}
+}
+
+type connectDialer struct {
+	dial          DialFunc
+	addr          string
+	tlsConfig     *tls.Config
+	authorization string
+}
+
+func (c *connectDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := c.dial(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, errors.New("unable to dial upstream proxy %v: %v", c.addr, err)
+	}
+
+	// Don't let the handshake outlive ctx.
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	if c.tlsConfig != nil {
+		tlsConn := tls.Client(conn, c.tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, errors.New("unable to handshake with upstream proxy %v: %v", c.addr, err)
+		}
+		conn = tlsConn
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if c.authorization != "" {
+		req.Header.Set("Proxy-Authorization", c.authorization)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, errors.New("unable to send CONNECT to upstream proxy %v: %v", c.addr, err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, errors.New("unable to read CONNECT response from upstream proxy %v: %v", c.addr, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, errors.New("upstream proxy %v refused CONNECT to %v: %v", c.addr, addr, resp.Status)
+	}
+
+	if !stop() {
+		// ctx was done and the deadline may have been set after the handshake
+		// finished
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	conn.SetDeadline(time.Time{})
+	if br.Buffered() > 0 {
+		// the origin already sent something, don't lose it
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,181 @@
+package upstream
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var direct DialFunc = (&net.Dialer{}).DialContext
+
+// echoServer echoes whatever it's sent, after greeting with hello.
+func echoServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write([]byte("hello"))
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// connectProxy is an HTTP CONNECT proxy requiring the given Proxy-Authorization.
+func connectProxy(t *testing.T, authorization string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				if req.Method != http.MethodConnect || req.Header.Get("Proxy-Authorization") != authorization {
+					conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+					return
+				}
+				origin, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+					return
+				}
+				defer origin.Close()
+				conn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+				go io.Copy(origin, conn)
+				io.Copy(conn, origin)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// socksProxy is a minimal SOCKS5 proxy supporting unauthenticated CONNECT to
+// IPv4 addresses.
+func socksProxy(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				greeting := make([]byte, 2)
+				if _, err := io.ReadFull(conn, greeting); err != nil {
+					return
+				}
+				if _, err := io.ReadFull(conn, make([]byte, greeting[1])); err != nil {
+					return
+				}
+				conn.Write([]byte{5, 0})
+				req := make([]byte, 10)
+				if _, err := io.ReadFull(conn, req); err != nil || req[3] != 1 {
+					return
+				}
+				addr := net.JoinHostPort(net.IP(req[4:8]).String(), strconv.Itoa(int(binary.BigEndian.Uint16(req[8:]))))
+				origin, err := net.Dial("tcp", addr)
+				if err != nil {
+					conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer origin.Close()
+				conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+				go io.Copy(origin, conn)
+				io.Copy(conn, origin)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func assertEchoes(t *testing.T, conn net.Conn) {
+	t.Helper()
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 5)
+	_, err := io.ReadFull(conn, b)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	b = make([]byte, 4)
+	_, err = io.ReadFull(conn, b)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(b))
+}
+
+func TestConnect(t *testing.T) {
+	origin := echoServer(t)
+	proxyAddr := connectProxy(t, "Basic dXNlcjpwYXNz")
+
+	dial, err := New("http://user:pass@"+proxyAddr, direct)
+	require.NoError(t, err)
+	conn, err := dial(context.Background(), "tcp", origin)
+	require.NoError(t, err)
+	assertEchoes(t, conn)
+
+	dial, err = New("http://user:wrong@"+proxyAddr, direct)
+	require.NoError(t, err)
+	_, err = dial(context.Background(), "tcp", origin)
+	assert.ErrorContains(t, err, "407")
+}
+
+func TestSOCKS5(t *testing.T) {
+	origin := echoServer(t)
+	dial, err := New("socks5://"+socksProxy(t), direct)
+	require.NoError(t, err)
+	conn, err := dial(context.Background(), "tcp", origin)
+	require.NoError(t, err)
+	assertEchoes(t, conn)
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	// accepts connections but never responds
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	dial, err := New("http://"+l.Addr().String(), direct)
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = dial(ctx, "tcp", "example.com:443")
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestInvalidURLs(t *testing.T) {
+	for _, u := range []string{"ftp://host:21", "socks5://", "://"} {
+		_, err := New(u, direct)
+		assert.Error(t, err, u)
+	}
+}
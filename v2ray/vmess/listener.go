@@ -2,16 +2,24 @@ package vmess
 
 import (
 	"context"
+	"errors"
 	"net"
 
+	"github.com/getlantern/golog"
 	vmess "github.com/getlantern/sing-vmess"
 	N "github.com/getlantern/sing-vmess/network"
 	"github.com/sagernet/sing/common/metadata"
+
+	"github.com/getlantern/http-proxy-lantern/v2/common"
+	"github.com/getlantern/http-proxy-lantern/v2/udprelay"
 )
 
+var log = golog.LoggerFor("vmess")
+
 type listener struct {
 	net.Listener
 	service *vmess.Service[int]
+	relay   *udprelay.Relay
 }
 
 // NewVMessListener wraps a net.Listener with a VMess service
@@ -20,7 +28,8 @@ type listener struct {
 // The UUIDs are generated on route setup and stored in the database, there could be several UUIDs per proxy
 // The UUIDs will be distributed between the users. There is no 1-1 mapping between UUIDs and users and this is just
 // intended as a source of extra entropy
-func NewVMessListener(baseListener net.Listener, uuids []string) (net.Listener, error) {
+// UDP sessions are relayed through relay, or refused if it's nil.
+func NewVMessListener(baseListener net.Listener, uuids []string, relay *udprelay.Relay) (net.Listener, error) {
 	var userNum []int
 	var userAlt []int
 	for i := range uuids {
@@ -28,7 +37,7 @@ func NewVMessListener(baseListener net.Listener, uuids []string) (net.Listener,
 		userAlt = append(userAlt, 0) // we don't use altId
 	}
 
-	l := &listener{baseListener, nil}
+	l := &listener{baseListener, nil, relay}
 	l.service = vmess.NewService[int]()
 
 	if err := l.service.UpdateUsers(userNum, uuids, userAlt); err != nil {
@@ -45,6 +54,7 @@ func (l *listener) Close() error {
 // it's only purpose is to implement N.ConnectionHandler and store the connection
 type handler struct {
 	conn        net.Conn
+	packetConn  N.PacketConn
 	source      metadata.Socksaddr
 	destination metadata.Socksaddr
 }
@@ -55,19 +65,79 @@ func (h *handler) NewConnectionEx(_ context.Context, conn net.Conn, source metad
 	h.destination = destination
 }
 
-func (h *handler) NewPacketConnectionEx(_ context.Context, _ N.PacketConn, _ metadata.Socksaddr, _ metadata.Socksaddr, _ N.CloseHandlerFunc) {
-	// not used
+func (h *handler) NewPacketConnectionEx(_ context.Context, conn N.PacketConn, source metadata.Socksaddr, destination metadata.Socksaddr, _ N.CloseHandlerFunc) {
+	h.packetConn = conn
+	h.source = source
+	h.destination = destination
 }
 
 func (l *listener) Accept() (net.Conn, error) {
-	conn, err := l.Listener.Accept()
-	if err != nil {
-		return nil, err
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		h := &handler{}
+		err = l.service.NewConnection(context.Background(), conn, metadata.Socksaddr{}, nil, h)
+		if err != nil {
+			return nil, err
+		}
+		if h.packetConn == nil {
+			return h.conn, nil
+		}
+		// UDP sessions don't carry HTTP, so they're relayed here rather than
+		// returned.
+		l.relayPackets(conn.RemoteAddr(), h.packetConn, h.destination)
+	}
+}
+
+// relayPackets relays the packets of the UDP session pc, from the client at
+// clientAddr, in the background. Packets go to destination unless they name
+// their own.
+func (l *listener) relayPackets(clientAddr net.Addr, pc N.PacketConn, destination metadata.Socksaddr) {
+	npc, ok := pc.(net.PacketConn)
+	if l.relay == nil || !ok {
+		log.Debugf("Refusing UDP session from %v", clientAddr)
+		pc.Close()
+		return
+	}
+	ctx := map[string]interface{}{}
+	if host, _, err := net.SplitHostPort(clientAddr.String()); err == nil {
+		ctx[common.ClientIP] = host
+	}
+	session, err := l.relay.Open("vmess "+clientAddr.String(), udprelay.Client{
+		Reply: func(b []byte, from *net.UDPAddr) error {
+			_, err := npc.WriteTo(b, from)
+			return err
+		},
+		Context: ctx,
+		OnClose: func() { pc.Close() },
+	})
+	if errors.Is(err, udprelay.ErrRefused) {
+		log.Debugf("Refusing UDP session from %v: %v", clientAddr, err)
+		pc.Close()
+		return
 	}
-	h := &handler{}
-	err = l.service.NewConnection(context.Background(), conn, metadata.Socksaddr{}, nil, h)
 	if err != nil {
-		return nil, err
+		log.Errorf("Unable to relay UDP session from %v: %v", clientAddr, err)
+		pc.Close()
+		return
 	}
-	return h.conn, nil
+	go func() {
+		defer session.Close()
+		b := make([]byte, udprelay.MaxPacketSize)
+		for {
+			n, addr, err := npc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			dst := destination.String()
+			if udpAddr, ok := addr.(*net.UDPAddr); ok && len(udpAddr.IP) > 0 && !udpAddr.IP.IsUnspecified() {
+				dst = udpAddr.String()
+			}
+			if err := session.Forward(b[:n], dst); err != nil {
+				log.Debugf("Dropping UDP packet from %v: %v", clientAddr, err)
+			}
+		}
+	}()
 }
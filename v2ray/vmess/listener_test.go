@@ -10,6 +10,8 @@ import (
 	"github.com/sagernet/sing/common/metadata"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/http-proxy-lantern/v2/udprelay"
 )
 
 func TestWrap(t *testing.T) {
@@ -26,7 +28,7 @@ func TestWrap(t *testing.T) {
 			require.NoError(t, err)
 			defer tcpListener.Close()
 
-			l, err := NewVMessListener(tcpListener, []string{uuid})
+			l, err := NewVMessListener(tcpListener, []string{uuid}, nil)
 			require.NoError(t, err)
 			defer l.Close()
 
@@ -113,7 +115,7 @@ func TestUUIDMismatch(t *testing.T) {
 	require.NoError(t, err)
 	defer tcpListener.Close()
 
-	l, err := NewVMessListener(tcpListener, []string{uuid1})
+	l, err := NewVMessListener(tcpListener, []string{uuid1}, nil)
 	require.NoError(t, err)
 	defer l.Close()
 
@@ -165,3 +167,68 @@ func TestUUIDMismatch(t *testing.T) {
 		}
 	}
 }
+
+func TestUDP(t *testing.T) {
+	uuid := "3fed9a96-900c-4dd4-9fd2-f333a566768c"
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer echo.Close()
+	go func() {
+		b := make([]byte, 1024)
+		for {
+			n, addr, err := echo.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(b[:n], addr)
+		}
+	}()
+
+	tcpListener, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer tcpListener.Close()
+	relay := udprelay.New(udprelay.Options{AllowLocal: true})
+	defer relay.Close()
+	l, err := NewVMessListener(tcpListener, []string{uuid}, relay)
+	require.NoError(t, err)
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	tcpConn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer tcpConn.Close()
+	client, err := vmess.NewClient(uuid, "auto", 0)
+	require.NoError(t, err)
+	target := metadata.SocksaddrFromNet(echo.LocalAddr())
+	conn, err := client.DialPacketConn(tcpConn, target)
+	require.NoError(t, err)
+
+	for _, msg := range []string{"hello", "world"} {
+		_, err = conn.WriteTo([]byte(msg), target.UDPAddr())
+		require.NoError(t, err)
+		buf := make([]byte, 1024)
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		require.NoError(t, err)
+		assert.Equal(t, msg, string(buf[:n]))
+	}
+	assert.Equal(t, 1, relay.Len())
+
+	conn.Close()
+	assert.Eventually(t, func() bool { return relay.Len() == 0 }, 5*time.Second, 10*time.Millisecond, "the session should end with the connection")
+	select {
+	case <-accepted:
+		t.Fatal("UDP sessions shouldn't be accepted as connections")
+	default:
+	}
+}
@@ -0,0 +1,54 @@
+package vmess
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"hash/crc32"
+
+	vmess "github.com/getlantern/sing-vmess"
+	"github.com/gofrs/uuid/v5"
+
+	"github.com/getlantern/http-proxy-lantern/v2/sniff"
+)
+
+// authIDLen is the length of the encrypted auth ID VMess AEAD requests start
+// with.
+const authIDLen = 16
+
+// NewMatcher returns a sniff.Matcher recognizing VMess connections from users
+// identified by uuids, by decrypting their auth ID the way the service does.
+func NewMatcher(uuids []string) (sniff.Matcher, error) {
+	blocks := make([]cipher.Block, 0, len(uuids))
+	for _, id := range uuids {
+		userUUID := uuid.FromStringOrNil(id)
+		if userUUID == uuid.Nil {
+			userUUID = uuid.NewV5(userUUID, id)
+		}
+		key, err := vmess.Key(userUUID)
+		if err != nil {
+			return nil, err
+		}
+		block, err := aes.NewCipher(vmess.KDF(key[:], vmess.KDFSaltConstAuthIDEncryptionKey)[:16])
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, block)
+	}
+	return func(b []byte) sniff.Result {
+		if len(blocks) == 0 {
+			return sniff.NoMatch
+		}
+		if len(b) < authIDLen {
+			return sniff.NeedMore
+		}
+		var decoded [authIDLen]byte
+		for _, block := range blocks {
+			block.Decrypt(decoded[:], b[:authIDLen])
+			if crc32.ChecksumIEEE(decoded[:12]) == binary.BigEndian.Uint32(decoded[12:]) {
+				return sniff.Match
+			}
+		}
+		return sniff.NoMatch
+	}, nil
+}
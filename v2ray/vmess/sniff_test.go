@@ -0,0 +1,43 @@
+package vmess
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	vmess "github.com/getlantern/sing-vmess"
+	"github.com/sagernet/sing/common/metadata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/http-proxy-lantern/v2/sniff"
+)
+
+func TestMatcher(t *testing.T) {
+	match, err := NewMatcher([]string{"3fed9a96-900c-4dd4-9fd2-f333a5667681", "not a uuid"})
+	require.NoError(t, err)
+
+	for id, expected := range map[string]sniff.Result{
+		"3fed9a96-900c-4dd4-9fd2-f333a5667681": sniff.Match,
+		"not a uuid":                           sniff.Match,
+		"3fed9a96-900c-4dd4-9fd2-f333a5667682": sniff.NoMatch,
+	} {
+		client, err := vmess.NewClient(id, "auto", 0)
+		require.NoError(t, err)
+		clientConn, serverConn := net.Pipe()
+		conn := client.DialEarlyConn(clientConn, metadata.ParseSocksaddrHostPort("random.stuff.com", 443))
+		go conn.Write([]byte("hello"))
+		b := make([]byte, 1024)
+		n, err := io.ReadAtLeast(serverConn, b, authIDLen)
+		require.NoError(t, err)
+		clientConn.Close()
+		serverConn.Close()
+
+		assert.Equal(t, sniff.NeedMore, match(b[:authIDLen-1]), id)
+		assert.Equal(t, expected, match(b[:n]), id)
+	}
+
+	match, err = NewMatcher(nil)
+	require.NoError(t, err)
+	assert.Equal(t, sniff.NoMatch, match(nil))
+}